@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apcupsdDefaultPort = "3551"
+
+// apcupsdSource polls apcupsd's Network Information Server (NIS) for the
+// UPS status, battery charge and load.
+type apcupsdSource struct {
+	Addr     string
+	Interval time.Duration
+}
+
+func (a *apcupsdSource) Name() string {
+	return "apcupsd:" + a.Addr
+}
+
+func (a *apcupsdSource) Run(ctx context.Context, events chan<- powerEvent) {
+	runPoller(ctx, a.Name(), a.Interval, a.poll, events)
+}
+
+// poll sends the NIS "status" command and parses the response, which is a
+// sequence of length-prefixed "KEY : VALUE" lines ending with an empty one.
+func (a *apcupsdSource) poll(ctx context.Context) (PowerAlarmMessage, error) {
+	addr := a.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, apcupsdDefaultPort)
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.Interval)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return PowerAlarmMessage{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if err := writeNISRecord(conn, "status"); err != nil {
+		return PowerAlarmMessage{}, err
+	}
+	status := make(map[string]string)
+	for {
+		rec, err := readNISRecord(conn)
+		if err != nil {
+			return PowerAlarmMessage{}, fmt.Errorf("failed to read apcupsd status: %w", err)
+		}
+		if rec == "" {
+			break
+		}
+		if k, v, ok := strings.Cut(rec, ":"); ok {
+			status[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+
+	msgs, err := normalizeApcupsdStatus("", []byte(status["STATUS"]))
+	if err != nil {
+		return PowerAlarmMessage{}, err
+	}
+	m := msgs[0]
+	m.Battery = apcupsdPercent(status["BCHARGE"])
+	m.Load = apcupsdPercent(status["LOADPCT"])
+	return m, nil
+}
+
+func writeNISRecord(w io.Writer, s string) error {
+	buf := make([]byte, 2+len(s))
+	binary.BigEndian.PutUint16(buf, uint16(len(s)))
+	copy(buf[2:], s)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readNISRecord(r io.Reader) (string, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(buf), "\n"), nil
+}
+
+// apcupsdPercent parses values like "100.0 Percent", returning nil if absent.
+func apcupsdPercent(v string) *float64 {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(v, " Percent"), 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
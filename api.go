@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// apiHistorySize is how many recent events GET /events returns.
+const apiHistorySize = 100
+
+// eventHistory is a ring buffer of recently handled events.
+type eventHistory struct {
+	mu     sync.Mutex
+	events []historyEntry
+	next   int
+}
+
+type historyEntry struct {
+	At      time.Time         `json:"at"`
+	Source  string            `json:"source"`
+	Message PowerAlarmMessage `json:"message"`
+}
+
+func newEventHistory(size int) *eventHistory {
+	return &eventHistory{events: make([]historyEntry, 0, size)}
+}
+
+// Record adds an event, evicting the oldest if the buffer is full.
+func (h *eventHistory) Record(at time.Time, ev powerEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := historyEntry{At: at, Source: ev.Source, Message: ev.Message}
+	if len(h.events) < cap(h.events) {
+		h.events = append(h.events, e)
+		return
+	}
+	h.events[h.next] = e
+	h.next = (h.next + 1) % len(h.events)
+}
+
+// Events returns the recorded events, oldest first.
+func (h *eventHistory) Events() []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]historyEntry, 0, len(h.events))
+	out = append(out, h.events[h.next:]...)
+	return append(out, h.events[:h.next]...)
+}
+
+// apiState is the response to GET /state and to a status control command.
+type apiState struct {
+	Host      string      `json:"host"`
+	Pending   *apiPending `json:"pending"`
+	Executing bool        `json:"executing"`
+	HeldUntil *time.Time  `json:"held_until,omitempty"`
+}
+
+type apiPending struct {
+	ArmedAt      time.Time         `json:"armed_at"`
+	ExecuteAt    time.Time         `json:"execute_at"`
+	Source       string            `json:"source"`
+	Trigger      PowerAlarmMessage `json:"trigger"`
+	ClockWarning string            `json:"clock_warning,omitempty"`
+}
+
+func newAPIState(host string, st EngineStatus) apiState {
+	s := apiState{Host: host, Executing: st.Executing}
+	if p := st.Pending; p != nil {
+		s.Pending = &apiPending{
+			ArmedAt:      p.ArmedAt,
+			ExecuteAt:    p.ExecuteAt,
+			Source:       p.Trigger.Source,
+			Trigger:      p.Trigger.Message,
+			ClockWarning: p.ClockWarning,
+		}
+	}
+	if !st.HeldUntil.IsZero() {
+		s.HeldUntil = &st.HeldUntil
+	}
+	return s
+}
+
+// loopbackListenAddress reports whether the listen address addr, as given to
+// net.Listen, accepts connections only from the local host.
+func loopbackListenAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,170 @@
+//go:build !minimal
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apiServer serves a small REST API for inspecting and controlling the
+// Engine, authenticated with a bearer token:
+//
+//	GET  /state    the pending action, if any
+//	GET  /rules    the state of each named rule, by name
+//	GET  /events   recently handled events
+//	POST /trigger  arm the action; the body may be a canonical JSON power event
+//	POST /cancel   cancel the pending action
+//	GET  /journal  journal entries; takes since (RFC 3339), kind, and limit
+//	               query parameters
+//	GET  /snapshot the complete runtime state, as written on SIGUSR1
+//
+// /state, /trigger and /cancel take a rule query parameter naming a named
+// rule to act on instead of the top-level one.
+type apiServer struct {
+	Listen      string
+	Token       string
+	Hostname    string
+	Engine      *Engine
+	Rules       []namedRule
+	History     *eventHistory
+	Journal     *journal // nil unless -journal is set
+	Snapshotter *snapshotter
+}
+
+func (a *apiServer) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /state", a.auth(a.withEngine(func(rw http.ResponseWriter, r *http.Request, e *Engine) {
+		writeJSON(rw, http.StatusOK, newAPIState(a.Hostname, e.Status()))
+	})))
+	mux.HandleFunc("GET /rules", a.auth(func(rw http.ResponseWriter, r *http.Request) {
+		states := ruleStates(a.Hostname, a.Rules)
+		if states == nil {
+			states = map[string]apiState{}
+		}
+		writeJSON(rw, http.StatusOK, states)
+	}))
+	mux.HandleFunc("GET /events", a.auth(func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, a.History.Events())
+	}))
+	mux.HandleFunc("GET /snapshot", a.auth(func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, http.StatusOK, a.Snapshotter.Snapshot())
+	}))
+	mux.HandleFunc("GET /journal", a.auth(func(rw http.ResponseWriter, r *http.Request) {
+		if a.Journal == nil {
+			http.Error(rw, "the journal is not enabled", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		var since time.Time
+		if s := q.Get("since"); s != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, s); err != nil {
+				http.Error(rw, fmt.Sprintf("invalid since: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		limit := apiHistorySize
+		if l := q.Get("limit"); l != "" {
+			var err error
+			if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+				http.Error(rw, "invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := a.Journal.Query(since, q.Get("kind"), limit)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, entries)
+	}))
+	mux.HandleFunc("POST /trigger", a.auth(a.withEngine(func(rw http.ResponseWriter, r *http.Request, e *Engine) {
+		m := PowerAlarmMessage{Online: false, PowerType: PowerTypeUtility, Scope: ScopeGlobal}
+		body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, webhookMaxBody))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if len(body) > 0 {
+			msgs, err := normalizeJSON("", body)
+			if err != nil || len(msgs) != 1 {
+				http.Error(rw, fmt.Sprintf("invalid power event: %v", err), http.StatusBadRequest)
+				return
+			}
+			m = msgs[0]
+		}
+		// the action must outlive this request:
+		if err := e.Trigger(ctx, powerEvent{Source: "api:" + r.RemoteAddr, Message: m}); err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	})))
+	mux.HandleFunc("POST /cancel", a.auth(a.withEngine(func(rw http.ResponseWriter, r *http.Request, e *Engine) {
+		p := e.Pending()
+		if p == nil {
+			http.Error(rw, "nothing is pending", http.StatusConflict)
+			return
+		}
+		if err := e.Cancel(ctx, powerEvent{Source: "api:" + r.RemoteAddr, Message: p.Trigger.Message}); err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	})))
+
+	srv := &http.Server{
+		Addr:              a.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	log.Printf("api: listening on %s", a.Listen)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("api: %s", err)
+	}
+}
+
+func (a *apiServer) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !bearerAuthorized(r, a.Token) {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(rw, r)
+	}
+}
+
+// withEngine passes h the Engine of the rule named by the request's rule
+// query parameter, or the top-level Engine if it has none.
+func (a *apiServer) withEngine(h func(http.ResponseWriter, *http.Request, *Engine)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		e, err := ruleEngine(a.Engine, a.Rules, r.URL.Query().Get("rule"))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		h(rw, r, e)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("api: failed to write response: %s", err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build minimal
+
+package main
+
+import "context"
+
+// apiServer is left out of minimal builds, along with the HTTP server;
+// -api-listen is rejected at startup.
+type apiServer struct {
+	Listen      string
+	Token       string
+	Hostname    string
+	Engine      *Engine
+	Rules       []namedRule
+	History     *eventHistory
+	Journal     *journal
+	Snapshotter *snapshotter
+}
+
+func (a *apiServer) Run(context.Context) {}
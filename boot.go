@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	stateFileHeartbeat = "heartbeat.json"
+	stateFileShutdown  = "shutdown.json"
+	stateFileBoot      = "boot.json"
+
+	// heartbeatInterval is how often the daemon records that it's alive; it
+	// bounds the precision of the reported downtime.
+	heartbeatInterval = time.Minute
+)
+
+type heartbeatRecord struct {
+	At time.Time `json:"at"`
+}
+
+// shutdownRecord is written immediately before mqttshutdownd powers off the
+// host, so after the next boot operators can distinguish a shutdown initiated
+// by mqttshutdownd from a crash or power loss.
+type shutdownRecord struct {
+	At      time.Time          `json:"at"`
+	ArmedAt time.Time          `json:"armed_at"`
+	Reason  string             `json:"reason"`
+	Rule    string             `json:"rule"`
+	Source  string             `json:"source"`
+	Trigger *PowerAlarmMessage `json:"trigger,omitempty"`
+	// ClockWarning is set if the clock was untrustworthy when the shutdown
+	// was armed.
+	ClockWarning string `json:"clock_warning,omitempty"`
+}
+
+func (r *shutdownRecord) String() string {
+	s := fmt.Sprintf("at %s (armed at %s by %s from %s; rule: %s)",
+		r.At.Format(time.RFC3339), r.ArmedAt.Format(time.RFC3339), r.Reason, r.Source, r.Rule)
+	if r.ClockWarning != "" {
+		s += fmt.Sprintf(" [clock untrustworthy: %s]", r.ClockWarning)
+	}
+	return s
+}
+
+// loadShutdownRecord returns the shutdown record left by a previous run, or
+// nil if there is none.
+func loadShutdownRecord(store stateStore) *shutdownRecord {
+	var sr shutdownRecord
+	if err := store.ReadJSON(stateFileShutdown, &sr); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("failed to read shutdown state: %s", err)
+		}
+		return nil
+	}
+	return &sr
+}
+
+type bootRecord struct {
+	BootedAt time.Time `json:"booted_at"`
+}
+
+// BootAnnouncement is published once per boot, on the first connection to the
+// broker after the host comes back up.
+type BootAnnouncement struct {
+	Host             string          `json:"host"`
+	Version          string          `json:"version"`
+	BootedAt         time.Time       `json:"booted_at"`
+	DownSince        *time.Time      `json:"down_since,omitempty"`
+	DownSeconds      *float64        `json:"down_seconds,omitempty"`
+	ShutdownByDaemon bool            `json:"shutdown_by_mqttshutdownd"`
+	PreviousShutdown *shutdownRecord `json:"previous_shutdown,omitempty"`
+}
+
+// pendingBootAnnouncement returns the announcement for this boot, or nil if
+// this boot has already been announced (e.g. the daemon was restarted).
+// prev is the shutdown record left by the previous run, if any.
+// It must be called before the heartbeat is started.
+func pendingBootAnnouncement(store stateStore, host string, prev *shutdownRecord) (*BootAnnouncement, error) {
+	booted, err := bootTime()
+	if err != nil {
+		return nil, err
+	}
+	var br bootRecord
+	if err := store.ReadJSON(stateFileBoot, &br); err == nil && br.BootedAt.Sub(booted).Abs() < time.Minute {
+		return nil, nil
+	}
+
+	a := &BootAnnouncement{Host: host, Version: version, BootedAt: booted}
+	var hb heartbeatRecord
+	if err := store.ReadJSON(stateFileHeartbeat, &hb); err == nil && hb.At.Before(booted) {
+		a.DownSince = &hb.At
+		secs := booted.Sub(hb.At).Seconds()
+		a.DownSeconds = &secs
+	}
+	if prev != nil && prev.At.Before(booted) {
+		a.ShutdownByDaemon = true
+		a.PreviousShutdown = prev
+	}
+	return a, nil
+}
+
+// markBootAnnounced records that this boot has been announced and clears the
+// previous shutdown record.
+func markBootAnnounced(store stateStore, a *BootAnnouncement) {
+	if err := store.WriteJSON(stateFileBoot, bootRecord{BootedAt: a.BootedAt}); err != nil {
+		log.Printf("failed to write boot state: %s", err)
+	}
+	if err := store.Remove(stateFileShutdown); err != nil {
+		log.Printf("failed to clear shutdown state: %s", err)
+	}
+}
+
+// runHeartbeat records the current time every heartbeatInterval until ctx is done.
+func runHeartbeat(ctx context.Context, store stateStore) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		writeHeartbeat(store)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func writeHeartbeat(store stateStore) {
+	if err := store.WriteJSON(stateFileHeartbeat, heartbeatRecord{At: time.Now()}); err != nil {
+		log.Printf("failed to write heartbeat: %s", err)
+	}
+}
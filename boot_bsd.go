@@ -0,0 +1,31 @@
+//go:build darwin || freebsd || openbsd || netbsd || dragonfly
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var kernBoottimeRegexp = regexp.MustCompile(`sec = (\d+)`)
+
+// bootTime reads the system boot time via `sysctl -n kern.boottime`, whose
+// output looks like "{ sec = 1700000000, usec = 0 } Tue Nov 14 22:13:20 2023".
+func bootTime() (time.Time, error) {
+	out, err := exec.Command("sysctl", "-n", "kern.boottime").Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("sysctl kern.boottime failed: %w", err)
+	}
+	m := kernBoottimeRegexp.FindSubmatch(out)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("unexpected kern.boottime output '%s'", out)
+	}
+	secs, err := strconv.ParseInt(string(m[1]), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0), nil
+}
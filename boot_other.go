@@ -0,0 +1,12 @@
+//go:build !linux && !windows && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func bootTime() (time.Time, error) {
+	return time.Time{}, errors.New("determining boot time is not supported on this platform")
+}
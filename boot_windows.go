@@ -0,0 +1,14 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+var procGetTickCount64 = syscall.NewLazyDLL("kernel32.dll").NewProc("GetTickCount64")
+
+// bootTime derives the system boot time from GetTickCount64.
+func bootTime() (time.Time, error) {
+	ms, _, _ := procGetTickCount64.Call()
+	return time.Now().Add(-time.Duration(ms) * time.Millisecond).Truncate(time.Second), nil
+}
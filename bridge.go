@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// bridgeConfig configures forwarding of power topics from an upstream broker
+// to the local broker.
+type bridgeConfig struct {
+	Server      string
+	TLS         bool
+	Username    string
+	Password    string
+	ClientID    string
+	Topics      []string
+	LocalPrefix string
+	Retain      bool
+	KeepAlive   uint16
+}
+
+// localTopic returns the local topic to which a message received upstream on
+// topic is forwarded.
+func (b bridgeConfig) localTopic(topic string) string {
+	if b.LocalPrefix == "" {
+		return topic
+	}
+	return strings.TrimSuffix(b.LocalPrefix, "/") + "/" + topic
+}
+
+// startBridge connects to the upstream broker and forwards every message
+// received on the configured topics to the local broker via pub. Messages are
+// forwarded retained by default so the local fleet keeps the last known power
+// state while the upstream link is down.
+func startBridge(ctx context.Context, b bridgeConfig, pub *publisher) (*autopaho.ConnectionManager, error) {
+	scheme := "mqtt"
+	var tlsCfg *tls.Config
+	if b.TLS {
+		scheme = "mqtts"
+		tlsCfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	u, err := url.Parse(fmt.Sprintf("%s://%s", scheme, b.Server))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse bridge server URL '%s://%s': %w", scheme, b.Server, err)
+	}
+
+	subs := make([]paho.SubscribeOptions, len(b.Topics))
+	for i, t := range b.Topics {
+		subs[i] = paho.SubscribeOptions{Topic: t, QoS: 1}
+	}
+
+	return autopaho.NewConnection(ctx, autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{u},
+		TlsCfg:                        tlsCfg,
+		AttemptConnection:             brokerConnectionAttempter(mqttVersion5),
+		ConnectUsername:               b.Username,
+		ConnectPassword:               []byte(b.Password),
+		KeepAlive:                     b.KeepAlive,
+		CleanStartOnInitialConnection: false,
+		SessionExpiryInterval:         5 * 60,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			log.Printf("bridge: connected to upstream '%s'", b.Server)
+			if _, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: subs}); err != nil {
+				log.Printf("bridge: failed to subscribe upstream to %s: %s", strings.Join(b.Topics, ", "), err)
+				return
+			}
+			log.Printf("bridge: subscribed upstream to %s", strings.Join(b.Topics, ", "))
+		},
+		OnConnectError: func(err error) {
+			log.Printf("bridge: error while attempting upstream connection: %s", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: b.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					local := b.localTopic(pr.Packet.Topic)
+					cm, err := pub.connectionManager()
+					if err != nil {
+						log.Printf("bridge: dropping message on '%s': local %s", pr.Packet.Topic, err)
+						return true, nil
+					}
+					if _, err := cm.Publish(ctx, &paho.Publish{
+						Topic:   local,
+						QoS:     1,
+						Retain:  b.Retain,
+						Payload: pr.Packet.Payload,
+					}); err != nil {
+						log.Printf("bridge: failed to forward '%s' to local '%s': %s", pr.Packet.Topic, local, err)
+					}
+					return true, nil
+				}},
+			OnClientError: func(err error) {
+				log.Printf("bridge: client error: %s", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				if sessionTakenOver(d) {
+					log.Printf("bridge: upstream server disconnected us: another client connected with client ID '%s'", b.ClientID)
+					return
+				}
+				log.Printf("bridge: upstream server requested disconnect; reason code: %d", d.ReasonCode)
+			},
+		},
+	})
+}
@@ -0,0 +1,103 @@
+//go:build !minimal
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// minimalBuild is set in binaries built with the minimal tag (matcher.go).
+	minimalBuild = false
+	// exprLanguage names the language of -down-expr and -recovered-expr.
+	exprLanguage = "CEL"
+	// exprLanguageHelp is printed in the usage message.
+	exprLanguageHelp = "-down-expr and -recovered-expr are Common Experssion Language (CEL) expressions. For more information on CEL, see https://cel.dev ."
+)
+
+func newCELEnv(proto *protoDescriptor) (*cel.Env, error) {
+	opts := []cel.EnvOption{
+		cel.Variable(exprVarPowerType, cel.IntType),
+		cel.Variable(exprVarOnline, cel.BoolType),
+		cel.Variable(exprVarScope, cel.StringType),
+		cel.Variable(exprVarBattery, cel.DoubleType),
+		cel.Variable(exprVarLoad, cel.DoubleType),
+		cel.Variable(exprVarSource, cel.StringType),
+		cel.Variable(exprVarRuntime, cel.DoubleType),
+		cel.Variable(exprVarExpiry, cel.DoubleType),
+		cel.Variable(exprVarProps, cel.MapType(cel.StringType, cel.StringType)),
+	}
+	if proto != nil {
+		opts = append(opts,
+			cel.TypeDescs(proto.Types),
+			cel.Variable(exprVarMsg, cel.ObjectType(string(proto.Message.FullName()))),
+		)
+	}
+	return cel.NewEnv(opts...)
+}
+
+// newExprCompiler returns a function compiling CEL expressions against one
+// shared environment, with msg declared as the proto message type, if set.
+func newExprCompiler(proto *protoDescriptor) (func(expr string) (exprProgram, error), error) {
+	env, err := newCELEnv(proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CEL environment: %w", err)
+	}
+	return func(expr string) (exprProgram, error) {
+		prg, err := compileBoolExpr(env, expr)
+		if err != nil {
+			return nil, err
+		}
+		p := celProgram{prg: prg}
+		if proto != nil {
+			p.emptyMsg = dynamicpb.NewMessage(proto.Message)
+		}
+		return p, nil
+	}, nil
+}
+
+// compileBoolExpr compiles a CEL expression that must evaluate to a boolean.
+func compileBoolExpr(env *cel.Env, expr string) (cel.Program, error) {
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return nil, fmt.Errorf("failed to compile '%s': %w", expr, iss.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("'%s' does not return a boolean", expr)
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate program for '%s': %w", expr, err)
+	}
+	return prg, nil
+}
+
+// celProgram is a compiled CEL expression.
+type celProgram struct {
+	prg cel.Program
+	// emptyMsg is msg for events without one, e.g. from other sources, if
+	// msg is declared: a message whose fields all have their default values.
+	emptyMsg *dynamicpb.Message
+}
+
+func (p celProgram) Eval(ev powerEvent) (bool, error) {
+	vars := exprVars(ev)
+	if p.emptyMsg != nil {
+		vars[exprVarMsg] = p.emptyMsg
+		if ev.Msg != nil {
+			vars[exprVarMsg] = ev.Msg
+		}
+	}
+	out, _, err := p.prg.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := out.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %T, not bool", out.Value())
+	}
+	return b, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// chaosDefaultMaxDelay is the default longest delay chaos mode adds to a
+// delayed delivery.
+const chaosDefaultMaxDelay = 30 * time.Second
+
+// chaosMonkey injects faults while the daemon runs against a staging broker,
+// to check that it copes with them: each fault is injected at a random time
+// within every period of its interval. Disconnects close the connection to
+// the broker; like any lost connection, that makes the daemon exit, so it
+// must run under a supervisor that restarts it. Delayed, duplicate and
+// malformed deliveries affect the next power message received after they're
+// due. Chaos mode is enabled by the hidden -chaos flag.
+type chaosMonkey struct {
+	Disconnect time.Duration
+	Delay      time.Duration
+	MaxDelay   time.Duration
+	Duplicate  time.Duration
+	Malformed  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	delayDue, duplicateDue, malformedDue atomic.Bool
+}
+
+// parseChaos parses a -chaos spec: comma-separated FAULT=INTERVAL pairs, e.g.
+// "disconnect=10m,delay=2m,duplicate=3m,malformed=5m,max-delay=20s".
+func parseChaos(spec string) (*chaosMonkey, error) {
+	kvs, err := parseTags(spec)
+	if err != nil {
+		return nil, err
+	}
+	c := &chaosMonkey{MaxDelay: chaosDefaultMaxDelay}
+	fields := map[string]*time.Duration{
+		"disconnect": &c.Disconnect,
+		"delay":      &c.Delay,
+		"max-delay":  &c.MaxDelay,
+		"duplicate":  &c.Duplicate,
+		"malformed":  &c.Malformed,
+	}
+	for k, v := range kvs {
+		f, ok := fields[k]
+		if !ok {
+			return nil, fmt.Errorf("unknown fault '%s'", k)
+		}
+		if *f, err = time.ParseDuration(v); err != nil || *f <= 0 {
+			return nil, fmt.Errorf("%s must be a positive duration", k)
+		}
+	}
+	return c, nil
+}
+
+// Run schedules faults until ctx is done.
+func (c *chaosMonkey) Run(ctx context.Context) {
+	log.Printf("[WARN] chaos mode: injecting faults (disconnect every %s, delay every %s, duplicate every %s, malformed every %s); never use this in production",
+		c.Disconnect, c.Delay, c.Duplicate, c.Malformed)
+	go c.every(ctx, c.Disconnect, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.conn != nil {
+			log.Println("[WARN] chaos: closing the connection to the broker")
+			_ = c.conn.Close()
+		}
+	})
+	go c.every(ctx, c.Delay, func() { c.delayDue.Store(true) })
+	go c.every(ctx, c.Duplicate, func() { c.duplicateDue.Store(true) })
+	go c.every(ctx, c.Malformed, func() { c.malformedDue.Store(true) })
+}
+
+// every calls f at a random time within each period of length interval.
+func (c *chaosMonkey) every(ctx context.Context, interval time.Duration, f func()) {
+	if interval <= 0 {
+		return
+	}
+	offset := interval // so the first fault falls within the first period
+	for {
+		next := rand.N(interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval - offset + next):
+		}
+		offset = next
+		f()
+	}
+}
+
+// AttemptConnection dials the broker with attemptBrokerConnection, keeping
+// hold of the connection so it can be closed.
+func (c *chaosMonkey) AttemptConnection(ctx context.Context, cfg autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+	conn, err := attemptBrokerConnection(ctx, cfg, u)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	return conn, nil
+}
+
+// Deliver passes a received message to deliver, applying any faults that are
+// due.
+func (c *chaosMonkey) Deliver(broker string, p *paho.Publish, deliver func(broker string, p *paho.Publish)) {
+	if c.malformedDue.CompareAndSwap(true, false) {
+		bad := *p
+		bad.Payload = append([]byte{}, p.Payload[:len(p.Payload)/2]...)
+		log.Printf("[WARN] chaos: delivering a malformed copy of a message on '%s': '%s'", p.Topic, bad.Payload)
+		deliver(broker, &bad)
+	}
+	if c.duplicateDue.CompareAndSwap(true, false) {
+		log.Printf("[WARN] chaos: delivering a message on '%s' twice", p.Topic)
+		deliver(broker, p)
+	}
+	if c.delayDue.CompareAndSwap(true, false) {
+		d := rand.N(c.MaxDelay)
+		log.Printf("[WARN] chaos: delaying a message on '%s' by %s", p.Topic, d.Round(time.Millisecond))
+		time.AfterFunc(d, func() { deliver(broker, p) })
+		return
+	}
+	deliver(broker, p)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// checkConfig is what -check validates beyond what startup already has.
+type checkConfig struct {
+	ServerURL   *url.URL
+	TLS         *tls.Config
+	MQTTVersion string
+	Creds       *brokerCredentials
+	Topics      []string
+	// Connect, if set, also connects to the broker and subscribes to Topics.
+	Connect bool
+}
+
+// checkResolveTimeout bounds how long -check waits for DNS.
+const checkResolveTimeout = 5 * time.Second
+
+// runCheck is the -check validate-only mode, for CI and systemd's
+// ExecStartPre=. By the time it runs, flags, -config and the environment
+// have been parsed and validated and both rules compiled, since any problem
+// with them exits during startup; it resolves the server and, if asked,
+// connects and subscribes. It returns the process exit code.
+func runCheck(ctx context.Context, cfg checkConfig) int {
+	r := &doctorReport{}
+	r.Add(doctorOK, "config", "flags, configuration and rules are valid", "")
+
+	host := cfg.ServerURL.Hostname()
+	if cfg.ServerURL.Scheme == unixSocketScheme {
+		if fi, err := os.Stat(cfg.ServerURL.Path); err != nil || fi.Mode().Type() != fs.ModeSocket {
+			r.Add(doctorFail, "server", fmt.Sprintf("no socket at '%s'", cfg.ServerURL.Path), "check -server and that the broker is running")
+			return 1
+		}
+		r.Add(doctorOK, "server", cfg.ServerURL.String(), "")
+	} else if net.ParseIP(host) == nil {
+		resolveCtx, cancel := context.WithTimeout(ctx, checkResolveTimeout)
+		addrs, err := net.DefaultResolver.LookupHost(resolveCtx, host)
+		cancel()
+		if err != nil {
+			r.Add(doctorFail, "server", fmt.Sprintf("can't resolve '%s': %s", host, err), "check -server and DNS")
+			return 1
+		}
+		r.Add(doctorOK, "server", fmt.Sprintf("%s resolves to %v", cfg.ServerURL, addrs), "")
+	} else {
+		r.Add(doctorOK, "server", cfg.ServerURL.String(), "")
+	}
+
+	if cfg.Connect {
+		checkConnect(ctx, r, cfg)
+	}
+	if r.failed {
+		return 1
+	}
+	return 0
+}
+
+func checkConnect(ctx context.Context, r *doctorReport, cfg checkConfig) {
+	username, password := cfg.Creds.Get()
+	probe := brokerProbe{Server: brokerProbeServer(cfg.ServerURL), TLS: cfg.TLS, MQTTVersion: cfg.MQTTVersion, Username: username, Password: string(password)}
+	c, closeConn, res := probe.Connect(ctx, func(*paho.Publish) {})
+	switch {
+	case res.DialErr != nil:
+		r.Add(doctorFail, "connect", fmt.Sprintf("can't reach %s: %s", probe.Server, res.DialErr),
+			"check -server, DNS, and that no firewall blocks the port")
+		return
+	case res.ConnectErr != nil:
+		r.Add(doctorFail, "connect", fmt.Sprintf("connection to %s refused: %s", probe.Server, res.ConnectErr),
+			"check -user and the password, keyring entry, or Vault secret")
+		return
+	}
+	defer closeConn()
+	r.Add(doctorOK, "connect", fmt.Sprintf("connected to %s", probe.Server), "")
+
+	opCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for _, t := range cfg.Topics {
+		if err := probeSubscribe(opCtx, c, t); err != nil {
+			r.Add(doctorFail, "subscribe", fmt.Sprintf("'%s': %s", t, err),
+				"grant this user read access to the topic in the broker's ACLs")
+			continue
+		}
+		r.Add(doctorOK, "subscribe", fmt.Sprintf("'%s'", t), "")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// disconnectSessionTakenOver is the MQTT 5 DISCONNECT reason code a broker
+// sends when another client connects with the same client ID.
+const disconnectSessionTakenOver = 0x8E
+
+// newClientID returns the client ID to connect with: id if set, otherwise
+// HOSTNAME/NAME, followed, if suffix is set, by a random suffix so several
+// instances on one host don't take over each other's sessions.
+func newClientID(id, hostname string, suffix bool) string {
+	if id == "" {
+		id = fmt.Sprintf("%s/%s", hostname, name)
+	}
+	if suffix {
+		id = fmt.Sprintf("%s-%08x", id, rand.Uint32()) //nolint:gosec // not a secret
+	}
+	return id
+}
+
+// sessionTakenOver reports whether the broker sent d because another client
+// connected with our client ID.
+func sessionTakenOver(d *paho.Disconnect) bool {
+	return d.ReasonCode == disconnectSessionTakenOver
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// minPlausibleYear is the earliest year the system clock can plausibly be
+// set to; hosts without an RTC (e.g. Raspberry Pis) often boot in 1970 or at
+// the time they were last shut down until NTP catches up.
+const minPlausibleYear = 2024
+
+// checkClock reports whether the system clock can be trusted and, if not,
+// why. A clock whose synchronization status can't be determined is trusted
+// as long as it's plausible.
+func checkClock(now time.Time) (ok bool, detail string) {
+	if now.Year() < minPlausibleYear {
+		return false, fmt.Sprintf("system time %s is implausible", now.Format(time.RFC3339))
+	}
+	if synced, err := clockSynchronized(); err == nil && !synced {
+		return false, "system clock is not synchronized"
+	}
+	return true, ""
+}
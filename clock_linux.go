@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	adjtimexTimeError = 5      // TIME_ERROR
+	adjtimexStaUnsync = 0x0040 // STA_UNSYNC
+)
+
+// clockSynchronized asks the kernel whether NTP (or PTP, chrony, ...) has
+// disciplined the system clock, via a read-only adjtimex(2).
+func clockSynchronized() (bool, error) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false, err
+	}
+	if state < 0 {
+		return false, errors.New("adjtimex failed")
+	}
+	return state != adjtimexTimeError && tx.Status&adjtimexStaUnsync == 0, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func clockSynchronized() (bool, error) {
+	return false, errors.New("checking clock synchronization is not supported on this platform")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// shellCommand returns a command running command line s via the system shell.
+func shellCommand(ctx context.Context, s string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", s)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", s)
+}
+
+// parseStep parses a -step value, given as OFFSET:COMMAND, into a Step that
+// runs COMMAND via the shell OFFSET after a shutdown is armed.
+func parseStep(spec string) (Step, error) {
+	offset, command, ok := strings.Cut(spec, ":")
+	if !ok || strings.TrimSpace(command) == "" {
+		return Step{}, fmt.Errorf("invalid -step '%s': must be given as OFFSET:COMMAND", spec)
+	}
+	d, err := time.ParseDuration(offset)
+	if err != nil || d < 0 {
+		return Step{}, fmt.Errorf("invalid -step '%s': OFFSET must be a non-negative duration, e.g. '30s'", spec)
+	}
+	return Step{
+		Offset: d,
+		Name:   command,
+		Run: func(ctx context.Context, _ Pending) {
+			runStepCommand(ctx, d, command)
+		},
+	}, nil
+}
+
+func runStepCommand(ctx context.Context, offset time.Duration, command string) {
+	log.Printf("step +%s: running '%s'", offset, command)
+	out, err := shellCommand(ctx, command).CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("step +%s output: %s", offset, strings.TrimSpace(string(out)))
+	}
+	switch {
+	case ctx.Err() != nil:
+		log.Printf("step +%s: cancelled", offset)
+	case err != nil:
+		log.Printf("step +%s: '%s' failed: %s", offset, command, err)
+	}
+}
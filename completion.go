@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// subcommands lists mqttshutdownd's subcommands with a short description.
+var subcommands = [][2]string{
+	{"setup", "Interactively configure and install the systemd service"},
+	{"doctor", "Check the configuration, broker, and host"},
+	{"verify-broker", "Check broker credentials, topic ACLs, and latency"},
+	{"completion", "Generate shell completions"},
+	{"schema", "Print the JSON Schema of accepted payloads"},
+	{"genconfig", "Print a sample config file or systemd unit"},
+}
+
+func subcommandNames() []string {
+	names := make([]string, len(subcommands))
+	for i, sc := range subcommands {
+		names[i] = sc[0]
+	}
+	return names
+}
+
+// completionFileFlags are flags whose value is a path, for which shells
+// should offer filename completion.
+var completionFileFlags = map[string]bool{
+	"tls-cert":             true,
+	"tls-key":              true,
+	"tls-ca":               true,
+	"vault-token-file":     true,
+	"vault-secret-id-file": true,
+	"gpio-chip":            true,
+	"serial-device":        true,
+	"webhook-token-file":   true,
+	"api-token-file":       true,
+	"debug-token-file":     true,
+	"trigger-file":         true,
+	"state-dir":            true,
+	"snapshot-file":        true,
+	"config":               true,
+	"config-dir":           true,
+	"user-file":            true,
+	"password-file":        true,
+	"down-expr-file":       true,
+	"recovered-expr-file":  true,
+}
+
+// completionFlag describes one command-line flag for completion purposes.
+type completionFlag struct {
+	Name    string
+	Summary string
+	IsBool  bool
+	IsFile  bool
+	Choices []string
+}
+
+func completionFlags(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, isAlias := flagAliases[f.Name]; isAlias || hiddenFlags[f.Name] {
+			return
+		}
+		cf := completionFlag{
+			Name:    f.Name,
+			Summary: flagSummary(f.Usage),
+			IsFile:  completionFileFlags[f.Name],
+		}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+			cf.IsBool = true
+		}
+		switch f.Name {
+		case "format", "udp-format", "webhook-format":
+			cf.Choices = formatNames()
+		case "color":
+			cf.Choices = colorModes
+		case "mqtt-version":
+			cf.Choices = []string{mqttVersion5, mqttVersion311}
+		case "retained":
+			cf.Choices = []string{retainedHonor, retainedIgnore, retainedIgnoreIfOlderThan + "="}
+		}
+		flags = append(flags, cf)
+	})
+	return flags
+}
+
+// flagSummary returns the first sentence of a flag's usage string.
+func flagSummary(usage string) string {
+	if i := strings.Index(usage, ". "); i >= 0 {
+		usage = usage[:i]
+	}
+	return strings.TrimSuffix(usage, ".")
+}
+
+// writeCompletion writes a completion script for the given shell covering the
+// flags defined on fs and the subcommands.
+func writeCompletion(w io.Writer, shell string, fs *flag.FlagSet) error {
+	flags := completionFlags(fs)
+	switch shell {
+	case "bash":
+		writeBashCompletion(w, flags)
+	case "zsh":
+		writeZshCompletion(w, flags)
+	case "fish":
+		writeFishCompletion(w, flags)
+	default:
+		return fmt.Errorf("unsupported shell '%s' (supported: %s)", shell, strings.Join(completionShells, ", "))
+	}
+	return nil
+}
+
+func writeBashCompletion(w io.Writer, flags []completionFlag) {
+	var all, files, valued []string
+	fmt.Fprintf(w, "# bash completion for %s\n", name)
+	fmt.Fprintf(w, "_%s() {\n", name)
+	fmt.Fprintln(w, `	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"`)
+	fmt.Fprintln(w, `	if [[ "${COMP_WORDS[1]}" == completion ]]; then`)
+	fmt.Fprintf(w, "\t\t[[ $COMP_CWORD -eq 2 ]] && COMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(completionShells, " "))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintln(w, `	case "$prev" in`)
+	for _, f := range flags {
+		all = append(all, "-"+f.Name)
+		switch {
+		case len(f.Choices) > 0:
+			fmt.Fprintf(w, "\t-%s | --%s)\n", f.Name, f.Name)
+			fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(f.Choices, " "))
+			fmt.Fprintln(w, "\t\treturn ;;")
+		case f.IsFile:
+			files = append(files, "-"+f.Name, "--"+f.Name)
+		case !f.IsBool:
+			valued = append(valued, "-"+f.Name, "--"+f.Name)
+		}
+	}
+	if len(files) > 0 {
+		fmt.Fprintf(w, "\t%s)\n", strings.Join(files, " | "))
+		fmt.Fprintln(w, "\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))")
+		fmt.Fprintln(w, "\t\treturn ;;")
+	}
+	if len(valued) > 0 {
+		fmt.Fprintf(w, "\t%s)\n", strings.Join(valued, " | "))
+		fmt.Fprintln(w, "\t\treturn ;;")
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, `	if [[ $COMP_CWORD -eq 1 && "$cur" != -* ]]; then`)
+	fmt.Fprintf(w, "\t\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(subcommandNames(), " "))
+	fmt.Fprintln(w, "\t\treturn")
+	fmt.Fprintln(w, "\tfi")
+	fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W \"%s\" -- \"$cur\"))\n", strings.Join(all, " "))
+	fmt.Fprintln(w, "}")
+	fmt.Fprintf(w, "complete -F _%s %s\n", name, name)
+}
+
+func writeZshCompletion(w io.Writer, flags []completionFlag) {
+	esc := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+	fmt.Fprintf(w, "#compdef %s\n\n", name)
+	fmt.Fprintln(w, "if [[ $words[2] == completion ]]; then")
+	fmt.Fprintf(w, "\t_arguments '2:shell:(%s)'\n", strings.Join(completionShells, " "))
+	fmt.Fprintln(w, "\treturn")
+	fmt.Fprintln(w, "fi")
+	fmt.Fprintln(w, "_arguments \\")
+	for _, f := range flags {
+		spec := fmt.Sprintf("-%s[%s]", f.Name, esc.Replace(f.Summary))
+		switch {
+		case f.IsBool:
+		case len(f.Choices) > 0:
+			spec += fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(f.Choices, " "))
+		case f.IsFile:
+			spec += fmt.Sprintf(":%s:_files", f.Name)
+		default:
+			spec += fmt.Sprintf(":%s:", f.Name)
+		}
+		fmt.Fprintf(w, "\t'%s' \\\n", spec)
+	}
+	fmt.Fprintf(w, "\t'1::command:(%s)'\n", strings.Join(subcommandNames(), " "))
+}
+
+func writeFishCompletion(w io.Writer, flags []completionFlag) {
+	esc := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	fmt.Fprintf(w, "complete -c %s -f\n", name)
+	for _, sc := range subcommands {
+		fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a %s -d '%s'\n", name, sc[0], sc[1])
+	}
+	fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from completion' -a '%s'\n", name, strings.Join(completionShells, " "))
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c %s -o %s -d '%s'", name, f.Name, esc.Replace(f.Summary))
+		switch {
+		case f.IsBool:
+		case len(f.Choices) > 0:
+			line += fmt.Sprintf(" -x -a '%s'", strings.Join(f.Choices, " "))
+		case f.IsFile:
+			line += " -r -F"
+		default:
+			line += " -x"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configValues maps flag names to the values a config file gives them; a
+// flag that may be given multiple times can have several.
+type configValues map[string][]string
+
+// readConfigFile reads the -config file at path. Keys are long flag names
+// (e.g. "server", "down-expr"); a list sets a flag that may be given
+// multiple times once per item. Named rules are declared under "rules" (see
+// splitRuleConfigs). Apply the values with applyConfigValues after the
+// environment, so that the command line and the environment override the
+// file.
+//
+// Files are YAML (.yaml, .yml) or TOML (.toml), with string, number, boolean
+// or list values, in mappings or tables that are flattened into dotted keys,
+// e.g. "rules.rack2.topic".
+func readConfigFile(path string) (configValues, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var values configValues
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		values, err = parseYAMLConfig(b)
+	case ".toml":
+		values, err = parseTOMLConfig(b)
+	default:
+		return nil, fmt.Errorf("unsupported config file type '%s'; use .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, key := range []string{"config", "config-dir"} {
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("%s: unknown setting '%s'", path, key)
+		}
+	}
+	return values, nil
+}
+
+// configDirExts are the extensions of the files readConfigDir reads.
+var configDirExts = []string{".yaml", ".yml", ".toml"}
+
+// readConfigDir reads the YAML and TOML files in the -config-dir dir, in the
+// lexical order of their names, conf.d style: a setting in a later file
+// replaces the same setting in an earlier one, so packages and admins can
+// layer rules and overrides, e.g. 10-defaults.yaml and 50-local.yaml. Other
+// files, such as editor backups, are ignored.
+func readConfigDir(dir string) (configValues, error) {
+	entries, err := os.ReadDir(dir) // sorted by name
+	if err != nil {
+		return nil, err
+	}
+	values := make(configValues)
+	for _, e := range entries {
+		ext := strings.ToLower(filepath.Ext(e.Name()))
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !slices.Contains(configDirExts, ext) {
+			continue
+		}
+		vs, err := readConfigFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(values, vs)
+	}
+	return values, nil
+}
+
+// readConfig reads the -config file at path, if set, then the -config-dir
+// dir, if set, whose files override it.
+func readConfig(path, dir string) (configValues, error) {
+	values := make(configValues)
+	if path != "" {
+		vs, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(values, vs)
+	}
+	if dir != "" {
+		vs, err := readConfigDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(values, vs)
+	}
+	return values, nil
+}
+
+// configSourceName names the -config file and -config-dir in messages.
+func configSourceName(path, dir string) string {
+	switch {
+	case dir == "":
+		return path
+	case path == "":
+		return dir
+	}
+	return path + " + " + dir
+}
+
+// envPrefix prefixes the environment variable for each flag: -server is
+// MQTTSHUTDOWND_SERVER, -down-expr is MQTTSHUTDOWND_DOWN_EXPR, and so on.
+const envPrefix = "MQTTSHUTDOWND_"
+
+// envVarName returns the environment variable for the flag name.
+func envVarName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// loadEnvConfig sets every flag that has an environment variable and wasn't
+// given on the command line, so command-line flags override the environment.
+// A flag that may be given multiple times also takes numbered variables,
+// e.g. MQTTSHUTDOWND_STEP_1, MQTTSHUTDOWND_STEP_2, ..., after the plain one.
+// Variables holding passwords are removed from the environment once read, so
+// they aren't passed on to commands the daemon runs.
+func loadEnvConfig(fs *flag.FlagSet) error {
+	values := make(configValues)
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, isAlias := flagAliases[f.Name]; isAlias {
+			return
+		}
+		env := envVarName(f.Name)
+		var vs []string
+		if v, ok := os.LookupEnv(env); ok {
+			vs = append(vs, v)
+		}
+		if _, multi := f.Value.(*stringsFlag); multi {
+			for i := 1; ; i++ {
+				v, ok := os.LookupEnv(fmt.Sprintf("%s_%d", env, i))
+				if !ok {
+					break
+				}
+				vs = append(vs, v)
+			}
+		}
+		if len(vs) == 0 {
+			return
+		}
+		values[f.Name] = vs
+		if strings.Contains(f.Name, "password") {
+			_ = os.Unsetenv(env)
+		}
+	})
+	return applyConfigValues(fs, values, "environment")
+}
+
+// explicitFlags returns the long names of the flags that have been set on
+// fs, directly or through an alias.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		if long, ok := flagAliases[f.Name]; ok {
+			set[long] = true
+		}
+		set[f.Name] = true
+	})
+	return set
+}
+
+// applyConfigValues sets each flag in values that wasn't set explicitly on
+// fs. source names where the values came from, for error messages.
+func applyConfigValues(fs *flag.FlagSet, values configValues, source string) error {
+	set := explicitFlags(fs)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vs := values[name]
+		if long, ok := flagAliases[name]; ok {
+			name = long
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s: unknown setting '%s'", source, name)
+		}
+		if set[name] {
+			continue
+		}
+		if _, multi := f.Value.(*stringsFlag); !multi && len(vs) != 1 {
+			return fmt.Errorf("%s: '%s' takes a single value, not a list", source, name)
+		}
+		for _, v := range vs {
+			if err := fs.Set(name, v); err != nil {
+				if strings.Contains(name, "password") {
+					v = "(redacted)"
+				}
+				return fmt.Errorf("%s: invalid value '%s' for '%s': %w", source, v, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parseYAMLConfig parses YAML, flattening nested mappings into dotted keys,
+// e.g. "rules.rack2.topic". Values are scalars or lists of scalars, and are
+// kept as written, so "1m" and "0.5" reach their flags unchanged.
+func parseYAMLConfig(b []byte) (configValues, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	values := make(configValues)
+	if len(doc.Content) == 0 {
+		return values, nil // empty file
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping of settings", root.Line)
+	}
+	if err := flattenYAMLMapping(values, "", root); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// flattenYAMLMapping adds the settings in the mapping n to values, with
+// their keys prefixed with prefix.
+func flattenYAMLMapping(values configValues, prefix string, n *yaml.Node) error {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		key := prefix + k.Value
+		if v.Kind == yaml.AliasNode {
+			v = v.Alias
+		}
+		if _, dup := values[key]; dup {
+			return fmt.Errorf("line %d: '%s' is set more than once", k.Line, key)
+		}
+		switch v.Kind {
+		case yaml.MappingNode:
+			if err := flattenYAMLMapping(values, key+".", v); err != nil {
+				return err
+			}
+		case yaml.SequenceNode:
+			vs := []string{}
+			for _, item := range v.Content {
+				if item.Kind == yaml.AliasNode {
+					item = item.Alias
+				}
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("line %d: %s: list items must be strings, numbers or booleans", item.Line, key)
+				}
+				vs = append(vs, item.Value)
+			}
+			values[key] = vs
+		case yaml.ScalarNode:
+			if v.Tag == "!!null" {
+				return fmt.Errorf("line %d: '%s' has no value", k.Line, key)
+			}
+			values[key] = []string{v.Value}
+		default:
+			return fmt.Errorf("line %d: %s: unsupported value", v.Line, key)
+		}
+	}
+	return nil
+}
+
+// parseTOMLConfig parses TOML, flattening tables into dotted keys, as
+// parseYAMLConfig does mappings. Values are strings, numbers, booleans or
+// arrays of those; numbers are passed on in their shortest form, so 0.50
+// reaches its flag as "0.5".
+func parseTOMLConfig(b []byte) (configValues, error) {
+	var doc map[string]any
+	if _, err := toml.Decode(string(b), &doc); err != nil {
+		return nil, err
+	}
+	values := make(configValues)
+	if err := flattenTOMLTable(values, "", doc); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// flattenTOMLTable adds the settings in the table t to values, with their
+// keys prefixed with prefix.
+func flattenTOMLTable(values configValues, prefix string, t map[string]any) error {
+	keys := slices.Sorted(maps.Keys(t))
+	for _, k := range keys {
+		key := prefix + k
+		if _, dup := values[key]; dup {
+			return fmt.Errorf("'%s' is set more than once", key)
+		}
+		switch v := t[k].(type) {
+		case map[string]any:
+			if err := flattenTOMLTable(values, key+".", v); err != nil {
+				return err
+			}
+		case []any:
+			vs := []string{}
+			for _, item := range v {
+				s, ok := tomlScalar(item)
+				if !ok {
+					return fmt.Errorf("%s: array items must be strings, numbers or booleans", key)
+				}
+				vs = append(vs, s)
+			}
+			values[key] = vs
+		case []map[string]any:
+			return fmt.Errorf("%s: arrays of tables are not supported", key)
+		default:
+			s, ok := tomlScalar(v)
+			if !ok {
+				return fmt.Errorf("%s: unsupported value", key)
+			}
+			values[key] = []string{s}
+		}
+	}
+	return nil
+}
+
+// tomlScalar formats a decoded TOML string, number or boolean for its flag.
+func tomlScalar(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFileFlattensYAMLAndTOMLAlike(t *testing.T) {
+	want := configValues{
+		"server":                {"mqtt.lan:1883"},
+		"recovery-period":       {"1m"},
+		"low-battery-threshold": {"0.5"},
+		"retries":               {"3"},
+		"strict":                {"true"},
+		"topic":                 {"ups/a", "ups/b"},
+		"rules.rack2.topic":     {"power/alarms/rack2"},
+		"rules.rack2.command":   {"/usr/local/bin/rack2-poweroff"},
+	}
+	for _, tc := range []struct{ name, content string }{
+		{"config.yaml", `
+server: mqtt.lan:1883
+recovery-period: 1m
+low-battery-threshold: 0.5
+retries: 3
+strict: true
+topic: [ups/a, "ups/b"]
+rules:
+  rack2:
+    topic: power/alarms/rack2
+    command: /usr/local/bin/rack2-poweroff
+`},
+		{"config.toml", `
+server = "mqtt.lan:1883"
+recovery-period = "1m"
+low-battery-threshold = 0.50
+retries = 3
+strict = true
+topic = [
+  "ups/a",
+  "ups/b", # trailing comma
+]
+
+[rules.rack2]
+topic = "power/alarms/rack2"
+command = "/usr/local/bin/rack2-poweroff"
+`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readConfigFile(writeConfigFile(t, tc.name, tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.EqualFunc(got, want, slices.Equal) {
+				t.Fatalf("values = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFileRejects(t *testing.T) {
+	for _, tc := range []struct{ name, content, wantErr string }{
+		{"unknown.ini", "server = x", "unsupported config file type"},
+		{"nested.yaml", "config: other.yaml", "unknown setting 'config'"},
+		{"nested.toml", `config-dir = "conf.d"`, "unknown setting 'config-dir'"},
+		{"dup.yaml", "server: a\nserver: b", "set more than once"},
+		{"null.yaml", "server:", "has no value"},
+		{"list.yaml", "topic: [[a]]", "list items must be"},
+		{"invalid.toml", "server = mqtt.lan", ""},
+		{"tables.toml", "[[rules]]\ntopic = \"a\"", "arrays of tables are not supported"},
+		{"date.toml", "since = 2026-01-01", "unsupported value"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readConfigFile(writeConfigFile(t, tc.name, tc.content))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("err = %v, want one containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadConfigDirLayersFilesInNameOrder(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"10-defaults.yaml": "server: a\nrecovery-period: 1m",
+		"50-local.toml":    `server = "b"`,
+		"50-local.toml~":   `server = "c"`,
+		".hidden.yaml":     "server: d",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := readConfigDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := configValues{"server": {"b"}, "recovery-period": {"1m"}}
+	if !maps.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("values = %v, want %v", got, want)
+	}
+}
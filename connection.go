@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// connectionState tracks the daemon's connection to the broker, for status
+// reporting.
+type connectionState struct {
+	mu        sync.Mutex
+	connected bool
+	since     time.Time
+	lastErr   string
+	lastErrAt time.Time
+}
+
+// connectionStatus is a snapshot of a connectionState.
+type connectionStatus struct {
+	Connected bool `json:"connected"`
+	// Since is when the connection came up or, if it isn't up, when it was
+	// lost or the daemon started.
+	Since       time.Time  `json:"since"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+func newConnectionState(now time.Time) *connectionState {
+	return &connectionState{since: now}
+}
+
+// Up records that the connection came up.
+func (c *connectionState) Up(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected, c.since = true, now
+}
+
+// Lost records that the connection went down.
+func (c *connectionState) Lost(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected {
+		c.connected, c.since = false, now
+	}
+}
+
+// Failed records a failed connection attempt.
+func (c *connectionState) Failed(now time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastErr, c.lastErrAt = err.Error(), now
+}
+
+func (c *connectionState) Status() connectionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := connectionStatus{Connected: c.connected, Since: c.since, LastError: c.lastErr}
+	if !c.lastErrAt.IsZero() {
+		at := c.lastErrAt
+		st.LastErrorAt = &at
+	}
+	return st
+}
+
+// connectionLoss handles the daemon's connection to -server going down. Like
+// losing a -redundant-server, it isn't fatal: the loss is recorded in Conn,
+// for the unreachable watchdog and status reporting, and autopaho reconnects
+// with the -reconnect-min/-reconnect-max backoff, while a pending action's
+// countdown, the redundant brokers and the other event sources carry on. Only
+// a session takeover exits, since reconnecting would take the session back
+// from the other client, which would then do the same; otherwise, as with
+// failed subscriptions, the daemon only gives up once reconnecting has failed
+// -reconnect-max-failures times in a row.
+type connectionLoss struct {
+	Conn     *connectionState
+	ClientID string
+}
+
+// ClientError is the OnClientError handler, called when the connection fails,
+// e.g. because the broker or the network went away.
+func (l connectionLoss) ClientError(err error) {
+	l.Conn.Lost(time.Now())
+	log.Printf("[WARN] client error: %s; reconnecting", err)
+}
+
+// ServerDisconnect is the OnServerDisconnect handler.
+func (l connectionLoss) ServerDisconnect(d *paho.Disconnect) {
+	l.Conn.Lost(time.Now())
+	if sessionTakenOver(d) {
+		log.Fatalf("server disconnected us: another client connected with client ID '%s'; give each instance its own with -client-id or -client-id-suffix\n", l.ClientID)
+	}
+	if d.Properties != nil && d.Properties.ReasonString != "" {
+		log.Printf("[WARN] server requested disconnect: %s; reconnecting", d.Properties.ReasonString)
+	} else {
+		log.Printf("[WARN] server requested disconnect; reason code: %d; reconnecting", d.ReasonCode)
+	}
+}
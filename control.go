@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	ControlCommandHold    = "hold"
+	ControlCommandResume  = "resume"
+	ControlCommandConfirm = "confirm"
+	ControlCommandStatus  = "status"
+)
+
+// ControlMessage is an operator command received on the control topic, e.g.
+//
+//	{"command": "hold", "duration": "10m"}
+//
+// pauses a pending shutdown's countdown for ten minutes. Host, if set, limits
+// the command to the host with that name. Rule, if set, applies hold and
+// resume to the named rule of that name instead of the top-level rule.
+//
+// If the command is published with an MQTT v5 Response Topic, each host that
+// handles it publishes a ControlResponse there, carrying the request's
+// Correlation Data, so one "status" request can collect every host's state.
+type ControlMessage struct {
+	Command  string `json:"command"`
+	Duration string `json:"duration,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+}
+
+// ControlResponse is the reply to a ControlMessage.
+type ControlResponse struct {
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	OK      bool      `json:"ok"`
+	Error   string    `json:"error,omitempty"`
+	State   *apiState `json:"state,omitempty"`
+	// Rules is the state of each named rule, by name, in response to status.
+	Rules map[string]apiState `json:"rules,omitempty"`
+}
+
+// controlHandler applies ControlMessages to the Engine, or to a named rule's.
+type controlHandler struct {
+	Topic    string
+	Hostname string
+	Engine   *Engine
+	Rules    []namedRule
+	Observer *observer // nil unless in observation mode
+	// Publisher sends responses to requests with a Response Topic.
+	Publisher *publisher
+}
+
+// Handle applies a control message and responds to it if requested. It
+// returns false if the message is not on the control topic. Invalid or
+// inapplicable commands are logged and ignored.
+func (c controlHandler) Handle(ctx context.Context, p *paho.Publish) bool {
+	if c.Topic == "" || !topicMatches(c.Topic, p.Topic) {
+		return false
+	}
+	var msg ControlMessage
+	if err := json.Unmarshal(p.Payload, &msg); err != nil {
+		log.Printf("[WARN] control: failed to decode message on '%s': %s", p.Topic, err)
+		return true
+	}
+	if msg.Host != "" && msg.Host != c.Hostname {
+		return true
+	}
+	resp := ControlResponse{Host: c.Hostname, Command: msg.Command, OK: true}
+	if msg.Command == ControlCommandStatus {
+		st := newAPIState(c.Hostname, c.Engine.Status())
+		resp.State = &st
+		resp.Rules = ruleStates(c.Hostname, c.Rules)
+	} else if err := c.apply(ctx, msg); err != nil {
+		log.Printf("[WARN] control: %s: %s", msg.Command, err)
+		resp.OK, resp.Error = false, err.Error()
+	}
+	if p.Properties != nil && p.Properties.ResponseTopic != "" {
+		// don't block the client's receive path waiting for the PUBACK:
+		go func() {
+			ctx, cancel := context.WithTimeout(ctx, publishIntentTimeout)
+			defer cancel()
+			if err := c.Publisher.RespondJSON(ctx, p, resp); err != nil {
+				log.Printf("control: failed to respond on '%s': %s", p.Properties.ResponseTopic, err)
+			}
+		}()
+	} else if msg.Command == ControlCommandStatus {
+		log.Printf("[WARN] control: ignoring status request without a response topic")
+	}
+	return true
+}
+
+func (c controlHandler) apply(ctx context.Context, msg ControlMessage) error {
+	switch msg.Command {
+	case ControlCommandHold:
+		d, err := time.ParseDuration(msg.Duration)
+		if err != nil {
+			return fmt.Errorf("invalid duration '%s': %w", msg.Duration, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("duration must be positive")
+		}
+		e, err := ruleEngine(c.Engine, c.Rules, msg.Rule)
+		if err != nil {
+			return err
+		}
+		return e.Hold(ctx, d)
+	case ControlCommandResume:
+		e, err := ruleEngine(c.Engine, c.Rules, msg.Rule)
+		if err != nil {
+			return err
+		}
+		return e.Resume(ctx)
+	case ControlCommandConfirm:
+		if c.Observer == nil {
+			return fmt.Errorf("not in observation mode")
+		}
+		return c.Observer.Enable()
+	default:
+		return fmt.Errorf("unknown command (supported: %s, %s, %s, %s)", ControlCommandHold, ControlCommandResume, ControlCommandConfirm, ControlCommandStatus)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"text/template"
+	"time"
+)
+
+const (
+	IntentStatePending   = "pending"
+	IntentStateHeld      = "held"
+	IntentStateCancelled = "cancelled"
+	IntentStateExecuting = "executing"
+)
+
+// ShutdownIntentMessage is published to the coordination topic when this host
+// schedules, holds, cancels, or executes a shutdown, so peers and other automation
+// can react.
+type ShutdownIntentMessage struct {
+	Host    string             `json:"host"`
+	State   string             `json:"state"`
+	At      time.Time          `json:"at"`
+	Reason  string             `json:"reason"`
+	Trigger *PowerAlarmMessage `json:"trigger,omitempty"`
+	// ClockWarning is set if this host's clock was untrustworthy when the
+	// shutdown was armed, so At may be wrong.
+	ClockWarning string `json:"clock_warning,omitempty"`
+	Rule         string `json:"rule,omitempty"`
+	Source       string `json:"source,omitempty"`
+}
+
+// publishIntentTimeout bounds how long we wait for the broker to acknowledge
+// an intent message; a shutdown must not be held up by an unreachable broker.
+const publishIntentTimeout = 5 * time.Second
+
+// publishIntent publishes a ShutdownIntentMessage to topic, if topic is set,
+// as JSON or, if tmpl is set, rendered with it (-coordination-template).
+// Failures are logged, not fatal.
+func publishIntent(ctx context.Context, p *publisher, topic string, tmpl *template.Template, msg ShutdownIntentMessage) {
+	if topic == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishIntentTimeout)
+	defer cancel()
+	var err error
+	if tmpl == nil {
+		err = p.PublishJSON(ctx, topic, msg, false)
+	} else {
+		var trigger PowerAlarmMessage
+		if msg.Trigger != nil {
+			trigger = *msg.Trigger
+		}
+		data := newMessageData(msg.Host, msg.Rule, msg.State, msg.At, powerEvent{Source: msg.Source, Message: trigger})
+		data.Reason = msg.Reason
+		var payload string
+		if payload, err = renderMessage(tmpl, data); err == nil {
+			err = p.Publish(ctx, topic, []byte(payload), false)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to publish shutdown intent (%s) to '%s': %s", msg.State, topic, err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialsCmdTimeout bounds each run of -credentials-cmd.
+const credentialsCmdTimeout = 30 * time.Second
+
+// brokerCredentials holds the username and password presented to the broker.
+// They may be updated while the daemon is running; new values are used on the
+// next (re)connection attempt.
+type brokerCredentials struct {
+	// UserFile and PasswordFile, if set, are files holding the username and
+	// password. Get re-reads them, so a rotated credential is picked up on
+	// the next (re)connection attempt.
+	UserFile     string
+	PasswordFile string
+	// Command, if set, is a shell command printing the credentials. Get
+	// runs it before each (re)connection attempt, so short-lived
+	// credentials are fetched as needed; see parseCredentialsOutput.
+	Command string
+
+	mu       sync.RWMutex
+	username string
+	password []byte
+}
+
+func (c *brokerCredentials) Set(username string, password []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username = username
+	c.password = password
+}
+
+func (c *brokerCredentials) Get() (string, []byte) {
+	if err := c.LoadFiles(); err != nil {
+		log.Printf("[WARN] %s; using the previously read credentials", err)
+	}
+	if err := c.LoadCommand(); err != nil {
+		log.Printf("[WARN] %s; using the previously fetched credentials", err)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username, c.password
+}
+
+// LoadFiles reads UserFile and PasswordFile, if set. If either can't be
+// read, the credentials are left unchanged.
+func (c *brokerCredentials) LoadFiles() error {
+	if c.UserFile == "" && c.PasswordFile == "" {
+		return nil
+	}
+	var username, password string
+	var err error
+	if c.UserFile != "" {
+		if username, err = readCredentialFile(c.UserFile); err != nil {
+			return err
+		}
+	}
+	if c.PasswordFile != "" {
+		if password, err = readCredentialFile(c.PasswordFile); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.UserFile != "" {
+		c.username = username
+	}
+	if c.PasswordFile != "" {
+		c.password = []byte(password)
+	}
+	return nil
+}
+
+// LoadCommand runs Command, if set, and stores the credentials it prints. If
+// it fails, the credentials are left unchanged.
+func (c *brokerCredentials) LoadCommand() error {
+	if c.Command == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), credentialsCmdTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := shellCommand(ctx, c.Command)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return fmt.Errorf("-credentials-cmd failed: %w", err)
+	}
+	username, password, err := parseCredentialsOutput(out)
+	if err != nil {
+		return fmt.Errorf("-credentials-cmd: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if username != "" {
+		c.username = username
+	}
+	c.password = []byte(password)
+	return nil
+}
+
+// parseCredentialsOutput parses what -credentials-cmd prints: either a JSON
+// object with "password" (or "token") and, optionally, "username", or just
+// the password or token, in which case the username is left as is.
+func parseCredentialsOutput(out []byte) (username, password string, err error) {
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return "", "", errors.New("printed nothing")
+	}
+	if out[0] != '{' {
+		return "", string(out), nil
+	}
+	var v struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Token    string `json:"token"`
+	}
+	if err := json.Unmarshal(out, &v); err != nil {
+		// don't echo the output, which holds secrets:
+		return "", "", errors.New("printed invalid JSON")
+	}
+	if v.Password == "" {
+		v.Password = v.Token
+	}
+	if v.Password == "" {
+		return "", "", errors.New("printed no \"password\" or \"token\"")
+	}
+	return v.Username, v.Password, nil
+}
+
+// readCredentialFile reads a credential from path, trimming surrounding
+// whitespace such as a trailing newline.
+func readCredentialFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read credential: %w", err)
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "" {
+		return "", fmt.Errorf("credential file '%s' is empty", path)
+	}
+	return v, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cyberpowerDefaultSocket = "/var/pwrstatd.ipc"
+
+// cyberpowerSource polls CyberPower's PowerPanel daemon (pwrstatd), first via
+// its local IPC socket and falling back to parsing `pwrstat -status`.
+type cyberpowerSource struct {
+	Socket   string
+	Interval time.Duration
+}
+
+func (c *cyberpowerSource) Name() string {
+	return "cyberpower"
+}
+
+func (c *cyberpowerSource) Run(ctx context.Context, events chan<- powerEvent) {
+	runPoller(ctx, c.Name(), c.Interval, c.poll, events)
+}
+
+func (c *cyberpowerSource) poll(ctx context.Context) (PowerAlarmMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Interval)
+	defer cancel()
+	if c.Socket != "" {
+		m, sockErr := c.pollSocket(ctx)
+		if sockErr == nil {
+			return m, nil
+		}
+		m, err := c.pollCommand(ctx)
+		if err != nil {
+			return m, fmt.Errorf("socket: %s; pwrstat: %w", sockErr, err)
+		}
+		return m, nil
+	}
+	return c.pollCommand(ctx)
+}
+
+// pollSocket queries pwrstatd's IPC socket, which answers a "STATUS" request
+// with key=value lines (e.g. ac_present=yes, battery_capacity=100).
+func (c *cyberpowerSource) pollSocket(ctx context.Context) (PowerAlarmMessage, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.Socket)
+	if err != nil {
+		return PowerAlarmMessage{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte("STATUS\n\n")); err != nil {
+		return PowerAlarmMessage{}, err
+	}
+
+	kv := make(map[string]string)
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" && len(kv) > 0 {
+			break
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			kv[k] = v
+		}
+	}
+	if err := sc.Err(); err != nil && len(kv) == 0 {
+		return PowerAlarmMessage{}, err
+	}
+
+	ac, ok := kv["ac_present"]
+	if !ok {
+		return PowerAlarmMessage{}, fmt.Errorf("pwrstatd response has no ac_present field")
+	}
+	m := PowerAlarmMessage{Online: ac == "yes", PowerType: PowerTypeUtility, Scope: ScopeGlobal}
+	if pct, err := strconv.ParseFloat(kv["battery_capacity"], 64); err == nil {
+		m.Battery = &pct
+	}
+	return m, nil
+}
+
+// pollCommand runs `pwrstat -status` and parses its human-readable output.
+func (c *cyberpowerSource) pollCommand(ctx context.Context) (PowerAlarmMessage, error) {
+	out, err := exec.CommandContext(ctx, "pwrstat", "-status").Output()
+	if err != nil {
+		return PowerAlarmMessage{}, fmt.Errorf("failed to run pwrstat -status: %w", err)
+	}
+	return parsePwrstatStatus(out)
+}
+
+// parsePwrstatStatus parses the output of `pwrstat -status`, e.g.:
+//
+//	Power Supply by.............. Utility Power
+//	Battery Capacity............. 100 %
+func parsePwrstatStatus(out []byte) (PowerAlarmMessage, error) {
+	m := PowerAlarmMessage{PowerType: PowerTypeUtility, Scope: ScopeGlobal}
+	found := false
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		i := strings.Index(line, "..")
+		if i < 0 {
+			continue
+		}
+		key := line[:i]
+		val := strings.TrimSpace(strings.TrimLeft(line[i:], "."))
+		switch key {
+		case "Power Supply by":
+			found = true
+			m.Online = strings.HasPrefix(val, "Utility")
+		case "Battery Capacity":
+			if pct, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(val, "%")), 64); err == nil {
+				m.Battery = &pct
+			}
+		}
+	}
+	if !found {
+		return m, fmt.Errorf("pwrstat output has no 'Power Supply by' line")
+	}
+	return m, nil
+}
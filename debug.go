@@ -0,0 +1,95 @@
+//go:build !minimal
+
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// debugServer serves net/http/pprof profiles under /debug/pprof/ and expvar
+// variables at /debug/vars, so long-running instances can be profiled in the
+// field. Requests must present Token as a bearer token, if set; without one,
+// it must listen on a loopback address. The command line, which may include
+// -password, isn't served.
+type debugServer struct {
+	Listen string
+	Token  string
+	Engine *Engine
+	Rules  []namedRule
+	Conn   *connectionState
+	Events *eventQueue
+}
+
+func (d *debugServer) Run(ctx context.Context) {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	expvar.Publish("engine", expvar.Func(func() any { return newAPIState(d.Engine.Hostname, d.Engine.Status()) }))
+	expvar.Publish("rules", expvar.Func(func() any { return ruleStates(d.Engine.Hostname, d.Rules) }))
+	expvar.Publish("connection", expvar.Func(func() any { return d.Conn.Status() }))
+	expvar.Publish("event_queue", expvar.Func(func() any {
+		offered, dropped := d.Events.Stats()
+		return map[string]uint64{"offered": offered, "dropped": dropped, "queued": uint64(len(d.Events.C()))}
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", serveExpvars)
+
+	var handler http.Handler = mux
+	if d.Token != "" {
+		handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if !bearerAuthorized(r, d.Token) {
+				http.Error(rw, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			mux.ServeHTTP(rw, r)
+		})
+	}
+	srv := &http.Server{
+		Addr:              d.Listen,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	log.Printf("debug: serving pprof and expvar on %s", d.Listen)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		// The debug server is only an aid; losing it mustn't stop the daemon,
+		// e.g. with a shutdown pending.
+		log.Printf("[ERROR] debug: %s", err)
+	}
+}
+
+// serveExpvars is expvar.Handler, leaving out the "cmdline" variable expvar
+// publishes itself.
+func serveExpvars(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(rw, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprint(rw, ",\n")
+		}
+		first = false
+		fmt.Fprintf(rw, "%s: %s", strconv.Quote(kv.Key), kv.Value)
+	})
+	fmt.Fprint(rw, "\n}\n")
+}
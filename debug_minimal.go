@@ -0,0 +1,18 @@
+//go:build minimal
+
+package main
+
+import "context"
+
+// debugServer is left out of minimal builds, along with net/http/pprof and
+// expvar; -debug-listen is rejected at startup.
+type debugServer struct {
+	Listen string
+	Token  string
+	Engine *Engine
+	Rules  []namedRule
+	Conn   *connectionState
+	Events *eventQueue
+}
+
+func (d *debugServer) Run(context.Context) {}
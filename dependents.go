@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dependentsTracker tracks the availability of dependent hosts, as reported on
+// their MQTT availability topics, so this host can delay its own poweroff until
+// they have gone down. A dependent that has never reported is assumed to be up.
+type dependentsTracker struct {
+	topics         []string
+	offlinePayload string
+
+	mu      sync.Mutex
+	offline map[string]bool
+	changed chan struct{}
+}
+
+func newDependentsTracker(topics []string, offlinePayload string) *dependentsTracker {
+	return &dependentsTracker{
+		topics:         topics,
+		offlinePayload: offlinePayload,
+		offline:        make(map[string]bool),
+		changed:        make(chan struct{}),
+	}
+}
+
+// Topics returns the availability topics being tracked.
+func (d *dependentsTracker) Topics() []string {
+	return d.topics
+}
+
+// Handle records an availability message. It returns false if topic does not
+// belong to a tracked dependent.
+func (d *dependentsTracker) Handle(topic string, payload []byte) bool {
+	tracked := false
+	for _, f := range d.topics {
+		if topicMatches(f, topic) {
+			tracked = true
+			break
+		}
+	}
+	if !tracked {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.offline[topic] = d.isOffline(payload)
+	close(d.changed)
+	d.changed = make(chan struct{})
+	return true
+}
+
+// isOffline reports whether an availability payload indicates the dependent
+// is down: an empty (cleared) payload, the configured offline payload, or a
+// JSON object whose "status" field is the offline payload.
+func (d *dependentsTracker) isOffline(payload []byte) bool {
+	p := strings.TrimSpace(string(payload))
+	if p == "" || strings.EqualFold(p, d.offlinePayload) {
+		return true
+	}
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(payload, &status); err == nil {
+		return strings.EqualFold(status.Status, d.offlinePayload)
+	}
+	return false
+}
+
+// Up returns the availability topics of dependents not known to be down.
+func (d *dependentsTracker) Up() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.up()
+}
+
+func (d *dependentsTracker) up() []string {
+	var up []string
+	for _, f := range d.topics {
+		seen := false
+		for topic, offline := range d.offline {
+			if !topicMatches(f, topic) {
+				continue
+			}
+			seen = true
+			if !offline {
+				up = append(up, topic)
+			}
+		}
+		if !seen {
+			up = append(up, f)
+		}
+	}
+	sort.Strings(up)
+	return up
+}
+
+// WaitAllDown blocks until every dependent has reported down, timeout elapses,
+// or ctx is done. It returns the dependents still up when it returned.
+func (d *dependentsTracker) WaitAllDown(ctx context.Context, timeout time.Duration) []string {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		d.mu.Lock()
+		up := d.up()
+		changed := d.changed
+		d.mu.Unlock()
+		if len(up) == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return up
+		case <-ctx.Done():
+			return up
+		}
+	}
+}
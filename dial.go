@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+)
+
+const (
+	// dialStagger is how long dialHappyEyeballs waits for a connection
+	// attempt before starting one to the next address.
+	dialStagger = 250 * time.Millisecond
+	// dialAddressTimeout bounds each connection attempt to a single address.
+	dialAddressTimeout = 5 * time.Second
+	// brokerConnectTimeout bounds establishing a broker connection, including
+	// any TLS or WebSocket handshake, when autopaho's ConnectTimeout isn't
+	// set; it is autopaho's default.
+	brokerConnectTimeout = 10 * time.Second
+)
+
+// dialHappyEyeballs connects to address (host:port) in the style of RFC 8305
+// ("Happy Eyeballs"): it resolves every address of host, alternating IPv6 and
+// IPv4 ones, and starts connecting to each in turn, dialStagger after the
+// previous attempt started or as soon as it failed. The first connection
+// established wins. Unlike net.Dialer, which splits its timeout across the
+// addresses of a family and tries them one at a time, a dead route to one
+// address only costs dialStagger, not the whole timeout.
+func dialHappyEyeballs(ctx context.Context, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for '%s'", host)
+	}
+	addrs = interleaveAddressFamilies(addrs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	start := func(a net.IPAddr) {
+		go func() {
+			dialCtx, cancel := context.WithTimeout(ctx, dialAddressTimeout)
+			defer cancel()
+			conn, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", net.JoinHostPort(a.String(), port))
+			results <- result{conn, err}
+		}()
+	}
+
+	start(addrs[0])
+	next, running := 1, 1
+	var errs []error
+	for running > 0 {
+		var stagger <-chan time.Time
+		if next < len(addrs) {
+			stagger = time.After(dialStagger)
+		}
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// close connections that are established after this one:
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(running)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+		case <-stagger:
+		}
+		if next < len(addrs) {
+			start(addrs[next])
+			next++
+			running++
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// interleaveAddressFamilies orders addrs IPv6, IPv4, IPv6, ..., keeping the
+// resolver's order within each family.
+func interleaveAddressFamilies(addrs []net.IPAddr) []net.IPAddr {
+	var v6, v4 []net.IPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	out := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// dialBroker connects to the broker at address with dialHappyEyeballs,
+// negotiating TLS if tlsCfg is set.
+func dialBroker(ctx context.Context, address string, tlsCfg *tls.Config) (net.Conn, error) {
+	conn, err := dialHappyEyeballs(ctx, address)
+	if err != nil || tlsCfg == nil {
+		return conn, err
+	}
+	cfg := tlsCfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(address)
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// dialUnixSocket connects to the broker listening on the Unix domain socket
+// at path.
+func dialUnixSocket(ctx context.Context, path string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialAddressTimeout)
+	defer cancel()
+	return (&net.Dialer{}).DialContext(ctx, "unix", path)
+}
+
+// attemptBrokerConnection is an autopaho AttemptConnection function using
+// dialBroker, dialWebSocket for ws:// and wss:// URLs, or dialUnixSocket for
+// unix:// URLs. Like autopaho's own dialing, it gives up after ConnectTimeout,
+// so a broker that accepts connections but stalls the handshake can't hold up
+// reconnecting.
+func attemptBrokerConnection(ctx context.Context, cfg autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+	timeout := cfg.ConnectTimeout
+	if timeout <= 0 {
+		timeout = brokerConnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if u.Scheme == unixSocketScheme {
+		conn, err := dialUnixSocket(ctx, u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return packets.NewThreadSafeConn(conn), nil
+	}
+	useTLS, webSocket := webSocketSchemes[u.Scheme]
+	var tlsCfg *tls.Config
+	if u.Scheme == "mqtts" || useTLS {
+		tlsCfg = cfg.TlsCfg
+		if tlsCfg == nil {
+			tlsCfg = &tls.Config{}
+		}
+	}
+	if webSocket {
+		return dialWebSocket(ctx, u, tlsCfg)
+	}
+	conn, err := dialBroker(ctx, u.Host, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return packets.NewThreadSafeConn(conn), nil
+}
+
+// brokerConnectionAttempter returns the AttemptConnection function for
+// autopaho connections using the given -mqtt-version: attemptBrokerConnection,
+// unless a proxy is configured with $all_proxy, which only autopaho's own
+// dialing supports.
+func brokerConnectionAttempter(mqttVersion string) func(context.Context, autopaho.ClientConfig, *url.URL) (net.Conn, error) {
+	if os.Getenv("all_proxy") != "" {
+		return nil
+	}
+	if mqttVersion == mqttVersion311 {
+		return func(ctx context.Context, cfg autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+			conn, err := attemptBrokerConnection(ctx, cfg, u)
+			if err != nil {
+				return nil, err
+			}
+			return packets.NewThreadSafeConn(newMQTT311Conn(conn)), nil
+		}
+	}
+	return attemptBrokerConnection
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// doctorConfig is the subset of the daemon's configuration checked by the
+// doctor subcommand.
+type doctorConfig struct {
+	Server      string
+	TLS         *tls.Config
+	MQTTVersion string
+	Creds       *brokerCredentials
+	Topics      []string
+	StateDir    string
+}
+
+// doctorProbeWait is how long doctor waits for a message on each topic.
+const doctorProbeWait = 5 * time.Second
+
+type doctorStatus int
+
+const (
+	doctorOK doctorStatus = iota
+	doctorWarn
+	doctorFail
+)
+
+func (s doctorStatus) String() string {
+	switch s {
+	case doctorOK:
+		return " OK "
+	case doctorWarn:
+		return "WARN"
+	default:
+		return "FAIL"
+	}
+}
+
+// doctorReport prints findings and tracks whether any check failed.
+type doctorReport struct {
+	failed bool
+}
+
+// Add prints a finding. hint, if given, tells the operator what to do about it.
+func (r *doctorReport) Add(s doctorStatus, check, detail, hint string) {
+	if s == doctorFail {
+		r.failed = true
+	}
+	fmt.Printf("[%s] %s: %s\n", s, check, detail)
+	if hint != "" && s != doctorOK {
+		fmt.Printf("       -> %s\n", hint)
+	}
+}
+
+// runDoctor checks the given configuration and the host's ability to shut
+// down, printing actionable findings. It returns the process exit code.
+func runDoctor(ctx context.Context, cfg doctorConfig) int {
+	r := &doctorReport{}
+	fmt.Printf("%s %s doctor\n\n", name, version)
+
+	doctorBroker(ctx, r, cfg)
+	doctorClock(r, cfg.TLS)
+	doctorShutdown(r)
+	doctorStateDir(r, cfg.StateDir)
+	doctorSystemd(r)
+
+	if r.failed {
+		return 1
+	}
+	return 0
+}
+
+func doctorBroker(ctx context.Context, r *doctorReport, cfg doctorConfig) {
+	username, password := cfg.Creds.Get()
+	probe := brokerProbe{
+		Server:      cfg.Server,
+		TLS:         cfg.TLS,
+		MQTTVersion: cfg.MQTTVersion,
+		Username:    username,
+		Password:    string(password),
+	}
+
+	res := probe.Run(ctx, "", 0)
+	switch {
+	case res.DialErr != nil:
+		r.Add(doctorFail, "broker", fmt.Sprintf("can't reach %s: %s", cfg.Server, res.DialErr),
+			"check -server, DNS, and that no firewall blocks the port")
+		return
+	case res.ConnectErr != nil:
+		r.Add(doctorFail, "broker", fmt.Sprintf("connection to %s refused: %s", cfg.Server, res.ConnectErr),
+			"check -user and the password, keyring entry, or Vault secret")
+		return
+	}
+	r.Add(doctorOK, "broker", fmt.Sprintf("connected to %s", cfg.Server), "")
+
+	for _, t := range cfg.Topics {
+		res := probe.Run(ctx, t, doctorProbeWait)
+		switch {
+		case !res.OK():
+			r.Add(doctorFail, "subscribe", fmt.Sprintf("'%s': %s", t, firstErr(res.DialErr, res.ConnectErr, res.SubscribeErr)),
+				"grant this user read access to the topic in the broker's ACLs")
+		case res.Message == nil:
+			r.Add(doctorOK, "subscribe", fmt.Sprintf("'%s': subscribed; no retained message within %s", t, doctorProbeWait), "")
+		default:
+			r.Add(doctorOK, "subscribe", fmt.Sprintf("'%s': subscribed; received %d byte message on '%s'", t, len(res.Message.Payload), res.Message.Topic), "")
+		}
+	}
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func doctorClock(r *doctorReport, tlsCfg *tls.Config) {
+	now := time.Now()
+	if now.Year() < minPlausibleYear {
+		r.Add(doctorFail, "clock", fmt.Sprintf("system time is %s", now.Format(time.RFC3339)),
+			"set the clock or enable NTP; TLS and timers depend on it")
+		return
+	}
+	if tlsCfg != nil && tlsCfg.GetClientCertificate != nil {
+		if c, err := tlsCfg.GetClientCertificate(nil); err == nil && c != nil && c.Leaf != nil {
+			if now.Before(c.Leaf.NotBefore) || now.After(c.Leaf.NotAfter) {
+				r.Add(doctorFail, "clock", fmt.Sprintf("client certificate is valid %s to %s, but it's now %s",
+					c.Leaf.NotBefore.Format(time.RFC3339), c.Leaf.NotAfter.Format(time.RFC3339), now.Format(time.RFC3339)),
+					"renew the certificate, or fix the system clock if it's wrong")
+				return
+			}
+		}
+	}
+	if synced, err := clockSynchronized(); err == nil && !synced {
+		r.Add(doctorWarn, "clock", fmt.Sprintf("%s, but not NTP-synchronized", now.Format(time.RFC3339)),
+			"enable time synchronization, e.g. 'timedatectl set-ntp true'")
+		return
+	}
+	r.Add(doctorOK, "clock", now.Format(time.RFC3339), "")
+}
+
+func doctorShutdown(r *doctorReport) {
+	path, err := exec.LookPath("shutdown")
+	if err != nil {
+		r.Add(doctorFail, "shutdown", "'shutdown' command not found in $PATH", "install it or add its directory to $PATH")
+		return
+	}
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		r.Add(doctorWarn, "shutdown", fmt.Sprintf("found %s, but not running as root", path),
+			"run mqttshutdownd as root (as the provided systemd unit does), or grant this user permission to shut down")
+		return
+	}
+	r.Add(doctorOK, "shutdown", fmt.Sprintf("found %s", path), "")
+}
+
+func doctorStateDir(r *doctorReport, dir string) {
+	if dir == "" {
+		r.Add(doctorWarn, "state", "state persistence disabled", "set -state-dir to record shutdown reasons and boot announcements")
+		return
+	}
+	store, err := newStateStore(dir)
+	if err == nil {
+		err = store.WriteJSON("doctor.json", map[string]time.Time{"at": time.Now()})
+	}
+	if err == nil {
+		err = store.Remove("doctor.json")
+	}
+	if err != nil {
+		r.Add(doctorWarn, "state", fmt.Sprintf("%s is not writable: %s", dir, err), "create it or fix its permissions")
+		return
+	}
+	r.Add(doctorOK, "state", fmt.Sprintf("%s is writable", dir), "")
+}
+
+func doctorSystemd(r *doctorReport) {
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		r.Add(doctorOK, "systemd", "not running under systemd; skipped", "")
+		return
+	}
+	unit := name + ".service"
+	if exec.Command("systemctl", "cat", unit).Run() != nil {
+		r.Add(doctorWarn, "systemd", fmt.Sprintf("%s is not installed", unit), fmt.Sprintf("run '%s setup' or install the unit from the package", name))
+		return
+	}
+	enabled, _ := exec.Command("systemctl", "is-enabled", unit).Output()
+	if strings.TrimSpace(string(enabled)) != "enabled" {
+		r.Add(doctorWarn, "systemd", fmt.Sprintf("%s is %s", unit, strings.TrimSpace(string(enabled))), fmt.Sprintf("sudo systemctl enable %s", name))
+		return
+	}
+	active, _ := exec.Command("systemctl", "is-active", unit).Output()
+	if strings.TrimSpace(string(active)) != "active" {
+		r.Add(doctorWarn, "systemd", fmt.Sprintf("%s is enabled but %s", unit, strings.TrimSpace(string(active))), fmt.Sprintf("check 'journalctl -u %s'", name))
+		return
+	}
+	r.Add(doctorOK, "systemd", fmt.Sprintf("%s is enabled and active", unit), "")
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock abstracts time for the Engine, so its arm/cancel behavior can be
+// driven by a fake clock.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call scheduled by Clock.AfterFunc.
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// AfterFunc calls f once d has elapsed on the monotonic clock or the
+// wall-clock deadline has passed, whichever is first. Go's timers use the
+// monotonic clock, which stops while the host is suspended; checking the wall
+// clock too makes a timer fire promptly after a resume instead of being
+// extended by however long the host slept.
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	t := &wallTimer{stop: make(chan struct{})}
+	deadline := time.Now().Round(0).Add(d)
+	go func() {
+		mono := time.NewTimer(d)
+		defer mono.Stop()
+		tick := time.NewTicker(wallClockCheckInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-t.stop:
+				return
+			case <-mono.C:
+			case <-tick.C:
+				if time.Now().Round(0).Before(deadline) {
+					continue
+				}
+			}
+			if t.fired.CompareAndSwap(false, true) {
+				f()
+			}
+			return
+		}
+	}()
+	return t
+}
+
+// wallClockCheckInterval is how often a realClock timer compares the wall
+// clock against its deadline.
+const wallClockCheckInterval = 5 * time.Second
+
+type wallTimer struct {
+	stop  chan struct{}
+	fired atomic.Bool
+}
+
+// Stop prevents the timer from firing. It returns false if it already fired
+// or was already stopped.
+func (t *wallTimer) Stop() bool {
+	if !t.fired.CompareAndSwap(false, true) {
+		return false
+	}
+	close(t.stop)
+	return true
+}
+
+// staleTimerTolerance is how late a timer may fire, by the wall clock, before
+// the Engine assumes the host was suspended (or the clock stepped) and that
+// the decision it was about to act on is stale.
+const staleTimerTolerance = time.Minute
+
+// Evaluator decides whether an event should arm a shutdown (Down) or cancel
+// a pending one (Recovered).
+type Evaluator interface {
+	Down(ev powerEvent) (bool, error)
+	Recovered(ev powerEvent) (bool, error)
+}
+
+// exprEvaluator evaluates -down-expr and -recovered-expr.
+type exprEvaluator struct {
+	down      exprProgram
+	recovered exprProgram
+}
+
+func (e exprEvaluator) Down(ev powerEvent) (bool, error) {
+	return e.down.Eval(ev)
+}
+
+func (e exprEvaluator) Recovered(ev powerEvent) (bool, error) {
+	return e.recovered.Eval(ev)
+}
+
+// batteryHysteresis gates another Evaluator on the battery state of charge, so
+// a state of charge jittering around a single threshold can't repeatedly arm
+// and cancel a shutdown: it only arms below ArmBelow and only considers power
+// recovered above RecoverAbove. Either is disabled when zero.
+type batteryHysteresis struct {
+	Evaluator
+	ArmBelow     float64
+	RecoverAbove float64
+}
+
+// Down requires the battery to be known and below ArmBelow.
+func (b batteryHysteresis) Down(ev powerEvent) (bool, error) {
+	down, err := b.Evaluator.Down(ev)
+	if err != nil || !down || b.ArmBelow == 0 {
+		return down, err
+	}
+	battery := ev.Message.BatteryPercent()
+	return battery >= 0 && battery < b.ArmBelow, nil
+}
+
+// Recovered requires the battery, if known, to be above RecoverAbove; an
+// event without battery information (e.g. utility power returning, reported by
+// a different source) is left to the wrapped Evaluator.
+func (b batteryHysteresis) Recovered(ev powerEvent) (bool, error) {
+	recovered, err := b.Evaluator.Recovered(ev)
+	if err != nil || !recovered || b.RecoverAbove == 0 {
+		return recovered, err
+	}
+	battery := ev.Message.BatteryPercent()
+	return battery < 0 || battery > b.RecoverAbove, nil
+}
+
+// Pending describes an armed shutdown.
+type Pending struct {
+	Trigger   powerEvent
+	ArmedAt   time.Time
+	ExecuteAt time.Time
+	// ClockWarning is set if the system clock was untrustworthy when the
+	// shutdown was armed, so ArmedAt and ExecuteAt may be wrong.
+	ClockWarning string
+}
+
+// Action carries out the effects of the Engine's decisions.
+type Action interface {
+	// Armed is called when a shutdown is scheduled.
+	Armed(ctx context.Context, p Pending)
+	// Held is called when a pending shutdown's countdown is paused until
+	// the given time.
+	Held(ctx context.Context, p Pending, until time.Time)
+	// Cancelled is called when a pending shutdown is cancelled by ev.
+	Cancelled(ctx context.Context, p Pending, ev powerEvent)
+	// Execute is called when the delay elapses. ctx is cancelled if the
+	// shutdown is cancelled while Execute is still running (e.g. while
+	// waiting for dependents).
+	Execute(ctx context.Context, p Pending)
+}
+
+// Step is an additional action run at Offset after a shutdown is armed,
+// e.g. a notification or stopping services before the host powers off.
+type Step struct {
+	Offset time.Duration
+	Name   string
+	Run    func(ctx context.Context, p Pending)
+}
+
+// Engine is the decision loop: a Down event arms a shutdown that is executed
+// after Delay unless a Recovered event cancels it first. Steps are scheduled
+// along with the shutdown and cancelled with it as one group.
+type Engine struct {
+	Clock     Clock
+	Evaluator Evaluator
+	Action    Action
+	Delay     time.Duration
+	Steps     []Step
+	Debug     func(m string)
+	// ActionName describes the action in logs; defaults to "shutdown".
+	ActionName string
+	// Rule names the rule the Engine evaluates, if it's a named rule from
+	// -config rather than the top-level one.
+	Rule string
+	// Hostname is matched against events' host/target field; events aimed
+	// at other hosts are ignored.
+	Hostname string
+	// Tags are matched against events' targets selector; events selecting
+	// other hosts are ignored.
+	Tags map[string]string
+	// Supply is the phase and circuit feeding this host; single-phase and
+	// single-circuit events about other phases or circuits are ignored.
+	Supply supply
+	// History, if set, records every event the Engine handles.
+	History *eventHistory
+	// Journal, if set, durably records every event and rule evaluation.
+	Journal *journal
+	// Runtime, if set, estimates the remaining battery runtime from the
+	// events handled; the estimate is available to rules.
+	Runtime *runtimeEstimator
+	// RuntimeMargin, if set, moves a pending action's deadline up so that
+	// it runs at least this long before the estimated runtime is exhausted.
+	RuntimeMargin time.Duration
+	// CheckClock, if set, is consulted when arming, to flag decisions made
+	// with an untrustworthy system clock.
+	CheckClock func(now time.Time) (ok bool, detail string)
+
+	mu         sync.Mutex
+	pending    *Pending
+	pendingCtx context.Context
+	cancel     context.CancelFunc
+	executing  bool
+	timers     []Timer
+	stepRan    []bool
+	// gen is incremented whenever timers are stopped, so a timer that fired
+	// concurrently can tell it's stale.
+	gen uint64
+	// elapsed is how much of the countdown ran before the current segment,
+	// which started at resumedAt; it only differs from zero after a hold.
+	elapsed   time.Duration
+	resumedAt time.Time
+	heldUntil time.Time
+	// nextDelay, if set, replaces Delay once nothing is pending.
+	nextDelay *time.Duration
+}
+
+// Handle processes a single event.
+func (e *Engine) Handle(ctx context.Context, ev powerEvent) error {
+	if e.Debug != nil {
+		e.Debug(fmt.Sprintf("%s: %s", ev.Source, ev.Message.String()))
+	}
+	if e.History != nil {
+		e.History.Record(e.Clock.Now(), ev)
+	}
+	e.journal(JournalKindEvent, ev, "received")
+	if !ev.Expires.IsZero() && !e.Clock.Now().Before(ev.Expires) {
+		log.Printf("ignoring event from %s: the message expired at %s", ev.Source, ev.Expires.Format(time.RFC3339))
+		return nil
+	}
+	if !ev.Message.TargetsHost(e.Hostname) {
+		if e.Debug != nil {
+			e.Debug(fmt.Sprintf("ignoring event from %s: it targets another host", ev.Source))
+		}
+		return nil
+	}
+	if match, err := ev.Message.MatchesTags(e.Tags); err != nil {
+		log.Printf("[WARN] ignoring event from %s: %s", ev.Source, err)
+		return nil
+	} else if !match {
+		if e.Debug != nil {
+			e.Debug(fmt.Sprintf("ignoring event from %s: its targets selector doesn't match this host's tags", ev.Source))
+		}
+		return nil
+	}
+	if !ev.Message.AffectsSupply(e.Supply) {
+		if e.Debug != nil {
+			e.Debug(fmt.Sprintf("ignoring event from %s: it concerns another phase or circuit", ev.Source))
+		}
+		return nil
+	}
+	if e.Runtime != nil {
+		e.Runtime.Observe(e.Clock.Now(), ev.Message)
+		if est, ok := e.Runtime.Estimate(); ok {
+			ev.Runtime = est
+			if e.Debug != nil {
+				e.Debug(fmt.Sprintf("estimated battery runtime remaining: %s", est.Round(time.Second)))
+			}
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pending == nil {
+		down, err := e.Evaluator.Down(ev)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate %s: %w", e.exprName("down-expr"), err)
+		}
+		e.journal(JournalKindEvaluation, ev, fmt.Sprintf("down: %t", down))
+		if !down {
+			return nil
+		}
+		log.Printf("power down; %s in %s", e.actionName(), e.Delay)
+		e.arm(ctx, ev)
+		e.tuneDeadline(ctx, ev.Runtime)
+		return nil
+	}
+
+	recovered, err := e.Evaluator.Recovered(ev)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate %s: %w", e.exprName("recovered-expr"), err)
+	}
+	e.journal(JournalKindEvaluation, ev, fmt.Sprintf("recovered: %t", recovered))
+	if !recovered {
+		e.tuneDeadline(ctx, ev.Runtime)
+		return nil
+	}
+	log.Printf("power recovered; cancelling pending %s", e.actionName())
+	p := *e.pending
+	e.disarm()
+	e.Action.Cancelled(ctx, p, ev)
+	return nil
+}
+
+// arm schedules the action for ev. e.mu must be held.
+func (e *Engine) arm(ctx context.Context, ev powerEvent) {
+	now := e.Clock.Now()
+	p := Pending{Trigger: ev, ArmedAt: now, ExecuteAt: now.Add(e.Delay)}
+	if e.CheckClock != nil {
+		if ok, detail := e.CheckClock(now); !ok {
+			log.Printf("[WARN] %s armed with an untrustworthy clock: %s", e.actionName(), detail)
+			p.ClockWarning = detail
+		}
+	}
+	e.Action.Armed(ctx, p)
+	e.pending = &p
+	e.pendingCtx, e.cancel = context.WithCancel(ctx)
+	e.elapsed, e.resumedAt = 0, now
+	e.stepRan = make([]bool, len(e.Steps))
+	e.schedule()
+}
+
+// deadlineTuneMinShift is the least amount by which tuneDeadline moves a
+// deadline up, so a jittery runtime estimate doesn't reschedule constantly.
+const deadlineTuneMinShift = 15 * time.Second
+
+// tuneDeadline moves the pending action's deadline up if the estimated
+// battery runtime, less RuntimeMargin, would run out first. A held action is
+// left alone. e.mu must be held.
+func (e *Engine) tuneDeadline(ctx context.Context, runtime time.Duration) {
+	if e.RuntimeMargin == 0 || runtime <= 0 || e.pending == nil || e.executing || !e.heldUntil.IsZero() {
+		return
+	}
+	now := e.Clock.Now()
+	remaining := e.Delay - e.elapsed - now.Sub(e.resumedAt)
+	budget := max(runtime-e.RuntimeMargin, 0)
+	if budget > remaining-deadlineTuneMinShift {
+		return
+	}
+	log.Printf("[WARN] estimated battery runtime is %s; moving %s up to %s from now (was %s)",
+		runtime.Round(time.Second), e.actionName(), budget.Round(time.Second), remaining.Round(time.Second))
+	e.stopTimers()
+	e.elapsed, e.resumedAt = e.Delay-budget, now
+	e.pending.ExecuteAt = now.Add(budget)
+	e.Action.Armed(ctx, *e.pending)
+	e.schedule()
+}
+
+// Trigger arms the action for ev without evaluating -down-expr, e.g. on an
+// operator's request. It fails if the action is already pending.
+func (e *Engine) Trigger(ctx context.Context, ev powerEvent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending != nil {
+		return fmt.Errorf("a %s is already pending", e.actionName())
+	}
+	log.Printf("%s triggered by %s; %s in %s", e.actionName(), ev.Source, e.actionName(), e.Delay)
+	e.arm(ctx, ev)
+	return nil
+}
+
+// Cancel cancels the pending action as if ev were a recovery, without
+// evaluating -recovered-expr. It fails if nothing is pending.
+func (e *Engine) Cancel(ctx context.Context, ev powerEvent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil {
+		return fmt.Errorf("no %s is pending", e.actionName())
+	}
+	log.Printf("pending %s cancelled by %s", e.actionName(), ev.Source)
+	p := *e.pending
+	e.disarm()
+	e.Action.Cancelled(ctx, p, ev)
+	return nil
+}
+
+// Alarm reports whether ev would arm an action were none pending. An
+// evaluation error counts, so the event reaches Handle, which reports it.
+func (e *Engine) Alarm(ev powerEvent) bool {
+	e.mu.Lock()
+	evaluator := e.Evaluator
+	e.mu.Unlock()
+	down, err := evaluator.Down(ev)
+	return down || err != nil
+}
+
+// SetEvaluator replaces the Evaluator for subsequent events.
+func (e *Engine) SetEvaluator(ev Evaluator) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Evaluator = ev
+}
+
+// Reconfigure replaces the Evaluator for subsequent events and sets Delay. A
+// pending action keeps its deadline; the new Delay applies from the next one.
+func (e *Engine) Reconfigure(ev Evaluator, delay time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Evaluator = ev
+	if e.pending == nil {
+		e.Delay = delay
+		return
+	}
+	e.nextDelay = &delay
+}
+
+func (e *Engine) journal(kind string, ev powerEvent, detail string) {
+	m := ev.Message
+	e.Journal.Record(journalEntry{At: e.Clock.Now(), Kind: kind, Source: ev.Source, Message: &m, Detail: detail})
+}
+
+// exprName names the rule's expression setting in errors.
+func (e *Engine) exprName(setting string) string {
+	if e.Rule == "" {
+		return "-" + setting
+	}
+	return fmt.Sprintf("%s of rule '%s'", setting, e.Rule)
+}
+
+func (e *Engine) actionName() string {
+	if e.ActionName == "" {
+		return "shutdown"
+	}
+	return e.ActionName
+}
+
+// schedule starts timers for the steps and the action that are still due,
+// given that e.elapsed of the countdown has already run. e.mu must be held.
+//
+// A timer that fires well past its wall-clock deadline means the host was
+// asleep (or the clock stepped) through the countdown; power may well have
+// been restored meanwhile, so instead of acting on the stale decision the
+// countdown is restarted, giving messages that arrive on reconnect a chance
+// to cancel it.
+func (e *Engine) schedule() {
+	gen := e.gen
+	p, pendingCtx := *e.pending, e.pendingCtx
+	start := e.resumedAt.Round(0)
+	for i, step := range e.Steps {
+		if e.stepRan[i] {
+			continue // before a hold or deadline change
+		}
+		// a step whose offset has passed because the deadline was moved up
+		// runs right away:
+		d := max(step.Offset-e.elapsed, 0)
+		due := start.Add(d)
+		e.timers = append(e.timers, e.Clock.AfterFunc(d, func() {
+			e.mu.Lock()
+			current := e.gen == gen
+			if current {
+				e.stepRan[i] = true
+			}
+			e.mu.Unlock()
+			if !current {
+				return
+			}
+			if late := e.Clock.Now().Round(0).Sub(due); late > staleTimerTolerance {
+				log.Printf("[WARN] skipping step '%s': it's %s late; was the host suspended?", step.Name, late.Round(time.Second))
+				return
+			}
+			step.Run(pendingCtx, p)
+		}))
+	}
+	due := start.Add(e.Delay - e.elapsed)
+	e.timers = append(e.timers, e.Clock.AfterFunc(e.Delay-e.elapsed, func() {
+		e.mu.Lock()
+		if e.gen != gen {
+			// cancelled or held after the timer fired but before we got the lock
+			e.mu.Unlock()
+			return
+		}
+		now := e.Clock.Now()
+		if late := now.Round(0).Sub(due); late > staleTimerTolerance {
+			log.Printf("[WARN] pending %s is %s late; was the host suspended? restarting the countdown: %s in %s", e.actionName(), late.Round(time.Second), e.actionName(), e.Delay)
+			e.stopTimers()
+			e.elapsed, e.resumedAt = 0, now
+			e.stepRan = make([]bool, len(e.Steps))
+			e.pending.ExecuteAt = now.Add(e.Delay)
+			e.Action.Armed(pendingCtx, *e.pending)
+			e.schedule()
+			e.mu.Unlock()
+			return
+		}
+		e.executing = true
+		p := *e.pending
+		e.mu.Unlock()
+		e.Action.Execute(pendingCtx, p)
+	}))
+}
+
+// stopTimers stops all of the pending shutdown's timers. e.mu must be held.
+func (e *Engine) stopTimers() {
+	for _, t := range e.timers {
+		t.Stop()
+	}
+	e.timers = nil
+	e.gen++
+}
+
+// disarm stops the pending shutdown's timers and cancels its context.
+// e.mu must be held.
+func (e *Engine) disarm() {
+	e.stopTimers()
+	e.cancel()
+	e.pending, e.pendingCtx, e.cancel, e.executing = nil, nil, nil, false
+	e.heldUntil = time.Time{}
+	if e.nextDelay != nil {
+		e.Delay, e.nextDelay = *e.nextDelay, nil
+	}
+}
+
+// Hold pauses the countdown of the pending shutdown for d, after which it
+// resumes where it left off. Holding an already held shutdown replaces the
+// hold. It fails if nothing is pending or the action is already executing.
+func (e *Engine) Hold(ctx context.Context, d time.Duration) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil {
+		return fmt.Errorf("no %s is pending", e.actionName())
+	}
+	if e.executing {
+		return fmt.Errorf("%s is already executing", e.actionName())
+	}
+	now := e.Clock.Now()
+	if e.heldUntil.IsZero() {
+		e.elapsed += now.Sub(e.resumedAt)
+	}
+	e.stopTimers()
+	e.heldUntil = now.Add(d)
+	gen := e.gen
+	e.timers = append(e.timers, e.Clock.AfterFunc(d, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.gen == gen {
+			e.resume(ctx)
+		}
+	}))
+	remaining := e.Delay - e.elapsed
+	log.Printf("pending %s held until %s; %s will remain when it resumes", e.actionName(), e.heldUntil.Format(time.RFC3339), remaining)
+	e.pending.ExecuteAt = e.heldUntil.Add(remaining)
+	e.Action.Held(ctx, *e.pending, e.heldUntil)
+	return nil
+}
+
+// Resume ends a hold early.
+func (e *Engine) Resume(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil || e.heldUntil.IsZero() {
+		return fmt.Errorf("no %s is held", e.actionName())
+	}
+	e.resume(ctx)
+	return nil
+}
+
+// resume restarts the countdown after a hold. e.mu must be held.
+func (e *Engine) resume(ctx context.Context) {
+	e.stopTimers()
+	now := e.Clock.Now()
+	e.heldUntil = time.Time{}
+	e.resumedAt = now
+	e.pending.ExecuteAt = now.Add(e.Delay - e.elapsed)
+	log.Printf("pending %s resumed; %s in %s", e.actionName(), e.actionName(), e.Delay-e.elapsed)
+	e.Action.Armed(ctx, *e.pending)
+	e.schedule()
+}
+
+// EngineStatus is a snapshot of the Engine's state.
+type EngineStatus struct {
+	Pending   *Pending
+	Executing bool
+	HeldUntil time.Time // zero unless held
+	// StepsRan records which Steps have run for the pending action.
+	StepsRan []bool
+}
+
+// Status returns a snapshot of the Engine's state.
+func (e *Engine) Status() EngineStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	st := EngineStatus{Executing: e.executing, HeldUntil: e.heldUntil}
+	if e.pending != nil {
+		p := *e.pending
+		st.Pending = &p
+		st.StepsRan = slices.Clone(e.stepRan)
+	}
+	return st
+}
+
+// Pending returns the currently armed shutdown, if any.
+func (e *Engine) Pending() *Pending {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil {
+		return nil
+	}
+	p := *e.pending
+	return &p
+}
+
+// Abandon stops a pending shutdown that has not started executing, e.g.
+// because the daemon is exiting, and returns it. It returns nil if no
+// shutdown is pending or one is already executing.
+func (e *Engine) Abandon() *Pending {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil || e.executing {
+		return nil
+	}
+	p := *e.pending
+	e.disarm()
+	return &p
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves when the test advances it.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c       *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.stopped = true
+	return true
+}
+
+// Advance moves the clock forward by d, firing the timers that come due in
+// order, each at its own time.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if !t.stopped && !t.at.After(target) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		if next.at.After(c.now) {
+			c.now = next.at
+		}
+		next.stopped = true
+		c.mu.Unlock()
+		next.f()
+	}
+}
+
+// Jump moves the clock forward by d without firing timers, as when the host
+// is suspended; the next Advance fires them late.
+func (c *fakeClock) Jump(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// onlineEvaluator arms on any message reporting power down and cancels on any
+// reporting it up.
+type onlineEvaluator struct{}
+
+func (onlineEvaluator) Down(ev powerEvent) (bool, error)      { return !ev.Message.Online, nil }
+func (onlineEvaluator) Recovered(ev powerEvent) (bool, error) { return ev.Message.Online, nil }
+
+// recordingAction records the Engine's calls to it.
+type recordingAction struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (a *recordingAction) record(call string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, call)
+}
+
+func (a *recordingAction) Calls() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.calls)
+}
+
+func (a *recordingAction) Armed(context.Context, Pending)                 { a.record("armed") }
+func (a *recordingAction) Held(context.Context, Pending, time.Time)       { a.record("held") }
+func (a *recordingAction) Cancelled(context.Context, Pending, powerEvent) { a.record("cancelled") }
+func (a *recordingAction) Execute(context.Context, Pending)               { a.record("executed") }
+
+func newTestEngine(delay time.Duration, steps ...Step) (*Engine, *fakeClock, *recordingAction) {
+	clock := newFakeClock()
+	action := &recordingAction{}
+	return &Engine{Clock: clock, Evaluator: onlineEvaluator{}, Action: action, Delay: delay, Steps: steps}, clock, action
+}
+
+func powerDown() powerEvent {
+	return powerEvent{Source: "test", Message: PowerAlarmMessage{Online: false, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}
+}
+
+func powerUp() powerEvent {
+	return powerEvent{Source: "test", Message: PowerAlarmMessage{Online: true, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}
+}
+
+func assertCalls(t *testing.T, a *recordingAction, want ...string) {
+	t.Helper()
+	if got := a.Calls(); !slices.Equal(got, want) {
+		t.Fatalf("action calls = %v, want %v", got, want)
+	}
+}
+
+func TestEngineExecutesAfterDelay(t *testing.T) {
+	ctx := context.Background()
+	e, clock, action := newTestEngine(time.Minute)
+
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, action, "armed")
+	if p := e.Pending(); p == nil || !p.ExecuteAt.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatalf("pending = %+v, want one executing in a minute", p)
+	}
+
+	clock.Advance(59 * time.Second)
+	assertCalls(t, action, "armed")
+	clock.Advance(time.Second)
+	assertCalls(t, action, "armed", "executed")
+}
+
+func TestEngineRecoveryCancels(t *testing.T) {
+	ctx := context.Background()
+	e, clock, action := newTestEngine(time.Minute)
+
+	if err := e.Handle(ctx, powerUp()); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, action)
+
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Handle(ctx, powerUp()); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, action, "armed", "cancelled")
+	if e.Pending() != nil {
+		t.Fatal("still pending after recovery")
+	}
+
+	clock.Advance(time.Hour)
+	assertCalls(t, action, "armed", "cancelled")
+}
+
+func TestEngineStepsAreCancelledWithTheAction(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	step := func(name string, offset time.Duration) Step {
+		return Step{Offset: offset, Name: name, Run: func(context.Context, Pending) {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, name)
+		}}
+	}
+	assertRan := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !slices.Equal(ran, want) {
+			t.Fatalf("steps ran = %v, want %v", ran, want)
+		}
+	}
+	e, clock, action := newTestEngine(time.Minute, step("early", 10*time.Second), step("late", 50*time.Second))
+
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+	assertRan("early")
+	if err := e.Handle(ctx, powerUp()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	assertRan("early")
+	assertCalls(t, action, "armed", "cancelled")
+}
+
+func TestEngineHoldPausesTheCountdown(t *testing.T) {
+	ctx := context.Background()
+	e, clock, action := newTestEngine(time.Minute)
+
+	if err := e.Hold(ctx, time.Minute); err == nil {
+		t.Fatal("Hold succeeded with nothing pending")
+	}
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(20 * time.Second)
+	if err := e.Hold(ctx, 5*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if want := clock.Now().Add(5*time.Minute + 40*time.Second); !e.Pending().ExecuteAt.Equal(want) {
+		t.Fatalf("executes at %s, want %s", e.Pending().ExecuteAt, want)
+	}
+
+	clock.Advance(5 * time.Minute)
+	assertCalls(t, action, "armed", "held", "armed")
+	clock.Advance(39 * time.Second)
+	assertCalls(t, action, "armed", "held", "armed")
+	clock.Advance(time.Second)
+	assertCalls(t, action, "armed", "held", "armed", "executed")
+}
+
+func TestEngineResumeEndsAHoldEarly(t *testing.T) {
+	ctx := context.Background()
+	e, clock, action := newTestEngine(time.Minute)
+
+	if err := e.Resume(ctx); err == nil {
+		t.Fatal("Resume succeeded with nothing held")
+	}
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(20 * time.Second)
+	if err := e.Hold(ctx, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10 * time.Minute)
+	if err := e.Resume(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := clock.Now().Add(40 * time.Second); !e.Pending().ExecuteAt.Equal(want) {
+		t.Fatalf("executes at %s after Resume, want %s", e.Pending().ExecuteAt, want)
+	}
+	if err := e.Resume(ctx); err == nil {
+		t.Fatal("Resume succeeded once no longer held")
+	}
+	clock.Advance(40 * time.Second)
+	assertCalls(t, action, "armed", "held", "armed", "executed")
+}
+
+func TestEngineRestartsAStaleCountdown(t *testing.T) {
+	ctx := context.Background()
+	e, clock, action := newTestEngine(time.Minute)
+
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	// the host sleeps through the countdown:
+	clock.Jump(time.Minute + 2*staleTimerTolerance)
+	clock.Advance(0)
+	assertCalls(t, action, "armed", "armed")
+	if p := e.Pending(); p == nil || !p.ExecuteAt.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatalf("pending = %+v, want one executing a minute after the resume", p)
+	}
+
+	// power came back while the host was asleep:
+	if err := e.Handle(ctx, powerUp()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	assertCalls(t, action, "armed", "armed", "cancelled")
+}
+
+func TestEngineTriggerAndCancel(t *testing.T) {
+	ctx := context.Background()
+	e, clock, action := newTestEngine(time.Minute)
+
+	if err := e.Cancel(ctx, powerUp()); err == nil {
+		t.Fatal("Cancel succeeded with nothing pending")
+	}
+	// Trigger arms without evaluating the event:
+	if err := e.Trigger(ctx, powerUp()); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Trigger(ctx, powerUp()); err == nil {
+		t.Fatal("Trigger succeeded with an action already pending")
+	}
+	if !e.Status().HeldUntil.IsZero() {
+		t.Fatal("triggered action is held")
+	}
+	if err := e.Cancel(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	assertCalls(t, action, "armed", "cancelled")
+}
+
+func TestEngineReconfigureAppliesToTheNextAction(t *testing.T) {
+	ctx := context.Background()
+	e, clock, action := newTestEngine(time.Minute)
+
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	e.Reconfigure(onlineEvaluator{}, 10*time.Minute)
+	if p := e.Pending(); !p.ExecuteAt.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatalf("pending executes at %s, want its original deadline", p.ExecuteAt)
+	}
+	if err := e.Handle(ctx, powerUp()); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Handle(ctx, powerDown()); err != nil {
+		t.Fatal(err)
+	}
+	if p := e.Pending(); !p.ExecuteAt.Equal(clock.Now().Add(10 * time.Minute)) {
+		t.Fatalf("next action executes at %s, want 10m from now", p.ExecuteAt)
+	}
+	clock.Advance(10 * time.Minute)
+	assertCalls(t, action, "armed", "cancelled", "armed", "executed")
+}
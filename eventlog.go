@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Windows Event Log event IDs. They're kept within 1-1000 so the source can
+// use EventCreate.exe's generic message file, which displays the event's
+// string as-is.
+const (
+	eventIDArmed     = 100
+	eventIDHeld      = 101
+	eventIDCancelled = 102
+	eventIDExecuting = 103
+	eventIDWarning   = 200
+	eventIDError     = 300
+)
+
+// Event levels, as understood by eventLog.Report.
+const (
+	eventLevelInfo = iota
+	eventLevelWarning
+	eventLevelError
+)
+
+// eventLog is a system event log, i.e. the Windows Event Log.
+type eventLog interface {
+	Report(id uint32, level int, msg string) error
+	Close() error
+}
+
+// eventLogWriter forwards [WARN] and [ERROR] entries from the standard
+// logger to an eventLog; it's meant to be combined with the console output
+// using io.MultiWriter.
+type eventLogWriter struct {
+	Log eventLog
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	level, msg := logLevel(stripLogPrefix(strings.TrimSuffix(string(p), "\n"), log.Flags()))
+	switch level {
+	case "WARN":
+		_ = w.Log.Report(eventIDWarning, eventLevelWarning, msg)
+	case "ERROR":
+		_ = w.Log.Report(eventIDError, eventLevelError, msg)
+	}
+	return len(p), nil
+}
+
+// stripLogPrefix removes the date and time the standard logger, configured
+// with flags, puts before each entry.
+func stripLogPrefix(entry string, flags int) string {
+	n := 0
+	if flags&log.Ldate != 0 {
+		n += len("2006/01/02 ")
+	}
+	if flags&(log.Ltime|log.Lmicroseconds) != 0 {
+		n += len("15:04:05 ")
+		if flags&log.Lmicroseconds != 0 {
+			n += len(".000000")
+		}
+	}
+	if n > len(entry) {
+		return entry
+	}
+	return entry[n:]
+}
+
+// eventLogAction reports the Action's state transitions to an eventLog, each
+// with its own event ID, before passing them on.
+type eventLogAction struct {
+	Action
+	Log eventLog
+}
+
+func (a eventLogAction) report(id uint32, level int, msg string) {
+	if err := a.Log.Report(id, level, msg); err != nil {
+		log.Printf("failed to write to the event log: %s", err)
+	}
+}
+
+func (a eventLogAction) Armed(ctx context.Context, p Pending) {
+	a.report(eventIDArmed, eventLevelWarning, fmt.Sprintf("%s: action armed by %s; executing at %s", p.Trigger.Message.String(), p.Trigger.Source, p.ExecuteAt.Format(time.RFC3339)))
+	a.Action.Armed(ctx, p)
+}
+
+func (a eventLogAction) Held(ctx context.Context, p Pending, until time.Time) {
+	a.report(eventIDHeld, eventLevelInfo, fmt.Sprintf("pending action held until %s", until.Format(time.RFC3339)))
+	a.Action.Held(ctx, p, until)
+}
+
+func (a eventLogAction) Cancelled(ctx context.Context, p Pending, ev powerEvent) {
+	a.report(eventIDCancelled, eventLevelInfo, fmt.Sprintf("%s: action cancelled by %s", ev.Message.String(), ev.Source))
+	a.Action.Cancelled(ctx, p, ev)
+}
+
+func (a eventLogAction) Execute(ctx context.Context, p Pending) {
+	a.report(eventIDExecuting, eventLevelWarning, fmt.Sprintf("%s: executing action armed at %s", p.Trigger.Message.String(), p.ArmedAt.Format(time.RFC3339)))
+	a.Action.Execute(ctx, p)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	eventlogErrorType       = 0x1
+	eventlogWarningType     = 0x2
+	eventlogInformationType = 0x4
+
+	eventLogRegistryKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+	eventMessageFile    = `%SystemRoot%\System32\EventCreate.exe`
+)
+
+var (
+	procRegisterEventSource   = modAdvapi32.NewProc("RegisterEventSourceW")
+	procDeregisterEventSource = modAdvapi32.NewProc("DeregisterEventSource")
+	procReportEvent           = modAdvapi32.NewProc("ReportEventW")
+	procRegCreateKeyEx        = modAdvapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueEx         = modAdvapi32.NewProc("RegSetValueExW")
+)
+
+// windowsEventLog writes to the Application log as the given source.
+type windowsEventLog struct {
+	h uintptr
+}
+
+// openEventLog opens the Application event log for source, first registering
+// the source so the Event Viewer can display its events. Registering needs
+// administrator rights; if it fails, events are still written, but the Event
+// Viewer prefixes them with a note that their description can't be found.
+func openEventLog(source string) (eventLog, error) {
+	if err := registerEventSource(source); err != nil {
+		log.Printf("[WARN] failed to register event log source '%s': %s", source, err)
+	}
+	name, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(name)))
+	if h == 0 {
+		return nil, fmt.Errorf("RegisterEventSourceW failed: %w", err)
+	}
+	return &windowsEventLog{h: h}, nil
+}
+
+func (l *windowsEventLog) Report(id uint32, level int, msg string) error {
+	etype := eventlogInformationType
+	switch level {
+	case eventLevelWarning:
+		etype = eventlogWarningType
+	case eventLevelError:
+		etype = eventlogErrorType
+	}
+	s, err := syscall.UTF16PtrFromString(msg)
+	if err != nil {
+		return err
+	}
+	strs := []*uint16{s}
+	r, _, err := procReportEvent.Call(l.h, uintptr(etype), 0, uintptr(id), 0, uintptr(len(strs)), 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+	if r == 0 {
+		return fmt.Errorf("ReportEventW failed: %w", err)
+	}
+	return nil
+}
+
+func (l *windowsEventLog) Close() error {
+	r, _, err := procDeregisterEventSource.Call(l.h)
+	if r == 0 {
+		return fmt.Errorf("DeregisterEventSource failed: %w", err)
+	}
+	return nil
+}
+
+// registerEventSource creates the registry key describing source, using
+// EventCreate.exe's message file.
+func registerEventSource(source string) error {
+	subKey, err := syscall.UTF16PtrFromString(eventLogRegistryKey + source)
+	if err != nil {
+		return err
+	}
+	var key syscall.Handle
+	if r, _, _ := procRegCreateKeyEx.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(subKey)), 0, 0, 0,
+		syscall.KEY_SET_VALUE, 0, uintptr(unsafe.Pointer(&key)), 0); r != 0 {
+		return fmt.Errorf("RegCreateKeyExW failed: %w", syscall.Errno(r))
+	}
+	defer syscall.RegCloseKey(key) //nolint:errcheck
+
+	msgFile, err := syscall.UTF16FromString(eventMessageFile)
+	if err != nil {
+		return err
+	}
+	if err := regSetValue(key, "EventMessageFile", syscall.REG_EXPAND_SZ, unsafe.Pointer(&msgFile[0]), uint32(len(msgFile)*2)); err != nil {
+		return err
+	}
+	types := uint32(eventlogErrorType | eventlogWarningType | eventlogInformationType)
+	return regSetValue(key, "TypesSupported", syscall.REG_DWORD, unsafe.Pointer(&types), 4)
+}
+
+func regSetValue(key syscall.Handle, name string, vtype uint32, data unsafe.Pointer, size uint32) error {
+	n, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if r, _, _ := procRegSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(n)), 0, uintptr(vtype), uintptr(data), uintptr(size)); r != 0 {
+		return fmt.Errorf("RegSetValueExW %s failed: %w", name, syscall.Errno(r))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"text/template"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// gracefulExitTimeout bounds how long the daemon spends shutting itself down
+// after SIGTERM/SIGINT.
+const gracefulExitTimeout = 10 * time.Second
+
+// gracefulExit tears the daemon down cleanly once it's been asked to exit.
+type gracefulExit struct {
+	Conn      *autopaho.ConnectionManager
+	Bridge    *autopaho.ConnectionManager // may be nil
+	Redundant []*autopaho.ConnectionManager
+	Topics    []string
+	Publisher *publisher
+	Engine    *Engine
+	// Rules are the named rules, whose pending actions are abandoned too.
+	Rules             []namedRule
+	CoordinationTopic string
+	// CoordinationTemplate, if set, renders intent messages instead of JSON.
+	CoordinationTemplate *template.Template
+	// StatusTopic, if set, is where the daemon announces it's going offline.
+	StatusTopic string
+	Rule        string
+	Hostname    string
+	Store       stateStore
+}
+
+// Run unsubscribes, abandons any pending (not yet executing) shutdown and
+// announces that, announces the daemon is offline, waits for in-flight
+// publishes, persists state, and finally
+// disconnects with a DISCONNECT packet.
+func (g gracefulExit) Run() {
+	ctx, cancel := context.WithTimeout(context.Background(), gracefulExitTimeout)
+	defer cancel()
+
+	if len(g.Topics) > 0 {
+		_, err := g.Conn.Unsubscribe(ctx, &paho.Unsubscribe{Topics: g.Topics})
+		if err != nil && !errors.Is(err, autopaho.ConnectionDownError) {
+			log.Printf("failed to unsubscribe: %s", err)
+		}
+	}
+	g.abandon(ctx, g.Engine, g.Rule)
+	for _, r := range g.Rules {
+		g.abandon(ctx, r.Engine, r.DownExpr)
+	}
+	publishStatus(ctx, g.Publisher, g.StatusTopic, StatusMessage{Status: StatusOffline, Host: g.Hostname})
+	if err := g.Publisher.Drain(ctx); err != nil {
+		log.Printf("gave up waiting for in-flight publishes: %s", err)
+	}
+	if g.Store.Enabled() {
+		writeHeartbeat(g.Store)
+	}
+	if g.Bridge != nil {
+		if err := g.Bridge.Disconnect(ctx); err != nil {
+			log.Printf("failed to disconnect bridge: %s", err)
+		}
+	}
+	for _, r := range g.Redundant {
+		if err := r.Disconnect(ctx); err != nil {
+			log.Printf("failed to disconnect from redundant server: %s", err)
+		}
+	}
+	if err := g.Conn.Disconnect(ctx); err != nil {
+		log.Printf("failed to disconnect: %s", err)
+	}
+}
+
+// abandon abandons e's pending action, if any, and announces that.
+func (g gracefulExit) abandon(ctx context.Context, e *Engine, rule string) {
+	p := e.Abandon()
+	if p == nil {
+		return
+	}
+	log.Printf("abandoning pending %s because mqttshutdownd is exiting", e.actionName())
+	publishIntent(ctx, g.Publisher, g.CoordinationTopic, g.CoordinationTemplate, ShutdownIntentMessage{
+		Host:    g.Hostname,
+		State:   IntentStateCancelled,
+		At:      time.Now(),
+		Reason:  "mqttshutdownd exiting",
+		Trigger: &p.Trigger.Message,
+		Rule:    rule,
+		Source:  p.Trigger.Source,
+	})
+}
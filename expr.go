@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Variables available to -down-expr and -recovered-expr.
+const (
+	exprVarPowerType = "powerType"
+	exprVarOnline    = "online"
+	exprVarScope     = "scope"
+	exprVarBattery   = "battery"
+	exprVarLoad      = "load"
+	exprVarSource    = "source"
+	exprVarRuntime   = "runtime"
+	exprVarProps     = "props"
+	exprVarExpiry    = "expiry"
+	exprVarMsg       = "msg"
+)
+
+// exprProgram is a compiled -down-expr or -recovered-expr. Full builds
+// compile CEL expressions (cel.go); minimal builds compile the much simpler
+// matcher expressions (matcher.go).
+type exprProgram interface {
+	Eval(ev powerEvent) (bool, error)
+}
+
+// exprCache compiles boolean expressions and caches the resulting programs by
+// expression text, so rules sharing an expression share a program, and a
+// reload only compiles expressions that changed.
+type exprCache struct {
+	compile func(expr string) (exprProgram, error)
+
+	mu    sync.Mutex
+	progs map[string]exprProgram
+}
+
+func newExprCache(proto *protoDescriptor) (*exprCache, error) {
+	compile, err := newExprCompiler(proto)
+	if err != nil {
+		return nil, err
+	}
+	return &exprCache{compile: compile, progs: make(map[string]exprProgram)}, nil
+}
+
+// Compile returns the program for expr, compiling it on first use.
+func (c *exprCache) Compile(expr string) (exprProgram, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prg, ok := c.progs[expr]; ok {
+		return prg, nil
+	}
+	prg, err := c.compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	c.progs[expr] = prg
+	return prg, nil
+}
+
+// Retain evicts every cached program whose expression is not in exprs; call
+// it after a reload with the expressions still in use.
+func (c *exprCache) Retain(exprs ...string) {
+	keep := make(map[string]bool, len(exprs))
+	for _, e := range exprs {
+		keep[e] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := range c.progs {
+		if !keep[e] {
+			delete(c.progs, e)
+		}
+	}
+}
+
+// exprVars returns the expression variables for an event.
+func exprVars(ev powerEvent) map[string]any {
+	m := ev.Message
+	runtime := -1.0
+	if ev.Runtime > 0 {
+		runtime = ev.Runtime.Seconds()
+	}
+	expiry := -1.0
+	if !ev.Expires.IsZero() {
+		expiry = max(time.Until(ev.Expires).Seconds(), 0)
+	}
+	props := ev.Props
+	if props == nil {
+		props = map[string]string{}
+	}
+	return map[string]any{
+		exprVarScope:     m.Scope,
+		exprVarPowerType: m.PowerType,
+		exprVarOnline:    m.Online,
+		exprVarBattery:   m.BatteryPercent(),
+		exprVarLoad:      m.LoadPercent(),
+		exprVarSource:    ev.Source,
+		exprVarRuntime:   runtime,
+		exprVarProps:     props,
+		exprVarExpiry:    expiry,
+	}
+}
+
+// checkEvaluates evaluates prg against a representative set of messages, as
+// produced by every supported format and source, so an expression that
+// type-checks but fails at runtime (e.g. a division by zero when the battery
+// is unknown) is rejected at startup rather than during an outage.
+func checkEvaluates(prg exprProgram) error {
+	for _, m := range exprSampleMessages() {
+		var runtime time.Duration
+		if m.Battery != nil {
+			runtime = time.Duration(*m.Battery) * time.Minute
+		}
+		if _, err := prg.Eval(powerEvent{Source: "mqtt:power/alarms", Message: m, Runtime: runtime}); err != nil {
+			return fmt.Errorf("fails for %s: %w", m.String(), err)
+		}
+	}
+	return nil
+}
+
+// exprSampleMessages returns messages covering every power type, both states,
+// every scope, and known and unknown battery and load.
+func exprSampleMessages() []PowerAlarmMessage {
+	zero, half, full := 0.0, 50.0, 100.0
+	var ms []PowerAlarmMessage
+	for t := PowerTypeUtility; t <= PowerTypeOther; t++ {
+		for _, online := range []bool{true, false} {
+			for _, scope := range []string{ScopeGlobal, ScopeLocal, ScopeSinglePhase, ScopeOneCircuit} {
+				for _, pct := range []*float64{nil, &zero, &half, &full} {
+					ms = append(ms, PowerAlarmMessage{Online: online, PowerType: t, Scope: scope, Battery: pct, Load: pct})
+				}
+			}
+		}
+	}
+	return ms
+}
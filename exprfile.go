@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exprFileWatchInterval is how often -down-expr-file and -recovered-expr-file
+// are checked for changes.
+const exprFileWatchInterval = 5 * time.Second
+
+// exprFileWatcher watches -down-expr-file and -recovered-expr-file and, when
+// either changes, recompiles both expressions and swaps them in for
+// subsequent events. An expression that fails to compile is logged and the
+// running rules are kept.
+type exprFileWatcher struct {
+	// DownPath and RecoveredPath are the files; either may be empty.
+	DownPath      string
+	RecoveredPath string
+	// Flags holds the current -down-expr and -recovered-expr, which are
+	// updated along with the Engine.
+	Flags        *flag.FlagSet
+	Rules        *exprCache
+	NewEvaluator func(down, recovered exprProgram) Evaluator
+	Engine       *Engine
+	Snapshots    *snapshotter
+	// Mu serializes changes to the rules with reloads of -config.
+	Mu *sync.Mutex
+}
+
+// Run watches the files until ctx is done.
+func (w *exprFileWatcher) Run(ctx context.Context) {
+	var paths []string
+	for _, p := range []string{w.DownPath, w.RecoveredPath} {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	watchFiles(ctx, exprFileWatchInterval, func() {
+		if err := w.Reload(); err != nil {
+			log.Printf("[ERROR] %s; keeping the current rules", err)
+		}
+	}, paths...)
+}
+
+// Reload re-reads the files and applies them if both expressions compile.
+func (w *exprFileWatcher) Reload() error {
+	w.Mu.Lock()
+	defer w.Mu.Unlock()
+	exprs := map[string]string{
+		"down-expr":      w.Flags.Lookup("down-expr").Value.String(),
+		"recovered-expr": w.Flags.Lookup("recovered-expr").Value.String(),
+	}
+	for setting, path := range map[string]string{"down-expr": w.DownPath, "recovered-expr": w.RecoveredPath} {
+		if path == "" {
+			continue
+		}
+		expr, err := readExprFile(path)
+		if err != nil {
+			return fmt.Errorf("invalid -%s-file: %w", setting, err)
+		}
+		exprs[setting] = expr
+	}
+	if exprs["down-expr"] == w.Flags.Lookup("down-expr").Value.String() &&
+		exprs["recovered-expr"] == w.Flags.Lookup("recovered-expr").Value.String() {
+		return nil
+	}
+
+	prgs := make(map[string]exprProgram, len(exprs))
+	for setting, expr := range exprs {
+		prg, err := w.Rules.Compile(expr)
+		if err == nil {
+			err = checkEvaluates(prg)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid -%s-file: %w", setting, err)
+		}
+		prgs[setting] = prg
+	}
+	w.Engine.SetEvaluator(w.NewEvaluator(prgs["down-expr"], prgs["recovered-expr"]))
+	w.Rules.Retain(exprs["down-expr"], exprs["recovered-expr"])
+	for setting, expr := range exprs {
+		if err := w.Flags.Set(setting, expr); err != nil {
+			return err // can't happen; -down-expr and -recovered-expr are strings
+		}
+	}
+	delay, _ := time.ParseDuration(w.Flags.Lookup("recovery-period").Value.String())
+	w.Snapshots.Reconfigured(nil, nil, configHash(w.Flags), exprs["down-expr"], exprs["recovered-expr"], delay)
+	log.Printf("reloaded rules: -down-expr '%s', -recovered-expr '%s'", exprs["down-expr"], exprs["recovered-expr"])
+	return nil
+}
+
+// readExprFile reads an expression from path, trimming surrounding
+// whitespace such as a trailing newline.
+func readExprFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	expr := strings.TrimSpace(string(b))
+	if expr == "" {
+		return "", fmt.Errorf("'%s' is empty", path)
+	}
+	return expr, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// fakeBroker is a minimal MQTT v5 broker for tests: it acknowledges CONNECT,
+// SUBSCRIBE and QoS 1 PUBLISH packets, and hands what is published to it to
+// Published.
+type fakeBroker struct {
+	ln        net.Listener
+	Published chan *packets.Publish
+
+	mu     sync.Mutex
+	conn   net.Conn
+	refuse bool
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, Published: make(chan *packets.Publish, 16)}
+	t.Cleanup(func() {
+		_ = ln.Close()
+		b.Drop()
+	})
+	go b.accept()
+	return b
+}
+
+func (b *fakeBroker) URL() *url.URL {
+	return &url.URL{Scheme: "mqtt", Host: b.ln.Addr().String()}
+}
+
+// Drop closes the client's connection, as a broker going away would, and
+// refuses new ones until Restore.
+func (b *fakeBroker) Drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refuse = true
+	if b.conn != nil {
+		_ = b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// Restore accepts connections again after Drop.
+func (b *fakeBroker) Restore() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refuse = false
+}
+
+func (b *fakeBroker) accept() {
+	for {
+		c, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		if b.refuse {
+			b.mu.Unlock()
+			_ = c.Close()
+			continue
+		}
+		b.conn = c
+		b.mu.Unlock()
+		go b.serve(c)
+	}
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		cp, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		var resp *packets.ControlPacket
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			resp = packets.NewControlPacket(packets.CONNACK)
+		case *packets.Subscribe:
+			resp = packets.NewControlPacket(packets.SUBACK)
+			sa := resp.Content.(*packets.Suback)
+			sa.PacketID = p.PacketID
+			for _, s := range p.Subscriptions {
+				sa.Reasons = append(sa.Reasons, s.QoS)
+			}
+		case *packets.Publish:
+			b.Published <- p
+			if p.QoS == 1 {
+				resp = packets.NewControlPacket(packets.PUBACK)
+				resp.Content.(*packets.Puback).PacketID = p.PacketID
+			}
+		case *packets.Pingreq:
+			resp = packets.NewControlPacket(packets.PINGRESP)
+		case *packets.Disconnect:
+			return
+		}
+		if resp != nil {
+			if _, err := resp.WriteTo(c); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// connectPrimary connects to b the way the daemon connects to -server,
+// recording the connection in conn and handing the connection manager to
+// pub, if set, on each connection.
+func connectPrimary(t *testing.T, b *fakeBroker, conn *connectionState, pub *publisher) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	loss := connectionLoss{Conn: conn, ClientID: "test"}
+	_, err := autopaho.NewConnection(ctx, autopaho.ClientConfig{
+		ServerUrls:        []*url.URL{b.URL()},
+		KeepAlive:         30,
+		ConnectRetryDelay: 20 * time.Millisecond,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			conn.Up(time.Now())
+			if pub != nil {
+				pub.SetConnectionManager(cm)
+				go pub.Flush(ctx)
+			}
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID:           "test",
+			OnClientError:      loss.ClientError,
+			OnServerDisconnect: loss.ServerDisconnect,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
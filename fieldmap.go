@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mappedFormat is the format of JSON payloads with their own schema, whose
+// fields are mapped to PowerAlarmMessage fields by -field-map.
+const mappedFormat = "mapped"
+
+// fieldMapping maps the value at a path in a JSON payload to a
+// PowerAlarmMessage field, given by its JSON name.
+type fieldMapping struct {
+	Field string
+	Path  []string
+}
+
+// mappableFields are the PowerAlarmMessage fields -field-map may set. "online"
+// is accepted as a synonym for "up".
+var mappableFields = []string{"up", "type", "scope", "battery", "load", "host", "target", "targets", "phase", "circuit", "at"}
+
+// parseFieldMappings parses the -field-map values, each given as FIELD=PATH, e.g. 'up=$.state.power_ok'. A PATH is a JSONPath-style list
+// of object keys and array indexes: '$.a.b', 'a.b', '$.a[0].b' and 'a.0.b'
+// are all accepted.
+func parseFieldMappings(specs []string) ([]fieldMapping, error) {
+	var mappings []fieldMapping
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		field, p, ok := strings.Cut(spec, "=")
+		field = strings.TrimSpace(field)
+		if field == "online" {
+			field = "up"
+		}
+		if !ok || !slices.Contains(mappableFields, field) {
+			return nil, fmt.Errorf("invalid -field-map '%s': must be given as FIELD=PATH, where FIELD is one of %s", spec, strings.Join(mappableFields, ", "))
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("invalid -field-map '%s': %s is already mapped", spec, field)
+		}
+		seen[field] = true
+		path, err := parseJSONPath(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -field-map '%s': %w", spec, err)
+		}
+		mappings = append(mappings, fieldMapping{Field: field, Path: path})
+	}
+	if len(specs) > 0 && !seen["up"] {
+		return nil, errors.New("-field-map must map up")
+	}
+	return mappings, nil
+}
+
+// parseJSONPath splits a -field-map PATH into keys and indexes.
+func parseJSONPath(p string) ([]string, error) {
+	p = strings.TrimSpace(p)
+	p = strings.TrimPrefix(p, "$")
+	p = strings.TrimPrefix(p, ".")
+	p = strings.ReplaceAll(strings.ReplaceAll(p, "[", "."), "]", "")
+	if p == "" {
+		return nil, errors.New("PATH is empty")
+	}
+	path := strings.Split(p, ".")
+	for _, k := range path {
+		if k == "" {
+			return nil, fmt.Errorf("PATH '%s' has an empty key", p)
+		}
+	}
+	return path, nil
+}
+
+// lookupJSONPath returns the value at path in v, decoded by encoding/json.
+func lookupJSONPath(v any, path []string) (any, bool) {
+	for _, k := range path {
+		switch c := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = c[k]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			v = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, v != nil
+}
+
+// newMappedNormalizer returns a normalizer for the mapped format: each
+// field mapped by -field-map is read from the payload, converting its value
+// where the meaning is clear (e.g. "on" or 1 for up, "generator" for type, a
+// numeric string for battery, or Unix seconds for at). Up must be present;
+// type defaults to utility, and scope to global.
+func newMappedNormalizer(opts formatOptions) normalizer {
+	return mappedNormalizer(opts.FieldMappings, false)
+}
+
+// mappedNormalizer returns a normalizer for the mapped format. If absentUp
+// is set, a payload with no value mapped to up reports power down instead of
+// being rejected, for payloads that leave out false values.
+func mappedNormalizer(mappings []fieldMapping, absentUp bool) normalizer {
+	return func(_ string, payload []byte) ([]PowerAlarmMessage, error) {
+		var doc any
+		if err := json.Unmarshal(payload, &doc); err != nil {
+			return nil, err
+		}
+		m := PowerAlarmMessage{PowerType: PowerTypeUtility, Scope: ScopeGlobal}
+		for _, fm := range mappings {
+			v, ok := lookupJSONPath(doc, fm.Path)
+			if !ok {
+				if fm.Field == "up" && !absentUp {
+					return nil, fmt.Errorf("no value at '%s', mapped to up", strings.Join(fm.Path, "."))
+				}
+				continue
+			}
+			if err := setMappedField(&m, fm.Field, v); err != nil {
+				return nil, fmt.Errorf("value at '%s', mapped to %s: %w", strings.Join(fm.Path, "."), fm.Field, err)
+			}
+		}
+		if !m.Valid() {
+			return nil, fmt.Errorf("invalid power type %d", m.PowerType)
+		}
+		return []PowerAlarmMessage{m}, nil
+	}
+}
+
+func setMappedField(m *PowerAlarmMessage, field string, v any) error {
+	switch field {
+	case "up":
+		up, err := mappedBool(v)
+		if err != nil {
+			return err
+		}
+		m.Online = up
+	case "type":
+		t, err := mappedPowerType(v)
+		if err != nil {
+			return err
+		}
+		m.PowerType = t
+	case "battery", "load":
+		f, err := mappedNumber(v)
+		if err != nil {
+			return err
+		}
+		if field == "battery" {
+			m.Battery = &f
+		} else {
+			m.Load = &f
+		}
+	case "at":
+		at, err := mappedTime(v)
+		if err != nil {
+			return err
+		}
+		m.At = &at
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %v", v)
+		}
+		switch field {
+		case "scope":
+			m.Scope = s
+		case "host":
+			m.Host = s
+		case "target":
+			m.Target = s
+		case "targets":
+			m.Targets = s
+		case "phase":
+			m.Phase = s
+		case "circuit":
+			m.Circuit = s
+		}
+	}
+	return nil
+}
+
+func mappedBool(v any) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case float64:
+		return v != 0, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "1", "on", "up", "online", "ok", "yes":
+			return true, nil
+		case "false", "0", "off", "down", "offline", "fail", "no":
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("expected a boolean, got %v", v)
+}
+
+func mappedPowerType(v any) (int, error) {
+	if s, ok := v.(string); ok {
+		for t := PowerTypeUtility; t <= PowerTypeOther; t++ {
+			if strings.EqualFold(strings.TrimSpace(s), powerTypeName(t)) {
+				return t, nil
+			}
+		}
+	}
+	f, err := mappedNumber(v)
+	if err != nil || f != float64(int(f)) {
+		return 0, fmt.Errorf("expected a power type number or name, got %v", v)
+	}
+	return int(f), nil
+}
+
+func mappedNumber(v any) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("expected a number, got %v", v)
+}
+
+func mappedTime(v any) (time.Time, error) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(0, int64(v*float64(time.Second))), nil
+	case string:
+		if t, err := time.Parse(time.RFC3339, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("expected an RFC 3339 time or Unix seconds, got %v", v)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseFieldMappings(t *testing.T) {
+	got, err := parseFieldMappings([]string{"online=$.state.power_ok", "battery=$.batteries[0].soc", "load=ups.load"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fieldMapping{
+		{Field: "up", Path: []string{"state", "power_ok"}},
+		{Field: "battery", Path: []string{"batteries", "0", "soc"}},
+		{Field: "load", Path: []string{"ups", "load"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseFieldMappings = %+v, want %+v", got, want)
+	}
+
+	if got, err := parseFieldMappings(nil); err != nil || got != nil {
+		t.Fatalf("parseFieldMappings(nil) = %+v, %v; want nothing", got, err)
+	}
+
+	for _, specs := range [][]string{
+		{"battery=$.soc"},         // no up
+		{"up=$.a", "up=$.b"},      // mapped twice
+		{"up=$.a", "online=$.b"},  // synonym mapped twice
+		{"voltage=$.v", "up=$.a"}, // not mappable
+		{"up"},                    // no PATH
+		{"up=$"},                  // empty PATH
+		{"up=$.a..b"},             // empty key
+	} {
+		if _, err := parseFieldMappings(specs); err == nil {
+			t.Errorf("parseFieldMappings(%q) succeeded", specs)
+		}
+	}
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	var v any
+	if err := json.Unmarshal([]byte(`{"a": {"b": [10, {"c": "x"}], "n": null}}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path []string
+		want any
+		ok   bool
+	}{
+		{path: []string{"a", "b", "0"}, want: 10.0, ok: true},
+		{path: []string{"a", "b", "1", "c"}, want: "x", ok: true},
+		{path: []string{"a", "b", "2"}},
+		{path: []string{"a", "b", "-1"}},
+		{path: []string{"a", "b", "c"}},
+		{path: []string{"a", "missing"}},
+		{path: []string{"a", "n"}},
+		{path: []string{"a", "b", "1", "c", "d"}},
+	} {
+		got, ok := lookupJSONPath(v, tt.path)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("lookupJSONPath(%q) = %v, %t; want %v, %t", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stringsFlag is a flag.Value collecting the values of a flag that may be
+// given multiple times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// secondsDurationFlag is a flag.Value holding a time.Duration. For backward
+// compatibility with flags that used to take integer seconds, a bare integer
+// is accepted as a number of seconds.
+type secondsDurationFlag time.Duration
+
+func (d *secondsDurationFlag) String() string {
+	if d == nil {
+		return "0s"
+	}
+	return time.Duration(*d).String()
+}
+
+func (d *secondsDurationFlag) Set(v string) error {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		*d = secondsDurationFlag(time.Duration(secs) * time.Second)
+		return nil
+	}
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return errors.New("must be a duration (e.g. '90s', '5m') or an integer number of seconds")
+	}
+	*d = secondsDurationFlag(parsed)
+	return nil
+}
+
+// Seconds returns d in whole seconds.
+func (d secondsDurationFlag) Seconds() int64 {
+	return int64(time.Duration(d) / time.Second)
+}
+
+// flagAliases maps short aliases to the long flag they stand for. Go's flag
+// package already accepts both -name and --name, so aliases and long options
+// work in either style. -password has none, so as not to make it any easier
+// to pass on the command line, where other users can read it.
+var flagAliases = map[string]string{
+	"s": "server",
+	"t": "topic",
+	"u": "user",
+	"d": "debug",
+	"v": "version",
+}
+
+// registerFlagAliases defines each alias in flagAliases on fs, sharing the
+// long flag's value.
+func registerFlagAliases(fs *flag.FlagSet) {
+	for short, long := range flagAliases {
+		f := fs.Lookup(long)
+		if f == nil {
+			panic(fmt.Sprintf("alias -%s refers to undefined flag -%s", short, long))
+		}
+		fs.Var(f.Value, short, fmt.Sprintf("Alias for -%s.", long))
+	}
+}
+
+// hiddenFlags are left out of the help text and shell completions.
+var hiddenFlags = map[string]bool{
+	"chaos": true,
+}
+
+// flagGroup is a help section, listing the flags whose names have any of the
+// given prefixes (or are exactly equal to one of them).
+type flagGroup struct {
+	Title    string
+	Prefixes []string
+}
+
+var flagGroups = []flagGroup{
+	{"MQTT connection", []string{"server", "redundant-server", "topic", "format", "down-match", "recovered-match", "field-map", "proto-", "ha-", "user", "password", "credentials-cmd", "tls-", "subscribe-", "retained", "share-group", "client-id", "session-expiry", "clean-start", "resume-session", "keepalive", "reconnect-", "mqtt-version", "unreachable-"}},
+	{"Vault", []string{"vault-"}},
+	{"Shutdown", []string{"recovery-period", "command", "cancel-command", "systemd-", "step", "down-expr", "recovered-expr", "battery-", "runtime-", "observe", "poweroff-fallback", "wake-after", "rtc-device"}},
+	{"Coordination", []string{"coordination-", "status-topic", "tags", "phase", "circuit", "control-", "api-", "dependent-", "dependents-"}},
+	{"Messages", []string{"wall", "notify-"}},
+	{"Relay & bridge", []string{"relay", "bridge-", "source-relay-", "producer"}},
+	{"Event sources", []string{"nut-", "apcupsd-", "cyberpower", "modbus-", "gpio-", "serial-", "webhook-", "udp-", "trigger-"}},
+	{"State", []string{"state-dir", "journal", "eventlog", "snapshot-file", "boot-topic"}},
+}
+
+func (g flagGroup) contains(name string) bool {
+	for _, p := range g.Prefixes {
+		if name == p || (strings.HasSuffix(p, "-") && strings.HasPrefix(name, p)) || strings.HasPrefix(name, p+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// printFlagGroups prints the flags defined on fs in the format of
+// flag.PrintDefaults, grouped into flagGroups sections. Flags not in any
+// group are listed last under "Other".
+func printFlagGroups(w io.Writer, fs *flag.FlagSet) {
+	aliasesOf := make(map[string][]string)
+	for short, long := range flagAliases {
+		aliasesOf[long] = append(aliasesOf[long], short)
+	}
+	grouped := make([][]*flag.Flag, len(flagGroups)+1)
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, isAlias := flagAliases[f.Name]; isAlias || hiddenFlags[f.Name] {
+			return
+		}
+		i := len(flagGroups)
+		for gi, g := range flagGroups {
+			if g.contains(f.Name) {
+				i = gi
+				break
+			}
+		}
+		grouped[i] = append(grouped[i], f)
+	})
+	for i, flags := range grouped {
+		if len(flags) == 0 {
+			continue
+		}
+		title := "Other"
+		if i < len(flagGroups) {
+			title = flagGroups[i].Title
+		}
+		fmt.Fprintf(w, "%s:\n", title)
+		for _, f := range flags {
+			printFlag(w, f, aliasesOf[f.Name])
+		}
+		fmt.Fprintln(w, "")
+	}
+}
+
+func printFlag(w io.Writer, f *flag.Flag, aliases []string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "  -%s", f.Name)
+	sort.Strings(aliases)
+	for _, a := range aliases {
+		fmt.Fprintf(&b, ", -%s", a)
+	}
+	typeName, usage := flag.UnquoteUsage(f)
+	if typeName != "" {
+		fmt.Fprintf(&b, " %s", typeName)
+	}
+	b.WriteString("\n    \t")
+	b.WriteString(strings.ReplaceAll(usage, "\n", "\n    \t"))
+	switch f.DefValue {
+	case "", "0", "0s", "false":
+	default:
+		if typeName == "string" {
+			fmt.Fprintf(&b, " (default %q)", f.DefValue)
+		} else {
+			fmt.Fprintf(&b, " (default %v)", f.DefValue)
+		}
+	}
+	fmt.Fprintln(w, b.String())
+}
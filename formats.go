@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// normalizer converts a payload received on topic into canonical
+// PowerAlarmMessages. It may return no messages (and no error) when the payload
+// doesn't carry a complete power state on its own, e.g. a single telemetry
+// field that a stateful normalizer combines with others.
+type normalizer func(topic string, payload []byte) ([]PowerAlarmMessage, error)
+
+// formatOptions configures the formats that need more than the payload,
+// from their flags.
+type formatOptions struct {
+	// DownMatch and RecoveredMatch are -down-match and -recovered-match, for
+	// the raw format.
+	DownMatch, RecoveredMatch *regexp.Regexp
+	// FieldMappings are the -field-map values, for the mapped and protobuf
+	// formats.
+	FieldMappings []fieldMapping
+	// Proto is the -proto-message type, for the protobuf format.
+	Proto *protoDescriptor
+	// HomeAssistantOnIsDown is -ha-on-is-down, for the homeassistant format.
+	HomeAssistantOnIsDown bool
+}
+
+// formats maps payload format names to constructors for their normalizers.
+// Each subscription gets its own normalizer since some formats are stateful.
+var formats = map[string]func(formatOptions) normalizer{
+	"json":              func(formatOptions) normalizer { return normalizeJSON },
+	"nut-status":        func(formatOptions) normalizer { return normalizeNUTStatus },
+	"apcupsd-status":    func(formatOptions) normalizer { return normalizeApcupsdStatus },
+	"ecoflow":           func(formatOptions) normalizer { return normalizeEcoFlow },
+	"bluetti":           func(formatOptions) normalizer { return newBluettiNormalizer() },
+	rawFormat:           newRawNormalizer,
+	mappedFormat:        newMappedNormalizer,
+	homeAssistantFormat: newHomeAssistantNormalizer,
+	"tasmota":           func(formatOptions) normalizer { return normalizeTasmota },
+	"shelly":            func(formatOptions) normalizer { return normalizeShelly },
+}
+
+// formatRequirements checks, for formats configured by other flags, that
+// those flags were given.
+var formatRequirements = map[string]func(formatOptions) error{
+	rawFormat: func(o formatOptions) error {
+		if o.DownMatch == nil || o.RecoveredMatch == nil {
+			return fmt.Errorf("the %s format requires -down-match and -recovered-match", rawFormat)
+		}
+		return nil
+	},
+	mappedFormat: func(o formatOptions) error {
+		if len(o.FieldMappings) == 0 {
+			return fmt.Errorf("the %s format requires -field-map", mappedFormat)
+		}
+		return nil
+	},
+}
+
+func formatNames() []string {
+	names := make([]string, 0, len(formats))
+	for n := range formats {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newNormalizer returns a normalizer for the named format, configured by opts.
+func newNormalizer(format string, opts formatOptions) (normalizer, error) {
+	f, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format '%s' (supported: %s)", format, strings.Join(formatNames(), ", "))
+	}
+	if check, ok := formatRequirements[format]; ok {
+		if err := check(opts); err != nil {
+			return nil, err
+		}
+	}
+	return f(opts), nil
+}
+
+// newStrictNormalizer is newNormalizer for -strict mode, in which the json
+// format is decoded with normalizeStrictJSON.
+func newStrictNormalizer(format string, strict bool, opts formatOptions) (normalizer, error) {
+	if strict && format == "json" {
+		return normalizeStrictJSON, nil
+	}
+	return newNormalizer(format, opts)
+}
+
+// normalizeJSON accepts the canonical PowerAlarmMessage JSON schema, or an
+// array of such messages (as sent by gateways that batch events), which are
+// returned in order.
+func normalizeJSON(_ string, payload []byte) ([]PowerAlarmMessage, error) {
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '[' {
+		var ms []PowerAlarmMessage
+		if err := json.Unmarshal(trimmed, &ms); err != nil {
+			return nil, err
+		}
+		for i := range ms {
+			if !ms[i].Valid() {
+				return nil, fmt.Errorf("invalid message schema at index %d: '%s'", i, payload)
+			}
+		}
+		return ms, nil
+	}
+	var m PowerAlarmMessage
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, err
+	}
+	if !m.Valid() {
+		return nil, fmt.Errorf("invalid message schema: '%s'", payload)
+	}
+	return []PowerAlarmMessage{m}, nil
+}
+
+// normalizeNUTStatus accepts a NUT ups.status value, e.g. "OL", "OB DISCHRG", or "OL CHRG LB".
+func normalizeNUTStatus(_ string, payload []byte) ([]PowerAlarmMessage, error) {
+	flags := strings.Fields(strings.ToUpper(string(payload)))
+	for _, f := range flags {
+		switch f {
+		case "OL":
+			return []PowerAlarmMessage{{Online: true, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+		case "OB":
+			return []PowerAlarmMessage{{Online: false, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+		}
+	}
+	return nil, fmt.Errorf("NUT status '%s' has neither OL nor OB flag", payload)
+}
+
+// normalizeApcupsdStatus accepts an apcupsd STATUS value, e.g. "ONLINE" or "ONBATT".
+func normalizeApcupsdStatus(_ string, payload []byte) ([]PowerAlarmMessage, error) {
+	s := strings.ToUpper(strings.TrimSpace(string(payload)))
+	switch {
+	case strings.HasPrefix(s, "ONLINE"):
+		return []PowerAlarmMessage{{Online: true, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+	case strings.HasPrefix(s, "ONBATT"):
+		return []PowerAlarmMessage{{Online: false, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+	}
+	return nil, fmt.Errorf("unrecognized apcupsd status '%s'", payload)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// genconfigSkipFlags are left out of generated config files: they select what
+// the daemon does on startup rather than configure it, or can't be set in a
+// config file.
+var genconfigSkipFlags = map[string]bool{
+	"config":             true,
+	"config-dir":         true,
+	"check":              true,
+	"check-connect":      true,
+	"version":            true,
+	"help-systemd-usage": true,
+}
+
+// genconfigExamples are the example values given to the required settings,
+// which are left uncommented in generated config files.
+var genconfigExamples = map[string]string{
+	"server": "mymqttserver.lan:1883",
+	"topic":  "power/alarms",
+}
+
+// genconfigWrap is the width to which comments in generated files are wrapped.
+const genconfigWrap = 78
+
+// runGenconfig implements the genconfig subcommand: it prints a commented
+// sample -config file listing every setting defined on fs with its default,
+// or, with -unit, the systemd unit, set up to read that file.
+func runGenconfig(args []string, fs *flag.FlagSet) int {
+	gfs := flag.NewFlagSet(name+" genconfig", flag.ContinueOnError)
+	format := gfs.String("format", "yaml", "Config file format: yaml or toml.")
+	unit := gfs.Bool("unit", false, "Print the systemd unit instead of the config file.")
+	path := gfs.String("path", "", "Path of the config file, used in the unit's ExecStart line. Defaults to /etc/mqttshutdownd.yaml or /etc/mqttshutdownd.toml, depending on -format.")
+	if err := gfs.Parse(args); err != nil {
+		return 2 // EXIT_INVALIDARGUMENT
+	}
+	if *format != "yaml" && *format != "toml" {
+		fmt.Fprintf(os.Stderr, "invalid -format '%s': must be yaml or toml\n", *format)
+		return 2 // EXIT_INVALIDARGUMENT
+	}
+	if *path == "" {
+		*path = fmt.Sprintf("/etc/%s.%s", name, *format)
+	}
+	if *unit {
+		writeGenconfigUnit(os.Stdout, *path)
+	} else {
+		writeGenconfig(os.Stdout, fs, *format == "toml")
+	}
+	return 0
+}
+
+// writeGenconfig writes the sample config file, grouped into flagGroups
+// sections. Every setting but the required ones is commented out, set to its
+// default.
+func writeGenconfig(w io.Writer, fs *flag.FlagSet, toml bool) {
+	fmt.Fprintf(w, "# %s %s configuration, generated by '%s genconfig'.\n", name, version, name)
+	writeComment(w, "Settings are keyed by flag name; see '"+name+" -help'. Flags given on the command line or in the environment override this file. Uncomment and change what you need.")
+
+	grouped := make([][]*flag.Flag, len(flagGroups)+1)
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, isAlias := flagAliases[f.Name]; isAlias || hiddenFlags[f.Name] || genconfigSkipFlags[f.Name] {
+			return
+		}
+		i := len(flagGroups)
+		for gi, g := range flagGroups {
+			if g.contains(f.Name) {
+				i = gi
+				break
+			}
+		}
+		grouped[i] = append(grouped[i], f)
+	})
+	for i, flags := range grouped {
+		if len(flags) == 0 {
+			continue
+		}
+		title := "Other"
+		if i < len(flagGroups) {
+			title = flagGroups[i].Title
+		}
+		fmt.Fprintf(w, "\n# ==== %s ====\n", title)
+		for _, f := range flags {
+			fmt.Fprintln(w, "")
+			writeComment(w, f.Usage)
+			if ex, ok := genconfigExamples[f.Name]; ok {
+				fmt.Fprintln(w, genconfigSetting(f.Name, genconfigValue(f, ex), toml))
+			} else {
+				fmt.Fprintln(w, "# "+genconfigSetting(f.Name, genconfigValue(f, f.DefValue), toml))
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "\n# ==== Rules ====")
+	fmt.Fprintln(w, "")
+	writeComment(w, "Additional named rules, each evaluated against the messages on its own topic. Each setting left out defaults to the top-level setting of the same name.")
+	if toml {
+		fmt.Fprintln(w, "# [rules.rack2]")
+		fmt.Fprintln(w, `# topic = "power/alarms/rack2"`)
+		fmt.Fprintln(w, `# recovery-period = "1m"`)
+		fmt.Fprintln(w, `# command = "/usr/local/bin/rack2-poweroff"`)
+	} else {
+		fmt.Fprintln(w, "# rules:")
+		fmt.Fprintln(w, "#   rack2:")
+		fmt.Fprintln(w, `#     topic: "power/alarms/rack2"`)
+		fmt.Fprintln(w, `#     recovery-period: "1m"`)
+		fmt.Fprintln(w, `#     command: "/usr/local/bin/rack2-poweroff"`)
+	}
+}
+
+// genconfigValue formats v, a value of f, for a config file.
+func genconfigValue(f *flag.Flag, v string) string {
+	if _, multi := f.Value.(*stringsFlag); multi {
+		if v == "" {
+			return "[]"
+		}
+		return fmt.Sprintf("[%q]", v)
+	}
+	if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+		return v
+	}
+	switch typeName, _ := flag.UnquoteUsage(f); typeName {
+	case "int", "uint", "int64", "uint64", "float":
+		return v
+	}
+	return fmt.Sprintf("%q", v)
+}
+
+func genconfigSetting(key, value string, toml bool) string {
+	if toml {
+		return key + " = " + value
+	}
+	return key + ": " + value
+}
+
+// writeComment writes text as comment lines, wrapped at genconfigWrap.
+func writeComment(w io.Writer, text string) {
+	line := "#"
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > genconfigWrap && line != "#" {
+			fmt.Fprintln(w, line)
+			line = "#"
+		}
+		line += " " + word
+	}
+	fmt.Fprintln(w, line)
+}
+
+// writeGenconfigUnit writes the systemd unit, with ExecStart reading the
+// config file at path.
+func writeGenconfigUnit(w io.Writer, path string) {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(systemdUnit, "\n") {
+		if strings.HasPrefix(line, "ExecStart=") {
+			cmd := systemdQuote([]string{"/usr/bin/" + name, "-config", path})
+			line = fmt.Sprintf("ExecStartPre=%s -check\nExecStart=%s\n", cmd, cmd)
+		}
+		b.WriteString(line)
+	}
+	fmt.Fprint(w, b.String())
+}
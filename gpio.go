@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// gpioPollInterval is how often the GPIO line is sampled.
+const gpioPollInterval = 100 * time.Millisecond
+
+// gpioLine is a single GPIO input line.
+type gpioLine interface {
+	// Value reports whether the line is active (taking active-low into account).
+	Value() (bool, error)
+	Close() error
+}
+
+// gpioSource watches a GPIO input line indicating mains presence, as exposed
+// by many UPS HATs, and emits a power event whenever its debounced state changes.
+type gpioSource struct {
+	Chip      string
+	Line      int
+	ActiveLow bool
+	PullUp    bool
+	Debounce  time.Duration
+	Interval  time.Duration
+}
+
+func (g *gpioSource) Name() string {
+	return fmt.Sprintf("gpio:%s/%d", g.Chip, g.Line)
+}
+
+func (g *gpioSource) Run(ctx context.Context, events chan<- powerEvent) {
+	var line gpioLine
+	for line == nil {
+		var err error
+		if line, err = openGPIOLine(g.Chip, g.Line, g.ActiveLow, g.PullUp); err != nil {
+			log.Printf("%s: %s", g.Name(), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
+		}
+	}
+	defer line.Close()
+
+	var (
+		reported    *bool
+		candidate   bool
+		candidateAt time.Time
+	)
+	ticker := time.NewTicker(g.Interval)
+	defer ticker.Stop()
+	for {
+		v, err := line.Value()
+		if err != nil {
+			log.Printf("%s: %s", g.Name(), err)
+		} else {
+			now := time.Now()
+			if candidateAt.IsZero() || v != candidate {
+				candidate, candidateAt = v, now
+			}
+			if (reported == nil || *reported != candidate) && now.Sub(candidateAt) >= g.Debounce {
+				present := candidate
+				reported = &present
+				m := PowerAlarmMessage{Online: present, PowerType: PowerTypeUtility, Scope: ScopeLocal}
+				select {
+				case events <- powerEvent{Source: g.Name(), Message: m}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
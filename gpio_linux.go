@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Linux GPIO character device ABI v1 (linux/gpio.h).
+const (
+	gpioGetLineHandleIoctl     = 0xc16cb403 // _IOWR(0xB4, 0x03, struct gpiohandle_request)
+	gpioHandleGetLineValsIoctl = 0xc040b408 // _IOWR(0xB4, 0x08, struct gpiohandle_data)
+
+	gpioHandleRequestInput     = 1 << 0
+	gpioHandleRequestActiveLow = 1 << 2
+	gpioHandleRequestPullUp    = 1 << 5
+)
+
+type gpiohandleRequest struct {
+	LineOffsets   [64]uint32
+	Flags         uint32
+	DefaultValues [64]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+type gpiohandleData struct {
+	Values [64]uint8
+}
+
+type linuxGPIOLine struct {
+	fd int
+}
+
+func openGPIOLine(chip string, line int, activeLow, pullUp bool) (gpioLine, error) {
+	f, err := os.Open(chip)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	req := gpiohandleRequest{Flags: gpioHandleRequestInput, Lines: 1}
+	req.LineOffsets[0] = uint32(line)
+	if activeLow {
+		req.Flags |= gpioHandleRequestActiveLow
+	}
+	if pullUp {
+		req.Flags |= gpioHandleRequestPullUp
+	}
+	copy(req.ConsumerLabel[:], name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), gpioGetLineHandleIoctl, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return nil, fmt.Errorf("failed to request line %d on %s: %w", line, chip, errno)
+	}
+	return &linuxGPIOLine{fd: int(req.Fd)}, nil
+}
+
+func (l *linuxGPIOLine) Value() (bool, error) {
+	var data gpiohandleData
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(l.fd), gpioHandleGetLineValsIoctl, uintptr(unsafe.Pointer(&data))); errno != 0 {
+		return false, fmt.Errorf("failed to read line value: %w", errno)
+	}
+	return data.Values[0] != 0, nil
+}
+
+func (l *linuxGPIOLine) Close() error {
+	return syscall.Close(l.fd)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openGPIOLine(_ string, _ int, _, _ bool) (gpioLine, error) {
+	return nil, errors.New("GPIO is only supported on Linux")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// homeAssistantFormat is the format of Home Assistant entity topics: the
+// state topic of a binary_sensor reporting whether utility power is present,
+// optionally alongside the state topics of battery and load sensors and a
+// JSON attributes topic.
+const homeAssistantFormat = "homeassistant"
+
+// homeAssistantUnavailable are the states Home Assistant reports for an
+// entity with no current value.
+var homeAssistantUnavailable = []string{"unavailable", "unknown", "none", ""}
+
+// newHomeAssistantNormalizer returns a normalizer for the homeassistant
+// format, with all of an entity's topics subscribed to, e.g.
+//
+//	homeassistant/binary_sensor/ups_online/state     ON
+//	homeassistant/sensor/ups_battery/state           85
+//	homeassistant/binary_sensor/ups_online/attributes  {"battery_charge": 85, "load": 23}
+//
+// An ON or OFF state (in any case, as published by MQTT entities or by
+// mqtt_statestream) reports utility power up or down, or the reverse with
+// -ha-on-is-down. A numeric state is the battery state of charge or the load,
+// in percent, if its topic mentions "battery" or "load"; it and the
+// attributes' battery and load are remembered for the next message. An
+// attributes object with a boolean or string "online", "power" or "state"
+// attribute reports whether power is up too, e.g. true or "on" for up,
+// regardless of -ha-on-is-down. Unavailable entities are ignored.
+func newHomeAssistantNormalizer(opts formatOptions) normalizer {
+	onIsDown := opts.HomeAssistantOnIsDown
+	var (
+		mu            sync.Mutex
+		battery, load *float64
+	)
+	message := func(up bool) []PowerAlarmMessage {
+		m := PowerAlarmMessage{Online: up, PowerType: PowerTypeUtility, Scope: ScopeGlobal, Battery: battery, Load: load}
+		return []PowerAlarmMessage{m}
+	}
+	return func(topic string, payload []byte) ([]PowerAlarmMessage, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		s := strings.ToLower(strings.Trim(strings.TrimSpace(string(payload)), `"`))
+		switch s {
+		case "on":
+			return message(!onIsDown), nil
+		case "off":
+			return message(onIsDown), nil
+		}
+		for _, u := range homeAssistantUnavailable {
+			if s == u {
+				return nil, nil
+			}
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			switch t := strings.ToLower(topic); {
+			case strings.Contains(t, "battery"):
+				battery = &f
+			case strings.Contains(t, "load"):
+				load = &f
+			}
+			return nil, nil
+		}
+
+		var attrs map[string]any
+		if err := json.Unmarshal(payload, &attrs); err != nil {
+			return nil, fmt.Errorf("'%s' is not an ON or OFF state, a number, or a JSON attributes object", s)
+		}
+		for _, k := range []string{"battery_charge", "battery_level", "battery"} {
+			if f, err := mappedNumber(attrs[k]); err == nil {
+				battery = &f
+				break
+			}
+		}
+		for _, k := range []string{"load", "ups_load"} {
+			if f, err := mappedNumber(attrs[k]); err == nil {
+				load = &f
+				break
+			}
+		}
+		for _, k := range []string{"online", "power", "state"} {
+			// A number is more likely a measurement, e.g. watts, than a
+			// power state.
+			switch v := attrs[k].(type) {
+			case bool, string:
+				if up, err := mappedBool(v); err == nil {
+					return message(up), nil
+				}
+			}
+		}
+		return nil, nil
+	}
+}
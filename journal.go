@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// journalCompactInterval is how often entries older than the retention
+// period are removed from the journal.
+const journalCompactInterval = time.Hour
+
+// Journal entry kinds.
+const (
+	JournalKindEvent      = "event"
+	JournalKindEvaluation = "evaluation"
+	JournalKindAction     = "action"
+)
+
+// journalEntry is a record of something the daemon received, decided, or did.
+type journalEntry struct {
+	At      time.Time          `json:"at"`
+	Kind    string             `json:"kind"`
+	Source  string             `json:"source,omitempty"`
+	Message *PowerAlarmMessage `json:"message,omitempty"`
+	Detail  string             `json:"detail"`
+}
+
+// Run compacts the journal now and then periodically until ctx is done.
+func (j *journal) Run(ctx context.Context) {
+	t := time.NewTicker(journalCompactInterval)
+	defer t.Stop()
+	for {
+		if err := j.Compact(time.Now()); err != nil {
+			log.Printf("journal: failed to compact: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// journalingAction is an Action that records each of the wrapped Action's
+// calls in a journal.
+type journalingAction struct {
+	Action
+	Journal *journal
+	Clock   Clock
+}
+
+func (a journalingAction) record(detail string, ev powerEvent) {
+	m := ev.Message
+	a.Journal.Record(journalEntry{At: a.Clock.Now(), Kind: JournalKindAction, Source: ev.Source, Message: &m, Detail: detail})
+}
+
+func (a journalingAction) Armed(ctx context.Context, p Pending) {
+	a.record(fmt.Sprintf("armed; executing at %s", p.ExecuteAt.Format(time.RFC3339)), p.Trigger)
+	a.Action.Armed(ctx, p)
+}
+
+func (a journalingAction) Held(ctx context.Context, p Pending, until time.Time) {
+	a.record(fmt.Sprintf("held until %s", until.Format(time.RFC3339)), p.Trigger)
+	a.Action.Held(ctx, p, until)
+}
+
+func (a journalingAction) Cancelled(ctx context.Context, p Pending, ev powerEvent) {
+	a.record("cancelled", ev)
+	a.Action.Cancelled(ctx, p, ev)
+}
+
+func (a journalingAction) Execute(ctx context.Context, p Pending) {
+	a.record(fmt.Sprintf("executing (armed at %s)", p.ArmedAt.Format(time.RFC3339)), p.Trigger)
+	a.Action.Execute(ctx, p)
+}
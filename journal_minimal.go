@@ -0,0 +1,159 @@
+//go:build minimal
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const stateFileJournal = "journal.jsonl"
+
+// journal is a durable, append-only record of events, rule evaluations, and
+// actions, kept as JSON lines in the state directory so it survives restarts
+// and reboots for post-incident review. Entries older than the retention
+// period are compacted away. A nil *journal records nothing.
+//
+// Minimal builds keep the journal as JSON lines rather than in SQLite, whose
+// pure-Go port doesn't support the MIPS targets they're built for.
+type journal struct {
+	path      string
+	retention time.Duration
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openJournal(store stateStore, retention time.Duration) (*journal, error) {
+	if !store.Enabled() {
+		return nil, errors.New("the journal requires -state-dir")
+	}
+	j := &journal{path: store.Path(stateFileJournal), retention: retention}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	return nil
+}
+
+// Record appends an entry. Actions are synced to disk immediately, since one
+// may be followed by the host powering off.
+func (j *journal) Record(e journalEntry) {
+	if j == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("journal: %s", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		log.Printf("journal: failed to write: %s", err)
+		return
+	}
+	if e.Kind == JournalKindAction {
+		if err := j.f.Sync(); err != nil {
+			log.Printf("journal: failed to sync: %s", err)
+		}
+	}
+}
+
+// Query returns entries at or after since, optionally only those of the given
+// kind, oldest first. If limit is positive, only the newest limit entries are
+// returned.
+func (j *journal) Query(since time.Time, kind string, limit int) ([]journalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.read(func(e journalEntry) bool {
+		return !e.At.Before(since) && (kind == "" || e.Kind == kind)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+// read returns the entries for which keep returns true. j.mu must be held.
+func (j *journal) read(keep func(journalEntry) bool) ([]journalEntry, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []journalEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			continue // e.g. a line truncated by a power loss
+		}
+		if keep(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, sc.Err()
+}
+
+// Compact removes entries older than the retention period.
+func (j *journal) Compact(now time.Time) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cutoff := now.Add(-j.retention)
+	entries, err := j.read(func(e journalEntry) bool { return e.At.After(cutoff) })
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".journal.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+	_ = j.f.Close()
+	if err := j.open(); err != nil {
+		return fmt.Errorf("failed to reopen: %w", err)
+	}
+	return nil
+}
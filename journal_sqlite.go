@@ -0,0 +1,130 @@
+//go:build !minimal
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+)
+
+const stateFileJournal = "journal.db"
+
+// journalSchema creates the journal's table. Times are Unix nanoseconds, so
+// they sort and compare as integers; messages are JSON.
+const journalSchema = `
+CREATE TABLE IF NOT EXISTS entries (
+	id      INTEGER PRIMARY KEY,
+	at      INTEGER NOT NULL,
+	kind    TEXT NOT NULL,
+	source  TEXT NOT NULL DEFAULT '',
+	message TEXT,
+	detail  TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS entries_at ON entries (at);
+`
+
+// journal is a durable record of events, rule evaluations, and actions, kept
+// in an SQLite database in the state directory so it survives restarts and
+// reboots for post-incident review. Entries older than the retention period
+// are deleted by Compact. A nil *journal records nothing.
+type journal struct {
+	db        *sql.DB
+	retention time.Duration
+}
+
+func openJournal(store stateStore, retention time.Duration) (*journal, error) {
+	if !store.Enabled() {
+		return nil, errors.New("the journal requires -state-dir")
+	}
+	// In WAL mode with synchronous=NORMAL, commits aren't synced to disk one
+	// by one; Record checkpoints after each action instead.
+	db, err := sql.Open("sqlite", "file:"+store.Path(stateFileJournal)+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(journalSchema); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &journal{db: db, retention: retention}, nil
+}
+
+// Record adds an entry. Actions are synced to disk immediately, since one may
+// be followed by the host powering off.
+func (j *journal) Record(e journalEntry) {
+	if j == nil {
+		return
+	}
+	var message sql.NullString
+	if e.Message != nil {
+		b, err := json.Marshal(e.Message)
+		if err != nil {
+			log.Printf("journal: %s", err)
+			return
+		}
+		message = sql.NullString{String: string(b), Valid: true}
+	}
+	if _, err := j.db.Exec("INSERT INTO entries (at, kind, source, message, detail) VALUES (?, ?, ?, ?, ?)",
+		e.At.UnixNano(), e.Kind, e.Source, message, e.Detail); err != nil {
+		log.Printf("journal: failed to write: %s", err)
+		return
+	}
+	if e.Kind == JournalKindAction {
+		if _, err := j.db.Exec("PRAGMA wal_checkpoint(FULL)"); err != nil {
+			log.Printf("journal: failed to sync: %s", err)
+		}
+	}
+}
+
+// Query returns entries at or after since, optionally only those of the given
+// kind, oldest first. If limit is positive, only the newest limit entries are
+// returned.
+func (j *journal) Query(since time.Time, kind string, limit int) ([]journalEntry, error) {
+	if limit <= 0 {
+		limit = -1 // no limit
+	}
+	rows, err := j.db.Query("SELECT at, kind, source, message, detail FROM entries WHERE at >= ? AND (? = '' OR kind = ?) ORDER BY id DESC LIMIT ?",
+		since.UnixNano(), kind, kind, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []journalEntry
+	for rows.Next() {
+		var (
+			e       journalEntry
+			at      int64
+			message sql.NullString
+		)
+		if err := rows.Scan(&at, &e.Kind, &e.Source, &message, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.At = time.Unix(0, at)
+		if message.Valid {
+			e.Message = &PowerAlarmMessage{}
+			if err := json.Unmarshal([]byte(message.String), e.Message); err != nil {
+				return nil, fmt.Errorf("entry at %s: %w", e.At.Format(time.RFC3339), err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(entries)
+	return entries, nil
+}
+
+// Compact deletes entries older than the retention period.
+func (j *journal) Compact(now time.Time) error {
+	_, err := j.db.Exec("DELETE FROM entries WHERE at <= ?", now.Add(-j.retention).UnixNano())
+	return err
+}
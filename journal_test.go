@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJournalQueryAndCompact(t *testing.T) {
+	store, err := newStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := openJournal(store, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	down := powerDown().Message
+	j.Record(journalEntry{At: start, Kind: JournalKindEvent, Source: "test", Message: &down, Detail: "received"})
+	j.Record(journalEntry{At: start.Add(time.Minute), Kind: JournalKindEvaluation, Source: "test", Message: &down, Detail: "down: true"})
+	j.Record(journalEntry{At: start.Add(2 * time.Minute), Kind: JournalKindAction, Detail: "armed"})
+
+	all, err := j.Query(time.Time{}, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[0].Detail != "received" || all[2].Detail != "armed" {
+		t.Fatalf("entries = %+v, want all three, oldest first", all)
+	}
+	if !all[0].At.Equal(start) || all[0].Message == nil || all[0].Message.Online || all[2].Message != nil {
+		t.Fatalf("first entry = %+v, last = %+v; want them as recorded", all[0], all[2])
+	}
+	if got, _ := j.Query(time.Time{}, JournalKindEvaluation, 0); len(got) != 1 || got[0].Detail != "down: true" {
+		t.Fatalf("evaluations = %+v, want the one recorded", got)
+	}
+	if got, _ := j.Query(time.Time{}, "", 2); len(got) != 2 || got[0].Detail != "down: true" {
+		t.Fatalf("newest two = %+v, want the evaluation and the action", got)
+	}
+	if got, _ := j.Query(start.Add(time.Minute), "", 0); len(got) != 2 {
+		t.Fatalf("since a minute in = %+v, want two entries", got)
+	}
+
+	if err := j.Compact(start.Add(time.Hour + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := j.Query(time.Time{}, "", 0); len(got) != 1 || got[0].Detail != "armed" {
+		t.Fatalf("after compacting = %+v, want only the entry within the retention period", got)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "errors"
+
+// ErrKeyringUnsupported is returned by keyringPassword on platforms without
+// a supported OS keyring.
+var ErrKeyringUnsupported = errors.New("OS keyring is not supported on this platform")
+
+// keyringAccount returns the account name used to look up the broker password
+// in the OS keyring; credentials are stored per MQTT username.
+func keyringAccount(user string) string {
+	if user == "" {
+		return name
+	}
+	return user
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keyringPassword retrieves a generic password from the macOS Keychain. Store one with:
+//
+//	security add-generic-password -s mqttshutdownd -a <user> -w
+func keyringPassword(service, account string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("security find-generic-password failed: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	pw := strings.TrimRight(string(out), "\r\n")
+	if pw == "" {
+		return "", fmt.Errorf("no Keychain item found for service '%s' account '%s'", service, account)
+	}
+	return pw, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keyringPassword retrieves a password from the Secret Service via libsecret's
+// secret-tool. Store one with:
+//
+//	secret-tool store --label=mqttshutdownd service mqttshutdownd account <user>
+func keyringPassword(service, account string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", "lookup", "service", service, "account", account)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("secret-tool lookup failed: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	pw := strings.TrimRight(string(out), "\r\n")
+	if pw == "" {
+		return "", fmt.Errorf("no Secret Service item found for service '%s' account '%s'", service, account)
+	}
+	return pw, nil
+}
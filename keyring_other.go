@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+func keyringPassword(_, _ string) (string, error) {
+	return "", ErrKeyringUnsupported
+}
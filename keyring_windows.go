@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const credTypeGeneric = 1
+
+var (
+	modAdvapi32  = syscall.NewLazyDLL("advapi32.dll")
+	procCredRead = modAdvapi32.NewProc("CredReadW")
+	procCredFree = modAdvapi32.NewProc("CredFree")
+)
+
+// credential mirrors the Win32 CREDENTIALW structure.
+type credential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// keyringPassword retrieves a generic credential from the Windows Credential Manager.
+// The credential's target name is "<service>:<account>". Store one with:
+//
+//	cmdkey /generic:mqttshutdownd:<user> /user:<user> /pass
+func keyringPassword(service, account string) (string, error) {
+	target, err := syscall.UTF16PtrFromString(fmt.Sprintf("%s:%s", service, account))
+	if err != nil {
+		return "", err
+	}
+	var cred *credential
+	r, _, err := procCredRead.Call(uintptr(unsafe.Pointer(target)), credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if r == 0 {
+		return "", fmt.Errorf("CredReadW failed for target '%s:%s': %w", service, account, err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred))) //nolint:errcheck
+
+	if cred.CredentialBlobSize == 0 || cred.CredentialBlob == nil {
+		return "", fmt.Errorf("credential '%s:%s' has no password", service, account)
+	}
+	blob := unsafe.Slice(cred.CredentialBlob, cred.CredentialBlobSize)
+	// Credentials created by cmdkey and the Credential Manager UI are UTF-16LE.
+	if len(blob)%2 == 0 {
+		u := make([]uint16, len(blob)/2)
+		for i := range u {
+			u[i] = uint16(blob[2*i]) | uint16(blob[2*i+1])<<8
+		}
+		return syscall.UTF16ToString(u), nil
+	}
+	return string(blob), nil
+}
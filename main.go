@@ -2,21 +2,27 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
-	"github.com/google/cel-go/cel"
 )
 
 const name = "mqttshutdownd"
@@ -29,37 +35,290 @@ func usage() {
 	fmt.Fprintln(os.Stderr, "mqttshutdownd subscribes to an MQTT topic and initiates a system shutdown when a message is received indicating that utility power is down.")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "Usage:")
-	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "  %s [flags]\n", name)
+	fmt.Fprintf(os.Stderr, "  %s setup                      interactively configure and install the systemd service\n", name)
+	fmt.Fprintf(os.Stderr, "  %s doctor [flags]             check the configuration, broker, and host, then exit\n", name)
+	fmt.Fprintf(os.Stderr, "  %s verify-broker [flags]      check broker credentials, topic ACLs, and latency, then exit\n", name)
+	fmt.Fprintf(os.Stderr, "  %s completion bash|zsh|fish   print a shell completion script\n", name)
+	fmt.Fprintf(os.Stderr, "  %s schema                     print the JSON Schema of accepted power alarm payloads\n", name)
+	fmt.Fprintf(os.Stderr, "  %s genconfig [-format toml]   print a commented sample -config file; with -unit, the systemd unit\n", name)
 	fmt.Fprintln(os.Stderr, "")
-	fmt.Fprintln(os.Stderr, "-down-expr and -recovered-expr are Common Experssion Language (CEL) expressions. For more information on CEL, see https://cel.dev .")
+	fmt.Fprintln(os.Stderr, "Flags may be given as -name or --name.")
+	fmt.Fprintf(os.Stderr, "Each flag may also be set by an environment variable, e.g. %s for -server or %s for -down-expr; flags given on the command line win.\n", envVarName("server"), envVarName("down-expr"))
+	fmt.Fprintln(os.Stderr, "")
+	printFlagGroups(os.Stderr, flag.CommandLine)
+	fmt.Fprintln(os.Stderr, exprLanguageHelp)
 	fmt.Fprintln(os.Stderr, "Within those expressions, the following variables are available:")
 	fmt.Fprintln(os.Stderr, "  - powerType: integer, representing the type of power event received from MQTT (e.g. 1 = utility power)")
 	fmt.Fprintln(os.Stderr, "  - online: boolean, representing whether the power type is online")
-	fmt.Fprintln(os.Stderr, "  - scope: string, representing the scope of the power event (e.g. 'global')")
+	fmt.Fprintln(os.Stderr, "  - scope: string, representing the scope of the power event (e.g. 'global'); '1p' and '1c' events about a phase or circuit other than -phase or -circuit never reach the expressions")
+	fmt.Fprintln(os.Stderr, "  - battery: double, the battery state of charge in percent, or -1 if not reported")
+	fmt.Fprintln(os.Stderr, "  - load: double, the output load in percent, or -1 if not reported")
+	fmt.Fprintln(os.Stderr, "  - source: string, where the event came from (e.g. 'mqtt:power/alarms', 'nut:ups@localhost', 'gpio:/dev/gpiochip0/17')")
+	fmt.Fprintln(os.Stderr, "  - runtime: double, the estimated battery runtime remaining in seconds, learned from the reported battery state of charge and load, or -1 if not yet known")
+	fmt.Fprintln(os.Stderr, "  - expiry: double, the seconds left before the MQTT message expires, per the publisher's message expiry interval, or -1 if it doesn't; e.g. 'expiry < 0.0 || expiry > 60.0' matches only alarms with no expiry or more than a minute left, ignoring those that spent too long queued")
+	if !minimalBuild {
+		fmt.Fprintln(os.Stderr, "  - props: map of string to string, the MQTT user properties of the message (e.g. 'site' in props && props.site == 'garage'); empty for other sources")
+		fmt.Fprintln(os.Stderr, "  - msg: with -proto-message, the message decoded from the payload, with the fields of its .proto type (e.g. msg.input_voltage < 100.0); empty for other sources")
+	}
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "mqttshutdownd is licensed under the LGPL-3.0 license.")
 	fmt.Fprintln(os.Stderr, "https://www.github.com/cdzombak/mqttshutdownd")
 	fmt.Fprintln(os.Stderr, "by Chris Dzombak <https://www.dzombak.com>")
 }
 
+// invalidArgument prints msg and the usage text, then exits with EXIT_INVALIDARGUMENT.
+func invalidArgument(msg any) {
+	fmt.Fprintln(os.Stderr, msg)
+	fmt.Fprintln(os.Stderr, "")
+	usage()
+	os.Exit(2) // EXIT_INVALIDARGUMENT
+}
+
 func main() {
-	topic := flag.String("topic", "", "MQTT topic to subscribe to. Required.")
-	server := flag.String("server", "", "MQTT server and port to connect to, e.g. 'mymqttserver.lan:1883'. Required.")
+	var topics stringsFlag
+	flag.Var(&topics, "topic", "MQTT topic to subscribe to. May be given multiple times, e.g. when utility and generator events are published on separate topics; messages on each are evaluated by the same rule. Required unless -relay is used.")
+	var topicVarSpecs stringsFlag
+	flag.Var(&topicVarSpecs, "topic-var", "Variable for topic templates, given as NAME=VALUE, e.g. 'site=barn'. Topic settings may refer to {NAME} and to {hostname}, e.g. 'site/{site}/power/alarms', so one configuration can be deployed fleet-wide. May be given multiple times.")
+	server := flag.String("server", "", "MQTT server and port to connect to, e.g. 'mymqttserver.lan:1883', or a URL, e.g. 'mqtts://mymqttserver.lan:8883' to connect using TLS, 'wss://mymqttserver.lan/mqtt' to connect over WebSockets, or 'unix:///var/run/mosquitto.sock' to connect to a Unix domain socket. The port defaults to 1883, or 8883 with TLS; over WebSockets, to 80, or 443 with TLS. Required.")
+	var redundantServers stringsFlag
+	flag.Var(&redundantServers, "redundant-server", "Additional MQTT server and port to subscribe to -topic on at the same time as -server, using the same credentials and TLS settings. Events from all servers are merged; a message already delivered by another server is dropped. May be given multiple times.")
+	redundantDedupWin := flag.Duration("redundant-dedup-window", redundantDedupWindow, "How long after one server delivers a message the same message from another -redundant-server or -server is dropped as a duplicate. Should exceed the delay of the slowest path, e.g. a bridge, between the publisher and any server.")
 	user := flag.String("user", "", "MQTT username.")
-	password := flag.String("password", "", "MQTT password.")
-	sessionExpiryS := flag.Int("session-expiry", 5*60, "Seconds that a session will survive after disconnection for delivery of QoS 1/2 messages.")
+	password := flag.String("password", "", "MQTT password. Visible in process listings; prefer -password-file.")
+	userFile := flag.String("user-file", "", "File containing the MQTT username, e.g. a root-readable file. Re-read on each reconnection.")
+	passwordFile := flag.String("password-file", "", "File containing the MQTT password, e.g. a root-readable file, so it doesn't appear in process listings or logs. Re-read on each reconnection.")
+	credentialsCmd := flag.String("credentials-cmd", "", "Shell command printing the MQTT credentials, run before each connection attempt, e.g. to fetch short-lived credentials from Vault, an OAuth token endpoint, or AWS IoT custom authentication. It prints either a JSON object with \"password\" (or \"token\") and optionally \"username\", or just the password or token, used with -user.")
+	userCredential := flag.String("user-credential", "", "Name of the systemd credential holding the MQTT username, passed to the service with LoadCredential= or SetCredentialEncrypted= and read from $CREDENTIALS_DIRECTORY.")
+	passwordCredential := flag.String("password-credential", "", "Name of the systemd credential holding the MQTT password, e.g. 'mqtt-pass' given 'LoadCredential=mqtt-pass:/etc/mqttshutdownd/password' or 'SetCredentialEncrypted=mqtt-pass: ...' in the unit; read from $CREDENTIALS_DIRECTORY.")
+	passwordKeyring := flag.Bool("password-keyring", false, "Read the MQTT password from the OS keyring (Secret Service, macOS Keychain, or Windows Credential Manager), using service 'mqttshutdownd' and the -user value as the account.")
+	useTLS := flag.Bool("tls", false, "Connect to the server using TLS (1.2 or later), verifying its certificate. Implied by an mqtts:// -server, -tls-cert, -tls-ca and -tls-skip-verify.")
+	tlsCA := flag.String("tls-ca", "", "File of PEM CA certificates to verify the server's certificate against, instead of the system roots.")
+	tlsSkipVerify := flag.Bool("tls-skip-verify", false, "Don't verify the server's TLS certificate. Insecure; for testing only.")
+	tlsCert := flag.String("tls-cert", "", "Path to a PEM client certificate for mutual TLS. Setting this connects to the server using TLS.")
+	tlsKey := flag.String("tls-key", "", "Path to the PEM private key for -tls-cert.")
+	vaultAddr := flag.String("vault-addr", "", "Vault server address, e.g. 'https://vault.lan:8200'. Enables reading broker credentials and TLS material from Vault. Defaults to $VAULT_ADDR when -vault-secret-path is set.")
+	vaultTokenFile := flag.String("vault-token-file", "", "File containing the Vault token. If neither this nor AppRole is configured, $VAULT_TOKEN is used.")
+	vaultRoleID := flag.String("vault-role-id", "", "Vault AppRole role ID. Enables AppRole authentication.")
+	vaultSecretIDFile := flag.String("vault-secret-id-file", "", "File containing the Vault AppRole secret ID.")
+	vaultSecretPath := flag.String("vault-secret-path", "", "Vault API path of the KV secret holding broker credentials, e.g. 'secret/data/mqttshutdownd'. Recognized keys: username, password, tls_cert, tls_key.")
+	vaultRefresh := flag.Duration("vault-refresh", 5*time.Minute, "How often to renew the Vault token and re-read the secret.")
+	mqttVersion := flag.String("mqtt-version", mqttVersion5, "MQTT protocol version to connect to -server and -redundant-server with: 5, or 3.1.1 for brokers with missing or broken MQTT 5 support. With 3.1.1, a -session-expiry of 0 connects with a clean session and any other with a persistent one, whose expiry is up to the broker; MQTT 5 features such as the -subscribe- options and response topics are unavailable.")
+	sessionExpiry := secondsDurationFlag(5 * time.Minute)
+	flag.Var(&sessionExpiry, "session-expiry", "How long a session will survive after disconnection for delivery of QoS 1/2 messages (e.g. '5m'; a bare integer is taken as seconds). 0 ends the session when the connection closes, so messages published while disconnected are never delivered.")
+	clientIDFlag := flag.String("client-id", "", "MQTT client ID. Defaults to HOSTNAME/mqttshutdownd; two clients connected with the same ID take over each other's session, so instances sharing a host need different IDs.")
+	clientIDSuffix := flag.Bool("client-id-suffix", false, "Append a random suffix to the client ID, e.g. to run several instances on one host for testing. Each run then starts a new session, so messages published while the daemon wasn't running aren't delivered.")
+	cleanStart := flag.Bool("clean-start", false, "Start with a new session when the daemon starts, discarding messages the broker queued for it while it wasn't running, e.g. alarms from hours ago, instead of replaying them.")
+	resumeSession := flag.Bool("resume-session", true, "Resume the session when reconnecting after the connection drops, receiving the messages published in the meantime. If false, every connection starts a new session.")
+	retained := flag.String("retained", retainedHonor, "How to treat retained power alarms, which the broker delivers on subscribing however long ago they were published: honor acts on them; ignore drops them; ignore-if-older-than=DURATION (e.g. '10m') drops those whose \"at\" timestamp is older than DURATION or missing.")
+	subscribeNoLocal := flag.Bool("subscribe-no-local", false, "MQTT v5 subscription option: don't deliver this daemon's own publishes back to it, e.g. when a -relay filter matches -relay-topic.")
+	subscribeRetainHandling := flag.Uint("subscribe-retain-handling", 0, "MQTT v5 subscription option: 0 delivers retained messages on every subscribe, 1 only when the subscription is new, 2 never.")
+	subscribeMaxFailures := flag.Uint("subscribe-max-failures", 5, "How many times in a row subscribing to a topic may fail, retried with the same backoff as reconnecting, before the daemon exits. 0 retries forever.")
+	subscribeRetainAsPublished := flag.Bool("subscribe-retain-as-published", false, "MQTT v5 subscription option: keep the retain flag on delivered messages.")
+	shareGroup := flag.String("share-group", "", "Subscribe to -topic, named rules' topics and -relay filters as MQTT v5 shared subscriptions in this group ($share/GROUP/...), so the broker delivers each message to only one of the group's hosts, e.g. to split relaying among a pool of gateways. Only that one host acts on a power alarm, so hosts that must each shut down shouldn't share a group.")
+	keepAlive := secondsDurationFlag(20 * time.Second)
+	flag.Var(&keepAlive, "keepalive", "MQTT keepalive interval (e.g. '20s'; a bare integer is taken as seconds). 0 disables keepalive.")
+	reconnectMin := flag.Duration("reconnect-min", time.Second, "How long to wait before reconnecting to the server after the first failed attempt. The wait doubles after each further failure, up to -reconnect-max.")
+	reconnectMax := flag.Duration("reconnect-max", 30*time.Second, "The longest to wait between attempts to reconnect to the server.")
+	reconnectMaxFailures := flag.Uint("reconnect-max-failures", 0, "How many times in a row connecting to the server may fail, retried with the -reconnect-min/-reconnect-max backoff, before the daemon exits, e.g. to be restarted by its supervisor with fresh DNS and credentials. 0 retries forever.")
+	format := flag.String("format", "json", fmt.Sprintf("Payload format of messages on -topic. Formats: %s.", strings.Join(formatNames(), ", ")))
+	downMatch := flag.String("down-match", "", "With the raw format, a regular expression matching payloads that report utility power down, e.g. '^ONBATT$'. Payloads are trimmed of surrounding whitespace first.")
+	recoveredMatch := flag.String("recovered-match", "", "With the raw format, a regular expression matching payloads that report utility power restored, e.g. '^ONLINE$'.")
+	var fieldMapSpecs stringsFlag
+	flag.Var(&fieldMapSpecs, "field-map", "With the mapped format, maps a field of the payload's own JSON schema to a power alarm field, given as FIELD=PATH, e.g. 'up=$.state.power_ok' or 'type=$.meta.source'. FIELD is up (or online), type, scope, battery, load, host, target, targets, phase, circuit or at; up must be mapped. May be given multiple times.")
+	protoDescriptor := flag.String("proto-descriptor", "", "With the protobuf format, a FileDescriptorSet describing the payload's message type, as written by 'protoc --include_imports --descriptor_set_out=FILE'.")
+	protoMessageName := flag.String("proto-message", "", "With the protobuf format, the full name of the payload's message type in -proto-descriptor, e.g. 'ups.v1.Status'. Its fields are mapped by -field-map, if given, or else must use the json format's field names; the decoded message is also available to expressions as msg.")
+	haOnIsDown := flag.Bool("ha-on-is-down", false, "With the homeassistant format, take an ON state to mean utility power is down, e.g. for a binary_sensor reporting that the UPS is on battery. By default ON means power is present.")
 	recoveryPeriod := flag.Duration("recovery-period", 3*time.Minute, "Duration to wait after utility power is lost before initiating shutdown.")
-	downExpr := flag.String("down-expr", "!online && powerType == 1", "CEL expression determining whether an event should trigger a shutdown.")
-	recoveredExpr := flag.String("recovered-expr", "online && powerType == 1", "CEL expression determining whether an event should cancel a pending shutdown.")
+	command := flag.String("command", "", "Command to run (via the shell) when -recovery-period elapses, instead of shutting down the host.")
+	cancelCommand := flag.String("cancel-command", "", "Command to run (via the shell) when -recovered-expr matches while the action is pending or after it has run, e.g. to undo -command.")
+	systemdUnit := flag.String("systemd-unit", "", "Linux only: systemd unit or target to start when -recovery-period elapses, instead of shutting down the host, e.g. 'power-fail.target'.")
+	systemdRecoveredUnit := flag.String("systemd-recovered-unit", "", "Linux only: systemd unit or target to start when -recovered-expr matches while the action is pending or after it has run, e.g. 'power-restored.target'.")
+	var powerOffFallbacks stringsFlag
+	flag.Var(&powerOffFallbacks, "poweroff-fallback", fmt.Sprintf("Command to run (via the shell) if 'shutdown -h now' still fails after retries; tried in order until one succeeds. 'sysrq' powers off via /proc/sysrq-trigger. May be given multiple times; 'none' disables fallbacks. Default: %s.", strings.Join(defaultPowerOffFallbacks, ", ")))
+	var stepSpecs stringsFlag
+	flag.Var(&stepSpecs, "step", "Additional command to run (via the shell) at an offset after a shutdown is armed, given as OFFSET:COMMAND, e.g. '2m:docker stop db'. Steps are cancelled along with the pending shutdown. May be given multiple times.")
+	downExpr := flag.String("down-expr", "!online && powerType == 1", exprLanguage+" expression determining whether an event should trigger a shutdown.")
+	recoveredExpr := flag.String("recovered-expr", "online && powerType == 1", exprLanguage+" expression determining whether an event should cancel a pending shutdown.")
+	downExprFile := flag.String("down-expr-file", "", "File containing -down-expr. It's watched for changes, and a changed expression is compiled and applied to subsequent events; if it doesn't compile, the error is logged and the running rule is kept.")
+	recoveredExprFile := flag.String("recovered-expr-file", "", "File containing -recovered-expr, watched like -down-expr-file.")
+	observe := flag.Duration("observe", 0, "Observation (canary) mode: for this long after startup, only log what would have been done, then report it. 0 disables.")
+	observeAutoEnable := flag.Bool("observe-auto-enable", false, "Enable real actions when the -observe period ends. Otherwise they are enabled by a {\"command\": \"confirm\"} message on -control-topic.")
+	observeReportTopic := flag.String("observe-report-topic", "", "MQTT topic to which the -observe report is published.")
+	observeReportURL := flag.String("observe-report-url", "", "URL to which the -observe report is POSTed as JSON.")
+	runtimeWindow := flag.Duration("runtime-window", 10*time.Minute, "Window of battery state of charge reports over which the discharge rate is fitted to estimate the remaining runtime.")
+	runtimeMargin := flag.Duration("runtime-margin", 0, "If set, move a pending shutdown up so it happens at least this long before the estimated battery runtime runs out. 0 disables.")
+	batteryArmBelow := flag.Float64("battery-arm-below", 0, "Hysteresis: only arm a shutdown when -down-expr matches and the battery state of charge is known and below this percentage. 0 disables.")
+	batteryRecoverAbove := flag.Float64("battery-recover-above", 0, "Hysteresis: only cancel a pending shutdown when -recovered-expr matches and the battery state of charge, if reported, is above this percentage. Should be set somewhat above -battery-arm-below. 0 disables.")
+	unreachableAfter := flag.Duration("unreachable-after", 0, "Alert once the broker, and every -redundant-server, has been unreachable this long, since this host then can't hear power alarms; a long outage often means the power is out too. 0 disables.")
+	unreachableCommand := flag.String("unreachable-command", "", "Shell command to run when -unreachable-after is exceeded.")
+	unreachableURL := flag.String("unreachable-url", "", "URL to which a JSON alert is POSTed when -unreachable-after is exceeded, and again when the broker is reachable again.")
+	unreachableShutdown := flag.Bool("unreachable-shutdown", false, "When -unreachable-after is exceeded, also arm a precautionary shutdown (after -recovery-period, as usual). It's cancelled if the broker is reachable again before it executes.")
+	coordinationTopic := flag.String("coordination-topic", "", "MQTT topic on which to publish this host's shutdown intent (pending, held, cancelled, executing) for peer coordination.")
+	coordinationTemplate := flag.String("coordination-template", "", "Go text/template for the payload published to -coordination-topic, replacing the default JSON; see -wall-template for the available fields.")
+	wall := flag.Bool("wall", false, "Unix only: broadcast each state change (pending, held, cancelled, executing) to logged-in users with wall(1), rendered with -wall-template.")
+	wallTemplate := flag.String("wall-template", defaultMessageTemplate, "Go text/template for -wall messages. Fields: .Hostname, .State, .Deadline (a time.Time), .Remaining, .Rule, .Source, .Reason, and the triggering message's .Online, .PowerType, .Scope, .Battery and .Load (-1 if unknown), or all of it as .Trigger.")
+	notifyURL := flag.String("notify-url", "", "URL to which each state change is POSTed as plain text rendered with -notify-template, e.g. an ntfy topic.")
+	notifyTemplate := flag.String("notify-template", defaultMessageTemplate, "Go text/template for -notify-url notifications; see -wall-template for the available fields.")
+	apiListen := flag.String("api-listen", "", "Address on which to serve the REST control API (e.g. '127.0.0.1:8472'): GET /state, GET /events, POST /trigger, POST /cancel.")
+	apiTokenFile := flag.String("api-token-file", "", "File containing the bearer token API requests must present. Required with -api-listen.")
+	tagSpec := flag.String("tags", "", "Tags describing this host, as comma-separated KEY=VALUE pairs, e.g. 'rack=2,tier=compute'. Messages with a \"targets\" selector (e.g. \"tier=compute,rack=2\") are ignored unless it matches these tags.")
+	phase := flag.String("phase", "", "The phase this host is supplied from, e.g. 'L1' or 'B'. Messages with scope '1p' naming another \"phase\" are ignored.")
+	circuit := flag.String("circuit", "", "The branch circuit this host is supplied from, e.g. '14'. Messages with scope '1c' naming another \"circuit\" are ignored.")
+	controlTopic := flag.String("control-topic", "", "MQTT topic on which to accept operator commands as JSON, e.g. {\"command\": \"hold\", \"duration\": \"10m\"} to pause a pending shutdown's countdown, {\"command\": \"resume\"}, or {\"command\": \"status\"}. An optional \"host\" limits a command to one host. Commands published with an MQTT v5 response topic are answered there, with the request's correlation data.")
+	var dependentTopics stringsFlag
+	flag.Var(&dependentTopics, "dependent-topic", "MQTT availability topic of a dependent host. Before powering off, wait until every dependent reports offline (or -dependents-timeout elapses). May be given multiple times.")
+	dependentsTimeout := flag.Duration("dependents-timeout", 5*time.Minute, "Maximum time to wait for dependent hosts to go offline before powering off.")
+	dependentOfflinePayload := flag.String("dependent-offline-payload", "offline", "Availability payload (or JSON \"status\" value) indicating a dependent host is offline. An empty payload also counts as offline.")
+	var relaySpecs stringsFlag
+	flag.Var(&relaySpecs, "relay", fmt.Sprintf("Relay mode: normalize messages on topics matching TOPIC_FILTER from FORMAT into the canonical schema and republish them to -relay-topic. Given as FORMAT:TOPIC_FILTER; may be given multiple times. Formats: %s.", strings.Join(formatNames(), ", ")))
+	relayTopic := flag.String("relay-topic", "", "MQTT topic to which normalized messages are published in relay mode.")
+	relayRetain := flag.Bool("relay-retain", false, "Publish normalized messages with the retain flag set.")
+	bridgeServer := flag.String("bridge-server", "", "Upstream MQTT server and port from which to bridge power topics to -server, e.g. 'cloud.example.com:8883'.")
+	bridgeTLS := flag.Bool("bridge-tls", false, "Connect to -bridge-server using TLS.")
+	bridgeUser := flag.String("bridge-user", "", "Upstream MQTT username.")
+	bridgePassword := flag.String("bridge-password", "", "Upstream MQTT password.")
+	var bridgeTopics stringsFlag
+	flag.Var(&bridgeTopics, "bridge-topic", "Upstream topic filter to bridge to the local broker. May be given multiple times.")
+	bridgePrefix := flag.String("bridge-prefix", "", "Prefix prepended to bridged topics on the local broker.")
+	bridgeRetain := flag.Bool("bridge-retain", true, "Publish bridged messages to the local broker with the retain flag set, so the last known state survives an upstream outage.")
+	nutServer := flag.String("nut-server", "", "NUT upsd server (host or host:port; default port 3493) to poll as an additional power event source.")
+	nutUPS := flag.String("nut-ups", "ups", "Name of the UPS on -nut-server.")
+	nutUser := flag.String("nut-user", "", "NUT username.")
+	nutPassword := flag.String("nut-password", "", "NUT password.")
+	nutInterval := flag.Duration("nut-interval", 10*time.Second, "How often to poll -nut-server.")
+	apcupsdServer := flag.String("apcupsd-server", "", "apcupsd Network Information Server (host or host:port; default port 3551) to poll as an additional power event source.")
+	apcupsdInterval := flag.Duration("apcupsd-interval", 10*time.Second, "How often to poll -apcupsd-server.")
+	cyberpower := flag.Bool("cyberpower", false, "Poll a local CyberPower PowerPanel daemon (pwrstatd) as an additional power event source.")
+	cyberpowerSocket := flag.String("cyberpower-socket", cyberpowerDefaultSocket, "pwrstatd IPC socket. If it can't be queried, 'pwrstat -status' is used instead.")
+	cyberpowerInterval := flag.Duration("cyberpower-interval", 10*time.Second, "How often to poll pwrstatd.")
+	modbusServer := flag.String("modbus-server", "", "Modbus TCP server (host or host:port; default port 502) to poll as an additional power event source.")
+	modbusUnit := flag.Uint("modbus-unit", 1, "Modbus unit (slave) ID.")
+	modbusGrid := flag.String("modbus-grid-register", "", "Register indicating grid presence, as TYPE:ADDRESS[:SCALE] where TYPE is 'h' (holding) or 'i' (input) and ADDRESS is zero-based, e.g. 'h:514:0.1'. Required with -modbus-server.")
+	modbusGridThreshold := flag.Float64("modbus-grid-threshold", 0, "Grid is considered present when the scaled grid register value exceeds this (e.g. a voltage).")
+	modbusSOC := flag.String("modbus-soc-register", "", "Optional register holding battery state of charge in percent, as TYPE:ADDRESS[:SCALE].")
+	modbusLoad := flag.String("modbus-load-register", "", "Optional register holding output load in percent, as TYPE:ADDRESS[:SCALE].")
+	modbusInterval := flag.Duration("modbus-interval", 10*time.Second, "How often to poll -modbus-server.")
+	gpioChip := flag.String("gpio-chip", "/dev/gpiochip0", "GPIO character device for -gpio-line.")
+	gpioLineNum := flag.Int("gpio-line", -1, "GPIO line offset indicating mains presence (active = power present), used as an additional power event source. Disabled if negative.")
+	gpioActiveLow := flag.Bool("gpio-active-low", false, "Treat -gpio-line as active-low (low = power present).")
+	gpioPullUp := flag.Bool("gpio-pull-up", false, "Enable the internal pull-up resistor on -gpio-line.")
+	gpioDebounce := flag.Duration("gpio-debounce", time.Second, "How long -gpio-line must hold a new state before it's reported.")
+	serialDevice := flag.String("serial-device", "", "Serial device of a directly attached Megatec/Q1 protocol UPS (e.g. /dev/ttyUSB0) to poll as an additional power event source.")
+	serialBaud := flag.Int("serial-baud", 2400, "Baud rate for -serial-device.")
+	serialInterval := flag.Duration("serial-interval", 5*time.Second, "How often to poll -serial-device.")
+	webhookListen := flag.String("webhook-listen", "", "Address on which to accept power events POSTed in -webhook-format (e.g. ':8470'), as an additional power event source.")
+	webhookPath := flag.String("webhook-path", "/event", "HTTP path for -webhook-listen.")
+	webhookFormat := flag.String("webhook-format", "json", fmt.Sprintf("Payload format of -webhook-listen request bodies. Formats: %s.", strings.Join(formatNames(), ", ")))
+	webhookTokenFile := flag.String("webhook-token-file", "", "File containing the bearer token webhook requests must present. Required with -webhook-listen.")
+	udpListen := flag.String("udp-listen", "", "Address on which to listen for power event datagrams, e.g. ':8471' for broadcast or '239.255.84.71:8471' to join a multicast group, as an additional power event source. Datagrams are not authenticated.")
+	udpFormat := flag.String("udp-format", "json", fmt.Sprintf("Payload format of -udp-listen datagrams. Formats: %s.", strings.Join(formatNames(), ", ")))
+	triggerFile := flag.String("trigger-file", "", "File or named pipe (e.g. /run/powerfail) whose contents are treated as power events, as an additional power event source.")
+	triggerDown := flag.String("trigger-down-content", "down", "-trigger-file content indicating utility power is down.")
+	triggerUp := flag.String("trigger-up-content", "up", "-trigger-file content indicating utility power is up.")
+	sourceRelayTopic := flag.String("source-relay-topic", "", "MQTT topic to which events from non-MQTT sources (NUT, CyberPower, Modbus, GPIO, serial, webhook, ...) are published in the canonical schema.")
+	producer := flag.Bool("producer", false, "Producer mode: publish events from local sources (NUT, apcupsd, serial, ...) to -source-relay-topic without acting on them; this host is never shut down.")
+	sourceRelayRetain := flag.Bool("source-relay-retain", true, "Publish -source-relay-topic messages with the retain flag set.")
+	wakeAfter := flag.Duration("wake-after", 0, "If set, program the RTC wake alarm to power the host back on this long after a shutdown initiated by mqttshutdownd (e.g. '12h'). Linux only.")
+	rtcDevice := flag.String("rtc-device", "rtc0", "RTC device (under /sys/class/rtc) used for -wake-after.")
+	stateDir := flag.String("state-dir", "/var/lib/mqttshutdownd", "Directory in which to persist state across restarts and reboots. Set to '' to disable.")
+	journalEnabled := flag.Bool("journal", false, "Durably record received events, rule evaluations, and actions in an SQLite database in -state-dir (JSON lines in minimal builds), for post-incident review. Queryable via GET /journal on -api-listen.")
+	journalRetention := flag.Duration("journal-retention", 30*24*time.Hour, "How long to keep -journal entries.")
+	chaosSpec := flag.String("chaos", "", "Test mode: inject faults, given as comma-separated FAULT=INTERVAL pairs (disconnect, delay, duplicate, malformed; and max-delay), e.g. 'disconnect=10m,delay=2m'. For use against a staging broker only.")
+	debugListen := flag.String("debug-listen", "", "Address on which to serve net/http/pprof profiles under /debug/pprof/ and expvar variables at /debug/vars, e.g. '127.0.0.1:6060', for profiling in the field. Must be a loopback address unless -debug-token-file is set.")
+	debugTokenFile := flag.String("debug-token-file", "", "File containing a bearer token requests to -debug-listen must present.")
+	snapshotFile := flag.String("snapshot-file", "", "File to which a JSON snapshot of the complete runtime state (connection, rules, pending action and steps, recent events, configuration hash) is written on SIGUSR1. Defaults to snapshot.json in -state-dir, or a file in the temporary directory. Also available via GET /snapshot on -api-listen.")
+	statusTopic := flag.String("status-topic", "", "MQTT topic on which to publish this daemon's status, retained: {\"status\": \"online\"}, with the version, -topic, -recovery-period and named rules, whenever it connects, and {\"status\": \"offline\"} when it exits or, as its MQTT will, when the broker loses the connection to it. E.g. 'mqttshutdownd/status/{hostname}'.")
+	bootTopic := flag.String("boot-topic", "", "MQTT topic on which to announce, once per boot, that this host is back up, how long it was down, and whether (and why) mqttshutdownd shut it down. Requires -state-dir.")
 	debug := flag.Bool("debug", false, "Enable debug-level logging.")
-	strict := flag.Bool("strict", false, "Exit on invalid messages or unexpected topics.")
+	eventLogEnabled := flag.Bool("eventlog", false, "Windows only: also write pending action state changes, warnings, and errors to the Application event log, as source 'mqttshutdownd'.")
+	colorMode := flag.String("color", "auto", fmt.Sprintf("Leveled, colorized console output: %s. 'auto' enables it only when stderr is a terminal.", strings.Join(colorModes, ", ")))
+	strict := flag.Bool("strict", false, "Exit on invalid messages or unexpected topics. JSON messages are also rejected if they're missing \"up\" or \"type\", or have unknown, repeated, null, mistyped, or out-of-range fields.")
 	printVersion := flag.Bool("version", false, "Print version, then exit.")
+	check := flag.Bool("check", false, "Validate the flags, -config and environment, compile -down-expr and -recovered-expr, and resolve -server, then exit 0 if all is well and non-zero otherwise, without connecting; e.g. for CI or a systemd ExecStartPre=.")
+	checkConnect := flag.Bool("check-connect", false, "With -check, also connect to the broker and subscribe to each topic.")
+	configFile := flag.String("config", "", "YAML (.yaml, .yml) or TOML (.toml) file of settings, keyed by flag name, e.g. 'server: mymqttserver.lan:1883'. Flags given on the command line or in the environment override it. Lists set flags that may be given multiple times. Additional named rules, each evaluated against the messages on its own topic with its own expressions, recovery period and action, may be declared under 'rules', e.g. 'rules.rack2.topic', with the settings topic, down-expr, recovered-expr, recovery-period, command, cancel-command, systemd-unit and systemd-recovered-unit; each one left out defaults to the flag of the same name. On SIGHUP, the file and -config-dir are re-read and changes to -down-expr, -recovered-expr, -recovery-period and -topic are applied without reconnecting.")
+	configDir := flag.String("config-dir", "", "conf.d-style directory of further -config files (*.yaml, *.yml, *.toml), e.g. '/etc/mqttshutdownd/conf.d', read after -config in lexical order of their names; a setting in a later file replaces the same setting in an earlier one.")
 	helpSystemdUsage := flag.Bool("help-systemd-usage", false, "Print instructions on configuring the systemd unit, then exit.")
+	registerFlagAliases(flag.CommandLine)
 	flag.Usage = usage
-	flag.Parse()
+
+	if len(os.Args) > 1 && os.Args[1] == "setup" {
+		os.Exit(runSetup())
+	}
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		if len(os.Args) != 3 {
+			invalidArgument(fmt.Sprintf("Usage: %s completion %s", name, strings.Join(completionShells, "|")))
+		}
+		if err := writeCompletion(os.Stdout, os.Args[2], flag.CommandLine); err != nil {
+			invalidArgument(err)
+		}
+		os.Exit(0)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "genconfig" {
+		os.Exit(runGenconfig(os.Args[2:], flag.CommandLine))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		if err := writeSchema(os.Stdout); err != nil {
+			log.Fatalf("failed to write schema: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	doctor := len(os.Args) > 1 && os.Args[1] == "doctor"
+	verifyBroker := len(os.Args) > 1 && os.Args[1] == "verify-broker"
+	if doctor || verifyBroker {
+		_ = flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+	if err := loadEnvConfig(flag.CommandLine); err != nil {
+		invalidArgument(err)
+	}
+	// flags given on the command line or in the environment; a reload of
+	// -config leaves them alone:
+	fixedFlags := explicitFlags(flag.CommandLine)
+	var (
+		configVals  configValues
+		ruleConfigs []ruleConfig
+	)
+	if *configFile != "" || *configDir != "" {
+		var (
+			flagVals configValues
+			err      error
+		)
+		if configVals, err = readConfig(*configFile, *configDir); err == nil {
+			ruleConfigs, flagVals, err = splitRuleConfigs(configVals)
+		}
+		if err == nil {
+			err = applyConfigValues(flag.CommandLine, flagVals, configSourceName(*configFile, *configDir))
+		}
+		if err != nil {
+			invalidArgument(fmt.Sprintf("invalid -config or -config-dir: %s", err))
+		}
+	}
+
+	if err := SetupConsoleLogging(*colorMode); err != nil {
+		invalidArgument(fmt.Sprintf("invalid -color: %s", err))
+	}
+	var sysLog eventLog
+	if *eventLogEnabled {
+		var err error
+		if sysLog, err = openEventLog(name); err != nil {
+			invalidArgument(fmt.Sprintf("invalid -eventlog: %s", err))
+		}
+		defer sysLog.Close() //nolint:errcheck
+		log.SetOutput(io.MultiWriter(log.Writer(), eventLogWriter{Log: sysLog}))
+	}
 
 	if *printVersion {
-		fmt.Printf("%s %s\n", name, version)
+		if minimalBuild {
+			fmt.Printf("%s %s (minimal)\n", name, version)
+		} else {
+			fmt.Printf("%s %s\n", name, version)
+		}
 		os.Exit(0)
 	}
 
@@ -77,6 +336,22 @@ func main() {
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "(Both ExecStart= lines are required; see https://stackoverflow.com/a/68818218 )")
 		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Alternatively, put the settings in a file, e.g. /etc/mqttshutdownd.yaml:")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "  server: mymqttserver.lan:1883")
+		fmt.Fprintln(os.Stderr, "  topic: power/alarms")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "and point ExecStart at it with -config:")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "  ExecStart=/usr/bin/mqttshutdownd -config /etc/mqttshutdownd.yaml")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Add -config-dir /etc/mqttshutdownd/conf.d to also read the files in that directory, in lexical order, so settings and rules can be layered without editing one file.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "To keep the MQTT password out of the unit file and the environment, pass it as a systemd credential:")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "  LoadCredential=mqtt-pass:/etc/mqttshutdownd/password")
+		fmt.Fprintln(os.Stderr, "  ExecStart=/usr/bin/mqttshutdownd -config /etc/mqttshutdownd.yaml -password-credential mqtt-pass")
+		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "After saving and closing the editor, reload systemd and restart the service:")
 		fmt.Fprintln(os.Stderr, "")
 		fmt.Fprintln(os.Stderr, "  sudo systemctl daemon-reload")
@@ -84,169 +359,1145 @@ func main() {
 		os.Exit(6) // EXIT_NOTCONFIGURED
 	}
 
-	if *topic == "" {
-		fmt.Fprintln(os.Stderr, "-topic is required.")
-		fmt.Fprintln(os.Stderr, "")
-		usage()
-		os.Exit(2) // EXIT_INVALIDARGUMENT
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("failed to get hostname: %s", err)
 	}
-	if *server == "" {
-		fmt.Fprintln(os.Stderr, "-server is required.")
-		fmt.Fprintln(os.Stderr, "")
-		usage()
-		os.Exit(2) // EXIT_INVALIDARGUMENT
+	tags, err := parseTags(*tagSpec)
+	if err != nil {
+		invalidArgument(fmt.Sprintf("invalid -tags: %s", err))
 	}
-	if *sessionExpiryS < 0 {
-		fmt.Fprintln(os.Stderr, "-session-expiry must be an unsigned 32 bit integer.")
-		fmt.Fprintln(os.Stderr, "")
-		usage()
-		os.Exit(2) // EXIT_INVALIDARGUMENT
+	topicVars, err := parseTopicVars(topicVarSpecs, hostname)
+	if err != nil {
+		invalidArgument(err)
+	}
+	for flagName, t := range map[string]*string{
+		"coordination-topic": coordinationTopic,
+		"control-topic":      controlTopic,
+		"relay-topic":        relayTopic,
+		"bridge-prefix":      bridgePrefix,
+		"source-relay-topic": sourceRelayTopic,
+		"boot-topic":         bootTopic,
+		"status-topic":       statusTopic,
+	} {
+		if *t, err = expandTopic(*t, topicVars); err != nil {
+			invalidArgument(fmt.Sprintf("invalid -%s: %s", flagName, err))
+		}
+	}
+	for flagName, ts := range map[string]stringsFlag{
+		"topic":           topics,
+		"dependent-topic": dependentTopics,
+		"bridge-topic":    bridgeTopics,
+		"relay":           relaySpecs,
+	} {
+		for i := range ts {
+			if ts[i], err = expandTopic(ts[i], topicVars); err != nil {
+				invalidArgument(fmt.Sprintf("invalid -%s: %s", flagName, err))
+			}
+		}
 	}
 
-	strictLog := StrictLogger(*strict)
-	debugLog := DebugLogger(*debug)
-
-	const (
-		celVarPowerType = "powerType"
-		celVarOnline    = "online"
-		celVarScope     = "scope"
-	)
-	celEnv, err := cel.NewEnv(
-		cel.Variable(celVarPowerType, cel.IntType),
-		cel.Variable(celVarOnline, cel.BoolType),
-		cel.Variable(celVarScope, cel.StringType),
-	)
+	formatOpts := formatOptions{HomeAssistantOnIsDown: *haOnIsDown}
+	if err := compileRawPatterns(&formatOpts, *downMatch, *recoveredMatch); err != nil {
+		invalidArgument(err.Error())
+	}
+	if formatOpts.FieldMappings, err = parseFieldMappings(fieldMapSpecs); err != nil {
+		invalidArgument(err.Error())
+	}
+	if *protoDescriptor != "" || *protoMessageName != "" {
+		if minimalBuild {
+			invalidArgument("-proto-descriptor is not supported in minimal builds.")
+		}
+		if formatOpts.Proto, err = loadProtoDescriptor(*protoDescriptor, *protoMessageName); err != nil {
+			invalidArgument(err.Error())
+		}
+		if *format != protobufFormat {
+			invalidArgument("-proto-descriptor and -proto-message require -format protobuf.")
+		}
+	}
+	decode, err := newStrictNormalizer(*format, *strict, formatOpts)
 	if err != nil {
-		log.Fatalf("failed to create CEL environment: %s", err)
+		invalidArgument(fmt.Sprintf("invalid -format: %s", err))
+	}
+
+	var relayRoutes []relayRoute
+	for _, spec := range relaySpecs {
+		r, err := parseRelayRoute(spec, formatOpts)
+		if err != nil {
+			invalidArgument(err)
+		}
+		relayRoutes = append(relayRoutes, r)
+	}
+	if len(relayRoutes) > 0 && *relayTopic == "" {
+		invalidArgument("-relay-topic is required when using -relay.")
+	}
+
+	if *bridgeServer != "" && len(bridgeTopics) == 0 {
+		invalidArgument("-bridge-topic is required when using -bridge-server.")
+	}
+
+	var sources []eventSource
+	if *nutServer != "" {
+		sources = append(sources, &nutSource{
+			Addr:     *nutServer,
+			UPS:      *nutUPS,
+			Username: *nutUser,
+			Password: *nutPassword,
+			Interval: *nutInterval,
+		})
+	}
+	if *apcupsdServer != "" {
+		sources = append(sources, &apcupsdSource{
+			Addr:     *apcupsdServer,
+			Interval: *apcupsdInterval,
+		})
+	}
+	if *cyberpower {
+		sources = append(sources, &cyberpowerSource{
+			Socket:   *cyberpowerSocket,
+			Interval: *cyberpowerInterval,
+		})
+	}
+	if *modbusServer != "" {
+		if *modbusUnit > 255 {
+			invalidArgument("-modbus-unit must be between 0 and 255.")
+		}
+		grid, err := parseModbusRegister(*modbusGrid)
+		if err != nil {
+			invalidArgument(err)
+		}
+		src := &modbusSource{
+			Addr:          *modbusServer,
+			Unit:          byte(*modbusUnit),
+			Grid:          grid,
+			GridThreshold: *modbusGridThreshold,
+			Interval:      *modbusInterval,
+		}
+		if *modbusSOC != "" {
+			r, err := parseModbusRegister(*modbusSOC)
+			if err != nil {
+				invalidArgument(err)
+			}
+			src.SOC = &r
+		}
+		if *modbusLoad != "" {
+			r, err := parseModbusRegister(*modbusLoad)
+			if err != nil {
+				invalidArgument(err)
+			}
+			src.Load = &r
+		}
+		sources = append(sources, src)
+	}
+
+	if *gpioLineNum >= 0 {
+		sources = append(sources, &gpioSource{
+			Chip:      *gpioChip,
+			Line:      *gpioLineNum,
+			ActiveLow: *gpioActiveLow,
+			PullUp:    *gpioPullUp,
+			Debounce:  *gpioDebounce,
+			Interval:  gpioPollInterval,
+		})
+	}
+
+	if *serialDevice != "" {
+		sources = append(sources, &megatecSource{
+			Device:   *serialDevice,
+			Baud:     *serialBaud,
+			Interval: *serialInterval,
+		})
+	}
+
+	if minimalBuild {
+		for _, f := range []string{"debug-listen", "api-listen", "webhook-listen", "vault-addr", "vault-secret-path"} {
+			if flag.Lookup(f).Value.String() != "" {
+				invalidArgument(fmt.Sprintf("-%s is not supported in minimal builds.", f))
+			}
+		}
+	}
+
+	var apiToken string
+	if *apiListen != "" {
+		if *apiTokenFile == "" {
+			invalidArgument("-api-token-file is required when using -api-listen.")
+		}
+		b, err := os.ReadFile(*apiTokenFile)
+		if err != nil {
+			log.Fatalf("failed to read -api-token-file: %s", err)
+		}
+		apiToken = strings.TrimSpace(string(b))
+		if apiToken == "" {
+			log.Fatalf("-api-token-file '%s' is empty", *apiTokenFile)
+		}
 	}
-	downExprAst, iss := celEnv.Compile(*downExpr)
-	if iss.Err() != nil {
-		log.Fatalf("failed to compile -down-expr '%s': %s", *downExpr, iss.Err())
+
+	if *webhookListen != "" {
+		if *webhookTokenFile == "" {
+			invalidArgument("-webhook-token-file is required when using -webhook-listen.")
+		}
+		b, err := os.ReadFile(*webhookTokenFile)
+		if err != nil {
+			log.Fatalf("failed to read -webhook-token-file: %s", err)
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			log.Fatalf("-webhook-token-file '%s' is empty", *webhookTokenFile)
+		}
+		n, err := newStrictNormalizer(*webhookFormat, *strict, formatOpts)
+		if err != nil {
+			invalidArgument(fmt.Sprintf("invalid -webhook-format: %s", err))
+		}
+		sources = append(sources, &webhookSource{
+			Listen:    *webhookListen,
+			Path:      *webhookPath,
+			Token:     token,
+			Normalize: n,
+		})
 	}
-	if downExprAst.OutputType() != cel.BoolType {
-		log.Fatalf("-down-expr '%s' does not return a boolean", *recoveredExpr)
+
+	if *udpListen != "" {
+		n, err := newStrictNormalizer(*udpFormat, *strict, formatOpts)
+		if err != nil {
+			invalidArgument(fmt.Sprintf("invalid -udp-format: %s", err))
+		}
+		sources = append(sources, &udpSource{
+			Listen:    *udpListen,
+			Format:    *udpFormat,
+			Normalize: n,
+		})
+	}
+
+	if *triggerFile != "" {
+		sources = append(sources, &triggerFileSource{
+			Path:        *triggerFile,
+			DownContent: *triggerDown,
+			UpContent:   *triggerUp,
+		})
+	}
+
+	if *producer {
+		if len(sources) == 0 {
+			invalidArgument("-producer requires at least one local event source.")
+		}
+		if *sourceRelayTopic == "" {
+			invalidArgument("-source-relay-topic is required when using -producer.")
+		}
+		if len(topics) > 0 || len(ruleConfigs) > 0 {
+			invalidArgument("-producer and -topic (or rules in -config) are mutually exclusive.")
+		}
+		if *controlTopic != "" {
+			invalidArgument("-producer and -control-topic are mutually exclusive.")
+		}
+		if *observe > 0 {
+			invalidArgument("-producer and -observe are mutually exclusive.")
+		}
+		if *apiListen != "" {
+			invalidArgument("-producer and -api-listen are mutually exclusive.")
+		}
 	}
-	downExprPrg, err := celEnv.Program(downExprAst)
+	if len(topics) == 0 && len(ruleConfigs) == 0 && len(relayRoutes) == 0 && *bridgeServer == "" && len(sources) == 0 {
+		invalidArgument("-topic is required.")
+	}
+	if *server == "" {
+		invalidArgument("-server is required.")
+	}
+	parsedServer, err := parseBrokerServer(*server)
 	if err != nil {
-		log.Fatalf("failed to generate program for -down-expr '%s': %s", *downExpr, err)
+		invalidArgument(fmt.Sprintf("invalid -server: %s", err))
+	}
+	*useTLS = *useTLS || parsedServer.TLS || *tlsCA != "" || *tlsSkipVerify
+	if parsedServer.Socket != "" {
+		if *useTLS {
+			invalidArgument("-tls, -tls-ca and -tls-skip-verify can't be used with a unix:// -server.")
+		}
+		if os.Getenv("all_proxy") != "" {
+			invalidArgument("a unix:// -server can't be used with a proxy set in $all_proxy.")
+		}
 	}
-	recoveredExprAst, iss := celEnv.Compile(*recoveredExpr)
-	if iss.Err() != nil {
-		log.Fatalf("failed to compile -recovered-expr '%s': %s", *recoveredExpr, iss.Err())
+	if *subscribeRetainHandling > 2 {
+		invalidArgument("-subscribe-retain-handling must be 0, 1, or 2.")
 	}
-	if recoveredExprAst.OutputType() != cel.BoolType {
-		log.Fatalf("-recovered-expr '%s' does not return a boolean", *recoveredExpr)
+	subOpts := subscribeOptions{
+		NoLocal:           *subscribeNoLocal,
+		RetainHandling:    byte(*subscribeRetainHandling),
+		RetainAsPublished: *subscribeRetainAsPublished,
+		ShareGroup:        *shareGroup,
 	}
-	recoveredExprPrg, err := celEnv.Program(recoveredExprAst)
+	retainedPol, err := parseRetainedPolicy(*retained)
 	if err != nil {
-		log.Fatalf("failed to generate program for -recovered-expr '%s': %s", *recoveredExpr, err)
+		invalidArgument(fmt.Sprintf("invalid -retained: %s", err))
+	}
+	if !retainedPol.Honors() && *subscribeRetainAsPublished {
+		invalidArgument("-subscribe-retain-as-published can't be used with -retained " + *retained + ": messages published live would look retained.")
+	}
+	if *shareGroup != "" {
+		if strings.ContainsAny(*shareGroup, "/+#") {
+			invalidArgument("-share-group must not contain '/', '+' or '#'.")
+		}
+		if *subscribeNoLocal {
+			invalidArgument("-subscribe-no-local can't be used with -share-group.")
+		}
+		if len(topics) > 0 {
+			log.Printf("[WARN] -share-group is set: each message on -topic is delivered to only one host in group '%s', and only that host will shut down", *shareGroup)
+		}
+	}
+	if len(redundantServers) > 0 && len(topics) == 0 {
+		invalidArgument("-topic is required when using -redundant-server.")
+	}
+	if *redundantDedupWin <= 0 {
+		invalidArgument("-redundant-dedup-window must be positive.")
+	}
+	switch *mqttVersion {
+	case mqttVersion5:
+	case mqttVersion311:
+		if subOpts.NoLocal || subOpts.RetainHandling != 0 || subOpts.RetainAsPublished {
+			invalidArgument("-subscribe-no-local, -subscribe-retain-handling and -subscribe-retain-as-published require -mqtt-version 5.")
+		}
+		if os.Getenv("all_proxy") != "" {
+			invalidArgument("-mqtt-version 3.1.1 can't be used with a proxy set in $all_proxy.")
+		}
+	default:
+		invalidArgument(fmt.Sprintf("-mqtt-version must be %s or %s.", mqttVersion5, mqttVersion311))
+	}
+	if sessionExpiry < 0 || sessionExpiry.Seconds() > math.MaxUint32 {
+		invalidArgument(fmt.Sprintf("-session-expiry must be between 0 and %d seconds.", uint32(math.MaxUint32)))
+	}
+	if keepAlive < 0 || keepAlive.Seconds() > math.MaxUint16 {
+		invalidArgument(fmt.Sprintf("-keepalive must be between 0 and %d seconds.", math.MaxUint16))
+	}
+	if *reconnectMin <= 0 {
+		invalidArgument("-reconnect-min must be positive.")
+	}
+	if *reconnectMax < *reconnectMin {
+		invalidArgument("-reconnect-max must not be less than -reconnect-min.")
+	}
+	for _, d := range []struct {
+		flag string
+		val  time.Duration
+	}{
+		{"vault-refresh", *vaultRefresh},
+		{"nut-interval", *nutInterval},
+		{"apcupsd-interval", *apcupsdInterval},
+		{"cyberpower-interval", *cyberpowerInterval},
+		{"modbus-interval", *modbusInterval},
+		{"serial-interval", *serialInterval},
+	} {
+		if d.val <= 0 {
+			invalidArgument(fmt.Sprintf("-%s must be positive.", d.flag))
+		}
+	}
+	if *recoveryPeriod < 0 {
+		invalidArgument("-recovery-period must not be negative.")
+	}
+	if *dependentsTimeout < 0 {
+		invalidArgument("-dependents-timeout must not be negative.")
+	}
+	if *gpioDebounce < 0 {
+		invalidArgument("-gpio-debounce must not be negative.")
+	}
+	var steps []Step
+	for _, spec := range stepSpecs {
+		step, err := parseStep(spec)
+		if err != nil {
+			invalidArgument(err)
+		}
+		if step.Offset > *recoveryPeriod {
+			invalidArgument(fmt.Sprintf("-step '%s' is scheduled after -recovery-period (%s).", spec, *recoveryPeriod))
+		}
+		steps = append(steps, step)
+	}
+	var namedRules []namedRule
+	for _, rc := range ruleConfigs {
+		r, err := newNamedRule(rc, flag.CommandLine, topicVars)
+		if err != nil {
+			invalidArgument(fmt.Sprintf("invalid -config: %s", err))
+		}
+		namedRules = append(namedRules, r)
+	}
+	if *wakeAfter < 0 {
+		invalidArgument("-wake-after must not be negative.")
+	}
+	if len(powerOffFallbacks) == 0 {
+		powerOffFallbacks = defaultPowerOffFallbacks
+	} else if slices.Contains(powerOffFallbacks, "none") {
+		powerOffFallbacks = nil
+	}
+	if (*systemdUnit != "" || *systemdRecoveredUnit != "") && runtime.GOOS != "linux" {
+		invalidArgument("-systemd-unit and -systemd-recovered-unit are only supported on Linux.")
+	}
+	if *systemdUnit != "" && *command != "" {
+		invalidArgument("-systemd-unit and -command are mutually exclusive.")
+	}
+	if *wall && runtime.GOOS == "windows" {
+		invalidArgument("-wall is not supported on Windows.")
+	}
+	var coordinationTmpl, wallTmpl, notifyTmpl *template.Template
+	for _, t := range []struct {
+		flag, text string
+		tmpl       **template.Template
+	}{
+		{"coordination-template", *coordinationTemplate, &coordinationTmpl},
+		{"wall-template", *wallTemplate, &wallTmpl},
+		{"notify-template", *notifyTemplate, &notifyTmpl},
+	} {
+		if t.text == "" {
+			continue
+		}
+		var err error
+		if *t.tmpl, err = parseMessageTemplate(t.flag, t.text); err != nil {
+			invalidArgument(fmt.Sprintf("invalid -%s: %s", t.flag, err))
+		}
+	}
+	var debugToken string
+	if *debugTokenFile != "" {
+		b, err := os.ReadFile(*debugTokenFile)
+		if err != nil {
+			log.Fatalf("failed to read -debug-token-file: %s", err)
+		}
+		debugToken = strings.TrimSpace(string(b))
+		if debugToken == "" {
+			log.Fatalf("-debug-token-file '%s' is empty", *debugTokenFile)
+		}
+	}
+	if *debugListen != "" && debugToken == "" && !loopbackListenAddress(*debugListen) {
+		invalidArgument("-debug-listen must be a loopback address, e.g. '127.0.0.1:6060', unless -debug-token-file is set.")
+	}
+	var chaos *chaosMonkey
+	if *chaosSpec != "" {
+		if chaos, err = parseChaos(*chaosSpec); err != nil {
+			invalidArgument(fmt.Sprintf("invalid -chaos: %s", err))
+		}
+		if *command == "" && *systemdUnit == "" && *observe == 0 {
+			invalidArgument("-chaos requires -command, -systemd-unit, or -observe, so it can't power off the host.")
+		}
+	}
+	if *unreachableAfter < 0 {
+		invalidArgument("-unreachable-after must not be negative.")
+	}
+	if *unreachableAfter == 0 && (*unreachableCommand != "" || *unreachableURL != "" || *unreachableShutdown) {
+		invalidArgument("-unreachable-command, -unreachable-url, and -unreachable-shutdown require -unreachable-after.")
+	}
+	if *runtimeWindow < runtimeMinSpan {
+		invalidArgument(fmt.Sprintf("-runtime-window must be at least %s.", runtimeMinSpan))
+	}
+	if *runtimeMargin < 0 {
+		invalidArgument("-runtime-margin must not be negative.")
+	}
+	if *journalRetention <= 0 {
+		invalidArgument("-journal-retention must be positive.")
+	}
+	if *observe < 0 {
+		invalidArgument("-observe must not be negative.")
+	}
+	if *observe > 0 && !*observeAutoEnable && *controlTopic == "" {
+		invalidArgument("-control-topic is required to confirm the end of -observe unless -observe-auto-enable is used.")
+	}
+	if *batteryArmBelow < 0 || *batteryArmBelow > 100 {
+		invalidArgument("-battery-arm-below must be a percentage between 0 and 100.")
+	}
+	if *batteryRecoverAbove < 0 || *batteryRecoverAbove > 100 {
+		invalidArgument("-battery-recover-above must be a percentage between 0 and 100.")
+	}
+	if *batteryArmBelow > 0 && *batteryRecoverAbove > 0 && *batteryRecoverAbove < *batteryArmBelow {
+		invalidArgument("-battery-recover-above must not be below -battery-arm-below.")
 	}
 
-	serverURL, err := url.Parse(fmt.Sprintf("mqtt://%s", *server))
-	if err != nil {
-		log.Fatalf("failed to parse server URL 'mqtt://%s': %s", *server, err)
+	for _, c := range []struct {
+		flag, fileFlag, name string
+		file                 *string
+	}{
+		{"user-credential", "user-file", *userCredential, userFile},
+		{"password-credential", "password-file", *passwordCredential, passwordFile},
+	} {
+		if c.name == "" {
+			continue
+		}
+		if *c.file != "" {
+			invalidArgument(fmt.Sprintf("-%s and -%s are mutually exclusive.", c.flag, c.fileFlag))
+		}
+		if *c.file, err = systemdCredentialPath(c.name); err != nil {
+			log.Fatalf("invalid -%s: %s", c.flag, err)
+		}
+	}
+	if *userFile != "" {
+		if *user != "" {
+			invalidArgument("-user and -user-file are mutually exclusive.")
+		}
+		if *user, err = readCredentialFile(*userFile); err != nil {
+			log.Fatalf("invalid -user-file: %s", err)
+		}
+	}
+	if *passwordFile != "" && (*password != "" || *passwordKeyring) {
+		invalidArgument("-password, -password-file and -password-keyring are mutually exclusive.")
+	}
+	if *credentialsCmd != "" && (*password != "" || *passwordFile != "" || *passwordKeyring) {
+		invalidArgument("-credentials-cmd can't be used with -password, -password-file or -password-keyring.")
+	}
+	// $VAULT_ADDR, which may be set for other tools, only applies once Vault is asked for:
+	if *vaultSecretPath != "" && *vaultAddr == "" {
+		*vaultAddr = os.Getenv("VAULT_ADDR")
+	}
+	if *vaultAddr != "" && (*password != "" || *passwordFile != "" || *passwordKeyring || *credentialsCmd != "") {
+		invalidArgument("-vault-* can't be used with -password, -password-file, -password-keyring or -credentials-cmd.")
+	}
+	if *passwordKeyring {
+		if *password != "" {
+			invalidArgument("-password and -password-keyring are mutually exclusive.")
+		}
+		pw, err := keyringPassword(name, keyringAccount(*user))
+		if err != nil {
+			log.Fatalf("failed to read password from OS keyring: %s", err)
+		}
+		*password = pw
 	}
 
-	hostname, err := os.Hostname()
+	if (*tlsCert == "") != (*tlsKey == "") {
+		invalidArgument("-tls-cert and -tls-key must be used together.")
+	}
+
+	if *vaultAddr != "" && *vaultSecretPath == "" {
+		invalidArgument("-vault-secret-path is required when using Vault.")
+	}
+	if *vaultSecretPath != "" && *vaultAddr == "" {
+		invalidArgument("-vault-secret-path requires -vault-addr or $VAULT_ADDR.")
+	}
+
+	setFlags := explicitFlags(flag.CommandLine)
+	for _, f := range []struct {
+		flag string
+		path string
+		expr *string
+	}{
+		{"down-expr", *downExprFile, downExpr},
+		{"recovered-expr", *recoveredExprFile, recoveredExpr},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if setFlags[f.flag] {
+			invalidArgument(fmt.Sprintf("-%s and -%s-file are mutually exclusive.", f.flag, f.flag))
+		}
+		if *f.expr, err = readExprFile(f.path); err != nil {
+			log.Fatalf("invalid -%s-file: %s", f.flag, err)
+		}
+		// the file, not -config, determines the expression from now on:
+		fixedFlags[f.flag] = true
+	}
+
+	strictLog := StrictLogger(*strict)
+	debugLog := DebugLogger(*debug)
+
+	rules, err := newExprCache(formatOpts.Proto)
 	if err != nil {
-		log.Fatalf("failed to get hostname: %s", err)
+		log.Fatalf("%s", err)
+	}
+	downExprPrg, err := rules.Compile(*downExpr)
+	if err != nil {
+		log.Fatalf("invalid -down-expr: %s", err)
+	}
+	recoveredExprPrg, err := rules.Compile(*recoveredExpr)
+	if err != nil {
+		log.Fatalf("invalid -recovered-expr: %s", err)
+	}
+	if err := checkEvaluates(downExprPrg); err != nil {
+		log.Fatalf("invalid -down-expr: %s", err)
+	}
+	if err := checkEvaluates(recoveredExprPrg); err != nil {
+		log.Fatalf("invalid -recovered-expr: %s", err)
+	}
+	for i := range namedRules {
+		if err := namedRules[i].Compile(rules); err != nil {
+			log.Fatalf("%s", err)
+		}
 	}
-	clientID := fmt.Sprintf("%s/%s", hostname, name)
-	log.Printf("generated client ID: %s", clientID)
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	receivedMessages := make(chan paho.PublishReceived)
-	go func(ctx context.Context) {
-		var (
-			t   *time.Timer
-			tMu sync.Mutex
-		)
-		for {
-			select {
-			case <-ctx.Done():
+	creds := &brokerCredentials{UserFile: *userFile, PasswordFile: *passwordFile, Command: *credentialsCmd}
+	creds.Set(*user, []byte(*password))
+	if err := creds.LoadFiles(); err != nil {
+		log.Fatalf("invalid -password-file: %s", err)
+	}
+	if err := creds.LoadCommand(); err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	var (
+		vault  *vaultClient
+		secret vaultSecret
+	)
+	if *vaultAddr != "" {
+		token := os.Getenv("VAULT_TOKEN")
+		if *vaultTokenFile != "" {
+			b, err := os.ReadFile(*vaultTokenFile)
+			if err != nil {
+				log.Fatalf("failed to read -vault-token-file: %s", err)
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		secretID := ""
+		if *vaultSecretIDFile != "" {
+			b, err := os.ReadFile(*vaultSecretIDFile)
+			if err != nil {
+				log.Fatalf("failed to read -vault-secret-id-file: %s", err)
+			}
+			secretID = strings.TrimSpace(string(b))
+		}
+		vault = newVaultClient(*vaultAddr, token, *vaultRoleID, secretID)
+		if err := vault.Login(ctx); err != nil {
+			log.Fatalf("vault: %s", err)
+		}
+		secret, err = vault.ReadSecret(ctx, *vaultSecretPath)
+		if err != nil {
+			log.Fatalf("vault: failed to read secret '%s': %s", *vaultSecretPath, err)
+		}
+		if secret.Username != "" || secret.Password != "" {
+			creds.Set(secret.Username, []byte(secret.Password))
+		}
+		log.Printf("read broker credentials from Vault secret '%s'", *vaultSecretPath)
+	}
+
+	var (
+		tlsCfg *tls.Config
+		certs  *certReloader
+	)
+	if *tlsCert != "" {
+		certs, err = newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		log.Printf("loaded client certificate '%s' (expires %s)", *tlsCert, certs.NotAfter().Format(time.RFC3339))
+
+		reloadCerts := func(why string) {
+			if err := certs.Reload(); err != nil {
+				log.Printf("%s; keeping previously loaded certificate", err)
 				return
-			case rm := <-receivedMessages:
-				// should never happen; can't hurt to check:
-				if rm.Packet.Topic != *topic {
-					strictLog(fmt.Sprintf("received message on unexpected topic: %s", rm.Packet.Topic))
-					continue
+			}
+			log.Printf("reloaded client certificate (%s; expires %s)", why, certs.NotAfter().Format(time.RFC3339))
+		}
+		go watchFiles(ctx, certWatchInterval, func() { reloadCerts("files changed") }, *tlsCert, *tlsKey)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hup:
+					reloadCerts("SIGHUP")
 				}
-				var m PowerAlarmMessage
-				if err := json.Unmarshal(rm.Packet.Payload, &m); err != nil {
-					strictLog(fmt.Sprintf("failed to unmarshal message: %s\n(content: '%s')", err, rm.Packet.Payload))
-					continue
+			}
+		}()
+	} else if secret.HasTLS() {
+		certs = &certReloader{}
+		if err := certs.SetPEM(secret.TLSCert, secret.TLSKey); err != nil {
+			log.Fatalf("vault: %s", err)
+		}
+		log.Printf("loaded client certificate from Vault (expires %s)", certs.NotAfter().Format(time.RFC3339))
+	}
+	if *useTLS || certs != nil {
+		if tlsCfg, err = newBrokerTLSConfig(*tlsCA, *tlsSkipVerify); err != nil {
+			log.Fatalf("invalid -tls-ca: %s", err)
+		}
+		if *tlsSkipVerify {
+			log.Printf("[WARN] -tls-skip-verify is set: the server's certificate is not verified")
+		}
+		if certs != nil {
+			tlsCfg.GetClientCertificate = certs.GetClientCertificate
+		}
+	}
+
+	if vault != nil {
+		useVaultTLS := *tlsCert == "" && certs != nil
+		go vault.Run(ctx, *vaultSecretPath, *vaultRefresh, func(s vaultSecret) {
+			if s.Username != "" || s.Password != "" {
+				creds.Set(s.Username, []byte(s.Password))
+			}
+			if useVaultTLS && s.HasTLS() {
+				if err := certs.SetPEM(s.TLSCert, s.TLSKey); err != nil {
+					log.Printf("vault: %s; keeping previously loaded certificate", err)
 				}
-				if !m.Valid() {
-					strictLog(fmt.Sprintf("invalid message schema: '%s'", rm.Packet.Payload))
+			}
+		})
+	}
+
+	serverURL := parsedServer.URL(tlsCfg != nil)
+	for i, rs := range redundantServers {
+		srv, err := parseBrokerServer(rs)
+		if err != nil {
+			invalidArgument(fmt.Sprintf("invalid -redundant-server: %s", err))
+		}
+		if srv.Socket != "" && os.Getenv("all_proxy") != "" {
+			invalidArgument("a unix:// -redundant-server can't be used with a proxy set in $all_proxy.")
+		}
+		redundantServers[i] = srv.URL(tlsCfg != nil).String()
+	}
+
+	// currentTopics are -topic, which a reload of -config may change:
+	var currentTopics atomic.Pointer[[]string]
+	currentTopicsValue := []string(slices.Clone(topics))
+	currentTopics.Store(&currentTopicsValue)
+	var subscriptions []string
+	for _, t := range topics {
+		if !slices.Contains(subscriptions, t) {
+			subscriptions = append(subscriptions, t)
+		}
+	}
+	for _, r := range namedRules {
+		if !slices.Contains(subscriptions, r.Topic) {
+			subscriptions = append(subscriptions, r.Topic)
+		}
+	}
+	for _, r := range relayRoutes {
+		subscriptions = append(subscriptions, r.Filter)
+	}
+	// filters are what the daemon actually subscribes to, with -share-group:
+	var filters []string
+	for _, t := range subscriptions {
+		filters = append(filters, subOpts.Shared(t))
+	}
+	subscriptions = append(subscriptions, dependentTopics...)
+	if *controlTopic != "" {
+		subscriptions = append(subscriptions, *controlTopic)
+	}
+	filters = append(filters, subscriptions[len(filters):]...)
+
+	if doctor {
+		os.Exit(runDoctor(ctx, doctorConfig{
+			Server:      brokerProbeServer(serverURL),
+			TLS:         tlsCfg,
+			MQTTVersion: *mqttVersion,
+			Creds:       creds,
+			Topics:      subscriptions,
+			StateDir:    *stateDir,
+		}))
+	}
+	if verifyBroker {
+		var publishTopics []string
+		for _, t := range []string{*coordinationTopic, *bootTopic, *statusTopic, *observeReportTopic} {
+			if t != "" && !slices.Contains(publishTopics, t) {
+				publishTopics = append(publishTopics, t)
+			}
+		}
+		os.Exit(runVerifyBroker(ctx, verifyConfig{
+			Server:        brokerProbeServer(serverURL),
+			TLS:           tlsCfg,
+			MQTTVersion:   *mqttVersion,
+			Creds:         creds,
+			Hostname:      hostname,
+			Topics:        subscriptions,
+			PublishTopics: publishTopics,
+		}))
+	}
+
+	if *check {
+		os.Exit(runCheck(ctx, checkConfig{
+			ServerURL:   serverURL,
+			TLS:         tlsCfg,
+			MQTTVersion: *mqttVersion,
+			Creds:       creds,
+			Topics:      subscriptions,
+			Connect:     *checkConnect,
+		}))
+	}
+	if *checkConnect {
+		invalidArgument("-check-connect requires -check.")
+	}
+
+	if ok, detail := checkClock(time.Now()); !ok {
+		log.Printf("[WARN] %s; timestamps in announcements and shutdown records may be wrong", detail)
+	}
+	clientID := newClientID(*clientIDFlag, hostname, *clientIDSuffix)
+	log.Printf("client ID: %s", clientID)
+
+	store, err := newStateStore(*stateDir)
+	if err != nil {
+		log.Printf("state persistence disabled: failed to create state directory '%s': %s", *stateDir, err)
+	}
+	prevShutdown := loadShutdownRecord(store)
+	if prevShutdown != nil {
+		log.Printf("mqttshutdownd initiated a shutdown of this host %s", prevShutdown)
+	}
+	var bootAnnouncement *BootAnnouncement
+	if *bootTopic != "" && store.Enabled() {
+		if bootAnnouncement, err = pendingBootAnnouncement(store, hostname, prevShutdown); err != nil {
+			log.Printf("boot announcement disabled: %s", err)
+		}
+	}
+	if bootAnnouncement == nil {
+		// nothing will publish the previous shutdown record; it has been logged, so clear it now:
+		if err := store.Remove(stateFileShutdown); err != nil {
+			log.Printf("failed to clear shutdown state: %s", err)
+		}
+	}
+	if store.Enabled() {
+		go runHeartbeat(ctx, store)
+	}
+	var bootAnnouncing atomic.Bool
+	unreachableSince := restoreUnreachableSince(store, time.Now())
+	conn := newConnectionState(unreachableSince)
+	// redundantConns track the -redundant-server connections, so the broker
+	// watchdog only alerts once no server is reachable:
+	redundantConns := make([]*connectionState, len(redundantServers))
+	for i := range redundantConns {
+		redundantConns[i] = newConnectionState(unreachableSince)
+	}
+
+	pub := &publisher{Store: store}
+	pub.Restore()
+	deps := newDependentsTracker(dependentTopics, *dependentOfflinePayload)
+
+	events := newEventQueue(eventQueueSize, debugLog)
+	go events.Report(ctx, eventQueueReportInterval)
+	newEvaluator := func(down, recovered exprProgram) Evaluator {
+		return batteryHysteresis{
+			Evaluator:    exprEvaluator{down: down, recovered: recovered},
+			ArmBelow:     *batteryArmBelow,
+			RecoverAbove: *batteryRecoverAbove,
+		}
+	}
+	shutdownAction := hostShutdown{
+		Clock:                realClock{},
+		Publisher:            pub,
+		CoordinationTopic:    *coordinationTopic,
+		CoordinationTemplate: coordinationTmpl,
+		Hostname:             hostname,
+		Deps:                 deps,
+		DependentsTimeout:    *dependentsTimeout,
+		Store:                store,
+		Rule:                 *downExpr,
+		WakeAfter:            *wakeAfter,
+		RTCDevice:            *rtcDevice,
+		Command:              *command,
+		CancelCommand:        *cancelCommand,
+		Unit:                 *systemdUnit,
+		RecoveredUnit:        *systemdRecoveredUnit,
+		PowerOffFallbacks:    powerOffFallbacks,
+	}
+	engine := &Engine{
+		Clock:         realClock{},
+		Evaluator:     newEvaluator(downExprPrg, recoveredExprPrg),
+		Action:        &shutdownAction,
+		Delay:         *recoveryPeriod,
+		Steps:         steps,
+		Debug:         debugLog,
+		Hostname:      hostname,
+		Tags:          tags,
+		Supply:        supply{Phase: *phase, Circuit: *circuit},
+		CheckClock:    checkClock,
+		Runtime:       &runtimeEstimator{Window: *runtimeWindow},
+		RuntimeMargin: *runtimeMargin,
+		History:       newEventHistory(apiHistorySize),
+	}
+	engine.ActionName = actionName(*command, *systemdUnit)
+	if *journalEnabled {
+		j, err := openJournal(store, *journalRetention)
+		if err != nil {
+			log.Fatalf("failed to open journal: %s", err)
+		}
+		engine.Journal = j
+		go j.Run(ctx)
+	}
+	// wrapAction adds the journaling, event log and messaging wrappers to an
+	// action whose rule is down:
+	wrapAction := func(a Action, down string) Action {
+		if engine.Journal != nil {
+			a = journalingAction{Action: a, Journal: engine.Journal, Clock: realClock{}}
+		}
+		if sysLog != nil {
+			a = eventLogAction{Action: a, Log: sysLog}
+		}
+		if *wall || *notifyURL != "" {
+			m := &messagingAction{Action: a, Hostname: hostname, Rule: down, NotifyURL: *notifyURL, Notify: notifyTmpl}
+			if *wall {
+				m.Wall = wallTmpl
+			}
+			a = m
+		}
+		return a
+	}
+	engine.Action = wrapAction(engine.Action, *downExpr)
+	for i, r := range namedRules {
+		a := shutdownAction
+		a.Rule, a.Command, a.CancelCommand, a.Unit, a.RecoveredUnit = r.DownExpr, r.Command, r.CancelCommand, r.Unit, r.RecoveredUnit
+		namedRules[i].Engine = &Engine{
+			Clock:         realClock{},
+			Evaluator:     newEvaluator(r.Down, r.Recovered),
+			Action:        wrapAction(&a, r.DownExpr),
+			Delay:         r.Delay,
+			Steps:         ruleSteps(steps, r.Name, r.Delay),
+			Debug:         debugLog,
+			ActionName:    fmt.Sprintf("%s for rule '%s'", actionName(r.Command, r.Unit), r.Name),
+			Rule:          r.Name,
+			Hostname:      hostname,
+			Tags:          tags,
+			Supply:        engine.Supply,
+			CheckClock:    checkClock,
+			Runtime:       &runtimeEstimator{Window: *runtimeWindow},
+			RuntimeMargin: *runtimeMargin,
+			Journal:       engine.Journal,
+		}
+	}
+	var obs *observer
+	if *observe > 0 {
+		obs = &observer{
+			Action:      engine.Action,
+			Clock:       realClock{},
+			Period:      *observe,
+			AutoEnable:  *observeAutoEnable,
+			Hostname:    hostname,
+			Publisher:   pub,
+			ReportTopic: *observeReportTopic,
+			ReportURL:   *observeReportURL,
+		}
+		engine.Action = obs
+		for i := range engine.Steps {
+			engine.Steps[i] = obs.WrapStep(engine.Steps[i])
+		}
+		for _, r := range namedRules {
+			r.Engine.Action = obs.Wrap(r.Engine.Action)
+			for i := range r.Engine.Steps {
+				r.Engine.Steps[i] = obs.WrapStep(r.Engine.Steps[i])
+			}
+		}
+		go obs.Run(ctx)
+	}
+	if *snapshotFile == "" {
+		*snapshotFile = filepath.Join(os.TempDir(), name+"-"+stateFileSnapshot)
+		if store.Enabled() {
+			*snapshotFile = store.Path(stateFileSnapshot)
+		}
+	}
+	snapshots := &snapshotter{
+		Path:          *snapshotFile,
+		Hostname:      hostname,
+		Server:        *server,
+		Subscriptions: subscriptions,
+		ConfigHash:    configHash(flag.CommandLine),
+		Rules: snapshotRules{
+			Down:                *downExpr,
+			Recovered:           *recoveredExpr,
+			Delay:               recoveryPeriod.String(),
+			BatteryArmBelow:     *batteryArmBelow,
+			BatteryRecoverAbove: *batteryRecoverAbove,
+		},
+		Engine:     engine,
+		NamedRules: namedRules,
+		Conn:       conn,
+		Publisher:  pub,
+	}
+	go snapshots.Run(ctx)
+	// rulesMu serializes changes to the top-level rule by reloads of -config
+	// and of -down-expr-file and -recovered-expr-file:
+	var rulesMu sync.Mutex
+	if *downExprFile != "" || *recoveredExprFile != "" {
+		go (&exprFileWatcher{
+			DownPath:      *downExprFile,
+			RecoveredPath: *recoveredExprFile,
+			Flags:         flag.CommandLine,
+			Rules:         rules,
+			NewEvaluator:  newEvaluator,
+			Engine:        engine,
+			Snapshots:     snapshots,
+			Mu:            &rulesMu,
+		}).Run(ctx)
+	}
+	if *debugListen != "" {
+		go (&debugServer{Listen: *debugListen, Token: debugToken, Engine: engine, Rules: namedRules, Conn: conn, Events: events}).Run(ctx)
+	}
+	if *unreachableAfter > 0 {
+		go (&unreachableWatchdog{
+			Conn:      conn,
+			Redundant: redundantConns,
+			After:     *unreachableAfter,
+			Command:   *unreachableCommand,
+			URL:       *unreachableURL,
+			Shutdown:  *unreachableShutdown,
+			Engine:    engine,
+			Hostname:  hostname,
+			Server:    *server,
+			Store:     store,
+		}).Run(ctx)
+	}
+	if *apiListen != "" {
+		go (&apiServer{
+			Listen:      *apiListen,
+			Token:       apiToken,
+			Hostname:    hostname,
+			Engine:      engine,
+			Rules:       namedRules,
+			History:     engine.History,
+			Journal:     engine.Journal,
+			Snapshotter: snapshots,
+		}).Run(ctx)
+	}
+	dispatcher := ruleDispatcher{Engine: engine, Topics: &currentTopics, Rules: namedRules}
+	events.Alarm = dispatcher.Alarm
+	control := controlHandler{Topic: *controlTopic, Hostname: hostname, Engine: engine, Rules: namedRules, Observer: obs, Publisher: pub}
+	if *producer {
+		log.Printf("producer mode: publishing local source events to '%s'", *sourceRelayTopic)
+		runSources(ctx, sources, nil, pub, *sourceRelayTopic, *sourceRelayRetain)
+	} else {
+		go dispatcher.Run(ctx, events.C())
+		runSources(ctx, sources, events, pub, *sourceRelayTopic, *sourceRelayRetain)
+	}
+
+	var dedup *messageDeduper
+	if len(redundantServers) > 0 {
+		dedup = newMessageDeduper(*redundantDedupWin)
+	}
+	handlePower := func(broker string, p *paho.Publish) {
+		if dedup != nil && dedup.Duplicate(broker, p.Topic, p.Payload) {
+			debugLog(fmt.Sprintf("dropping message on '%s' from '%s': already received from another server", p.Topic, broker))
+			return
+		}
+		msgs, err := decode(p.Topic, p.Payload)
+		if err != nil {
+			strictLog(fmt.Sprintf("failed to decode %s message: %s\n(content: '%s')", *format, err, p.Payload))
+			return
+		}
+		msg := formatOpts.Proto.ExprMsg(p.Payload)
+		props := userProperties(p.Properties)
+		var expires time.Time
+		if p.Properties != nil && p.Properties.MessageExpiry != nil {
+			expires = time.Now().Add(time.Duration(*p.Properties.MessageExpiry) * time.Second)
+		}
+		for _, m := range msgs {
+			if p.Retain {
+				if ok, why := retainedPol.Accept(m, time.Now()); !ok {
+					log.Printf("ignoring retained message on '%s' (%s): %s", p.Topic, m.String(), why)
 					continue
 				}
-				func() {
-					tMu.Lock()
-					defer tMu.Unlock()
-
-					if t == nil {
-						out, _, err := downExprPrg.Eval(map[string]any{
-							celVarScope:     m.Scope,
-							celVarPowerType: m.PowerType,
-							celVarOnline:    m.Online,
-						})
-						if err != nil {
-							log.Fatalf("failed to evaluate -down-expr: %s", err)
-						}
-						triggerShutdown := out.Value().(bool)
-						if triggerShutdown {
-							log.Printf("power down; shutdown in %s", *recoveryPeriod)
-							t = time.AfterFunc(*recoveryPeriod, func() {
-								log.Println("calling shutdown!")
-								err := exec.Command("shutdown", "-h", "now").Run()
-								if err != nil {
-									log.Fatalf("failed to call shutdown: %s", err)
-								}
-								log.Println("shutdown initiated!")
-							})
-						}
-					} else {
-						out, _, err := recoveredExprPrg.Eval(map[string]any{
-							celVarScope:     m.Scope,
-							celVarPowerType: m.PowerType,
-							celVarOnline:    m.Online,
-						})
-						if err != nil {
-							log.Fatalf("failed to evaluate -recovered-expr: %s", err)
-						}
-						triggerRecovery := out.Value().(bool)
-						if triggerRecovery {
-							log.Println("power recovered; cancelling pending shutdown")
-							t.Stop()
-							t = nil
-						}
-					}
-				}()
 			}
+			events.Offer(powerEvent{Source: "mqtt:" + p.Topic, Message: m, Props: props, Expires: expires, Msg: msg})
+		}
+	}
+
+	if chaos != nil {
+		deliver := handlePower
+		handlePower = func(broker string, p *paho.Publish) {
+			chaos.Deliver(broker, p, deliver)
 		}
-	}(ctx)
+	}
 
+	backoff := &reconnectBackoff{Min: *reconnectMin, Max: *reconnectMax}
+	subRetry := subscribeRetry{MaxFailures: int(*subscribeMaxFailures), Min: *reconnectMin, Max: *reconnectMax}
+	cancelSubscribe := context.CancelFunc(func() {})
+	loss := connectionLoss{Conn: conn, ClientID: clientID}
 	cliCfg := autopaho.ClientConfig{
-		ServerUrls:                    []*url.URL{serverURL},
-		ConnectUsername:               *user,
-		ConnectPassword:               []byte(*password),
-		KeepAlive:                     20,
-		CleanStartOnInitialConnection: false,
-		SessionExpiryInterval:         uint32(*sessionExpiryS),
+		ServerUrls:        []*url.URL{serverURL},
+		TlsCfg:            tlsCfg,
+		AttemptConnection: brokerConnectionAttempter(*mqttVersion),
+		ConnectPacketBuilder: func(cp *paho.Connect, _ *url.URL) *paho.Connect {
+			username, password := creds.Get()
+			cp.Username, cp.UsernameFlag = username, username != ""
+			cp.Password, cp.PasswordFlag = password, len(password) > 0
+			cp.CleanStart = cp.CleanStart || !*resumeSession
+			return cp
+		},
+		KeepAlive:                     uint16(keepAlive.Seconds()),
+		CleanStartOnInitialConnection: *cleanStart,
+		SessionExpiryInterval:         uint32(sessionExpiry.Seconds()),
 		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
 			log.Printf("connected to '%s'", *server)
-			// Subscribing in the OnConnectionUp callback is recommended (ensures the subscription is reestablished if the connection drops)
-			if _, err := cm.Subscribe(ctx, &paho.Subscribe{
-				Subscriptions: []paho.SubscribeOptions{{Topic: *topic, QoS: 1}},
-			}); err != nil {
-				log.Fatalf("failed to subscribe to topic '%s': %s", *topic, err)
+			conn.Up(time.Now())
+			backoff.Reset()
+			pub.SetConnectionManager(cm)
+			go pub.Flush(ctx)
+			if *statusTopic != "" {
+				rulesMu.Lock()
+				birth := StatusMessage{
+					Status:         StatusOnline,
+					Host:           hostname,
+					Version:        version,
+					Topics:         *currentTopics.Load(),
+					RecoveryPeriod: flag.Lookup("recovery-period").Value.String(),
+				}
+				rulesMu.Unlock()
+				for _, r := range namedRules {
+					if birth.Rules == nil {
+						birth.Rules = make(map[string]string)
+					}
+					birth.Rules[r.Name] = r.Topic
+				}
+				go publishStatus(ctx, pub, *statusTopic, birth)
 			}
-			log.Printf("subscribed to '%s'", *topic)
+			// announce once per boot; on failure, retry on the next connection:
+			if bootAnnouncement != nil && bootAnnouncing.CompareAndSwap(false, true) {
+				go func() {
+					publishCtx, cancel := context.WithTimeout(ctx, publishIntentTimeout)
+					defer cancel()
+					if err := pub.PublishJSON(publishCtx, *bootTopic, bootAnnouncement, false); err != nil {
+						log.Printf("failed to publish boot announcement to '%s': %s", *bootTopic, err)
+						bootAnnouncing.Store(false)
+						return
+					}
+					log.Printf("announced boot to '%s'", *bootTopic)
+					markBootAnnounced(store, bootAnnouncement)
+				}()
+			}
+			// Subscribing in the OnConnectionUp callback is recommended (ensures the subscription is reestablished if the connection drops).
+			// Subscriptions are retried in the background, superseded by the next connection's:
+			cancelSubscribe()
+			var subCtx context.Context
+			subCtx, cancelSubscribe = context.WithCancel(ctx)
+			go func() {
+				subscribe := func(opts paho.SubscribeOptions, what string) bool {
+					err := subRetry.Subscribe(subCtx, cm, opts)
+					if err != nil && subCtx.Err() == nil {
+						log.Fatalf("failed to subscribe to %s: %s", what, err)
+					}
+					return err == nil
+				}
+				subscribed := make(map[string]bool)
+				for _, topic := range *currentTopics.Load() {
+					if subscribed[topic] {
+						continue
+					}
+					subscribed[topic] = true
+					if !subscribe(subOpts.ForShared(topic), fmt.Sprintf("topic '%s'", topic)) {
+						return
+					}
+					log.Printf("subscribed to '%s'", topic)
+				}
+				for _, r := range namedRules {
+					if subscribed[r.Topic] {
+						continue
+					}
+					subscribed[r.Topic] = true
+					if !subscribe(subOpts.ForShared(r.Topic), fmt.Sprintf("topic '%s' of rule '%s'", r.Topic, r.Name)) {
+						return
+					}
+					log.Printf("subscribed to '%s' for rule '%s'", r.Topic, r.Name)
+				}
+				for _, r := range relayRoutes {
+					if !subscribe(subOpts.ForShared(r.Filter), fmt.Sprintf("relay topic '%s'", r.Filter)) {
+						return
+					}
+					log.Printf("relaying '%s' (%s) to '%s'", r.Filter, r.Format, *relayTopic)
+				}
+				for _, dt := range deps.Topics() {
+					if !subscribe(subOpts.For(dt), fmt.Sprintf("dependent topic '%s'", dt)) {
+						return
+					}
+					log.Printf("subscribed to dependent topic '%s'", dt)
+				}
+				if control.Topic != "" {
+					if !subscribe(subOpts.For(control.Topic), fmt.Sprintf("control topic '%s'", control.Topic)) {
+						return
+					}
+					log.Printf("accepting commands on '%s'", control.Topic)
+				}
+			}()
 		},
 		OnConnectError: func(err error) {
 			log.Printf("error while attempting connection: %s", err)
+			conn.Failed(time.Now(), err)
+			if failures := backoff.Failed(); *reconnectMaxFailures > 0 && failures >= int(*reconnectMaxFailures) {
+				log.Fatalf("failed to connect to '%s' %d times in a row; giving up", *server, failures)
+			}
 		},
 		// eclipse/paho.golang/paho provides base mqtt functionality, the below config will be passed in for each connection
 		ClientConfig: paho.ClientConfig{
@@ -254,26 +1505,147 @@ func main() {
 			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
 				func(pr paho.PublishReceived) (bool, error) {
 					debugLog(fmt.Sprintf("received message on topic %s; body: %s (retain: %t)", pr.Packet.Topic, pr.Packet.Payload, pr.Packet.Retain))
-					receivedMessages <- pr
+					power := dispatcher.Handles(pr.Packet.Topic)
+					if !power && deps.Handle(pr.Packet.Topic, pr.Packet.Payload) {
+						return true, nil
+					}
+					if !power && control.Handle(ctx, pr.Packet) {
+						return true, nil
+					}
+					if pr.Packet.Topic != *relayTopic {
+						for _, r := range relayRoutes {
+							if !topicMatches(r.Filter, pr.Packet.Topic) {
+								continue
+							}
+							msgs, err := r.Normalize(pr.Packet.Topic, pr.Packet.Payload)
+							if err != nil {
+								strictLog(fmt.Sprintf("relay: failed to normalize %s message on '%s': %s", r.Format, pr.Packet.Topic, err))
+								return true, nil
+							}
+							for _, m := range msgs {
+								if err := pub.PublishJSON(ctx, *relayTopic, m, *relayRetain); err != nil {
+									log.Printf("relay: failed to publish to '%s': %s", *relayTopic, err)
+								}
+							}
+							if !power {
+								return true, nil
+							}
+							break
+						}
+					}
+					// should never happen; can't hurt to check:
+					if !power {
+						strictLog(fmt.Sprintf("received message on unexpected topic: %s", pr.Packet.Topic))
+						return true, nil
+					}
+					handlePower(*server, pr.Packet)
 					return true, nil
 				}},
-			OnClientError: func(err error) {
-				log.Fatalf("client error: %s", err)
-			},
-			OnServerDisconnect: func(d *paho.Disconnect) {
-				if d.Properties != nil {
-					log.Fatalf("server requested disconnect: %s\n", d.Properties.ReasonString)
-				} else {
-					log.Fatalf("server requested disconnect; reason code: %d\n", d.ReasonCode)
-				}
-			},
+			OnClientError:      loss.ClientError,
+			OnServerDisconnect: loss.ServerDisconnect,
 		},
 	}
-	c, err := autopaho.NewConnection(ctx, cliCfg)
+	// the connections outlive ctx, so gracefulExit can still use them after a signal:
+	connCtx := context.WithoutCancel(ctx)
+	if chaos != nil {
+		cliCfg.AttemptConnection = chaos.AttemptConnection
+		go chaos.Run(ctx)
+	}
+	cliCfg.ConnectRetryDelay = backoff.Min
+	cliCfg.AttemptConnection = backoff.Wrap(cliCfg.AttemptConnection)
+	if *statusTopic != "" {
+		cliCfg.WillMessage = statusWill(*statusTopic, hostname)
+	}
+	c, err := autopaho.NewConnection(connCtx, cliCfg)
 	if err != nil {
 		log.Fatalf("failed to start connection: %s", err)
 	}
 
-	<-c.Done()
+	var redundant []*autopaho.ConnectionManager
+	for i, rs := range redundantServers {
+		rc, err := startRedundantBroker(connCtx, redundantBrokerConfig{
+			Server:        rs,
+			TLS:           tlsCfg,
+			MQTTVersion:   *mqttVersion,
+			Creds:         creds,
+			ClientID:      fmt.Sprintf("%s/redundant-%d", clientID, i+1),
+			Topics:        topics,
+			SubOpts:       subOpts,
+			KeepAlive:     uint16(keepAlive.Seconds()),
+			SessionExpiry: uint32(sessionExpiry.Seconds()),
+			CleanStart:    *cleanStart,
+			ResumeSession: *resumeSession,
+			ReconnectMin:  *reconnectMin,
+			ReconnectMax:  *reconnectMax,
+			Conn:          redundantConns[i],
+		}, func(p *paho.Publish) {
+			debugLog(fmt.Sprintf("received message from redundant server '%s' on topic %s; body: %s (retain: %t)", rs, p.Topic, p.Payload, p.Retain))
+			handlePower(rs, p)
+		})
+		if err != nil {
+			log.Fatalf("failed to start connection to redundant server: %s", err)
+		}
+		redundant = append(redundant, rc)
+	}
+
+	if *configFile != "" || *configDir != "" {
+		reloader := &configReloader{
+			Path:         *configFile,
+			Dir:          *configDir,
+			Flags:        flag.CommandLine,
+			Fixed:        fixedFlags,
+			Last:         configVals,
+			Rules:        rules,
+			NewEvaluator: newEvaluator,
+			Engine:       engine,
+			Steps:        engine.Steps,
+			Topics:       &currentTopics,
+			TopicVars:    topicVars,
+			Conn:         c,
+			SubOpts:      subOpts,
+			Snapshots:    snapshots,
+			Mu:           &rulesMu,
+		}
+		if len(redundantServers) > 0 {
+			reloader.TopicFixed = "-redundant-server subscribes to it too"
+		}
+		go reloader.Run(ctx)
+	}
+
+	var bc *autopaho.ConnectionManager
+	if *bridgeServer != "" {
+		bc, err = startBridge(connCtx, bridgeConfig{
+			Server:      *bridgeServer,
+			TLS:         *bridgeTLS,
+			Username:    *bridgeUser,
+			Password:    *bridgePassword,
+			ClientID:    fmt.Sprintf("%s/bridge", clientID),
+			Topics:      bridgeTopics,
+			LocalPrefix: *bridgePrefix,
+			Retain:      *bridgeRetain,
+			KeepAlive:   uint16(keepAlive.Seconds()),
+		}, pub)
+		if err != nil {
+			log.Fatalf("failed to start bridge connection: %s", err)
+		}
+	}
+
+	<-ctx.Done()
 	log.Println("signal caught - exiting")
+	gracefulExit{
+		Conn:                 c,
+		Bridge:               bc,
+		Redundant:            redundant,
+		Topics:               filters,
+		Publisher:            pub,
+		Engine:               engine,
+		Rules:                namedRules,
+		CoordinationTopic:    *coordinationTopic,
+		CoordinationTemplate: coordinationTmpl,
+		StatusTopic:          *statusTopic,
+		Rule:                 *downExpr,
+		Hostname:             hostname,
+		Store:                store,
+	}.Run()
+	log.Println("exited cleanly")
 }
@@ -0,0 +1,257 @@
+//go:build minimal
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// minimalBuild is set in binaries built with the minimal tag.
+	minimalBuild = true
+	// exprLanguage names the language of -down-expr and -recovered-expr.
+	exprLanguage = "matcher"
+	// exprLanguageHelp is printed in the usage message.
+	exprLanguageHelp = "This is a minimal build: -down-expr and -recovered-expr are matcher expressions, comparisons of a variable with a literal (e.g. 'powerType == 1', 'battery < 50', 'scope != \"local\"', '!online') joined by && and ||, with && binding tighter. Parentheses, arithmetic and functions are not supported."
+)
+
+// exprVarTypes gives the type of each matcher variable, as a zero value.
+var exprVarTypes = map[string]any{
+	exprVarPowerType: 0,
+	exprVarOnline:    false,
+	exprVarScope:     "",
+	exprVarBattery:   0.0,
+	exprVarLoad:      0.0,
+	exprVarSource:    "",
+	exprVarRuntime:   0.0,
+	exprVarExpiry:    0.0,
+}
+
+// newExprCompiler returns a function compiling matcher expressions, the
+// subset of CEL supported by minimal builds, which leave out cel-go to keep
+// the binary small enough for routers and tiny boards.
+func newExprCompiler(*protoDescriptor) (func(expr string) (exprProgram, error), error) {
+	return func(expr string) (exprProgram, error) {
+		m, err := compileMatcher(expr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile '%s': %w", expr, err)
+		}
+		return m, nil
+	}, nil
+}
+
+// matcher is a compiled matcher expression: a disjunction of conjunctions of
+// comparisons.
+type matcher [][]matcherComparison
+
+// matcherComparison compares a variable with a literal. A bare boolean
+// variable is compared with true, and a negated one with false.
+type matcherComparison struct {
+	Var   string
+	Op    string
+	Value any // bool, float64 or string
+}
+
+func (m matcher) Eval(ev powerEvent) (bool, error) {
+	vars := exprVars(ev)
+	for _, and := range m {
+		all := true
+		for _, c := range and {
+			if ok, err := c.Eval(vars[c.Var]); err != nil {
+				return false, err
+			} else if !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c matcherComparison) Eval(v any) (bool, error) {
+	switch want := c.Value.(type) {
+	case bool:
+		got, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("%s is %T, not bool", c.Var, v)
+		}
+		return (got == want) == (c.Op == "=="), nil
+	case string:
+		got, ok := v.(string)
+		if !ok {
+			return false, fmt.Errorf("%s is %T, not string", c.Var, v)
+		}
+		return (got == want) == (c.Op == "=="), nil
+	case float64:
+		var got float64
+		switch n := v.(type) {
+		case int:
+			got = float64(n)
+		case float64:
+			got = n
+		default:
+			return false, fmt.Errorf("%s is %T, not a number", c.Var, v)
+		}
+		switch c.Op {
+		case "==":
+			return got == want, nil
+		case "!=":
+			return got != want, nil
+		case "<":
+			return got < want, nil
+		case "<=":
+			return got <= want, nil
+		case ">":
+			return got > want, nil
+		case ">=":
+			return got >= want, nil
+		}
+	}
+	return false, fmt.Errorf("unsupported comparison %s %s %v", c.Var, c.Op, c.Value)
+}
+
+// compileMatcher parses and type-checks a matcher expression.
+func compileMatcher(expr string) (matcher, error) {
+	toks, err := matcherTokens(expr)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		m   matcher
+		and []matcherComparison
+	)
+	for {
+		c, rest, err := parseMatcherComparison(toks)
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, c)
+		if len(rest) == 0 {
+			return append(m, and), nil
+		}
+		switch rest[0] {
+		case "&&":
+		case "||":
+			m = append(m, and)
+			and = nil
+		default:
+			return nil, fmt.Errorf("expected && or ||, got '%s'", rest[0])
+		}
+		toks = rest[1:]
+	}
+}
+
+func parseMatcherComparison(toks []string) (matcherComparison, []string, error) {
+	if len(toks) == 0 {
+		return matcherComparison{}, nil, fmt.Errorf("unexpected end of expression")
+	}
+	negated := toks[0] == "!"
+	if negated {
+		toks = toks[1:]
+		if len(toks) == 0 {
+			return matcherComparison{}, nil, fmt.Errorf("unexpected end of expression")
+		}
+	}
+	name := toks[0]
+	typ, ok := exprVarTypes[name]
+	if !ok {
+		return matcherComparison{}, nil, fmt.Errorf("undeclared reference to '%s'", name)
+	}
+	toks = toks[1:]
+
+	if _, isBool := typ.(bool); isBool && (negated || len(toks) == 0 || toks[0] == "&&" || toks[0] == "||") {
+		return matcherComparison{Var: name, Op: "==", Value: !negated}, toks, nil
+	}
+	if negated {
+		return matcherComparison{}, nil, fmt.Errorf("'!' can only negate a bool variable, not '%s'", name)
+	}
+	if len(toks) < 2 {
+		return matcherComparison{}, nil, fmt.Errorf("expected a comparison after '%s'", name)
+	}
+	op, lit := toks[0], toks[1]
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return matcherComparison{}, nil, fmt.Errorf("expected a comparison operator after '%s', got '%s'", name, op)
+	}
+
+	c := matcherComparison{Var: name, Op: op}
+	switch typ.(type) {
+	case bool:
+		if lit != "true" && lit != "false" {
+			return c, nil, fmt.Errorf("'%s' is a bool; expected true or false, got '%s'", name, lit)
+		}
+		c.Value = lit == "true"
+	case string:
+		s, err := strconv.Unquote(lit)
+		if err != nil {
+			return c, nil, fmt.Errorf("'%s' is a string; expected a quoted string, got '%s'", name, lit)
+		}
+		c.Value = s
+	default:
+		f, err := strconv.ParseFloat(lit, 64)
+		if err != nil {
+			return c, nil, fmt.Errorf("'%s' is a number; expected a number, got '%s'", name, lit)
+		}
+		c.Value = f
+	}
+	if _, isNumber := c.Value.(float64); !isNumber && op != "==" && op != "!=" {
+		return c, nil, fmt.Errorf("'%s' can only be compared with == or !=", name)
+	}
+	return c, toks[2:], nil
+}
+
+// matcherTokens splits expr into identifiers, literals and operators.
+// Single-quoted strings are rewritten to double-quoted ones, so every string
+// literal can be parsed by strconv.Unquote.
+func matcherTokens(expr string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i++
+		case ch == '"' || ch == '\'':
+			j := i + 1
+			for j < len(expr) && expr[j] != ch {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			body := expr[i+1 : j]
+			if ch == '\'' {
+				body = strings.ReplaceAll(strings.ReplaceAll(body, `\'`, `'`), `"`, `\"`)
+			}
+			toks = append(toks, `"`+body+`"`)
+			i = j + 1
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"),
+			strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="),
+			strings.HasPrefix(expr[i:], "<="), strings.HasPrefix(expr[i:], ">="):
+			toks = append(toks, expr[i:i+2])
+			i += 2
+		case ch == '<' || ch == '>' || ch == '!':
+			toks = append(toks, expr[i:i+1])
+			i++
+		case ch == '-' || ch == '.' || unicode.IsLetter(rune(ch)) || unicode.IsDigit(rune(ch)) || ch == '_':
+			j := i + 1
+			for j < len(expr) && (expr[j] == '.' || expr[j] == '_' || unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j]))) {
+				j++
+			}
+			toks = append(toks, expr[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected '%c' at offset %d; matcher expressions only support comparisons joined by && and ||", ch, i)
+		}
+	}
+	return toks, nil
+}
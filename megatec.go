@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// megatecSource polls a directly attached UPS speaking the Megatec/Q1 serial
+// protocol, common to inexpensive line-interactive UPSes.
+type megatecSource struct {
+	Device   string
+	Baud     int
+	Interval time.Duration
+
+	mu   sync.Mutex
+	port io.ReadWriteCloser
+	r    *bufio.Reader
+}
+
+func (m *megatecSource) Name() string {
+	return "megatec:" + m.Device
+}
+
+func (m *megatecSource) Run(ctx context.Context, events chan<- powerEvent) {
+	defer m.close()
+	runPoller(ctx, m.Name(), m.Interval, m.poll, events)
+}
+
+func (m *megatecSource) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.port != nil {
+		_ = m.port.Close()
+		m.port, m.r = nil, nil
+	}
+}
+
+func (m *megatecSource) poll(_ context.Context) (PowerAlarmMessage, error) {
+	m.mu.Lock()
+	if m.port == nil {
+		p, err := openSerial(m.Device, m.Baud)
+		if err != nil {
+			m.mu.Unlock()
+			return PowerAlarmMessage{}, err
+		}
+		m.port, m.r = p, bufio.NewReader(p)
+	}
+	port, r := m.port, m.r
+	m.mu.Unlock()
+
+	if _, err := port.Write([]byte("Q1\r")); err != nil {
+		m.close()
+		return PowerAlarmMessage{}, err
+	}
+	resp, err := r.ReadString('\r')
+	if err != nil {
+		m.close()
+		return PowerAlarmMessage{}, fmt.Errorf("failed to read Q1 response: %w", err)
+	}
+	return parseMegatecQ1(resp)
+}
+
+// parseMegatecQ1 parses a Q1 status response:
+//
+//	(MMM.M NNN.N PPP.P QQQ RR.R S.SS TT.T b7b6b5b4b3b2b1b0
+//
+// where MMM.M is the input voltage, QQQ the output load in percent, and b7 is
+// set when utility power has failed.
+func parseMegatecQ1(resp string) (PowerAlarmMessage, error) {
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSpace(resp), "("))
+	if len(fields) != 8 || len(fields[7]) != 8 {
+		return PowerAlarmMessage{}, fmt.Errorf("malformed Q1 response '%s'", strings.TrimSpace(resp))
+	}
+	m := PowerAlarmMessage{
+		Online:    fields[7][0] == '0',
+		PowerType: PowerTypeUtility,
+		Scope:     ScopeLocal,
+	}
+	if load, err := strconv.ParseFloat(fields[3], 64); err == nil {
+		m.Load = &load
+	}
+	return m, nil
+}
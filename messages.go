@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultMessageTemplate is the default -wall-template and -notify-template.
+const defaultMessageTemplate = `{{.Hostname}}: {{if eq .State "pending"}}shutdown scheduled for {{.Deadline.Format "15:04:05"}}` +
+	`{{else if eq .State "held"}}shutdown countdown held until {{.Deadline.Format "15:04:05"}}` +
+	`{{else if eq .State "cancelled"}}pending shutdown cancelled{{else}}shutting down now{{end}} ({{.Reason}})`
+
+// messageData is the data available to -wall-template, -notify-template and
+// -coordination-template.
+type messageData struct {
+	Hostname string
+	// State is pending, held, cancelled or executing.
+	State string
+	// Deadline is when the action will execute; while held, when the
+	// countdown resumes; once cancelled or executing, when that happened.
+	Deadline time.Time
+	// Remaining is the time left until Deadline, rounded to the second.
+	Remaining time.Duration
+	// Rule is -down-expr.
+	Rule   string
+	Source string
+	Reason string
+
+	// Fields of the triggering message (or, once cancelled, the recovery
+	// message); Battery and Load are -1 if unknown.
+	Online    bool
+	PowerType int
+	Scope     string
+	Battery   float64
+	Load      float64
+	Trigger   PowerAlarmMessage
+}
+
+func newMessageData(hostname, rule, state string, deadline time.Time, ev powerEvent) messageData {
+	m := ev.Message
+	return messageData{
+		Hostname:  hostname,
+		State:     state,
+		Deadline:  deadline,
+		Remaining: max(time.Until(deadline), 0).Round(time.Second),
+		Rule:      rule,
+		Source:    ev.Source,
+		Reason:    m.String(),
+		Online:    m.Online,
+		PowerType: m.PowerType,
+		Scope:     m.Scope,
+		Battery:   m.BatteryPercent(),
+		Load:      m.LoadPercent(),
+		Trigger:   m,
+	}
+}
+
+// parseMessageTemplate parses a Go text/template and checks that it renders
+// for every state, so a misspelled field is rejected at startup rather than
+// during an outage.
+func parseMessageTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range []string{IntentStatePending, IntentStateHeld, IntentStateCancelled, IntentStateExecuting} {
+		for _, m := range exprSampleMessages()[:4] {
+			ev := powerEvent{Source: "mqtt:power/alarms", Message: m}
+			if _, err := renderMessage(t, newMessageData("host", "!online", state, time.Now(), ev)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+func renderMessage(t *template.Template, data messageData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// messageTimeout bounds how long broadcasting or POSTing a message may take.
+const messageTimeout = 10 * time.Second
+
+// messagingAction is an Action wrapper that broadcasts each state change to
+// logged-in users with wall(1), if Wall is set, and POSTs it to NotifyURL
+// (e.g. an ntfy or Gotify endpoint), if set, rendering each with its template.
+//
+// Messages are sent in the background, in order, after the wrapped Action has
+// run, so a slow wall or notification endpoint never delays the action or
+// holds up the Engine.
+type messagingAction struct {
+	Action
+	Hostname  string
+	Rule      string
+	Wall      *template.Template
+	NotifyURL string
+	Notify    *template.Template
+
+	mu   sync.Mutex
+	prev chan struct{}
+}
+
+func (a *messagingAction) Armed(ctx context.Context, p Pending) {
+	a.Action.Armed(ctx, p)
+	a.sendAsync(ctx, newMessageData(a.Hostname, a.Rule, IntentStatePending, p.ExecuteAt, p.Trigger))
+}
+
+func (a *messagingAction) Held(ctx context.Context, p Pending, until time.Time) {
+	a.Action.Held(ctx, p, until)
+	a.sendAsync(ctx, newMessageData(a.Hostname, a.Rule, IntentStateHeld, until, p.Trigger))
+}
+
+func (a *messagingAction) Cancelled(ctx context.Context, p Pending, ev powerEvent) {
+	a.Action.Cancelled(ctx, p, ev)
+	a.sendAsync(ctx, newMessageData(a.Hostname, a.Rule, IntentStateCancelled, time.Now(), ev))
+}
+
+func (a *messagingAction) Execute(ctx context.Context, p Pending) {
+	data := newMessageData(a.Hostname, a.Rule, IntentStateExecuting, time.Now(), p.Trigger)
+	a.Action.Execute(ctx, p)
+	a.sendAsync(ctx, data)
+}
+
+// sendAsync sends data in the background once every message queued before it
+// has been sent.
+func (a *messagingAction) sendAsync(ctx context.Context, data messageData) {
+	ctx = context.WithoutCancel(ctx)
+	done := make(chan struct{})
+	a.mu.Lock()
+	prev := a.prev
+	a.prev = done
+	a.mu.Unlock()
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		a.send(ctx, data)
+	}()
+}
+
+func (a *messagingAction) send(ctx context.Context, data messageData) {
+	ctx, cancel := context.WithTimeout(ctx, messageTimeout)
+	defer cancel()
+	if a.Wall != nil {
+		if msg, err := renderMessage(a.Wall, data); err != nil {
+			log.Printf("failed to render -wall-template: %s", err)
+		} else if err := broadcastWall(ctx, msg); err != nil {
+			log.Printf("failed to broadcast wall message: %s", err)
+		}
+	}
+	if a.NotifyURL != "" {
+		if msg, err := renderMessage(a.Notify, data); err != nil {
+			log.Printf("failed to render -notify-template: %s", err)
+		} else if err := postText(ctx, a.NotifyURL, msg); err != nil {
+			log.Printf("failed to POST notification to '%s': %s", a.NotifyURL, err)
+		}
+	}
+}
+
+// broadcastWall writes msg to the terminals of all logged-in users.
+func broadcastWall(ctx context.Context, msg string) error {
+	cmd := exec.CommandContext(ctx, "wall")
+	cmd.Stdin = strings.NewReader(msg + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// postText POSTs body to url as plain text.
+func postText(ctx context.Context, url, body string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	modbusDefaultPort = "502"
+
+	modbusFuncReadHolding = 0x03
+	modbusFuncReadInput   = 0x04
+)
+
+// modbusRegister identifies a single 16-bit register and how to scale its value.
+type modbusRegister struct {
+	Function byte
+	Address  uint16
+	Scale    float64
+}
+
+// parseModbusRegister parses a register spec of the form TYPE:ADDRESS[:SCALE],
+// where TYPE is "h" (holding) or "i" (input) and ADDRESS is the zero-based
+// protocol address, e.g. "h:514:0.1".
+func parseModbusRegister(spec string) (modbusRegister, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return modbusRegister{}, fmt.Errorf("invalid register '%s': expected TYPE:ADDRESS[:SCALE]", spec)
+	}
+	r := modbusRegister{Scale: 1}
+	switch parts[0] {
+	case "h":
+		r.Function = modbusFuncReadHolding
+	case "i":
+		r.Function = modbusFuncReadInput
+	default:
+		return modbusRegister{}, fmt.Errorf("invalid register '%s': type must be 'h' (holding) or 'i' (input)", spec)
+	}
+	addr, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return modbusRegister{}, fmt.Errorf("invalid register '%s': %w", spec, err)
+	}
+	r.Address = uint16(addr)
+	if len(parts) == 3 {
+		if r.Scale, err = strconv.ParseFloat(parts[2], 64); err != nil {
+			return modbusRegister{}, fmt.Errorf("invalid register '%s': %w", spec, err)
+		}
+	}
+	return r, nil
+}
+
+// modbusSource polls an inverter or UPS over Modbus TCP and synthesizes power
+// events from its grid-present, state-of-charge, and load registers.
+type modbusSource struct {
+	Addr          string
+	Unit          byte
+	Grid          modbusRegister
+	GridThreshold float64
+	SOC           *modbusRegister
+	Load          *modbusRegister
+	Interval      time.Duration
+
+	mu    sync.Mutex
+	txnID uint16
+}
+
+func (m *modbusSource) Name() string {
+	return fmt.Sprintf("modbus:%s/%d", m.Addr, m.Unit)
+}
+
+func (m *modbusSource) Run(ctx context.Context, events chan<- powerEvent) {
+	runPoller(ctx, m.Name(), m.Interval, m.poll, events)
+}
+
+func (m *modbusSource) poll(ctx context.Context) (PowerAlarmMessage, error) {
+	addr := m.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, modbusDefaultPort)
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.Interval)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return PowerAlarmMessage{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	grid, err := m.read(conn, m.Grid)
+	if err != nil {
+		return PowerAlarmMessage{}, fmt.Errorf("failed to read grid register: %w", err)
+	}
+	msg := PowerAlarmMessage{
+		Online:    grid > m.GridThreshold,
+		PowerType: PowerTypeUtility,
+		Scope:     ScopeLocal,
+	}
+	if m.SOC != nil {
+		soc, err := m.read(conn, *m.SOC)
+		if err != nil {
+			return PowerAlarmMessage{}, fmt.Errorf("failed to read SOC register: %w", err)
+		}
+		msg.Battery = &soc
+	}
+	if m.Load != nil {
+		load, err := m.read(conn, *m.Load)
+		if err != nil {
+			return PowerAlarmMessage{}, fmt.Errorf("failed to read load register: %w", err)
+		}
+		msg.Load = &load
+	}
+	return msg, nil
+}
+
+// read reads a single register and returns its scaled value.
+func (m *modbusSource) read(conn net.Conn, r modbusRegister) (float64, error) {
+	m.mu.Lock()
+	m.txnID++
+	txn := m.txnID
+	m.mu.Unlock()
+
+	// MBAP header (transaction, protocol, length, unit) followed by the PDU
+	// (function, start address, quantity).
+	req := make([]byte, 12)
+	binary.BigEndian.PutUint16(req[0:], txn)
+	binary.BigEndian.PutUint16(req[2:], 0)
+	binary.BigEndian.PutUint16(req[4:], 6)
+	req[6] = m.Unit
+	req[7] = r.Function
+	binary.BigEndian.PutUint16(req[8:], r.Address)
+	binary.BigEndian.PutUint16(req[10:], 1)
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	hdr := make([]byte, 7)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint16(hdr[0:]) != txn {
+		return 0, fmt.Errorf("mismatched transaction ID in response")
+	}
+	length := binary.BigEndian.Uint16(hdr[4:])
+	if length < 2 || length > 256 {
+		return 0, fmt.Errorf("invalid response length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(conn, pdu); err != nil {
+		return 0, err
+	}
+	if pdu[0] == r.Function|0x80 && len(pdu) >= 2 {
+		return 0, fmt.Errorf("modbus exception code %d", pdu[1])
+	}
+	if pdu[0] != r.Function || len(pdu) < 4 || pdu[1] != 2 {
+		return 0, fmt.Errorf("malformed response")
+	}
+	return float64(binary.BigEndian.Uint16(pdu[2:])) * r.Scale, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/eclipse/paho.golang/packets"
+)
+
+const (
+	// mqttVersion5 and mqttVersion311 are the values of -mqtt-version.
+	mqttVersion5   = "5"
+	mqttVersion311 = "3.1.1"
+
+	// mqtt311ProtocolLevel is the CONNECT protocol level of MQTT 3.1.1.
+	mqtt311ProtocolLevel = 4
+)
+
+// mqtt311ConnackCodes maps MQTT 3.1.1 CONNACK return codes to the MQTT 5
+// reason codes with the same meaning.
+var mqtt311ConnackCodes = map[byte]byte{
+	0: 0x00, // accepted: success
+	1: 0x84, // unacceptable protocol version: unsupported protocol version
+	2: 0x85, // identifier rejected: client identifier not valid
+	3: 0x88, // server unavailable: server unavailable
+	4: 0x86, // bad user name or password: bad user name or password
+	5: 0x87, // not authorized: not authorized
+}
+
+// mqtt311Conn is a connection to an MQTT 3.1.1 broker for paho, which only
+// speaks MQTT 5: it rewrites each packet paho writes as its 3.1.1
+// equivalent, and each packet the broker sends as its MQTT 5 equivalent.
+// MQTT 5 properties (e.g. message expiry) and subscription options other than
+// QoS are dropped. A session expiry interval, which 3.1.1 lacks, maps to a
+// clean session if it is zero and to a persistent session otherwise.
+type mqtt311Conn struct {
+	net.Conn
+
+	r    *bufio.Reader
+	rbuf []byte // rewritten bytes not yet returned by Read
+
+	writeMu sync.Mutex
+	wbuf    []byte // bytes written that don't yet make up a whole packet
+
+	mu sync.Mutex
+	// unsubscribes holds the number of topics in each UNSUBSCRIBE awaiting
+	// its UNSUBACK, which in MQTT 5 has a reason code for each.
+	unsubscribes map[uint16]int
+}
+
+func newMQTT311Conn(conn net.Conn) *mqtt311Conn {
+	return &mqtt311Conn{Conn: conn, r: bufio.NewReader(conn), unsubscribes: make(map[uint16]int)}
+}
+
+func (c *mqtt311Conn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		header, body, err := readRawPacket(c.r)
+		if err != nil {
+			return 0, err
+		}
+		if c.rbuf, err = c.upgrade(header, body); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *mqtt311Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.wbuf = append(c.wbuf, p...)
+	for {
+		n := rawPacketLen(c.wbuf)
+		if n == 0 {
+			return len(p), nil
+		}
+		cp, err := packets.ReadPacket(bytes.NewReader(c.wbuf[:n]))
+		if err != nil {
+			return 0, err
+		}
+		c.wbuf = c.wbuf[n:]
+		out, err := c.downgrade(cp)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// downgrade returns the MQTT 3.1.1 encoding of cp, an MQTT 5 packet.
+func (c *mqtt311Conn) downgrade(cp *packets.ControlPacket) ([]byte, error) {
+	var b bytes.Buffer
+	flags := byte(0)
+	switch p := cp.Content.(type) {
+	case *packets.Connect:
+		writeRawString(&b, "MQTT")
+		b.WriteByte(mqtt311ProtocolLevel)
+		cleanSession := p.CleanStart || p.Properties == nil || p.Properties.SessionExpiryInterval == nil || *p.Properties.SessionExpiryInterval == 0
+		var connectFlags byte
+		if cleanSession {
+			connectFlags |= 0x02
+		}
+		if p.WillFlag {
+			connectFlags |= 0x04 | p.WillQOS<<3
+			if p.WillRetain {
+				connectFlags |= 0x20
+			}
+		}
+		if p.PasswordFlag {
+			connectFlags |= 0x40
+		}
+		if p.UsernameFlag {
+			connectFlags |= 0x80
+		}
+		b.WriteByte(connectFlags)
+		_ = binary.Write(&b, binary.BigEndian, p.KeepAlive)
+		writeRawString(&b, p.ClientID)
+		if p.WillFlag {
+			writeRawString(&b, p.WillTopic)
+			writeRawString(&b, string(p.WillMessage))
+		}
+		if p.UsernameFlag {
+			writeRawString(&b, p.Username)
+		}
+		if p.PasswordFlag {
+			writeRawString(&b, string(p.Password))
+		}
+	case *packets.Publish:
+		flags = p.QoS << 1
+		if p.Duplicate {
+			flags |= 0x08
+		}
+		if p.Retain {
+			flags |= 0x01
+		}
+		writeRawString(&b, p.Topic)
+		if p.QoS > 0 {
+			_ = binary.Write(&b, binary.BigEndian, p.PacketID)
+		}
+		b.Write(p.Payload)
+	case *packets.Puback, *packets.Pubrec, *packets.Pubrel, *packets.Pubcomp:
+		// The MQTT 5 reason code and properties are dropped; 3.1.1 has only
+		// the packet ID.
+		if cp.Type == packets.PUBREL {
+			flags = 0x02
+		}
+		_ = binary.Write(&b, binary.BigEndian, cp.PacketID())
+	case *packets.Subscribe:
+		flags = 0x02
+		_ = binary.Write(&b, binary.BigEndian, p.PacketID)
+		for _, s := range p.Subscriptions {
+			writeRawString(&b, s.Topic)
+			b.WriteByte(s.QoS)
+		}
+	case *packets.Unsubscribe:
+		flags = 0x02
+		_ = binary.Write(&b, binary.BigEndian, p.PacketID)
+		for _, t := range p.Topics {
+			writeRawString(&b, t)
+		}
+		c.mu.Lock()
+		c.unsubscribes[p.PacketID] = len(p.Topics)
+		c.mu.Unlock()
+	case *packets.Pingreq, *packets.Disconnect:
+		// Neither has a body in 3.1.1.
+	default:
+		return nil, fmt.Errorf("MQTT 3.1.1 has no %s packet", cp.PacketType())
+	}
+	return rawPacket(cp.Type<<4|flags, b.Bytes()), nil
+}
+
+// upgrade returns the MQTT 5 encoding of the MQTT 3.1.1 packet with the given
+// fixed header byte and body.
+func (c *mqtt311Conn) upgrade(header byte, body []byte) ([]byte, error) {
+	switch header >> 4 {
+	case packets.CONNACK:
+		if len(body) != 2 {
+			return nil, errors.New("malformed CONNACK")
+		}
+		code, ok := mqtt311ConnackCodes[body[1]]
+		if !ok {
+			code = 0x80 // unspecified error
+		}
+		return rawPacket(header, []byte{body[0], code, 0}), nil
+	case packets.PUBLISH:
+		if len(body) < 2 {
+			return nil, errors.New("malformed PUBLISH")
+		}
+		// Add empty properties after the topic and, at QoS 1 or 2, the
+		// packet ID.
+		n := 2 + int(binary.BigEndian.Uint16(body))
+		if (header>>1)&0x3 > 0 {
+			n += 2
+		}
+		if n > len(body) {
+			return nil, errors.New("malformed PUBLISH")
+		}
+		return rawPacket(header, slices.Insert(body, n, 0)), nil
+	case packets.SUBACK:
+		if len(body) < 2 {
+			return nil, errors.New("malformed SUBACK")
+		}
+		// Add empty properties after the packet ID; the 3.1.1 return codes
+		// are valid MQTT 5 reason codes.
+		return rawPacket(header, slices.Insert(body, 2, 0)), nil
+	case packets.UNSUBACK:
+		if len(body) != 2 {
+			return nil, errors.New("malformed UNSUBACK")
+		}
+		id := binary.BigEndian.Uint16(body)
+		c.mu.Lock()
+		n := c.unsubscribes[id]
+		delete(c.unsubscribes, id)
+		c.mu.Unlock()
+		// Empty properties, then success for each topic.
+		return rawPacket(header, append(append(body, 0), make([]byte, n)...)), nil
+	default:
+		// PUBACK, PUBREC, PUBREL and PUBCOMP with only a packet ID, and
+		// PINGRESP, are the same in MQTT 5.
+		return rawPacket(header, body), nil
+	}
+}
+
+// readRawPacket reads an MQTT packet from r, returning its fixed header byte
+// and its body.
+func readRawPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > 268435455 { // the largest remaining length MQTT can encode
+		return 0, nil, errors.New("malformed packet length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// rawPacketLen returns the length of the whole packet at the start of b, or 0
+// if b doesn't hold all of it yet.
+func rawPacketLen(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	length, n := binary.Uvarint(b[1:])
+	if n <= 0 || 1+n+int(length) > len(b) {
+		return 0
+	}
+	return 1 + n + int(length)
+}
+
+// rawPacket encodes a packet from its fixed header byte and body. The MQTT
+// remaining length is a varint as encoded by encoding/binary.
+func rawPacket(header byte, body []byte) []byte {
+	out := []byte{header}
+	out = binary.AppendUvarint(out, uint64(len(body)))
+	return append(out, body...)
+}
+
+func writeRawString(b *bytes.Buffer, s string) {
+	_ = binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
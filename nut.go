@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const nutDefaultPort = "3493"
+
+// nutSource polls a NUT upsd server for ups.status and battery.charge.
+type nutSource struct {
+	Addr     string
+	UPS      string
+	Username string
+	Password string
+	Interval time.Duration
+}
+
+func (n *nutSource) Name() string {
+	return fmt.Sprintf("nut:%s@%s", n.UPS, n.Addr)
+}
+
+func (n *nutSource) Run(ctx context.Context, events chan<- powerEvent) {
+	runPoller(ctx, n.Name(), n.Interval, n.poll, events)
+}
+
+// poll makes a single connection to upsd and reads the UPS's status.
+func (n *nutSource) poll(ctx context.Context) (PowerAlarmMessage, error) {
+	addr := n.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, nutDefaultPort)
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.Interval)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return PowerAlarmMessage{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	r := bufio.NewReader(conn)
+
+	cmd := func(line string) (string, error) {
+		if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+			return "", err
+		}
+		resp, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		resp = strings.TrimSpace(resp)
+		if strings.HasPrefix(resp, "ERR ") {
+			return "", fmt.Errorf("upsd: %s", resp)
+		}
+		return resp, nil
+	}
+	getVar := func(v string) (string, error) {
+		resp, err := cmd(fmt.Sprintf("GET VAR %s %s", n.UPS, v))
+		if err != nil {
+			return "", err
+		}
+		// VAR <ups> <var> "<value>"
+		prefix := fmt.Sprintf("VAR %s %s ", n.UPS, v)
+		if !strings.HasPrefix(resp, prefix) {
+			return "", fmt.Errorf("unexpected upsd response: %s", resp)
+		}
+		return strconv.Unquote(strings.TrimPrefix(resp, prefix))
+	}
+
+	if n.Username != "" {
+		if _, err := cmd("USERNAME " + n.Username); err != nil {
+			return PowerAlarmMessage{}, err
+		}
+		if _, err := cmd("PASSWORD " + n.Password); err != nil {
+			return PowerAlarmMessage{}, err
+		}
+	}
+
+	status, err := getVar("ups.status")
+	if err != nil {
+		return PowerAlarmMessage{}, err
+	}
+	msgs, err := normalizeNUTStatus("", []byte(status))
+	if err != nil {
+		return PowerAlarmMessage{}, err
+	}
+	m := msgs[0]
+	if charge, err := getVar("battery.charge"); err == nil {
+		if pct, err := strconv.ParseFloat(charge, 64); err == nil {
+			m.Battery = &pct
+		}
+	}
+	_, _ = fmt.Fprintln(conn, "LOGOUT")
+	return m, nil
+}
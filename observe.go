@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// observeReportTimeout bounds how long publishing or POSTing the observation
+// report may take.
+const observeReportTimeout = 10 * time.Second
+
+// Observation is an action the daemon would have taken in observation mode.
+type Observation struct {
+	At     time.Time `json:"at"`
+	Action string    `json:"action"`
+	Reason string    `json:"reason"`
+}
+
+// ObservationReport summarizes an observation period.
+type ObservationReport struct {
+	Host         string        `json:"host"`
+	From         time.Time     `json:"from"`
+	To           time.Time     `json:"to"`
+	Observations []Observation `json:"observations"`
+	// Enabled reports whether real actions were enabled at the end of the
+	// period; if not, they await a "confirm" command on the control topic.
+	Enabled bool `json:"enabled"`
+}
+
+// observer is an Action that, during an observation (canary) period, only
+// records what the wrapped Action would have done. Once the period ends it
+// reports what it saw and, if AutoEnable is set or once confirmed, passes
+// everything through to the wrapped Action.
+type observer struct {
+	Action
+	Clock       Clock
+	Period      time.Duration
+	AutoEnable  bool
+	Hostname    string
+	Publisher   *publisher
+	ReportTopic string
+	ReportURL   string
+
+	mu           sync.Mutex
+	live         bool
+	started      time.Time
+	observations []Observation
+}
+
+// Run waits out the observation period, then reports and, if AutoEnable is
+// set, enables real actions.
+func (o *observer) Run(ctx context.Context) {
+	o.mu.Lock()
+	o.started = o.Clock.Now()
+	o.mu.Unlock()
+	log.Printf("observation mode: for %s, actions will be recorded but not taken", o.Period)
+
+	t := time.NewTimer(o.Period)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-t.C:
+	}
+
+	o.mu.Lock()
+	o.live = o.live || o.AutoEnable
+	report := ObservationReport{
+		Host:         o.Hostname,
+		From:         o.started,
+		To:           o.Clock.Now(),
+		Observations: append([]Observation(nil), o.observations...),
+		Enabled:      o.live,
+	}
+	o.mu.Unlock()
+	o.report(ctx, report)
+}
+
+// Enable ends observation, e.g. when an operator confirms the daemon's
+// behavior. It returns an error if actions are already enabled.
+func (o *observer) Enable() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.live {
+		return fmt.Errorf("actions are already enabled")
+	}
+	o.live = true
+	log.Printf("observation mode ended by confirmation; actions are now enabled")
+	return nil
+}
+
+// observing records an action if still observing, returning false if the
+// action should actually be taken.
+func (o *observer) observing(action, reason string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.live {
+		return false
+	}
+	log.Printf("[observe] would %s: %s", action, reason)
+	o.observations = append(o.observations, Observation{At: o.Clock.Now(), Action: action, Reason: reason})
+	return true
+}
+
+func (o *observer) Armed(ctx context.Context, p Pending) {
+	o.Wrap(o.Action).Armed(ctx, p)
+}
+
+func (o *observer) Held(ctx context.Context, p Pending, until time.Time) {
+	o.Wrap(o.Action).Held(ctx, p, until)
+}
+
+func (o *observer) Cancelled(ctx context.Context, p Pending, ev powerEvent) {
+	o.Wrap(o.Action).Cancelled(ctx, p, ev)
+}
+
+func (o *observer) Execute(ctx context.Context, p Pending) {
+	o.Wrap(o.Action).Execute(ctx, p)
+}
+
+// Wrap returns a, recorded instead of taken while observing, e.g. the
+// action of a named rule.
+func (o *observer) Wrap(a Action) Action {
+	return observedAction{Action: a, o: o}
+}
+
+// observedAction is an Action whose effects are recorded by an observer
+// while it's observing.
+type observedAction struct {
+	Action
+	o *observer
+}
+
+func (a observedAction) Armed(ctx context.Context, p Pending) {
+	if !a.o.observing("arm", fmt.Sprintf("%s from %s; would execute at %s", p.Trigger.Message.String(), p.Trigger.Source, p.ExecuteAt.Format(time.RFC3339))) {
+		a.Action.Armed(ctx, p)
+	}
+}
+
+func (a observedAction) Held(ctx context.Context, p Pending, until time.Time) {
+	if !a.o.observing("hold", fmt.Sprintf("until %s", until.Format(time.RFC3339))) {
+		a.Action.Held(ctx, p, until)
+	}
+}
+
+func (a observedAction) Cancelled(ctx context.Context, p Pending, ev powerEvent) {
+	if !a.o.observing("cancel", fmt.Sprintf("%s from %s", ev.Message.String(), ev.Source)) {
+		a.Action.Cancelled(ctx, p, ev)
+	}
+}
+
+func (a observedAction) Execute(ctx context.Context, p Pending) {
+	if !a.o.observing("execute", fmt.Sprintf("armed at %s by %s from %s", p.ArmedAt.Format(time.RFC3339), p.Trigger.Message.String(), p.Trigger.Source)) {
+		a.Action.Execute(ctx, p)
+	}
+}
+
+// WrapStep returns step, recorded instead of run while observing.
+func (o *observer) WrapStep(step Step) Step {
+	run := step.Run
+	step.Run = func(ctx context.Context, p Pending) {
+		if !o.observing("run step", fmt.Sprintf("+%s: %s", step.Offset, step.Name)) {
+			run(ctx, p)
+		}
+	}
+	return step
+}
+
+// report logs the report and sends it to the report topic and URL, if set.
+func (o *observer) report(ctx context.Context, r ObservationReport) {
+	next := "waiting for a \"confirm\" command on the control topic"
+	if r.Enabled {
+		next = "actions are now enabled"
+	}
+	log.Printf("observation period ended: %d actions would have been taken; %s", len(r.Observations), next)
+	for _, obs := range r.Observations {
+		log.Printf("  %s: would %s: %s", obs.At.Format(time.RFC3339), obs.Action, obs.Reason)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, observeReportTimeout)
+	defer cancel()
+	if o.ReportTopic != "" {
+		if err := o.Publisher.PublishJSON(ctx, o.ReportTopic, r, false); err != nil {
+			log.Printf("failed to publish observation report to '%s': %s", o.ReportTopic, err)
+		}
+	}
+	if o.ReportURL != "" {
+		if err := postJSON(ctx, o.ReportURL, r); err != nil {
+			log.Printf("failed to POST observation report to '%s': %s", o.ReportURL, err)
+		}
+	}
+}
+
+// postJSON POSTs v, marshalled as JSON, to url.
+func postJSON(ctx context.Context, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
@@ -1,6 +1,13 @@
 package main
 
-import "log"
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
 
 func StrictLogger(strict bool) func(m string) {
 	if strict {
@@ -23,3 +30,88 @@ func DebugLogger(debug bool) func(m string) {
 		return func(m string) {}
 	}
 }
+
+const (
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiCyan   = "\033[36m"
+	ansiGray   = "\033[90m"
+)
+
+var colorModes = []string{"auto", "always", "never"}
+
+// SetupConsoleLogging configures the standard logger for the given -color mode.
+// In "auto" mode, leveled, colorized output is used only when stderr is a
+// terminal and $NO_COLOR is unset, so output under systemd stays plain.
+func SetupConsoleLogging(mode string) error {
+	switch mode {
+	case "always":
+	case "never":
+		return nil
+	case "auto":
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" || !isTerminal(os.Stderr) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("must be one of: %s", strings.Join(colorModes, ", "))
+	}
+	log.SetFlags(0)
+	log.SetOutput(consoleWriter{os.Stderr})
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// consoleWriter receives one log entry per Write and prints it with a
+// timestamp and a colorized level. Messages tagged [DEBUG], [WARN] or [ERROR]
+// use that level; otherwise the level is inferred from the message.
+// Shutdown countdown and recovery lines are highlighted.
+type consoleWriter struct {
+	w io.Writer
+}
+
+func (c consoleWriter) Write(p []byte) (int, error) {
+	level, msg := logLevel(strings.TrimSuffix(string(p), "\n"))
+	var color string
+	switch level {
+	case "DEBUG":
+		color = ansiGray
+	case "INFO":
+		color = ansiCyan
+	case "WARN":
+		color = ansiYellow
+	case "ERROR":
+		color = ansiRed
+	}
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "shutdown in") || strings.Contains(lower, "calling shutdown") || strings.Contains(lower, "shutdown initiated"):
+		msg = ansiBold + ansiRed + msg + ansiReset
+	case strings.Contains(lower, "power recovered"):
+		msg = ansiBold + ansiGreen + msg + ansiReset
+	}
+	_, err := fmt.Fprintf(c.w, "%s%s%s %s%-5s%s %s\n", ansiGray, time.Now().Format("15:04:05"), ansiReset, color, level, ansiReset, msg)
+	return len(p), err
+}
+
+func logLevel(msg string) (level, rest string) {
+	for _, l := range []string{"DEBUG", "WARN", "ERROR"} {
+		if rest, ok := strings.CutPrefix(msg, "["+l+"] "); ok {
+			return l, rest
+		}
+	}
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "fail") || strings.Contains(lower, "error") || strings.Contains(lower, "invalid"):
+		return "ERROR", msg
+	case strings.Contains(lower, "timed out") || strings.Contains(lower, "disabled") || strings.Contains(lower, "unexpected"):
+		return "WARN", msg
+	}
+	return "INFO", msg
+}
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
 //goland:noinspection GoUnusedConst
 const (
 	PowerTypeUtility   = 1
@@ -20,6 +27,25 @@ type PowerAlarmMessage struct {
 	Online    bool   `json:"up"`
 	PowerType int    `json:"type"`
 	Scope     string `json:"scope"`
+	// Battery is the optional battery state of charge, in percent.
+	Battery *float64 `json:"battery,omitempty"`
+	// Load is the optional output load, in percent of capacity.
+	Load *float64 `json:"load,omitempty"`
+	// Host optionally limits the message to hosts whose name matches it,
+	// exactly or as a glob (e.g. "nas-*"). Target is accepted as a synonym.
+	Host   string `json:"host,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Targets optionally limits the message to hosts whose -tags match
+	// this selector, e.g. "rack=2,tier=compute"; see MatchesTags.
+	Targets string `json:"targets,omitempty"`
+	// Phase and Circuit optionally identify the phase or branch circuit a
+	// single-phase (1p) or single-circuit (1c) event is about; see
+	// AffectsSupply.
+	Phase   string `json:"phase,omitempty"`
+	Circuit string `json:"circuit,omitempty"`
+	// At is the optional time the event happened, which -retained
+	// ignore-if-older-than uses to age retained messages.
+	At *time.Time `json:"at,omitempty"`
 }
 
 func (p *PowerAlarmMessage) Valid() bool {
@@ -28,3 +54,81 @@ func (p *PowerAlarmMessage) Valid() bool {
 	}
 	return true
 }
+
+// BatteryPercent returns the battery state of charge, or -1 if unknown.
+func (p *PowerAlarmMessage) BatteryPercent() float64 {
+	if p.Battery == nil {
+		return -1
+	}
+	return *p.Battery
+}
+
+// LoadPercent returns the output load, or -1 if unknown.
+func (p *PowerAlarmMessage) LoadPercent() float64 {
+	if p.Load == nil {
+		return -1
+	}
+	return *p.Load
+}
+
+// Equal reports whether p and o carry the same information.
+func (p *PowerAlarmMessage) Equal(o PowerAlarmMessage) bool {
+	return p.Online == o.Online && p.PowerType == o.PowerType && p.Scope == o.Scope && p.BatteryPercent() == o.BatteryPercent() && p.LoadPercent() == o.LoadPercent() &&
+		p.Host == o.Host && p.Target == o.Target && p.Targets == o.Targets && p.Phase == o.Phase && p.Circuit == o.Circuit
+}
+
+// TargetsHost reports whether the message applies to the named host: it does
+// if it names no host, or if its host pattern matches hostname or hostname's
+// first label, case-insensitively.
+func (p *PowerAlarmMessage) TargetsHost(hostname string) bool {
+	pattern := p.Host
+	if pattern == "" {
+		pattern = p.Target
+	}
+	if pattern == "" {
+		return true
+	}
+	pattern, hostname = strings.ToLower(pattern), strings.ToLower(hostname)
+	short, _, _ := strings.Cut(hostname, ".")
+	for _, h := range []string{hostname, short} {
+		if ok, err := path.Match(pattern, h); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PowerAlarmMessage) String() string {
+	state := "down"
+	if p.Online {
+		state = "up"
+	}
+	scope := p.Scope
+	switch {
+	case p.Scope == ScopeSinglePhase && p.Phase != "":
+		scope += " " + p.Phase
+	case p.Scope == ScopeOneCircuit && p.Circuit != "":
+		scope += " " + p.Circuit
+	}
+	if p.Battery != nil {
+		return fmt.Sprintf("%s power %s (scope: %s, battery: %.0f%%)", powerTypeName(p.PowerType), state, scope, *p.Battery)
+	}
+	return fmt.Sprintf("%s power %s (scope: %s)", powerTypeName(p.PowerType), state, scope)
+}
+
+func powerTypeName(t int) string {
+	switch t {
+	case PowerTypeUtility:
+		return "utility"
+	case PowerTypeGenerator:
+		return "generator"
+	case PowerTypeBattery:
+		return "battery"
+	case PowerTypeSolar:
+		return "solar"
+	case PowerTypeOther:
+		return "other"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gridPresentWatts is the AC input power, in watts, above which a portable
+// power station is considered to be receiving grid power. A small threshold
+// avoids treating sensor noise on a disconnected input as grid presence.
+const gridPresentWatts = 5
+
+// normalizeEcoFlow accepts EcoFlow quota messages, e.g.
+//
+//	{"params": {"inv.acInVol": 121000, "inv.inputWatts": 80, "pd.soc": 95}}
+//
+// Grid presence is determined from the AC input voltage when reported, and
+// from AC input wattage otherwise. Messages carrying neither are ignored.
+func normalizeEcoFlow(_ string, payload []byte) ([]PowerAlarmMessage, error) {
+	var msg struct {
+		Params map[string]any `json:"params"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+	if msg.Params == nil {
+		return nil, fmt.Errorf("EcoFlow message has no params object")
+	}
+	num := func(keys ...string) (float64, bool) {
+		for _, k := range keys {
+			if v, ok := msg.Params[k].(float64); ok {
+				return v, true
+			}
+		}
+		return 0, false
+	}
+
+	m := PowerAlarmMessage{PowerType: PowerTypeUtility, Scope: ScopeLocal}
+	if vol, ok := num("inv.acInVol"); ok {
+		m.Online = vol > 0
+	} else if watts, ok := num("inv.inputWatts", "inv.acInWatts"); ok {
+		m.Online = watts > gridPresentWatts
+	} else {
+		return nil, nil
+	}
+	if soc, ok := num("pd.soc", "bms_bmsStatus.soc", "soc"); ok {
+		m.Battery = &soc
+	}
+	return []PowerAlarmMessage{m}, nil
+}
+
+// newBluettiNormalizer returns a normalizer for topics published by
+// bluetti_mqtt, where each field is published on its own topic:
+//
+//	bluetti/state/<device>/ac_input_power     123
+//	bluetti/state/<device>/total_battery_percent  85
+//
+// It remembers the latest state of charge and emits a message on each AC input
+// power update.
+func newBluettiNormalizer() normalizer {
+	var (
+		mu  sync.Mutex
+		soc = make(map[string]float64)
+	)
+	return func(topic string, payload []byte) ([]PowerAlarmMessage, error) {
+		device, field := path.Split(topic)
+		if field != "total_battery_percent" && field != "ac_input_power" {
+			return nil, nil // bluetti_mqtt publishes many fields that aren't used, some non-numeric
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+		if err != nil {
+			return nil, fmt.Errorf("non-numeric Bluetti %s value '%s'", field, payload)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if field == "total_battery_percent" {
+			soc[device] = v
+			return nil, nil
+		}
+		m := PowerAlarmMessage{
+			Online:    v > gridPresentWatts,
+			PowerType: PowerTypeUtility,
+			Scope:     ScopeLocal,
+		}
+		if pct, ok := soc[device]; ok {
+			m.Battery = &pct
+		}
+		return []PowerAlarmMessage{m}, nil
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// defaultPowerOffFallbacks are tried, in order, if the shutdown command keeps
+// failing: a forced poweroff that skips stopping services, then the kernel's
+// magic SysRq poweroff.
+var defaultPowerOffFallbacks = []string{"systemctl poweroff --force", powerOffSysRq}
+
+// sysrqSettle is how long sysrqPowerOff waits after each of the sync and
+// remount requests, which the kernel carries out asynchronously.
+const sysrqSettle = 3 * time.Second
+
+// sysrqPowerOff syncs and remounts filesystems read-only, then powers off
+// immediately via /proc/sysrq-trigger, bypassing init entirely.
+func sysrqPowerOff() error {
+	syscall.Sync()
+	for _, c := range []string{"s", "u", "o"} {
+		if err := os.WriteFile("/proc/sysrq-trigger", []byte(c), 0); err != nil {
+			return fmt.Errorf("failed to write '%s' to /proc/sysrq-trigger: %w", c, err)
+		}
+		if c != "o" {
+			time.Sleep(sysrqSettle)
+		}
+	}
+	return nil
+}
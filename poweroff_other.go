@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var defaultPowerOffFallbacks []string
+
+func sysrqPowerOff() error {
+	return errors.New("SysRq poweroff is only supported on Linux")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// brokerProbe is a short-lived, single-shot MQTT connection used by the
+// setup and doctor subcommands to check a broker configuration, as opposed
+// to the daemon's long-lived autopaho connection.
+type brokerProbe struct {
+	// Server is the broker's host and port or, for MQTT over WebSockets or
+	// a Unix domain socket, its ws://, wss:// or unix:// URL; see
+	// brokerProbeServer.
+	Server   string
+	TLS      *tls.Config // nil for plain TCP
+	Username string
+	Password string
+	// MQTTVersion is the -mqtt-version to connect with; empty means 5.
+	MQTTVersion string
+}
+
+// probeResult records how far a probe got. At most one of the errors is set;
+// later stages are not attempted after a failure.
+type probeResult struct {
+	DialErr      error
+	ConnectErr   error
+	SubscribeErr error
+
+	// Message is the first message received on the probed topic, if any.
+	Message *paho.Publish
+}
+
+// OK reports whether the probe connected and subscribed successfully.
+func (r probeResult) OK() bool {
+	return r.DialErr == nil && r.ConnectErr == nil && r.SubscribeErr == nil
+}
+
+// Run connects to the broker, subscribes to topic, and waits up to wait for a
+// message (typically a retained one) to arrive on it. If topic is empty, Run
+// only connects.
+func (p brokerProbe) Run(ctx context.Context, topic string, wait time.Duration) probeResult {
+	msgs := make(chan *paho.Publish, 1)
+	c, closeConn, res := p.Connect(ctx, func(m *paho.Publish) {
+		select {
+		case msgs <- m:
+		default:
+		}
+	})
+	if !res.OK() {
+		return res
+	}
+	defer closeConn()
+
+	if topic == "" {
+		return res
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := probeSubscribe(connectCtx, c, topic); err != nil {
+		res.SubscribeErr = err
+		return res
+	}
+
+	select {
+	case m := <-msgs:
+		res.Message = m
+	case <-time.After(wait):
+	case <-ctx.Done():
+	}
+	return res
+}
+
+// Connect dials the broker and connects, calling onPublish (from another
+// goroutine) for each message received. If the returned result is OK, the
+// caller must call closeConn when done with the client.
+func (p brokerProbe) Connect(ctx context.Context, onPublish func(*paho.Publish)) (c *paho.Client, closeConn func(), res probeResult) {
+	dialCtx, cancelDial := context.WithTimeout(ctx, 10*time.Second)
+	defer cancelDial()
+	conn, err := p.dial(dialCtx)
+	if err != nil {
+		res.DialErr = err
+		return nil, nil, res
+	}
+	if p.MQTTVersion == mqttVersion311 {
+		conn = packets.NewThreadSafeConn(newMQTT311Conn(conn))
+	}
+
+	c = paho.NewClient(paho.ClientConfig{
+		ClientID: fmt.Sprintf("%s-probe-%d", name, os.Getpid()),
+		Conn:     conn,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+			func(pr paho.PublishReceived) (bool, error) {
+				onPublish(pr.Packet)
+				return true, nil
+			},
+		},
+	})
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	ca, err := c.Connect(connectCtx, &paho.Connect{
+		KeepAlive:    30,
+		CleanStart:   true,
+		Username:     p.Username,
+		UsernameFlag: p.Username != "",
+		Password:     []byte(p.Password),
+		PasswordFlag: p.Password != "",
+	})
+	if err != nil {
+		_ = conn.Close()
+		if ca != nil && ca.ReasonCode != 0 {
+			err = fmt.Errorf("%w (reason code 0x%02x)", err, ca.ReasonCode)
+		}
+		res.ConnectErr = err
+		return nil, nil, res
+	}
+	return c, func() {
+		_ = c.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		_ = conn.Close()
+	}, res
+}
+
+// probeSubscribe subscribes c to topic, reporting a refusal's reason code.
+func probeSubscribe(ctx context.Context, c *paho.Client, topic string) error {
+	sa, err := c.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: topic, QoS: 1}},
+	})
+	return subackError(sa, err)
+}
+
+// dial connects to the broker at p.Server.
+func (p brokerProbe) dial(ctx context.Context) (net.Conn, error) {
+	if u, err := url.Parse(p.Server); err == nil {
+		if _, ok := webSocketSchemes[u.Scheme]; ok {
+			return dialWebSocket(ctx, u, p.TLS)
+		}
+		if u.Scheme == unixSocketScheme {
+			return dialUnixSocket(ctx, u.Path)
+		}
+	}
+	return dialBroker(ctx, p.Server, p.TLS)
+}
+
+// brokerProbeServer returns the brokerProbe Server for the broker at u.
+func brokerProbeServer(u *url.URL) string {
+	if _, ok := webSocketSchemes[u.Scheme]; ok || u.Scheme == unixSocketScheme {
+		return u.String()
+	}
+	return u.Host
+}
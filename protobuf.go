@@ -0,0 +1,139 @@
+//go:build !minimal
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufFormat is the format of protobuf payloads, decoded using the
+// message type named by -proto-message from the -proto-descriptor file.
+const protobufFormat = "protobuf"
+
+// protoDescriptor is the -proto-message type, with the types of the
+// -proto-descriptor file it is in.
+type protoDescriptor struct {
+	Types   *protoregistry.Files
+	Message protoreflect.MessageDescriptor
+}
+
+func init() {
+	formats[protobufFormat] = newProtobufNormalizer
+	formatRequirements[protobufFormat] = func(o formatOptions) error {
+		if o.Proto == nil {
+			return fmt.Errorf("the %s format requires -proto-descriptor and -proto-message", protobufFormat)
+		}
+		if len(o.FieldMappings) > 0 {
+			return nil
+		}
+		// protojson writes 64-bit integers as strings, which the json
+		// format's numeric fields don't accept; -field-map does.
+		fields := o.Proto.Message.Fields()
+		for _, name := range []protoreflect.Name{"type", "battery", "load"} {
+			if fd := fields.ByName(name); fd != nil && protoInt64Kinds[fd.Kind()] {
+				return fmt.Errorf("-proto-message field '%s' is a 64-bit integer; map it with -field-map, or use a 32-bit integer or a double", name)
+			}
+		}
+		return nil
+	}
+}
+
+// protoInt64Kinds are the 64-bit integer kinds, which protojson writes as
+// strings.
+var protoInt64Kinds = map[protoreflect.Kind]bool{
+	protoreflect.Int64Kind:    true,
+	protoreflect.Sint64Kind:   true,
+	protoreflect.Sfixed64Kind: true,
+	protoreflect.Uint64Kind:   true,
+	protoreflect.Fixed64Kind:  true,
+}
+
+// loadProtoDescriptor reads the FileDescriptorSet in file, as written by
+// 'protoc --include_imports --descriptor_set_out', and returns the message
+// type name from it.
+func loadProtoDescriptor(file, name string) (*protoDescriptor, error) {
+	if file == "" || name == "" {
+		return nil, errors.New("-proto-descriptor and -proto-message must be used together")
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read -proto-descriptor: %w", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("-proto-descriptor '%s' is not a FileDescriptorSet: %w", file, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -proto-descriptor '%s' (was it built with --include_imports?): %w", file, err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("-proto-message '%s' is not in -proto-descriptor '%s'", name, file)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("-proto-message '%s' is not a message type", name)
+	}
+	return &protoDescriptor{Types: files, Message: md}, nil
+}
+
+// Decode decodes payload as a d.Message. A payload that can't be decoded
+// yields an error and an empty message.
+func (d *protoDescriptor) Decode(payload []byte) (*dynamicpb.Message, error) {
+	m := dynamicpb.NewMessage(d.Message)
+	if err := proto.Unmarshal(payload, m); err != nil {
+		return dynamicpb.NewMessage(d.Message), err
+	}
+	return m, nil
+}
+
+// ExprMsg returns payload decoded for the msg expression variable, or nil if
+// d is nil or payload can't be decoded.
+func (d *protoDescriptor) ExprMsg(payload []byte) any {
+	if d == nil {
+		return nil
+	}
+	m, err := d.Decode(payload)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// newProtobufNormalizer returns a normalizer for the protobuf format. Each
+// payload is converted to JSON, using the field names of the .proto file and
+// enum numbers, and then normalized as the mapped format if -field-map is
+// given, or else as the json format, whose field names (up, type, scope, ...)
+// the message must then use. Fields left at their default value are left
+// out, as proto3 doesn't tell them from unset ones: an unset battery or load
+// isn't reported, and an unset up is false.
+func newProtobufNormalizer(opts formatOptions) normalizer {
+	desc := opts.Proto
+	next := normalizeJSON
+	if len(opts.FieldMappings) > 0 {
+		next = mappedNormalizer(opts.FieldMappings, true)
+	}
+	marshal := protojson.MarshalOptions{UseProtoNames: true, UseEnumNumbers: true}
+	return func(topic string, payload []byte) ([]PowerAlarmMessage, error) {
+		m, err := desc.Decode(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", desc.Message.FullName(), err)
+		}
+		j, err := marshal.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		return next(topic, j)
+	}
+}
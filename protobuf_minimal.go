@@ -0,0 +1,13 @@
+//go:build minimal
+
+package main
+
+// protobufFormat isn't among the formats of minimal builds, which leave out
+// the protobuf runtime; -proto-descriptor is rejected at startup.
+const protobufFormat = "protobuf"
+
+type protoDescriptor struct{}
+
+func loadProtoDescriptor(string, string) (*protoDescriptor, error) { return nil, nil }
+
+func (*protoDescriptor) ExprMsg([]byte) any { return nil }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// publishBufferSize bounds how many publishes are buffered while the broker
+// is unreachable; beyond it, the oldest are dropped.
+const publishBufferSize = 256
+
+// stateFilePublishes holds the publish buffer, so it survives the daemon
+// exiting while the broker is unreachable.
+const stateFilePublishes = "publishes.json"
+
+// publisher publishes messages over the daemon's MQTT connection. The
+// connection manager is provided once the connection comes up.
+//
+// Publishes attempted while the connection is down are buffered and sent by
+// Flush once it's back, so the record of what happened during an outage that
+// also cut the network reaches the broker late rather than never. The buffer
+// is persisted in Store, if it's enabled, and restored by Restore, so it also
+// survives the daemon exiting (e.g. when the primary broker disconnects) or
+// the host shutting down before the broker is back.
+type publisher struct {
+	Store stateStore
+
+	mu sync.RWMutex
+	cm *autopaho.ConnectionManager
+
+	inflight sync.WaitGroup
+
+	bufMu    sync.Mutex
+	buffered []bufferedPublish
+}
+
+type bufferedPublish struct {
+	Publish  *paho.Publish
+	QueuedAt time.Time
+}
+
+// persistedPublish is a bufferedPublish as stored in stateFilePublishes.
+type persistedPublish struct {
+	Topic    string    `json:"topic"`
+	Retain   bool      `json:"retain,omitempty"`
+	Payload  []byte    `json:"payload"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// Restore loads publishes buffered by a previous run from Store, ahead of
+// any buffered since, for the next Flush.
+func (p *publisher) Restore() {
+	var persisted []persistedPublish
+	if err := p.Store.ReadJSON(stateFilePublishes, &persisted); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[WARN] failed to restore buffered publishes: %s", err)
+		}
+		return
+	}
+	var restored []bufferedPublish
+	for _, pp := range persisted {
+		restored = append(restored, bufferedPublish{
+			Publish:  &paho.Publish{Topic: pp.Topic, QoS: 1, Retain: pp.Retain, Payload: pp.Payload},
+			QueuedAt: pp.QueuedAt,
+		})
+	}
+	p.bufMu.Lock()
+	defer p.bufMu.Unlock()
+	p.buffered = append(restored, p.buffered...)
+	if len(p.buffered) > publishBufferSize {
+		p.buffered = p.buffered[len(p.buffered)-publishBufferSize:]
+	}
+	if len(restored) > 0 {
+		log.Printf("restored %d buffered publishes from a previous run", len(restored))
+	}
+}
+
+// persist writes the buffer to Store. p.bufMu must be held.
+func (p *publisher) persist() {
+	var err error
+	if len(p.buffered) == 0 {
+		err = p.Store.Remove(stateFilePublishes)
+	} else {
+		persisted := make([]persistedPublish, 0, len(p.buffered))
+		for _, b := range p.buffered {
+			persisted = append(persisted, persistedPublish{
+				Topic:    b.Publish.Topic,
+				Retain:   b.Publish.Retain,
+				Payload:  b.Publish.Payload,
+				QueuedAt: b.QueuedAt,
+			})
+		}
+		err = p.Store.WriteJSON(stateFilePublishes, persisted)
+	}
+	if err != nil {
+		log.Printf("[WARN] failed to persist buffered publishes: %s", err)
+	}
+}
+
+func (p *publisher) SetConnectionManager(cm *autopaho.ConnectionManager) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cm = cm
+}
+
+// PublishJSON marshals v and publishes it to topic with QoS 1, blocking until
+// the broker acknowledges it or ctx is done. If the connection is down, the
+// message is buffered for Flush instead and PublishJSON returns nil.
+func (p *publisher) PublishJSON(ctx context.Context, topic string, v any, retain bool) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, topic, payload, retain)
+}
+
+// Publish is PublishJSON for a payload that is already encoded.
+func (p *publisher) Publish(ctx context.Context, topic string, payload []byte, retain bool) error {
+	p.inflight.Add(1)
+	defer p.inflight.Done()
+	pb := &paho.Publish{
+		Topic:   topic,
+		QoS:     1,
+		Retain:  retain,
+		Payload: payload,
+	}
+	cm, err := p.connectionManager()
+	if err == nil {
+		_, err = cm.Publish(ctx, pb)
+	}
+	if errors.Is(err, autopaho.ConnectionDownError) {
+		p.buffer(bufferedPublish{Publish: pb, QueuedAt: time.Now()})
+		return nil
+	}
+	return err
+}
+
+func (p *publisher) buffer(b bufferedPublish) {
+	p.bufMu.Lock()
+	defer p.bufMu.Unlock()
+	if len(p.buffered) >= publishBufferSize {
+		log.Printf("[WARN] publish buffer full; dropping buffered message to '%s' queued at %s", p.buffered[0].Publish.Topic, p.buffered[0].QueuedAt.Format(time.RFC3339))
+		p.buffered = p.buffered[1:]
+	}
+	p.buffered = append(p.buffered, b)
+	p.persist()
+	log.Printf("broker unreachable; buffered publish to '%s' (%d buffered)", b.Publish.Topic, len(p.buffered))
+}
+
+// Buffered returns how many publishes are waiting to be flushed.
+func (p *publisher) Buffered() int {
+	p.bufMu.Lock()
+	defer p.bufMu.Unlock()
+	return len(p.buffered)
+}
+
+// Flush sends buffered publishes in order, each with a "queued-at" user
+// property recording when it was originally attempted. It stops, keeping the
+// rest buffered, if the connection goes down again.
+func (p *publisher) Flush(ctx context.Context) {
+	p.bufMu.Lock()
+	pending := p.buffered
+	p.buffered = nil
+	p.bufMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	cm, err := p.connectionManager()
+	for i, b := range pending {
+		if err == nil {
+			b.Publish.Properties = &paho.PublishProperties{User: paho.UserProperties{
+				{Key: "queued-at", Value: b.QueuedAt.Format(time.RFC3339)},
+			}}
+			_, err = cm.Publish(ctx, b.Publish)
+		}
+		if err != nil {
+			log.Printf("failed to flush buffered publishes: %s", err)
+			p.bufMu.Lock()
+			p.buffered = append(pending[i:], p.buffered...)
+			p.persist()
+			p.bufMu.Unlock()
+			return
+		}
+	}
+	p.bufMu.Lock()
+	p.persist()
+	p.bufMu.Unlock()
+	log.Printf("flushed %d buffered publishes", len(pending))
+}
+
+// RespondJSON publishes v as the MQTT v5 response to req, on its Response
+// Topic and with its Correlation Data, so the requester can match it up.
+func (p *publisher) RespondJSON(ctx context.Context, req *paho.Publish, v any) error {
+	p.inflight.Add(1)
+	defer p.inflight.Done()
+	if req.Properties == nil || req.Properties.ResponseTopic == "" {
+		return errors.New("request has no response topic")
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	cm, err := p.connectionManager()
+	if err != nil {
+		return err
+	}
+	_, err = cm.Publish(ctx, &paho.Publish{
+		Topic:   req.Properties.ResponseTopic,
+		QoS:     1,
+		Payload: payload,
+		Properties: &paho.PublishProperties{
+			CorrelationData: req.Properties.CorrelationData,
+			ContentType:     "application/json",
+		},
+	})
+	return err
+}
+
+func (p *publisher) connectionManager() (*autopaho.ConnectionManager, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.cm == nil {
+		return nil, autopaho.ConnectionDownError
+	}
+	return p.cm, nil
+}
+
+// Drain waits until every in-progress publish has completed or ctx is done.
+func (p *publisher) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
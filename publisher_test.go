@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublisherFlushesBufferAfterReconnecting(t *testing.T) {
+	ctx := context.Background()
+	store, err := newStateStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := newFakeBroker(t)
+	conn := newConnectionState(time.Now())
+	pub := &publisher{Store: store}
+	connectPrimary(t, broker, conn, pub)
+	waitFor(t, "connected", func() bool { return conn.Status().Connected })
+
+	broker.Drop()
+	waitFor(t, "the connection is lost", func() bool { return !conn.Status().Connected })
+	queuedAt := time.Now()
+	if err := pub.Publish(ctx, "ups/status", []byte(`{"online":false}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if n := pub.Buffered(); n != 1 {
+		t.Fatalf("buffered = %d, want 1", n)
+	}
+	var persisted []persistedPublish
+	if err := store.ReadJSON(stateFilePublishes, &persisted); err != nil || len(persisted) != 1 {
+		t.Fatalf("persisted = %v, %v; want the buffered publish", persisted, err)
+	}
+
+	broker.Restore()
+	select {
+	case p := <-broker.Published:
+		if p.Topic != "ups/status" || string(p.Payload) != `{"online":false}` {
+			t.Fatalf("flushed %q to '%s', want the buffered publish", p.Payload, p.Topic)
+		}
+		var got string
+		for _, u := range p.Properties.User {
+			if u.Key == "queued-at" {
+				got = u.Value
+			}
+		}
+		at, err := time.Parse(time.RFC3339, got)
+		if err != nil || at.Before(queuedAt.Truncate(time.Second)) || at.After(time.Now()) {
+			t.Fatalf("queued-at = %q, want the time it was buffered", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the buffered publish to be flushed")
+	}
+	waitFor(t, "the flushed buffer is no longer persisted", func() bool {
+		return pub.Buffered() == 0 && store.ReadJSON(stateFilePublishes, &persisted) != nil
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// eventQueueSize bounds the number of events waiting for the Engine.
+	eventQueueSize = 64
+	// eventQueueReportInterval is how often overflows are logged.
+	eventQueueReportInterval = time.Minute
+)
+
+// eventQueue is a bounded queue of power events between producers (the MQTT
+// callback and event sources) and the Engine. Offer only blocks in the rare
+// case that the queue is full of distinct alarms: otherwise, when the queue
+// is full, an event is dropped to make room, so a slow evaluation can't stall
+// MQTT keepalives. Alarms, the events that would arm an action, are kept over
+// everything else: the oldest queued non-alarm goes first, then the newest
+// event if it isn't an alarm, then an alarm superseded by a later one from the
+// same source. Drops are counted and logged periodically.
+type eventQueue struct {
+	ch    chan powerEvent
+	debug func(m string)
+	// Alarm reports whether an event would arm an action; if nil, no event is
+	// considered one.
+	Alarm func(powerEvent) bool
+
+	mu      sync.Mutex // serializes Offer
+	offered atomic.Uint64
+	dropped atomic.Uint64
+}
+
+func newEventQueue(size int, debug func(m string)) *eventQueue {
+	return &eventQueue{ch: make(chan powerEvent, size), debug: debug}
+}
+
+// C returns the channel from which queued events are received.
+func (q *eventQueue) C() <-chan powerEvent {
+	return q.ch
+}
+
+// Offer enqueues ev, making room if the queue is full as described on
+// eventQueue.
+func (q *eventQueue) Offer(ev powerEvent) {
+	q.offered.Add(1)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case q.ch <- ev:
+		return
+	default:
+	}
+	// Only Offer adds to the queue, so once drained it has room to put back
+	// what's kept, in order, while the consumer goes on receiving from it.
+	queued := make([]powerEvent, 0, cap(q.ch))
+drain:
+	for {
+		select {
+		case old := <-q.ch:
+			queued = append(queued, old)
+		default:
+			break drain
+		}
+	}
+	if len(queued) < cap(q.ch) { // the consumer made room meanwhile
+		q.requeue(queued)
+		q.ch <- ev
+		return
+	}
+	victim := slices.IndexFunc(queued, func(old powerEvent) bool { return !q.isAlarm(old) })
+	if victim < 0 && !q.isAlarm(ev) {
+		q.requeue(queued)
+		q.drop(ev)
+		return
+	}
+	if victim < 0 {
+		victim = q.supersededAlarm(queued, ev)
+	}
+	if victim >= 0 {
+		q.drop(queued[victim])
+		queued = slices.Delete(queued, victim, victim+1)
+	}
+	q.requeue(queued)
+	if victim < 0 {
+		log.Printf("[WARN] event queue full of alarms from %d sources; waiting for room rather than drop one", len(queued))
+	}
+	q.ch <- ev
+}
+
+// supersededAlarm returns the index of the oldest of queued for which a later
+// event, in queued or ev, has the same source, or -1.
+func (q *eventQueue) supersededAlarm(queued []powerEvent, ev powerEvent) int {
+	for i, old := range queued {
+		if old.Source == ev.Source || slices.ContainsFunc(queued[i+1:], func(later powerEvent) bool { return later.Source == old.Source }) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *eventQueue) isAlarm(ev powerEvent) bool {
+	return q.Alarm != nil && q.Alarm(ev)
+}
+
+func (q *eventQueue) requeue(queued []powerEvent) {
+	for _, ev := range queued {
+		q.ch <- ev
+	}
+}
+
+func (q *eventQueue) drop(ev powerEvent) {
+	q.dropped.Add(1)
+	q.debug(fmt.Sprintf("event queue full; dropped %s event: %s", ev.Source, ev.Message.String()))
+}
+
+// Stats returns the number of events offered and dropped so far.
+func (q *eventQueue) Stats() (offered, dropped uint64) {
+	return q.offered.Load(), q.dropped.Load()
+}
+
+// Report logs the number of dropped events every interval, if it changed,
+// until ctx is done.
+func (q *eventQueue) Report(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var last uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			offered, dropped := q.Stats()
+			if dropped != last {
+				log.Printf("[WARN] event queue overflowed: dropped %d events in the last %s (%d of %d total); the decision loop is falling behind", dropped-last, interval, dropped, offered)
+				last = dropped
+			}
+		}
+	}
+}
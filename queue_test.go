@@ -0,0 +1,104 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestQueue(size int) *eventQueue {
+	q := newEventQueue(size, func(string) {})
+	q.Alarm = func(ev powerEvent) bool { return !ev.Message.Online }
+	return q
+}
+
+func queuedEvents(q *eventQueue) []string {
+	var got []string
+	for len(q.C()) > 0 {
+		ev := <-q.C()
+		state := "up"
+		if !ev.Message.Online {
+			state = "down"
+		}
+		got = append(got, ev.Source+":"+state)
+	}
+	return got
+}
+
+func event(source string, online bool) powerEvent {
+	ev := powerUp()
+	if !online {
+		ev = powerDown()
+	}
+	ev.Source = source
+	return ev
+}
+
+func assertQueued(t *testing.T, q *eventQueue, want ...string) {
+	t.Helper()
+	if got := queuedEvents(q); !slices.Equal(got, want) {
+		t.Fatalf("queued = %v, want %v", got, want)
+	}
+}
+
+func TestEventQueueEvictsTheOldestNonAlarm(t *testing.T) {
+	q := newTestQueue(3)
+	q.Offer(event("a", true))
+	q.Offer(event("b", false))
+	q.Offer(event("c", true))
+	q.Offer(event("d", true))
+	assertQueued(t, q, "b:down", "c:up", "d:up")
+
+	q.Offer(event("a", false))
+	q.Offer(event("b", true))
+	q.Offer(event("c", false))
+	q.Offer(event("d", false))
+	assertQueued(t, q, "a:down", "c:down", "d:down")
+	if _, dropped := q.Stats(); dropped != 2 {
+		t.Fatalf("dropped = %d, want 2", dropped)
+	}
+}
+
+func TestEventQueueNeverDropsAnAlarmForANonAlarm(t *testing.T) {
+	q := newTestQueue(2)
+	q.Offer(event("a", false))
+	q.Offer(event("b", false))
+	q.Offer(event("a", true))
+	assertQueued(t, q, "a:down", "b:down")
+}
+
+func TestEventQueueKeepsTheNewestAlarmPerSource(t *testing.T) {
+	q := newTestQueue(3)
+	q.Offer(event("a", false))
+	q.Offer(event("b", false))
+	q.Offer(event("b", false))
+	q.Offer(event("c", false))
+	assertQueued(t, q, "a:down", "b:down", "c:down")
+
+	q.Offer(event("a", false))
+	q.Offer(event("b", false))
+	q.Offer(event("c", false))
+	q.Offer(event("c", false))
+	assertQueued(t, q, "a:down", "b:down", "c:down")
+}
+
+func TestEventQueueWaitsRatherThanDropADistinctAlarm(t *testing.T) {
+	q := newTestQueue(2)
+	q.Offer(event("a", false))
+	q.Offer(event("b", false))
+	offered := make(chan struct{})
+	go func() {
+		q.Offer(event("c", false))
+		close(offered)
+	}()
+	select {
+	case <-offered:
+		t.Fatal("Offer made room by dropping an alarm")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if ev := <-q.C(); ev.Source != "a" {
+		t.Fatalf("received %s, want a", ev.Source)
+	}
+	<-offered
+	assertQueued(t, q, "b:down", "c:down")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// rawFormat is the format of plain-string payloads, such as "ONBATT" and
+// "ONLINE", matched against -down-match and -recovered-match.
+const rawFormat = "raw"
+
+// newRawNormalizer returns a normalizer for the raw format: a payload,
+// trimmed of surrounding whitespace, matching -down-match reports utility
+// power down, and one matching -recovered-match reports it up.
+func newRawNormalizer(opts formatOptions) normalizer {
+	down, recovered := opts.DownMatch, opts.RecoveredMatch
+	return func(_ string, payload []byte) ([]PowerAlarmMessage, error) {
+		s := strings.TrimSpace(string(payload))
+		switch {
+		case down.MatchString(s):
+			return []PowerAlarmMessage{{Online: false, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+		case recovered.MatchString(s):
+			return []PowerAlarmMessage{{Online: true, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+		}
+		return nil, fmt.Errorf("'%s' matches neither -down-match nor -recovered-match", s)
+	}
+}
+
+// compileRawPatterns compiles -down-match and -recovered-match into opts.
+func compileRawPatterns(opts *formatOptions, down, recovered string) error {
+	for _, p := range []struct {
+		flag, expr string
+		re         **regexp.Regexp
+	}{
+		{"down-match", down, &opts.DownMatch},
+		{"recovered-match", recovered, &opts.RecoveredMatch},
+	} {
+		if p.expr == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.expr)
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %w", p.flag, err)
+		}
+		*p.re = re
+	}
+	return nil
+}
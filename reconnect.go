@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+)
+
+// reconnectJitter is the fraction by which each backoff delay is randomly
+// shortened, so a fleet of hosts that lost the broker at once doesn't
+// reconnect in lockstep.
+const reconnectJitter = 0.2
+
+// reconnectBackoff spaces out attempts to connect to a broker exponentially:
+// Min after the first failure, doubling after each further failure up to Max,
+// and back to Min once connected. autopaho itself only waits a fixed
+// ConnectRetryDelay between attempts, which must be set to Min; Wrap adds
+// the rest.
+type reconnectBackoff struct {
+	Min, Max time.Duration
+
+	mu       sync.Mutex
+	failures int
+}
+
+// Failed records a failed connection attempt, returning how many have failed
+// in a row.
+func (b *reconnectBackoff) Failed() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	return b.failures
+}
+
+// Reset records that the connection came up.
+func (b *reconnectBackoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+// Delay returns how long to wait before the next attempt, in all.
+func (b *reconnectBackoff) Delay() time.Duration {
+	b.mu.Lock()
+	failures := b.failures
+	b.mu.Unlock()
+	if failures == 0 {
+		return 0
+	}
+	d := b.Min
+	for i := 1; i < failures && d < b.Max; i++ {
+		d *= 2
+	}
+	d = min(d, b.Max)
+	return d - time.Duration(rand.Float64()*reconnectJitter*float64(d-b.Min)) //nolint:gosec // jitter
+}
+
+// Wrap returns attempt, delayed so that, with autopaho's ConnectRetryDelay of
+// Min, attempts are Delay apart. A nil attempt, for autopaho's own dialing, is
+// returned as is, leaving attempts Min apart.
+func (b *reconnectBackoff) Wrap(attempt func(context.Context, autopaho.ClientConfig, *url.URL) (net.Conn, error)) func(context.Context, autopaho.ClientConfig, *url.URL) (net.Conn, error) {
+	if attempt == nil {
+		return nil
+	}
+	return func(ctx context.Context, cfg autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+		if extra := b.Delay() - b.Min; extra > 0 {
+			select {
+			case <-time.After(extra):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		return attempt(ctx, cfg, u)
+	}
+}
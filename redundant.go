@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// redundantDedupWindow is the default -redundant-dedup-window: how long after
+// one broker delivers a message the same message from another broker is
+// considered a duplicate.
+const redundantDedupWindow = 30 * time.Second
+
+// redundantBrokerConfig configures a connection to an additional broker that
+// carries the same power topic as -server, e.g. at a site whose brokers are
+// on separate power feeds.
+type redundantBrokerConfig struct {
+	// Server is the URL of the broker, e.g. mqtts://host:8883.
+	Server        string
+	TLS           *tls.Config // nil for plain TCP
+	MQTTVersion   string
+	Creds         *brokerCredentials
+	ClientID      string
+	Topics        []string
+	SubOpts       subscribeOptions
+	KeepAlive     uint16
+	SessionExpiry uint32
+	// CleanStart and ResumeSession are -clean-start and -resume-session.
+	CleanStart, ResumeSession bool
+	// ReconnectMin and ReconnectMax bound the reconnectBackoff.
+	ReconnectMin, ReconnectMax time.Duration
+	// Conn tracks the connection for the broker watchdog.
+	Conn *connectionState
+}
+
+// startRedundantBroker connects to a redundant broker, subscribes to the power
+// topic, and passes every message received on it to handle.
+func startRedundantBroker(ctx context.Context, b redundantBrokerConfig, handle func(*paho.Publish)) (*autopaho.ConnectionManager, error) {
+	u, err := url.Parse(b.Server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redundant server URL '%s': %w", b.Server, err)
+	}
+
+	backoff := &reconnectBackoff{Min: b.ReconnectMin, Max: b.ReconnectMax}
+	return autopaho.NewConnection(ctx, autopaho.ClientConfig{
+		ServerUrls:        []*url.URL{u},
+		TlsCfg:            b.TLS,
+		AttemptConnection: backoff.Wrap(brokerConnectionAttempter(b.MQTTVersion)),
+		ConnectRetryDelay: backoff.Min,
+		ConnectPacketBuilder: func(cp *paho.Connect, _ *url.URL) *paho.Connect {
+			username, password := b.Creds.Get()
+			cp.Username, cp.UsernameFlag = username, username != ""
+			cp.Password, cp.PasswordFlag = password, len(password) > 0
+			cp.CleanStart = cp.CleanStart || !b.ResumeSession
+			return cp
+		},
+		KeepAlive:                     b.KeepAlive,
+		CleanStartOnInitialConnection: b.CleanStart,
+		SessionExpiryInterval:         b.SessionExpiry,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			log.Printf("connected to redundant server '%s'", b.Server)
+			b.Conn.Up(time.Now())
+			backoff.Reset()
+			for _, topic := range b.Topics {
+				if _, err := cm.Subscribe(ctx, &paho.Subscribe{
+					Subscriptions: []paho.SubscribeOptions{b.SubOpts.ForShared(topic)},
+				}); err != nil {
+					log.Printf("failed to subscribe to '%s' on redundant server '%s': %s", topic, b.Server, err)
+					continue
+				}
+				log.Printf("subscribed to '%s' on redundant server '%s'", topic, b.Server)
+			}
+		},
+		OnConnectError: func(err error) {
+			log.Printf("error while attempting connection to redundant server '%s': %s", b.Server, err)
+			b.Conn.Failed(time.Now(), err)
+			backoff.Failed()
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: b.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					if slices.ContainsFunc(b.Topics, func(filter string) bool { return topicMatches(filter, pr.Packet.Topic) }) {
+						handle(pr.Packet)
+					}
+					return true, nil
+				}},
+			// unlike the primary connection, a redundant broker misbehaving is not fatal:
+			OnClientError: func(err error) {
+				log.Printf("redundant server '%s': client error: %s", b.Server, err)
+				b.Conn.Lost(time.Now())
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				b.Conn.Lost(time.Now())
+				if sessionTakenOver(d) {
+					log.Printf("redundant server '%s' disconnected us: another client connected with client ID '%s'", b.Server, b.ClientID)
+					return
+				}
+				log.Printf("redundant server '%s' requested disconnect; reason code: %d", b.Server, d.ReasonCode)
+			},
+		},
+	})
+}
+
+// messageDeduper drops a message that was already delivered by a different
+// broker within the dedup window. Repeats from the same broker are not
+// duplicates; the publisher sent them more than once.
+type messageDeduper struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]dedupEntry
+}
+
+type dedupEntry struct {
+	broker string
+	at     time.Time
+}
+
+func newMessageDeduper(window time.Duration) *messageDeduper {
+	return &messageDeduper{window: window, seen: make(map[[sha256.Size]byte]dedupEntry)}
+}
+
+// Duplicate reports whether the message has already been delivered by
+// another broker, recording it otherwise.
+func (d *messageDeduper) Duplicate(broker, topic string, payload []byte) bool {
+	key := sha256.Sum256(append([]byte(topic+"\x00"), payload...))
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, e := range d.seen {
+		if now.Sub(e.at) > d.window {
+			delete(d.seen, k)
+		}
+	}
+	if e, ok := d.seen[key]; ok && e.broker != broker {
+		return true
+	}
+	d.seen[key] = dedupEntry{broker: broker, at: now}
+	return false
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// relayRoute normalizes messages received on topics matching filter.
+type relayRoute struct {
+	Format    string
+	Filter    string
+	Normalize normalizer
+}
+
+// parseRelayRoute parses a -relay value of the form FORMAT:TOPIC_FILTER.
+func parseRelayRoute(spec string, opts formatOptions) (relayRoute, error) {
+	format, filter, ok := strings.Cut(spec, ":")
+	if !ok || format == "" || filter == "" {
+		return relayRoute{}, fmt.Errorf("invalid relay '%s': expected FORMAT:TOPIC_FILTER", spec)
+	}
+	n, err := newNormalizer(format, opts)
+	if err != nil {
+		return relayRoute{}, fmt.Errorf("invalid relay '%s': %w", spec, err)
+	}
+	return relayRoute{Format: format, Filter: filter, Normalize: n}, nil
+}
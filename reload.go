@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// reloadableFlags are the settings a reload of -config applies without a
+// restart; changes to any other setting are logged and ignored.
+var reloadableFlags = []string{"down-expr", "recovered-expr", "recovery-period", "topic"}
+
+// configReloader re-reads -config and -config-dir on SIGHUP and applies changes to
+// reloadableFlags while keeping the MQTT connection, and with it the QoS 1
+// session, up: new rules and a new -recovery-period apply to subsequent
+// events (a pending action keeps its deadline), and -topic values added are
+// subscribed to and ones removed unsubscribed from.
+type configReloader struct {
+	Path  string
+	Dir   string
+	Flags *flag.FlagSet
+	// Fixed are the flags given on the command line or in the environment,
+	// which the files don't override.
+	Fixed map[string]bool
+	// Last is what the files contained when they were last (re)loaded.
+	Last configValues
+
+	Rules        *exprCache
+	NewEvaluator func(down, recovered exprProgram) Evaluator
+	Engine       *Engine
+	Steps        []Step
+
+	// Topics are the current -topic values, read by the connection's
+	// handlers.
+	Topics    *atomic.Pointer[[]string]
+	TopicVars map[string]string
+	Conn      *autopaho.ConnectionManager
+	SubOpts   subscribeOptions
+	// TopicFixed is set if -topic can't be changed without a restart, e.g.
+	// because redundant servers subscribe to it too.
+	TopicFixed string
+
+	Snapshots *snapshotter
+	// Mu serializes reloads with other changes to the rules.
+	Mu *sync.Mutex
+}
+
+// Run reloads on each SIGHUP until ctx is done.
+func (r *configReloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := r.Reload(ctx); err != nil {
+				log.Printf("[ERROR] failed to reload '%s': %s; keeping the current configuration", r.source(), err)
+			}
+		}
+	}
+}
+
+// Reload re-reads the files and applies them. Nothing is applied unless every
+// reloadable setting in the file is valid.
+func (r *configReloader) Reload(ctx context.Context) error {
+	r.Mu.Lock()
+	defer r.Mu.Unlock()
+	values, err := readConfig(r.Path, r.Dir)
+	if err != nil {
+		return err
+	}
+	// the effective value of each reloadable flag, after the reload:
+	next := make(map[string]string)
+	var nextTopics []string
+	changed, topicsChanged := false, false
+	for _, key := range r.changedSettings(values) {
+		switch {
+		case r.Fixed[key]:
+			log.Printf("[WARN] ignoring the change to '%s' in '%s': -%s is set on the command line or in the environment", key, r.source(), key)
+		case !slices.Contains(reloadableFlags, key):
+			log.Printf("[WARN] '%s' changed in '%s'; restart %s to apply it", key, r.source(), name)
+		case key == "topic" && r.TopicFixed != "":
+			log.Printf("[WARN] '%s' changed in '%s', but %s; restart %s to apply it", key, r.source(), r.TopicFixed, name)
+		case key == "topic":
+			nextTopics, topicsChanged, changed = slices.Clone(values[key]), true, true
+		default:
+			v := r.Flags.Lookup(key).DefValue
+			if vs := values[key]; len(vs) == 1 {
+				v = vs[0]
+			} else if len(vs) > 1 {
+				return fmt.Errorf("'%s' takes a single value, not a list", key)
+			}
+			next[key] = v
+			changed = true
+		}
+	}
+	if !changed {
+		r.Last = values
+		log.Printf("reloaded '%s': nothing to apply", r.source())
+		return nil
+	}
+	for _, key := range reloadableFlags {
+		if _, ok := next[key]; !ok && key != "topic" {
+			next[key] = r.Flags.Lookup(key).Value.String()
+		}
+	}
+
+	down, err := r.compile(next["down-expr"])
+	if err != nil {
+		return fmt.Errorf("invalid -down-expr: %w", err)
+	}
+	recovered, err := r.compile(next["recovered-expr"])
+	if err != nil {
+		return fmt.Errorf("invalid -recovered-expr: %w", err)
+	}
+	delay, err := time.ParseDuration(next["recovery-period"])
+	if err != nil || delay < 0 {
+		return fmt.Errorf("invalid -recovery-period '%s'", next["recovery-period"])
+	}
+	for _, step := range r.Steps {
+		if step.Offset > delay {
+			return fmt.Errorf("-step '%s' would be scheduled after -recovery-period (%s)", step.Name, delay)
+		}
+	}
+	oldTopics := *r.Topics.Load()
+	topics := oldTopics
+	if topicsChanged {
+		topics = nextTopics
+		for i := range topics {
+			if topics[i], err = expandTopic(topics[i], r.TopicVars); err != nil {
+				return fmt.Errorf("invalid -topic: %w", err)
+			}
+		}
+		if (len(oldTopics) == 0) != (len(topics) == 0) {
+			return fmt.Errorf("-topic can't be added or removed without a restart")
+		}
+		if err := r.switchTopics(ctx, oldTopics, topics); err != nil {
+			return err
+		}
+	}
+
+	r.Engine.Reconfigure(r.NewEvaluator(down, recovered), delay)
+	r.Rules.Retain(next["down-expr"], next["recovered-expr"])
+	for _, key := range reloadableFlags {
+		if key == "topic" {
+			*r.Flags.Lookup(key).Value.(*stringsFlag) = slices.Clone(topics)
+			continue
+		}
+		if err := r.Flags.Set(key, next[key]); err != nil {
+			return err // can't happen; validated above
+		}
+	}
+	r.Snapshots.Reconfigured(oldTopics, topics, configHash(r.Flags), next["down-expr"], next["recovered-expr"], delay)
+	r.Last = values
+	log.Printf("reloaded '%s': -down-expr '%s', -recovered-expr '%s', -recovery-period %s, -topic '%s'",
+		r.source(), next["down-expr"], next["recovered-expr"], delay, strings.Join(topics, "', '"))
+	return nil
+}
+
+// changedSettings returns the names of the settings whose values differ
+// between r.Last and values, including ones added to or removed from the
+// files.
+func (r *configReloader) changedSettings(values configValues) []string {
+	var names []string
+	for name, vs := range values {
+		if !slices.Equal(vs, r.Last[name]) {
+			names = append(names, name)
+		}
+	}
+	for name := range r.Last {
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (r *configReloader) source() string {
+	return configSourceName(r.Path, r.Dir)
+}
+
+func (r *configReloader) compile(expr string) (exprProgram, error) {
+	prg, err := r.Rules.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return prg, checkEvaluates(prg)
+}
+
+// switchTopics subscribes to the topics not in oldTopics, then unsubscribes
+// from the oldTopics no longer in topics, on the existing session; the
+// connection's handlers follow r.Topics from then on.
+func (r *configReloader) switchTopics(ctx context.Context, oldTopics, topics []string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for _, topic := range topics {
+		if slices.Contains(oldTopics, topic) {
+			continue
+		}
+		if _, err := r.Conn.Subscribe(ctx, &paho.Subscribe{
+			Subscriptions: []paho.SubscribeOptions{r.SubOpts.ForShared(topic)},
+		}); err != nil {
+			return fmt.Errorf("failed to subscribe to topic '%s': %w", topic, err)
+		}
+		log.Printf("subscribed to '%s'", topic)
+	}
+	r.Topics.Store(&topics)
+	for _, oldTopic := range oldTopics {
+		if slices.Contains(topics, oldTopic) {
+			continue
+		}
+		if _, err := r.Conn.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{r.SubOpts.Shared(oldTopic)}}); err != nil {
+			log.Printf("[WARN] failed to unsubscribe from '%s': %s", oldTopic, err)
+		} else {
+			log.Printf("unsubscribed from '%s'", oldTopic)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// retainedHonor, retainedIgnore and retainedIgnoreIfOlderThan are the
+	// -retained policies; the last is followed by "=DURATION".
+	retainedHonor             = "honor"
+	retainedIgnore            = "ignore"
+	retainedIgnoreIfOlderThan = "ignore-if-older-than"
+)
+
+// retainedPolicy decides whether a retained power alarm, which the broker
+// delivers on subscribing however long ago it was published, is acted on.
+type retainedPolicy struct {
+	// Ignore drops every retained message.
+	Ignore bool
+	// MaxAge, if set, drops retained messages whose "at" timestamp is older
+	// than it, or which have none, since their age is unknown.
+	MaxAge time.Duration
+}
+
+// parseRetainedPolicy parses a -retained value.
+func parseRetainedPolicy(s string) (retainedPolicy, error) {
+	switch s {
+	case retainedHonor:
+		return retainedPolicy{}, nil
+	case retainedIgnore:
+		return retainedPolicy{Ignore: true}, nil
+	}
+	if v, ok := strings.CutPrefix(s, retainedIgnoreIfOlderThan+"="); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return retainedPolicy{}, fmt.Errorf("invalid duration '%s': %w", v, err)
+		}
+		if d <= 0 {
+			return retainedPolicy{}, fmt.Errorf("duration must be positive, got '%s'", v)
+		}
+		return retainedPolicy{MaxAge: d}, nil
+	}
+	return retainedPolicy{}, fmt.Errorf("must be %s, %s or %s=DURATION, got '%s'", retainedHonor, retainedIgnore, retainedIgnoreIfOlderThan, s)
+}
+
+// Honors reports whether every retained message is acted on.
+func (p retainedPolicy) Honors() bool {
+	return !p.Ignore && p.MaxAge == 0
+}
+
+// Accept reports whether the retained message m should be acted on at now
+// and, if not, why.
+func (p retainedPolicy) Accept(m PowerAlarmMessage, now time.Time) (bool, string) {
+	switch {
+	case p.Ignore:
+		return false, "-retained is " + retainedIgnore
+	case p.MaxAge == 0:
+		return true, ""
+	case m.At == nil:
+		return false, "it has no \"at\" timestamp"
+	case now.Sub(*m.At) > p.MaxAge:
+		return false, fmt.Sprintf("it was published at %s, more than %s ago", m.At.Format(time.RFC3339), p.MaxAge)
+	}
+	return true, ""
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetainedPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    retainedPolicy
+		wantErr bool
+	}{
+		{in: "honor", want: retainedPolicy{}},
+		{in: "ignore", want: retainedPolicy{Ignore: true}},
+		{in: "ignore-if-older-than=5m", want: retainedPolicy{MaxAge: 5 * time.Minute}},
+		{in: "ignore-if-older-than=0s", wantErr: true},
+		{in: "ignore-if-older-than=-1m", wantErr: true},
+		{in: "ignore-if-older-than=soon", wantErr: true},
+		{in: "ignore-if-older-than", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "Honor", wantErr: true},
+	} {
+		got, err := parseRetainedPolicy(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRetainedPolicy(%q) error = %v, want error: %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseRetainedPolicy(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
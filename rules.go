@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// rulesConfigKey is the -config key under which named rules are declared,
+// each as a mapping (YAML) or table (TOML) of ruleSettings, e.g.:
+//
+//	rules:
+//	  rack2:
+//	    topic: power/alarms/rack2
+//	    recovery-period: 1m
+//	    command: /usr/local/bin/rack2-poweroff
+const rulesConfigKey = "rules"
+
+// ruleSettings are the settings a named rule may give; each one left out
+// defaults to the top-level flag of the same name.
+var ruleSettings = []string{
+	"topic",
+	"down-expr",
+	"recovered-expr",
+	"recovery-period",
+	"command",
+	"cancel-command",
+	"systemd-unit",
+	"systemd-recovered-unit",
+}
+
+// ruleConfig is a named rule as declared in a -config file.
+type ruleConfig struct {
+	Name     string
+	Settings map[string]string
+}
+
+// splitRuleConfigs separates the rules.NAME.SETTING keys in values from the
+// rest, which are flag settings. The rules are sorted by name.
+func splitRuleConfigs(values configValues) ([]ruleConfig, configValues, error) {
+	rest := make(configValues)
+	settings := make(map[string]map[string]string)
+	for key, vs := range values {
+		k, ok := strings.CutPrefix(key, rulesConfigKey+".")
+		if !ok {
+			rest[key] = vs
+			continue
+		}
+		name, setting, ok := strings.Cut(k, ".")
+		if !ok || name == "" {
+			return nil, nil, fmt.Errorf("'%s' must be given as %s.NAME.SETTING", key, rulesConfigKey)
+		}
+		if !slices.Contains(ruleSettings, setting) {
+			return nil, nil, fmt.Errorf("rule '%s': unknown setting '%s'; rules may set %s", name, setting, strings.Join(ruleSettings, ", "))
+		}
+		if len(vs) != 1 {
+			return nil, nil, fmt.Errorf("rule '%s': '%s' takes a single value, not a list", name, setting)
+		}
+		if settings[name] == nil {
+			settings[name] = make(map[string]string)
+		}
+		settings[name][setting] = vs[0]
+	}
+	rules := make([]ruleConfig, 0, len(settings))
+	for name, s := range settings {
+		rules = append(rules, ruleConfig{Name: name, Settings: s})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules, rest, nil
+}
+
+// namedRule is a rule declared in -config, evaluated by its own Engine
+// against the messages on its topic, independently of the top-level rule
+// (-topic, -down-expr, -recovered-expr, -recovery-period and the action
+// flags) and of other named rules.
+type namedRule struct {
+	Name          string
+	Topic         string
+	DownExpr      string
+	RecoveredExpr string
+	Delay         time.Duration
+	Command       string
+	CancelCommand string
+	Unit          string
+	RecoveredUnit string
+
+	// Down and Recovered are set by Compile.
+	Down, Recovered exprProgram
+	Engine          *Engine
+}
+
+// newNamedRule validates rc, taking the value of each setting it leaves out
+// from the flag of the same name on fs.
+func newNamedRule(rc ruleConfig, fs *flag.FlagSet, topicVars map[string]string) (namedRule, error) {
+	get := func(setting string) string {
+		if v, ok := rc.Settings[setting]; ok {
+			return v
+		}
+		return fs.Lookup(setting).Value.String()
+	}
+	if _, ok := rc.Settings["topic"]; !ok && len(*fs.Lookup("topic").Value.(*stringsFlag)) > 1 {
+		return namedRule{}, fmt.Errorf("rule '%s': topic is required when -topic is given more than once", rc.Name)
+	}
+	r := namedRule{
+		Name:          rc.Name,
+		DownExpr:      get("down-expr"),
+		RecoveredExpr: get("recovered-expr"),
+		Command:       get("command"),
+		CancelCommand: get("cancel-command"),
+		Unit:          get("systemd-unit"),
+		RecoveredUnit: get("systemd-recovered-unit"),
+	}
+	var err error
+	if r.Topic, err = expandTopic(get("topic"), topicVars); err != nil {
+		return r, fmt.Errorf("rule '%s': invalid topic: %w", r.Name, err)
+	}
+	if r.Topic == "" {
+		return r, fmt.Errorf("rule '%s': topic is required unless -topic is set", r.Name)
+	}
+	if r.Delay, err = time.ParseDuration(get("recovery-period")); err != nil || r.Delay < 0 {
+		return r, fmt.Errorf("rule '%s': invalid recovery-period '%s'", r.Name, get("recovery-period"))
+	}
+	if (r.Unit != "" || r.RecoveredUnit != "") && runtime.GOOS != "linux" {
+		return r, fmt.Errorf("rule '%s': systemd-unit and systemd-recovered-unit are only supported on Linux", r.Name)
+	}
+	if r.Unit != "" && r.Command != "" {
+		return r, fmt.Errorf("rule '%s': systemd-unit and command are mutually exclusive", r.Name)
+	}
+	return r, nil
+}
+
+// Compile compiles and checks the rule's expressions.
+func (r *namedRule) Compile(rules *exprCache) error {
+	for _, expr := range []struct {
+		setting, text string
+		prg           *exprProgram
+	}{
+		{"down-expr", r.DownExpr, &r.Down},
+		{"recovered-expr", r.RecoveredExpr, &r.Recovered},
+	} {
+		prg, err := rules.Compile(expr.text)
+		if err == nil {
+			err = checkEvaluates(prg)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s of rule '%s': %w", expr.setting, r.Name, err)
+		}
+		*expr.prg = prg
+	}
+	return nil
+}
+
+// ruleEngine returns the Engine of the named rule name, or main if name is
+// empty.
+func ruleEngine(main *Engine, rules []namedRule, name string) (*Engine, error) {
+	if name == "" {
+		return main, nil
+	}
+	for _, r := range rules {
+		if r.Name == name {
+			return r.Engine, nil
+		}
+	}
+	return nil, fmt.Errorf("no rule named '%s'", name)
+}
+
+// ruleStates returns the state of each named rule's Engine, by rule name, or
+// nil if there are none.
+func ruleStates(host string, rules []namedRule) map[string]apiState {
+	if len(rules) == 0 {
+		return nil
+	}
+	states := make(map[string]apiState, len(rules))
+	for _, r := range rules {
+		states[r.Name] = newAPIState(host, r.Engine.Status())
+	}
+	return states
+}
+
+// ruleSteps returns the steps of steps that are scheduled within delay, for
+// a named rule whose action runs delay after it is armed.
+func ruleSteps(steps []Step, rule string, delay time.Duration) []Step {
+	var out []Step
+	for _, s := range steps {
+		if s.Offset > delay {
+			log.Printf("[WARN] -step '%s' is scheduled after the delay of rule '%s' (%s); it won't run for that rule", s.Name, rule, delay)
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// ruleDispatcher hands each event to the Engines of the rules it concerns:
+// messages on any -topic and events from other sources go to the top-level
+// rule's Engine, and messages on a named rule's topic to that rule's.
+type ruleDispatcher struct {
+	Engine *Engine
+	// Topics are the current -topic values.
+	Topics *atomic.Pointer[[]string]
+	Rules  []namedRule
+}
+
+// Run handles events until ctx is done. An evaluation error is fatal.
+func (d ruleDispatcher) Run(ctx context.Context, events <-chan powerEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			for _, e := range d.engines(ev) {
+				if err := e.Handle(ctx, ev); err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// Handles reports whether messages on topic concern any rule.
+func (d ruleDispatcher) Handles(topic string) bool {
+	return len(d.engines(powerEvent{Source: "mqtt:" + topic})) > 0
+}
+
+// Alarm reports whether ev would arm the action of any rule it concerns.
+func (d ruleDispatcher) Alarm(ev powerEvent) bool {
+	return slices.ContainsFunc(d.engines(ev), func(e *Engine) bool { return e.Alarm(ev) })
+}
+
+func (d ruleDispatcher) engines(ev powerEvent) []*Engine {
+	topic, isMQTT := strings.CutPrefix(ev.Source, "mqtt:")
+	if !isMQTT {
+		return []*Engine{d.Engine}
+	}
+	var engines []*Engine
+	if slices.ContainsFunc(*d.Topics.Load(), func(filter string) bool { return topicMatches(filter, topic) }) {
+		engines = append(engines, d.Engine)
+	}
+	for _, r := range d.Rules {
+		if topicMatches(r.Topic, topic) {
+			engines = append(engines, r.Engine)
+		}
+	}
+	return engines
+}
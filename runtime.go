@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// runtimeMinSpan is the least amount of discharge history needed before the
+// runtime is estimated.
+const runtimeMinSpan = time.Minute
+
+// runtimeEstimator estimates the remaining battery runtime from the state of
+// charge reported while on battery, rather than trusting the UPS's own
+// estimate, which is notoriously optimistic right after the load changes. The
+// discharge rate is fitted over a sliding window and scaled to the current
+// load, if reported.
+type runtimeEstimator struct {
+	Window time.Duration
+
+	mu      sync.Mutex
+	samples []socSample
+}
+
+type socSample struct {
+	At      time.Time
+	Battery float64
+	Load    float64 // -1 if unknown
+}
+
+// Observe records the battery state of charge reported by m. Any report that
+// power is back discards the history, since the battery is then charging.
+func (r *runtimeEstimator) Observe(at time.Time, m PowerAlarmMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m.Online && m.PowerType == PowerTypeUtility {
+		r.samples = nil
+		return
+	}
+	if m.Battery == nil {
+		return
+	}
+	r.samples = append(r.samples, socSample{At: at, Battery: *m.Battery, Load: m.LoadPercent()})
+	for len(r.samples) > 0 && at.Sub(r.samples[0].At) > r.Window {
+		r.samples = r.samples[1:]
+	}
+}
+
+// Estimate returns the estimated runtime remaining, or false if there isn't
+// enough discharge history to estimate it.
+func (r *runtimeEstimator) Estimate() (time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := len(r.samples)
+	if n < 2 || r.samples[n-1].At.Sub(r.samples[0].At) < runtimeMinSpan {
+		return 0, false
+	}
+
+	// least-squares fit of battery percent against minutes:
+	t0 := r.samples[0].At
+	var sumX, sumY, sumXY, sumXX, sumLoad float64
+	loads := 0
+	for _, s := range r.samples {
+		x := s.At.Sub(t0).Minutes()
+		sumX += x
+		sumY += s.Battery
+		sumXY += x * s.Battery
+		sumXX += x * x
+		if s.Load >= 0 {
+			sumLoad += s.Load
+			loads++
+		}
+	}
+	fn := float64(n)
+	denom := fn*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, false
+	}
+	rate := -(fn*sumXY - sumX*sumY) / denom // percent per minute
+	if rate <= 0 {
+		return 0, false
+	}
+
+	last := r.samples[n-1]
+	if loads == n && last.Load > 0 && sumLoad > 0 {
+		rate *= last.Load / (sumLoad / fn)
+	}
+	return time.Duration(last.Battery / rate * float64(time.Minute)), true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// powerAlarmSchema returns the JSON Schema for payloads accepted by the json
+// format: a PowerAlarmMessage, or an array of them.
+func powerAlarmSchema() map[string]any {
+	percent := func(desc string) map[string]any {
+		return map[string]any{"type": "number", "minimum": 0, "maximum": 100, "description": desc}
+	}
+	message := map[string]any{
+		"type":     "object",
+		"required": []string{"up", "type"},
+		"properties": map[string]any{
+			"up": map[string]any{
+				"type":        "boolean",
+				"description": "Whether power of this type is available.",
+			},
+			"type": map[string]any{
+				"type":        "integer",
+				"minimum":     PowerTypeUtility,
+				"maximum":     PowerTypeOther,
+				"description": "Power type: 1 utility, 2 generator, 3 battery, 4 solar, 5 unknown, 6 other.",
+			},
+			"scope": map[string]any{
+				"type":        "string",
+				"examples":    []string{ScopeGlobal, ScopeLocal, ScopeSinglePhase, ScopeOneCircuit},
+				"description": "How much of the site the event affects.",
+			},
+			"phase": map[string]any{
+				"type":        "string",
+				"description": "For scope 1p, the phase affected; hosts declaring another -phase ignore the event.",
+			},
+			"circuit": map[string]any{
+				"type":        "string",
+				"description": "For scope 1c, the circuit affected; hosts declaring another -circuit ignore the event.",
+			},
+			"battery": percent("Battery state of charge, in percent."),
+			"load":    percent("Output load, in percent of capacity."),
+			"at": map[string]any{
+				"type":        "string",
+				"format":      "date-time",
+				"description": "When the event happened (RFC 3339); lets -retained ignore-if-older-than ignore stale retained messages.",
+			},
+			"host": map[string]any{
+				"type":        "string",
+				"description": "Limits the message to hosts whose name matches this name or glob.",
+			},
+			"target": map[string]any{
+				"type":        "string",
+				"description": "Synonym for host.",
+			},
+			"targets": map[string]any{
+				"type":        "string",
+				"pattern":     `^\s*[^=,]+=[^,]*(\s*,\s*[^=,]+=[^,]*)*\s*$`,
+				"description": "Limits the message to hosts whose -tags match every KEY=VALUE term; VALUE may be a glob.",
+			},
+		},
+	}
+	return map[string]any{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "mqttshutdownd " + version + " power alarm",
+		"description": "Payload accepted on -topic (and by -webhook-listen and -udp-listen) in the json format.",
+		"$defs":       map[string]any{"message": message},
+		"oneOf": []any{
+			map[string]any{"$ref": "#/$defs/message"},
+			map[string]any{"type": "array", "items": map[string]any{"$ref": "#/$defs/message"}},
+		},
+	}
+}
+
+// writeSchema writes the power alarm JSON Schema to w.
+func writeSchema(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(powerAlarmSchema())
+}
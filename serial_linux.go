@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var serialBauds = map[int]uint32{
+	1200:   syscall.B1200,
+	2400:   syscall.B2400,
+	4800:   syscall.B4800,
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+// openSerial opens a serial device in raw 8N1 mode at the given baud rate.
+// Reads time out after one second.
+func openSerial(device string, baud int) (io.ReadWriteCloser, error) {
+	speed, ok := serialBauds[baud]
+	if !ok {
+		return nil, fmt.Errorf("unsupported baud rate %d", baud)
+	}
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := syscall.Termios{
+		Cflag: speed | syscall.CS8 | syscall.CREAD | syscall.CLOCAL,
+	}
+	t.Cc[syscall.VMIN] = 0
+	t.Cc[syscall.VTIME] = 10 // deciseconds
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to configure %s: %w", device, errno)
+	}
+	return f, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openSerial(_ string, _ int) (io.ReadWriteCloser, error) {
+	return nil, errors.New("serial UPS polling is only supported on Linux")
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed mqttshutdownd.service
+var systemdUnit string
+
+const (
+	systemdUnitPath   = "/etc/systemd/system/mqttshutdownd.service"
+	systemdDropInPath = "/etc/systemd/system/mqttshutdownd.service.d/override.conf"
+)
+
+// setupProbeWait is how long the setup wizard's test subscription waits for
+// a message on the power topic.
+const setupProbeWait = 10 * time.Second
+
+// prompter reads answers to interactive questions.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// Ask prompts for a line of input, returning def if the answer is empty.
+func (p prompter) Ask(question, def string) string {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintln(p.out, "")
+		os.Exit(1)
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def
+	}
+	return line
+}
+
+// AskRequired prompts until a non-empty answer is given.
+func (p prompter) AskRequired(question, def string) string {
+	for {
+		if a := p.Ask(question, def); a != "" {
+			return a
+		}
+	}
+}
+
+// Confirm asks a yes/no question.
+func (p prompter) Confirm(question string, def bool) bool {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		switch strings.ToLower(p.Ask(fmt.Sprintf("%s (%s)", question, hint), "")) {
+		case "":
+			return def
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
+
+// Choose asks the user to pick one of options by number, returning its index.
+func (p prompter) Choose(question string, options []string, def int) int {
+	fmt.Fprintln(p.out, question)
+	for i, o := range options {
+		fmt.Fprintf(p.out, "  %d) %s\n", i+1, o)
+	}
+	for {
+		n, err := strconv.Atoi(p.Ask("Choice", strconv.Itoa(def+1)))
+		if err == nil && n >= 1 && n <= len(options) {
+			return n - 1
+		}
+	}
+}
+
+// runSetup walks the operator through configuring mqttshutdownd, then writes
+// a systemd drop-in with the resulting ExecStart line and optionally installs
+// and enables the unit. It returns the process exit code.
+func runSetup() int {
+	p := prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+	fmt.Printf("%s %s setup\n\n", name, version)
+
+	// Broker:
+	var args []string
+	server := p.AskRequired("MQTT broker address (host[:port])", "")
+	args = append(args, "-server", server)
+	probe := brokerProbe{Server: server}
+	if p.Confirm("Connect using TLS?", false) {
+		ca := p.Ask("CA bundle (PEM) to verify the broker's certificate against (empty for the system roots)", "")
+		if ca == "" {
+			args = append(args, "-tls")
+		} else {
+			args = append(args, "-tls-ca", ca)
+		}
+		cfg, err := newBrokerTLSConfig(ca, false)
+		if err != nil {
+			fmt.Printf("Warning: %s\n", err)
+			cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		probe.TLS = cfg
+	}
+	if p.Confirm("Connect using mutual TLS (client certificate)?", false) {
+		cert := p.AskRequired("Client certificate file", "")
+		key := p.AskRequired("Client private key file", "")
+		args = append(args, "-tls-cert", cert, "-tls-key", key)
+		if probe.TLS == nil {
+			probe.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		if c, err := tls.LoadX509KeyPair(cert, key); err != nil {
+			fmt.Printf("Warning: %s\n", err)
+		} else {
+			probe.TLS.Certificates = []tls.Certificate{c}
+		}
+	}
+	probe.Server = withDefaultBrokerPort(server, probe.TLS != nil)
+	probe.Username = p.Ask("MQTT username (empty for none)", "")
+	if probe.Username != "" {
+		args = append(args, "-user", probe.Username)
+		if p.Confirm("Read the password from the OS keyring instead of the command line?", false) {
+			args = append(args, "-password-keyring")
+		} else {
+			fmt.Println("(The password will be echoed as you type it, and stored in the systemd drop-in, which is written readable only by root.)")
+			probe.Password = p.Ask("MQTT password", "")
+			if probe.Password != "" {
+				args = append(args, "-password", probe.Password)
+			}
+		}
+	}
+
+	// Topic and format:
+	topic := p.AskRequired("Power alarm topic", "power/alarms")
+	args = append(args, "-topic", topic)
+	formats := formatNames()
+	defFormat := 0
+	for i, f := range formats {
+		if f == "json" {
+			defFormat = i
+		}
+	}
+	format := formats[p.Choose("Payload format on that topic:", formats, defFormat)]
+	if format != "json" {
+		args = append(args, "-format", format)
+	}
+	var formatOpts formatOptions
+	if format == mappedFormat {
+		for {
+			specs := strings.Split(p.AskRequired("Field mappings, as comma-separated FIELD=PATH", "up=$.power_ok"), ",")
+			var err error
+			if formatOpts.FieldMappings, err = parseFieldMappings(specs); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			for _, s := range specs {
+				args = append(args, "-field-map", strings.TrimSpace(s))
+			}
+			break
+		}
+	}
+	if format == protobufFormat {
+		for {
+			file := p.AskRequired("FileDescriptorSet file (from 'protoc --include_imports --descriptor_set_out')", "")
+			name := p.AskRequired("Full name of the payload's message type", "")
+			var err error
+			if formatOpts.Proto, err = loadProtoDescriptor(file, name); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			args = append(args, "-proto-descriptor", file, "-proto-message", name)
+			break
+		}
+		for {
+			mappings := p.Ask("Field mappings, as comma-separated FIELD=PATH (blank if the message uses the json format's field names)", "")
+			if mappings == "" {
+				break
+			}
+			specs := strings.Split(mappings, ",")
+			var err error
+			if formatOpts.FieldMappings, err = parseFieldMappings(specs); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			for _, s := range specs {
+				args = append(args, "-field-map", strings.TrimSpace(s))
+			}
+			break
+		}
+	}
+	if format == homeAssistantFormat {
+		fmt.Println("Subscribe to the binary_sensor's state topic; battery and load sensors' state topics may be added as further -topic flags.")
+		if p.Confirm("Does ON mean utility power is down (e.g. an 'on battery' sensor)?", false) {
+			formatOpts.HomeAssistantOnIsDown = true
+			args = append(args, "-ha-on-is-down")
+		}
+	}
+	if format == rawFormat {
+		for {
+			down := p.AskRequired("Regular expression matching power-down payloads", "^ONBATT$")
+			recovered := p.AskRequired("Regular expression matching power-restored payloads", "^ONLINE$")
+			if err := compileRawPatterns(&formatOpts, down, recovered); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			args = append(args, "-down-match", down, "-recovered-match", recovered)
+			break
+		}
+	}
+
+	// Test subscribe:
+	fmt.Printf("\nConnecting to %s and subscribing to '%s' (waiting up to %s for a message)...\n", server, topic, setupProbeWait)
+	res := probe.Run(context.Background(), topic, setupProbeWait)
+	switch {
+	case res.DialErr != nil:
+		fmt.Printf("Could not reach the broker: %s\n", res.DialErr)
+	case res.ConnectErr != nil:
+		fmt.Printf("The broker refused the connection (check credentials): %s\n", res.ConnectErr)
+	case res.SubscribeErr != nil:
+		fmt.Printf("Subscribing to '%s' failed (check the broker's ACLs): %s\n", topic, res.SubscribeErr)
+	case res.Message == nil:
+		fmt.Println("Connected and subscribed, but no message arrived. That's fine if the publisher doesn't retain its messages.")
+	default:
+		fmt.Printf("Received on '%s': %s\n", res.Message.Topic, res.Message.Payload)
+		if n, err := newNormalizer(format, formatOpts); err == nil {
+			if msgs, err := n(res.Message.Topic, res.Message.Payload); err != nil {
+				fmt.Printf("Warning: that message can't be decoded as %s: %s\n", format, err)
+			} else {
+				for _, m := range msgs {
+					fmt.Printf("Decoded: %s\n", m.String())
+				}
+			}
+		}
+	}
+	if !res.OK() && !p.Confirm("Continue anyway?", false) {
+		return 1
+	}
+	fmt.Println("")
+
+	// Rules:
+	rules, err := newExprCache(formatOpts.Proto)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	downExpr, recoveredExpr := "!online && powerType == 1", "online && powerType == 1"
+	switch p.Choose("When should this host shut down?", []string{
+		"When utility power is lost",
+		"When utility power is lost and the battery falls below a threshold",
+		"Custom " + exprLanguage + " expressions",
+	}, 0) {
+	case 1:
+		for {
+			pct, err := strconv.ParseFloat(p.Ask("Battery threshold (percent)", "50"), 64)
+			if err == nil && pct > 0 && pct <= 100 {
+				downExpr = fmt.Sprintf("!online && powerType == 1 && battery >= 0.0 && battery < %g", pct)
+				break
+			}
+		}
+	case 2:
+		for {
+			downExpr = p.AskRequired("Shutdown (down) expression", downExpr)
+			prg, err := rules.Compile(downExpr)
+			if err == nil {
+				err = checkEvaluates(prg)
+			}
+			if err == nil {
+				break
+			}
+			fmt.Println(err)
+		}
+		for {
+			recoveredExpr = p.AskRequired("Cancel (recovered) expression", recoveredExpr)
+			prg, err := rules.Compile(recoveredExpr)
+			if err == nil {
+				err = checkEvaluates(prg)
+			}
+			if err == nil {
+				break
+			}
+			fmt.Println(err)
+		}
+	}
+	if downExpr != "!online && powerType == 1" {
+		args = append(args, "-down-expr", downExpr)
+	}
+	if recoveredExpr != "online && powerType == 1" {
+		args = append(args, "-recovered-expr", recoveredExpr)
+	}
+	for {
+		d, err := time.ParseDuration(p.Ask("How long to wait before shutting down, in case power returns", "3m"))
+		if err == nil && d >= 0 {
+			if d != 3*time.Minute {
+				args = append(args, "-recovery-period", d.String())
+			}
+			break
+		}
+	}
+
+	// Write configuration:
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "/usr/bin/" + name
+	}
+	execStart := systemdQuote(append([]string{exe}, args...))
+	fmt.Printf("\nmqttshutdownd will run as:\n\n  %s\n\n", execStart)
+	dropIn := p.AskRequired("Write systemd drop-in to", systemdDropInPath)
+	if _, err := os.Stat(dropIn); err == nil && !p.Confirm(fmt.Sprintf("%s exists. Overwrite?", dropIn), false) {
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(dropIn), 0o755); err != nil {
+		fmt.Printf("Failed to create %s: %s\n", filepath.Dir(dropIn), err)
+		return 1
+	}
+	if err := os.WriteFile(dropIn, []byte(fmt.Sprintf("[Service]\nExecStart=\nExecStart=%s\n", execStart)), 0o600); err != nil {
+		fmt.Printf("Failed to write %s: %s\n", dropIn, err)
+		return 1
+	}
+	fmt.Printf("Wrote %s\n", dropIn)
+
+	// Install and enable the unit:
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		fmt.Println("systemd doesn't appear to be running; skipping service installation.")
+		return 0
+	}
+	if exec.Command("systemctl", "cat", name+".service").Run() != nil {
+		if p.Confirm(fmt.Sprintf("The %s systemd unit isn't installed. Install it to %s?", name, systemdUnitPath), true) {
+			if err := os.WriteFile(systemdUnitPath, []byte(systemdUnit), 0o644); err != nil {
+				fmt.Printf("Failed to write %s: %s\n", systemdUnitPath, err)
+				return 1
+			}
+			fmt.Printf("Wrote %s\n", systemdUnitPath)
+		}
+	}
+	if p.Confirm("Reload systemd and enable and (re)start the service now?", true) {
+		for _, cmd := range [][]string{
+			{"systemctl", "daemon-reload"},
+			{"systemctl", "enable", name + ".service"},
+			{"systemctl", "restart", name + ".service"},
+		} {
+			fmt.Printf("$ %s\n", strings.Join(cmd, " "))
+			c := exec.Command(cmd[0], cmd[1:]...)
+			c.Stdout, c.Stderr = os.Stdout, os.Stderr
+			if err := c.Run(); err != nil {
+				fmt.Printf("Failed: %s\n", err)
+				return 1
+			}
+		}
+		fmt.Printf("\nDone. Follow the logs with: journalctl -fu %s\n", name)
+	} else {
+		fmt.Printf("\nDone. To apply: sudo systemctl daemon-reload && sudo systemctl enable --now %s\n", name)
+	}
+	return 0
+}
+
+// systemdQuote joins args into a systemd command line, quoting arguments
+// that contain whitespace, quotes, backslashes or specifiers.
+func systemdQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		a = strings.ReplaceAll(a, "%", "%%")
+		if a == "" || strings.ContainsAny(a, " \t\"'\\;$") {
+			r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `$$`)
+			a = `"` + r.Replace(a) + `"`
+		}
+		quoted[i] = a
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"strings"
+)
+
+// shellySwitch is the switch:0 component status of a Shelly Gen2 (Plus or
+// Pro) device. Notifications carry only the fields that changed.
+type shellySwitch struct {
+	Output  *bool    `json:"output"`
+	APower  *float64 `json:"apower"`
+	Voltage *float64 `json:"voltage"`
+}
+
+// normalizeShelly accepts messages from a Shelly Gen2 device upstream of the
+// UPS, with switch:0 feeding it:
+//
+//	<device>/events/rpc      {"method": "NotifyStatus", "params": {"switch:0": {"apower": 80.2}}}
+//	<device>/status/switch:0  {"id": 0, "output": true, "apower": 80.2, "voltage": 121.3}
+//	<device>/online          false
+//
+// As with EcoFlow, grid presence is determined from the measured voltage
+// when reported, and from the active power drawn otherwise; a switched-off
+// output reports power down. A device that loses mains power drops off the
+// broker, which then publishes false on its online topic, so that too
+// reports power down. Other topics, and messages carrying none of these,
+// are ignored.
+func normalizeShelly(topic string, payload []byte) ([]PowerAlarmMessage, error) {
+	var sw shellySwitch
+	switch base := path.Base(topic); {
+	case base == "online":
+		if strings.TrimSpace(string(payload)) == "false" {
+			return []PowerAlarmMessage{{Online: false, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+		}
+		return nil, nil
+	case base == "switch:0":
+		if err := json.Unmarshal(payload, &sw); err != nil {
+			return nil, err
+		}
+	case base == "rpc":
+		var msg struct {
+			Method string `json:"method"`
+			Params struct {
+				Switch *shellySwitch `json:"switch:0"`
+			} `json:"params"`
+		}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, err
+		}
+		if msg.Method != "NotifyStatus" && msg.Method != "NotifyFullStatus" {
+			return nil, nil
+		}
+		if msg.Params.Switch == nil {
+			return nil, nil
+		}
+		sw = *msg.Params.Switch
+	default:
+		return nil, nil
+	}
+
+	m := PowerAlarmMessage{PowerType: PowerTypeUtility, Scope: ScopeGlobal}
+	switch {
+	case sw.Output != nil && !*sw.Output:
+		m.Online = false
+	case sw.Voltage != nil:
+		m.Online = *sw.Voltage > 0
+	case sw.APower != nil:
+		m.Online = *sw.APower > gridPresentWatts
+	default:
+		return nil, nil
+	}
+	return []PowerAlarmMessage{m}, nil
+}
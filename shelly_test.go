@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeShelly(t *testing.T) {
+	for _, tt := range []struct {
+		topic   string
+		payload string
+		want    []bool // Online of each message
+		wantErr bool
+	}{
+		{topic: "plug/status/switch:0", payload: `{"id": 0, "output": true, "apower": 80.2, "voltage": 121.3}`, want: []bool{true}},
+		{topic: "plug/status/switch:0", payload: `{"id": 0, "output": true, "apower": 80.2, "voltage": 0}`, want: []bool{false}},
+		{topic: "plug/status/switch:0", payload: `{"id": 0, "output": false, "voltage": 121.3}`, want: []bool{false}},
+		{topic: "plug/status/switch:0", payload: `{"id": 0, "apower": 0}`, want: []bool{false}},
+		{topic: "plug/status/switch:0", payload: `{"id": 0}`},
+		{topic: "plug/events/rpc", payload: `{"method": "NotifyStatus", "params": {"switch:0": {"apower": 80.2}}}`, want: []bool{true}},
+		{topic: "plug/events/rpc", payload: `{"method": "NotifyStatus", "params": {"sys": {}}}`},
+		{topic: "plug/events/rpc", payload: `{"method": "NotifyEvent", "params": {"switch:0": {"output": false}}}`},
+		{topic: "plug/online", payload: "false", want: []bool{false}},
+		{topic: "plug/online", payload: "true"},
+		{topic: "plug/status/sys", payload: `{}`},
+		{topic: "plug/status/switch:0", payload: `not json`, wantErr: true},
+	} {
+		msgs, err := normalizeShelly(tt.topic, []byte(tt.payload))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeShelly(%q, %q) error = %v, want error: %t", tt.topic, tt.payload, err, tt.wantErr)
+			continue
+		}
+		assertOnline(t, tt.topic, tt.payload, msgs, tt.want)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// hostShutdown is the Action that announces shutdown intent, waits for
+// dependents, records why the host is going down, and powers it off.
+// If Command is set, it's run instead of powering off, making mqttshutdownd a
+// general MQTT-triggered delayed command runner; CancelCommand, if set, is run
+// when a pending or executed action is cancelled by a recovery. Unit and
+// RecoveredUnit do the same with systemd units, so the response can be
+// modelled in systemd dependencies instead.
+type hostShutdown struct {
+	Clock             Clock
+	Publisher         *publisher
+	CoordinationTopic string
+	// CoordinationTemplate, if set, renders intent messages instead of JSON.
+	CoordinationTemplate *template.Template
+	Hostname             string
+	Deps                 *dependentsTracker
+	DependentsTimeout    time.Duration
+	Store                stateStore
+	Rule                 string
+	WakeAfter            time.Duration
+	RTCDevice            string
+	Command              string
+	CancelCommand        string
+	Unit                 string
+	RecoveredUnit        string
+	// PowerOffFallbacks are tried in order if the shutdown command fails;
+	// each is a shell command or "sysrq".
+	PowerOffFallbacks []string
+}
+
+func (h *hostShutdown) Armed(ctx context.Context, p Pending) {
+	h.publishIntent(ctx, IntentStatePending, p.ExecuteAt, p)
+}
+
+// Held announces the hold; At is when the countdown will resume.
+func (h *hostShutdown) Held(ctx context.Context, p Pending, until time.Time) {
+	h.publishIntent(ctx, IntentStateHeld, until, p)
+}
+
+func (h *hostShutdown) Cancelled(ctx context.Context, p Pending, ev powerEvent) {
+	p.Trigger = ev
+	h.publishIntent(ctx, IntentStateCancelled, h.Clock.Now(), p)
+	if h.CancelCommand != "" {
+		log.Printf("running -cancel-command '%s'", h.CancelCommand)
+		if out, err := shellCommand(ctx, h.CancelCommand).CombinedOutput(); err != nil {
+			log.Printf("-cancel-command failed: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	if h.RecoveredUnit != "" {
+		if err := startSystemdUnit(ctx, h.RecoveredUnit); err != nil {
+			log.Printf("[ERROR] failed to start -systemd-recovered-unit: %s", err)
+		}
+	}
+}
+
+func (h *hostShutdown) Execute(ctx context.Context, p Pending) {
+	if len(h.Deps.Topics()) > 0 {
+		log.Printf("waiting up to %s for dependents to go offline: %s", h.DependentsTimeout, strings.Join(h.Deps.Up(), ", "))
+		up := h.Deps.WaitAllDown(ctx, h.DependentsTimeout)
+		if ctx.Err() != nil {
+			log.Println("pending shutdown cancelled while waiting for dependents")
+			return
+		}
+		if len(up) > 0 {
+			log.Printf("timed out waiting for dependents; still up: %s", strings.Join(up, ", "))
+		} else {
+			log.Println("all dependents are offline")
+		}
+	}
+	// intent and state must be recorded even if the shutdown is cancelled from here on:
+	ctx = context.WithoutCancel(ctx)
+	trigger := p.Trigger.Message
+	h.publishIntent(ctx, IntentStateExecuting, h.Clock.Now(), p)
+	if h.Command != "" {
+		log.Printf("running -command '%s'", h.Command)
+		out, err := shellCommand(ctx, h.Command).CombinedOutput()
+		if len(out) > 0 {
+			log.Printf("-command output: %s", strings.TrimSpace(string(out)))
+		}
+		if err != nil {
+			log.Printf("-command failed: %s", err)
+		}
+		return
+	}
+	if h.Unit != "" {
+		if err := startSystemdUnit(ctx, h.Unit); err != nil {
+			log.Printf("[ERROR] failed to start -systemd-unit: %s", err)
+		}
+		return
+	}
+	if err := h.Store.WriteJSON(stateFileShutdown, shutdownRecord{
+		At:           h.Clock.Now(),
+		ArmedAt:      p.ArmedAt,
+		Reason:       trigger.String(),
+		Rule:         h.Rule,
+		Source:       p.Trigger.Source,
+		Trigger:      &trigger,
+		ClockWarning: p.ClockWarning,
+	}); err != nil {
+		log.Printf("failed to record shutdown state: %s", err)
+	}
+	if h.WakeAfter > 0 {
+		wakeAt := h.Clock.Now().Add(h.WakeAfter)
+		if err := setRTCWake(h.RTCDevice, wakeAt); err != nil {
+			log.Printf("failed to set RTC wake alarm: %s", err)
+		} else {
+			log.Printf("RTC wake alarm set for %s", wakeAt.Format(time.RFC3339))
+		}
+	}
+	h.powerOff()
+}
+
+const (
+	// powerOffAttempts is how many times the shutdown command is tried
+	// before falling back to PowerOffFallbacks.
+	powerOffAttempts = 3
+	// powerOffBackoff is the delay before the second attempt; it doubles
+	// with each further attempt.
+	powerOffBackoff = 2 * time.Second
+	// powerOffSysRq names the built-in SysRq fallback in PowerOffFallbacks.
+	powerOffSysRq = "sysrq"
+)
+
+// powerOff runs the shutdown command, retrying with backoff, then tries each
+// fallback in turn. It only returns once one of them has succeeded; if all
+// fail, the daemon exits so that its failure is visible.
+func (h *hostShutdown) powerOff() {
+	backoff := powerOffBackoff
+	for attempt := 1; attempt <= powerOffAttempts; attempt++ {
+		log.Println("calling shutdown!")
+		out, err := exec.Command("shutdown", "-h", "now").CombinedOutput()
+		if err == nil {
+			log.Println("shutdown initiated!")
+			return
+		}
+		log.Printf("[ERROR] failed to call shutdown (attempt %d of %d): %s: %s", attempt, powerOffAttempts, err, strings.TrimSpace(string(out)))
+		if attempt < powerOffAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	for _, fb := range h.PowerOffFallbacks {
+		log.Printf("falling back to '%s'", fb)
+		var err error
+		if fb == powerOffSysRq {
+			err = sysrqPowerOff()
+		} else {
+			var out []byte
+			out, err = shellCommand(context.Background(), fb).CombinedOutput()
+			if err != nil {
+				err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+			}
+		}
+		if err == nil {
+			log.Printf("poweroff initiated via '%s'!", fb)
+			return
+		}
+		log.Printf("[ERROR] fallback '%s' failed: %s", fb, err)
+	}
+	log.Fatalf("failed to power off: shutdown and all fallbacks failed")
+}
+
+// actionName describes, in logs, the action of a rule with the given
+// -command and -systemd-unit.
+func actionName(command, unit string) string {
+	switch {
+	case command != "":
+		return fmt.Sprintf("'%s'", command)
+	case unit != "":
+		return fmt.Sprintf("start of '%s'", unit)
+	}
+	return "shutdown"
+}
+
+// publishIntent announces state for p; the reason is p's trigger.
+func (h *hostShutdown) publishIntent(ctx context.Context, state string, at time.Time, p Pending) {
+	trigger := p.Trigger.Message
+	publishIntent(ctx, h.Publisher, h.CoordinationTopic, h.CoordinationTemplate, ShutdownIntentMessage{
+		Host:         h.Hostname,
+		State:        state,
+		At:           at,
+		Reason:       trigger.String(),
+		Trigger:      &trigger,
+		ClockWarning: p.ClockWarning,
+		Rule:         h.Rule,
+		Source:       p.Trigger.Source,
+	})
+}
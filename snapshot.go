@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateFileSnapshot is the default name of the snapshot file in the state
+// directory.
+const stateFileSnapshot = "snapshot.json"
+
+// snapshot is the daemon's complete runtime state, for attaching to bug
+// reports and for external tooling.
+type snapshot struct {
+	At         time.Time          `json:"at"`
+	Host       string             `json:"host"`
+	Version    string             `json:"version"`
+	ConfigHash string             `json:"config_hash"`
+	Connection snapshotConnection `json:"connection"`
+	Rules      snapshotRules      `json:"rules"`
+	State      apiState           `json:"state"`
+	Steps      []snapshotStep     `json:"steps,omitempty"`
+	// RuntimeSeconds is the estimated battery runtime remaining, if known.
+	RuntimeSeconds    *float64       `json:"runtime_seconds,omitempty"`
+	BufferedPublishes int            `json:"buffered_publishes"`
+	RecentEvents      []historyEntry `json:"recent_events"`
+	// NamedRules are the named rules from -config, with their state.
+	NamedRules []snapshotNamedRule `json:"named_rules,omitempty"`
+}
+
+type snapshotConnection struct {
+	Server        string   `json:"server"`
+	Subscriptions []string `json:"subscriptions"`
+	connectionStatus
+}
+
+type snapshotRules struct {
+	Down                string  `json:"down"`
+	Recovered           string  `json:"recovered"`
+	Delay               string  `json:"delay"`
+	BatteryArmBelow     float64 `json:"battery_arm_below,omitempty"`
+	BatteryRecoverAbove float64 `json:"battery_recover_above,omitempty"`
+}
+
+type snapshotNamedRule struct {
+	Name      string         `json:"name"`
+	Topic     string         `json:"topic"`
+	Down      string         `json:"down"`
+	Recovered string         `json:"recovered"`
+	Delay     string         `json:"delay"`
+	State     apiState       `json:"state"`
+	Steps     []snapshotStep `json:"steps,omitempty"`
+}
+
+type snapshotStep struct {
+	Name   string `json:"name"`
+	Offset string `json:"offset"`
+	// Ran is whether the step has run for the pending action.
+	Ran bool `json:"ran"`
+}
+
+// snapshotter assembles snapshots and writes them to Path on request.
+type snapshotter struct {
+	Path          string
+	Hostname      string
+	Server        string
+	Subscriptions []string
+	ConfigHash    string
+	Rules         snapshotRules
+	Engine        *Engine
+	NamedRules    []namedRule
+	Conn          *connectionState
+	Publisher     *publisher
+
+	// mu guards Subscriptions, ConfigHash and Rules, which a reload of
+	// -config may change.
+	mu sync.Mutex
+}
+
+// Reconfigured records a reload of -config.
+func (s *snapshotter) Reconfigured(oldTopics, topics []string, hash, down, recovered string, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := slices.DeleteFunc(slices.Clone(s.Subscriptions), func(t string) bool {
+		return slices.Contains(oldTopics, t) && !slices.Contains(topics, t)
+	})
+	for _, t := range topics {
+		if !slices.Contains(subs, t) {
+			subs = append(subs, t)
+		}
+	}
+	s.Subscriptions = subs
+	s.ConfigHash = hash
+	s.Rules.Down, s.Rules.Recovered, s.Rules.Delay = down, recovered, delay.String()
+}
+
+// Snapshot returns the current state.
+func (s *snapshotter) Snapshot() snapshot {
+	st := s.Engine.Status()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := snapshot{
+		At:         time.Now(),
+		Host:       s.Hostname,
+		Version:    version,
+		ConfigHash: s.ConfigHash,
+		Connection: snapshotConnection{
+			Server:           s.Server,
+			Subscriptions:    s.Subscriptions,
+			connectionStatus: s.Conn.Status(),
+		},
+		Rules:             s.Rules,
+		State:             newAPIState(s.Hostname, st),
+		BufferedPublishes: s.Publisher.Buffered(),
+		RecentEvents:      s.Engine.History.Events(),
+	}
+	snap.Steps = snapshotSteps(s.Engine.Steps, st)
+	for _, r := range s.NamedRules {
+		rst := r.Engine.Status()
+		snap.NamedRules = append(snap.NamedRules, snapshotNamedRule{
+			Name:      r.Name,
+			Topic:     r.Topic,
+			Down:      r.DownExpr,
+			Recovered: r.RecoveredExpr,
+			Delay:     r.Delay.String(),
+			State:     newAPIState(s.Hostname, rst),
+			Steps:     snapshotSteps(r.Engine.Steps, rst),
+		})
+	}
+	if s.Engine.Runtime != nil {
+		if est, ok := s.Engine.Runtime.Estimate(); ok {
+			secs := est.Seconds()
+			snap.RuntimeSeconds = &secs
+		}
+	}
+	return snap
+}
+
+// snapshotSteps describes steps, as scheduled by an Engine with status st.
+func snapshotSteps(steps []Step, st EngineStatus) []snapshotStep {
+	var out []snapshotStep
+	for i, step := range steps {
+		out = append(out, snapshotStep{
+			Name:   step.Name,
+			Offset: step.Offset.String(),
+			Ran:    i < len(st.StepsRan) && st.StepsRan[i],
+		})
+	}
+	return out
+}
+
+// Write writes a snapshot to Path.
+func (s *snapshotter) Write() error {
+	b, err := json.MarshalIndent(s.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.Path, append(b, '\n'), 0o600)
+}
+
+// Run writes a snapshot whenever the process receives snapshotSignals, until
+// ctx is done.
+func (s *snapshotter) Run(ctx context.Context) {
+	if len(snapshotSignals) == 0 {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, snapshotSignals...)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case got := <-sig:
+			if err := s.Write(); err != nil {
+				log.Printf("[ERROR] failed to write state snapshot to '%s': %s", s.Path, err)
+				continue
+			}
+			log.Printf("wrote state snapshot to '%s' (%s)", s.Path, got)
+		}
+	}
+}
+
+// configHash returns a hash identifying the configuration in fs, so
+// snapshots from differently configured hosts can be told apart. Flags whose
+// name mentions a password are left out.
+func configHash(fs *flag.FlagSet) string {
+	h := sha256.New()
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, isAlias := flagAliases[f.Name]; isAlias || strings.Contains(f.Name, "password") {
+			return
+		}
+		fmt.Fprintf(h, "%s=%s\n", f.Name, f.Value.String())
+	})
+	return hex.EncodeToString(h.Sum(nil))
+}
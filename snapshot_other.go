@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// snapshotSignals request a state snapshot.
+var snapshotSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// snapshotSignals request a state snapshot. Windows has no SIGUSR1; use the
+// API's GET /snapshot instead.
+var snapshotSignals []os.Signal
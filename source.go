@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// powerEvent is a PowerAlarmMessage from any source, fed to the decision loop.
+type powerEvent struct {
+	Source  string
+	Message PowerAlarmMessage
+	// Runtime is the Engine's estimate of the battery runtime remaining when
+	// the event was handled, or 0 if unknown.
+	Runtime time.Duration
+	// Props are the MQTT user properties of the message the event was
+	// decoded from, if any.
+	Props map[string]string
+	// Expires is when the message the event was decoded from expires,
+	// according to its MQTT message expiry interval, or zero if it doesn't.
+	Expires time.Time
+	// Msg is the MQTT payload the event was decoded from, decoded as the
+	// -proto-message type for expressions, if any.
+	Msg any
+}
+
+// eventSource produces power events from something other than the MQTT
+// subscription, e.g. by polling a locally reachable UPS.
+type eventSource interface {
+	// Name identifies the source in logs.
+	Name() string
+	// Run sends events until ctx is done.
+	Run(ctx context.Context, events chan<- powerEvent)
+}
+
+// runSources starts each source in its own goroutine, feeding their events
+// into q (if not nil, i.e. not in producer mode). If relayTopic is set, every event from these sources is also
+// published to it in the canonical schema, so a host with a locally attached
+// UPS can share its state.
+func runSources(ctx context.Context, sources []eventSource, q *eventQueue, pub *publisher, relayTopic string, retain bool) {
+	if len(sources) == 0 {
+		return
+	}
+	in := make(chan powerEvent)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev := <-in:
+				if q != nil {
+					q.Offer(ev)
+				}
+				if relayTopic == "" {
+					continue
+				}
+				if err := pub.PublishJSON(ctx, relayTopic, ev.Message, retain); err != nil {
+					log.Printf("%s: failed to relay event to '%s': %s", ev.Source, relayTopic, err)
+				}
+			}
+		}
+	}()
+	for _, s := range sources {
+		go s.Run(ctx, in)
+	}
+}
+
+// runPoller calls poll every interval, sending an event whenever the polled
+// state differs from the last one sent. It returns when ctx is done.
+func runPoller(ctx context.Context, name string, interval time.Duration, poll func(context.Context) (PowerAlarmMessage, error), events chan<- powerEvent) {
+	var last *PowerAlarmMessage
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m, err := poll(ctx)
+		if err != nil {
+			log.Printf("%s: %s", name, err)
+		} else if last == nil || !last.Equal(m) {
+			last = &m
+			select {
+			case events <- powerEvent{Source: name, Message: m}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
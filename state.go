@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// stateStore persists small JSON state files in a directory, so information
+// survives restarts and reboots. A zero stateStore (no directory) stores nothing.
+type stateStore struct {
+	dir string
+}
+
+func newStateStore(dir string) (stateStore, error) {
+	if dir == "" {
+		return stateStore{}, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return stateStore{}, err
+	}
+	return stateStore{dir: dir}, nil
+}
+
+func (s stateStore) Enabled() bool {
+	return s.dir != ""
+}
+
+// ReadJSON reads the named state file into v. It returns os.ErrNotExist if the
+// file doesn't exist or the store is disabled.
+func (s stateStore) ReadJSON(name string, v any) error {
+	if !s.Enabled() {
+		return os.ErrNotExist
+	}
+	b, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// WriteJSON atomically replaces the named state file with v, syncing it to
+// disk since it may be written immediately before the system powers off.
+func (s stateStore) WriteJSON(name string, v any) error {
+	if !s.Enabled() {
+		return nil
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, name))
+}
+
+// Remove deletes the named state file, if it exists.
+func (s stateStore) Remove(name string) error {
+	if !s.Enabled() {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Path returns the path of the named state file. The store must be enabled.
+func (s stateStore) Path(name string) string {
+	return filepath.Join(s.dir, name)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	// StatusOnline and StatusOffline are the values of StatusMessage.Status.
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// StatusMessage is published, retained, on -status-topic: online whenever the
+// daemon connects to the broker, and offline when it exits or, as its MQTT
+// will, when the broker loses the connection. Its "status" field is what
+// -dependent-offline-payload looks for, so one mqttshutdownd can wait on
+// another as a dependent.
+//
+// The online ("birth") message also describes what the host is protected by,
+// so a fleet can be inventoried from the retained messages.
+type StatusMessage struct {
+	Status string     `json:"status"`
+	Host   string     `json:"host"`
+	At     *time.Time `json:"at,omitempty"`
+
+	// Set when online:
+	Version        string   `json:"version,omitempty"`
+	Topics         []string `json:"topics,omitempty"`
+	RecoveryPeriod string   `json:"recovery_period,omitempty"`
+	// Rules maps the name of each named rule to its topic.
+	Rules map[string]string `json:"rules,omitempty"`
+}
+
+// statusWill returns the will message announcing that host is offline on
+// topic.
+func statusWill(topic, host string) *paho.WillMessage {
+	payload, _ := json.Marshal(StatusMessage{Status: StatusOffline, Host: host}) // can't fail
+	return &paho.WillMessage{Topic: topic, Payload: payload, QoS: 1, Retain: true}
+}
+
+// publishStatus publishes msg on topic, if set.
+func publishStatus(ctx context.Context, p *publisher, topic string, msg StatusMessage) {
+	if topic == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishIntentTimeout)
+	defer cancel()
+	if msg.At == nil {
+		now := time.Now()
+		msg.At = &now
+	}
+	if err := p.PublishJSON(ctx, topic, msg, true); err != nil {
+		log.Printf("failed to publish status '%s' to '%s': %s", msg.Status, topic, err)
+	}
+}
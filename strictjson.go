@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// normalizeStrictJSON is normalizeJSON for -strict mode. Besides a valid
+// type, it requires that every message is an object with "up" and "type"
+// set, has no unknown or repeated fields, and that every field has the right
+// JSON type and range, so schema drift in publishers is caught loudly rather
+// than half-parsed: by default, a message missing "up" reads as power down.
+func normalizeStrictJSON(_ string, payload []byte) ([]PowerAlarmMessage, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		m, err := decodeStrictMessage(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		return []PowerAlarmMessage{m}, nil
+	}
+	var raws []json.RawMessage
+	if err := json.Unmarshal(trimmed, &raws); err != nil {
+		return nil, err
+	}
+	ms := make([]PowerAlarmMessage, 0, len(raws))
+	for i, raw := range raws {
+		m, err := decodeStrictMessage(raw)
+		if err != nil {
+			return nil, fmt.Errorf("message at index %d: %w", i, err)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func decodeStrictMessage(raw []byte) (PowerAlarmMessage, error) {
+	var m PowerAlarmMessage
+	if !json.Valid(raw) {
+		return m, fmt.Errorf("invalid JSON: '%s'", raw)
+	}
+
+	// check the object's keys first; encoding/json accepts a repeated key,
+	// keeping its last value, and leaves a missing or null field zero:
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, _ := dec.Token(); tok != json.Delim('{') {
+		return m, fmt.Errorf("message must be a JSON object, got '%s'", raw)
+	}
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return m, err
+		}
+		key := tok.(string)
+		if seen[key] {
+			return m, fmt.Errorf("field \"%s\" is repeated", key)
+		}
+		seen[key] = true
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return m, err
+		}
+		if string(v) == "null" {
+			return m, fmt.Errorf("field \"%s\" must not be null", key)
+		}
+	}
+	for _, required := range []string{"up", "type"} {
+		if !seen[required] {
+			return m, fmt.Errorf("missing required field \"%s\"", required)
+		}
+	}
+
+	dec = json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&m); err != nil {
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			return m, fmt.Errorf("field \"%s\" must be a JSON %s, got %s", te.Field, jsonTypeName(te.Type), te.Value)
+		}
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return m, fmt.Errorf("unknown field %s; see '%s schema' for the accepted fields", field, name)
+		}
+		return m, err
+	}
+	if !m.Valid() {
+		return m, fmt.Errorf("field \"type\" must be %d to %d, got %d", PowerTypeUtility, PowerTypeOther, m.PowerType)
+	}
+	for field, v := range map[string]*float64{"battery": m.Battery, "load": m.Load} {
+		if v != nil && (*v < 0 || *v > 100) {
+			return m, fmt.Errorf("field \"%s\" must be a percentage from 0 to 100, got %g", field, *v)
+		}
+	}
+	return m, nil
+}
+
+// jsonTypeName names the JSON type that decodes into t.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	default:
+		return t.String()
+	}
+}
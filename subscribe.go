@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// subscribeRetry subscribes on the daemon's connection, retrying a refused
+// or failed subscription with the same exponential backoff as reconnecting,
+// so a broker briefly refusing one (e.g. while its ACLs reload) doesn't kill
+// the daemon and, with it, a pending shutdown's timer.
+type subscribeRetry struct {
+	// MaxFailures is how many times in a row a subscription may fail before
+	// Subscribe gives up; 0 retries forever.
+	MaxFailures int
+	// Min and Max bound the reconnectBackoff between attempts.
+	Min, Max time.Duration
+}
+
+// Subscribe subscribes with cm to sub, retrying until it succeeds, fails
+// MaxFailures times in a row, or ctx is done, and returning the last error.
+func (r subscribeRetry) Subscribe(ctx context.Context, cm *autopaho.ConnectionManager, sub paho.SubscribeOptions) error {
+	backoff := &reconnectBackoff{Min: r.Min, Max: r.Max}
+	for failures := 1; ; failures++ {
+		sa, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{sub}})
+		if err == nil {
+			return nil
+		}
+		err = subackError(sa, err)
+		if ctx.Err() != nil || (r.MaxFailures > 0 && failures >= r.MaxFailures) {
+			return err
+		}
+		backoff.Failed()
+		delay := backoff.Delay()
+		log.Printf("[WARN] failed to subscribe to '%s' (attempt %d): %s; retrying in %s", sub.Topic, failures, err, delay.Round(time.Millisecond))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// subackError adds the reason code of a refused subscription, if any, to err,
+// which paho reports without it.
+func subackError(sa *paho.Suback, err error) error {
+	if err != nil && sa != nil && len(sa.Reasons) > 0 {
+		return fmt.Errorf("%w (reason code 0x%02x)", err, sa.Reasons[0])
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+package main
+
+import "strings"
+
+// supply describes which part of the site's electrical supply feeds this
+// host: the phase and the branch circuit it's on. Empty fields are unknown.
+type supply struct {
+	Phase   string
+	Circuit string
+}
+
+// AffectsSupply reports whether the message concerns power feeding a host on
+// supply s. Single-phase (1p) and single-circuit (1c) events only do if they
+// name the same phase or circuit as s, compared case-insensitively. Events of
+// any other scope, events that don't say which phase or circuit they're
+// about, and events about a phase or circuit s doesn't declare are assumed to
+// affect the host, so that an incomplete configuration errs on the side of
+// acting on alarms.
+func (p *PowerAlarmMessage) AffectsSupply(s supply) bool {
+	switch p.Scope {
+	case ScopeSinglePhase:
+		return p.Phase == "" || s.Phase == "" || strings.EqualFold(p.Phase, s.Phase)
+	case ScopeOneCircuit:
+		return p.Circuit == "" || s.Circuit == "" || strings.EqualFold(p.Circuit, s.Circuit)
+	default:
+		return true
+	}
+}
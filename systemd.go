@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// startSystemdUnit asks systemd (over D-Bus, via systemctl) to start unit,
+// e.g. "power-fail.target", without waiting for the job to complete, so a
+// slow unit doesn't hold up the daemon.
+func startSystemdUnit(ctx context.Context, unit string) error {
+	log.Printf("starting systemd unit '%s'", unit)
+	out, err := exec.CommandContext(ctx, "systemctl", "start", "--no-block", unit).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl start %s: %w: %s", unit, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// systemdCredentialPath returns the path of the systemd credential name,
+// passed to the service with LoadCredential= or SetCredentialEncrypted= and
+// found in $CREDENTIALS_DIRECTORY, so the secret never appears in the unit
+// file or the environment.
+func systemdCredentialPath(name string) (string, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return "", fmt.Errorf("$CREDENTIALS_DIRECTORY is not set; pass the credential '%s' to the service with LoadCredential= or SetCredentialEncrypted=", name)
+	}
+	if name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", fmt.Errorf("invalid credential name '%s'", name)
+	}
+	return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// parseTags parses a comma-separated list of KEY=VALUE tags, e.g.
+// "rack=2,tier=compute".
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if strings.TrimSpace(s) == "" {
+		return tags, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid tag '%s': must be given as KEY=VALUE", kv)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+// MatchesTags reports whether a host with the given tags is selected by the
+// message's targets selector. The selector is a comma-separated list of
+// KEY=VALUE terms, all of which must match; VALUE may be a glob. A message
+// without a selector matches every host. An error is returned if the
+// selector is malformed.
+func (p *PowerAlarmMessage) MatchesTags(tags map[string]string) (bool, error) {
+	if strings.TrimSpace(p.Targets) == "" {
+		return true, nil
+	}
+	selector, err := parseTags(p.Targets)
+	if err != nil {
+		return false, fmt.Errorf("invalid targets selector '%s': %w", p.Targets, err)
+	}
+	for k, pattern := range selector {
+		v, ok := tags[k]
+		if !ok {
+			return false, nil
+		}
+		match, err := path.Match(pattern, v)
+		if err != nil {
+			return false, fmt.Errorf("invalid targets selector '%s': %w", p.Targets, err)
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
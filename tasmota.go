@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// normalizeTasmota accepts messages from a Tasmota (e.g. Sonoff) smart plug
+// upstream of the UPS, whose relay feeding the UPS being on means utility
+// power is present:
+//
+//	tele/<device>/STATE   {"Time": "...", "POWER": "ON", ...}
+//	stat/<device>/POWER   ON
+//	tele/<device>/LWT     Offline
+//
+// The message's kind is taken from the last topic level, so custom Tasmota
+// FullTopics work too. POWER and POWER1 refer to the first relay. A plug
+// that loses mains power drops off the broker, which then publishes its
+// Offline LWT, so that too reports power down; Online is ignored, as the
+// relay state follows. Other Tasmota topics, e.g. tele/<device>/SENSOR, are
+// ignored.
+func normalizeTasmota(topic string, payload []byte) ([]PowerAlarmMessage, error) {
+	s := strings.TrimSpace(string(payload))
+	var state string
+	switch kind := strings.ToUpper(path.Base(topic)); kind {
+	case "POWER", "POWER1":
+		state = s
+	case "STATE":
+		var msg map[string]any
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			return nil, err
+		}
+		for _, k := range []string{"POWER", "POWER1"} {
+			if v, ok := msg[k].(string); ok {
+				state = v
+				break
+			}
+		}
+		if state == "" {
+			return nil, fmt.Errorf("Tasmota STATE has no POWER or POWER1: '%s'", payload)
+		}
+	case "LWT":
+		if strings.EqualFold(s, "offline") {
+			return []PowerAlarmMessage{{Online: false, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+		}
+		return nil, nil
+	default:
+		return nil, nil
+	}
+	switch strings.ToUpper(state) {
+	case "ON":
+		return []PowerAlarmMessage{{Online: true, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+	case "OFF":
+		return []PowerAlarmMessage{{Online: false, PowerType: PowerTypeUtility, Scope: ScopeGlobal}}, nil
+	}
+	return nil, fmt.Errorf("unrecognized Tasmota power state '%s'", state)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeTasmota(t *testing.T) {
+	for _, tt := range []struct {
+		topic   string
+		payload string
+		want    []bool // Online of each message
+		wantErr bool
+	}{
+		{topic: "stat/plug/POWER", payload: "ON", want: []bool{true}},
+		{topic: "stat/plug/POWER1", payload: "off", want: []bool{false}},
+		{topic: "tele/plug/STATE", payload: `{"Time": "2026-01-01T00:00:00", "POWER": "ON"}`, want: []bool{true}},
+		{topic: "tele/plug/STATE", payload: `{"POWER1": "OFF"}`, want: []bool{false}},
+		{topic: "tele/plug/LWT", payload: "Offline", want: []bool{false}},
+		{topic: "tele/plug/LWT", payload: "Online"},
+		{topic: "tele/plug/SENSOR", payload: `{"ENERGY": {"Power": 80}}`},
+		{topic: "stat/plug/POWER", payload: "TOGGLE", wantErr: true},
+		{topic: "tele/plug/STATE", payload: `{"Wifi": {}}`, wantErr: true},
+		{topic: "tele/plug/STATE", payload: `not json`, wantErr: true},
+	} {
+		msgs, err := normalizeTasmota(tt.topic, []byte(tt.payload))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeTasmota(%q, %q) error = %v, want error: %t", tt.topic, tt.payload, err, tt.wantErr)
+			continue
+		}
+		assertOnline(t, tt.topic, tt.payload, msgs, tt.want)
+	}
+}
+
+// assertOnline checks that msgs are utility power messages whose Online
+// fields are want.
+func assertOnline(t *testing.T, topic, payload string, msgs []PowerAlarmMessage, want []bool) {
+	t.Helper()
+	if len(msgs) != len(want) {
+		t.Errorf("%q on '%s': got %d messages, want %d", payload, topic, len(msgs), len(want))
+		return
+	}
+	for i, m := range msgs {
+		if m.Online != want[i] || m.PowerType != PowerTypeUtility || m.Scope != ScopeGlobal {
+			t.Errorf("%q on '%s': message %d = %+v, want up: %t", payload, topic, i, m, want[i])
+		}
+	}
+}
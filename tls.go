@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certWatchInterval is how often the client certificate and key files are
+// checked for changes.
+const certWatchInterval = 30 * time.Second
+
+// certReloader holds a TLS client certificate that can be reloaded from disk
+// while the daemon is running. The current certificate is presented on each
+// new TLS handshake, so a reload takes effect on the next (re)connection
+// without dropping the existing MQTT session. Files that changed since they
+// were loaded are reloaded at the handshake, so a renewal is picked up even
+// if the watcher hasn't noticed it yet.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	stamps []fileStamp // of certFile and keyFile when loaded
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate and key from disk. On error, the previously
+// loaded certificate remains in use.
+func (r *certReloader) Reload() error {
+	stamps := statFiles(r.certFile, r.keyFile)
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate '%s' / key '%s': %w", r.certFile, r.keyFile, err)
+	}
+	r.set(cert)
+	r.mu.Lock()
+	r.stamps = stamps
+	r.mu.Unlock()
+	return nil
+}
+
+// changed reports whether the certificate or key file changed since it was
+// loaded.
+func (r *certReloader) changed() bool {
+	if r.certFile == "" {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !slices.Equal(statFiles(r.certFile, r.keyFile), r.stamps)
+}
+
+// SetPEM replaces the current certificate with the given PEM-encoded
+// certificate and key. On error, the previously loaded certificate remains in use.
+func (r *certReloader) SetPEM(certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to parse client certificate/key: %w", err)
+	}
+	r.set(cert)
+	return nil
+}
+
+func (r *certReloader) set(cert tls.Certificate) {
+	if cert.Leaf == nil && len(cert.Certificate) > 0 {
+		cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+}
+
+// NotAfter returns the expiry time of the currently loaded certificate.
+func (r *certReloader) NotAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil || r.cert.Leaf == nil {
+		return time.Time{}
+	}
+	return r.cert.Leaf.NotAfter
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *certReloader) GetClientCertificate(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if r.changed() {
+		if err := r.Reload(); err != nil {
+			log.Printf("%s; keeping previously loaded certificate", err)
+		} else {
+			log.Printf("reloaded client certificate (files changed; expires %s)", r.NotAfter().Format(time.RFC3339))
+		}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+const (
+	// brokerPort and brokerTLSPort are the default MQTT ports.
+	brokerPort    = "1883"
+	brokerTLSPort = "8883"
+)
+
+// brokerSchemes maps the URL schemes accepted in -server to whether they
+// connect using TLS.
+var brokerSchemes = map[string]bool{"mqtt": false, "tcp": false, "mqtts": true, "ssl": true, "tls": true}
+
+// unixSocketScheme is the URL scheme accepted in -server for a broker
+// listening on a Unix domain socket, e.g. unix:///var/run/mosquitto.sock.
+const unixSocketScheme = "unix"
+
+// brokerServer is a -server or -redundant-server value, given as host[:port]
+// or as a URL such as mqtts://host:8883, wss://host/mqtt or
+// unix:///var/run/mosquitto.sock.
+type brokerServer struct {
+	// Address is the host and, if given, port.
+	Address string
+	// TLS is set if the URL's scheme asks for TLS.
+	TLS bool
+	// WebSocket is set for ws:// and wss:// URLs, which may give the Path
+	// of the broker's WebSocket endpoint.
+	WebSocket bool
+	Path      string
+	// Socket is the path of the broker's Unix domain socket, for unix://
+	// URLs, which have no Address.
+	Socket string
+}
+
+// parseBrokerServer parses a -server or -redundant-server value.
+func parseBrokerServer(server string) (brokerServer, error) {
+	scheme, address, ok := strings.Cut(server, "://")
+	if !ok {
+		return brokerServer{Address: server}, nil
+	}
+	scheme = strings.ToLower(scheme)
+	if scheme == unixSocketScheme {
+		if !path.IsAbs(address) {
+			return brokerServer{}, fmt.Errorf("'%s' must give the absolute path of a socket, e.g. unix:///var/run/mosquitto.sock", server)
+		}
+		return brokerServer{Socket: address}, nil
+	}
+	if useTLS, ok := webSocketSchemes[scheme]; ok {
+		if minimalBuild {
+			return brokerServer{}, fmt.Errorf("'%s': MQTT over WebSockets is not supported in minimal builds", server)
+		}
+		u, err := url.Parse(scheme + "://" + address)
+		if err != nil {
+			return brokerServer{}, err
+		}
+		if u.Host == "" {
+			return brokerServer{}, fmt.Errorf("'%s' has no host", server)
+		}
+		return brokerServer{Address: u.Host, TLS: useTLS, WebSocket: true, Path: u.Path}, nil
+	}
+	useTLS, known := brokerSchemes[scheme]
+	if !known {
+		return brokerServer{}, fmt.Errorf("unsupported scheme '%s'; use mqtt://, mqtts://, ws://, wss:// or unix://", scheme)
+	}
+	address = strings.TrimSuffix(address, "/")
+	if address == "" || strings.Contains(address, "/") {
+		return brokerServer{}, fmt.Errorf("'%s' must be a host and port, with no path", server)
+	}
+	return brokerServer{Address: address, TLS: useTLS}, nil
+}
+
+// URL returns the URL to connect to s at, using TLS if useTLS is set, with
+// the default port for its scheme if it gives none. A Unix domain socket is
+// never connected to using TLS.
+func (s brokerServer) URL(useTLS bool) *url.URL {
+	if s.Socket != "" {
+		return &url.URL{Scheme: unixSocketScheme, Path: s.Socket}
+	}
+	scheme, port := "mqtt", brokerPort
+	switch {
+	case s.WebSocket && useTLS:
+		scheme, port = "wss", webSocketTLSPort
+	case s.WebSocket:
+		scheme, port = "ws", webSocketPort
+	case useTLS:
+		scheme, port = "mqtts", brokerTLSPort
+	}
+	return &url.URL{Scheme: scheme, Host: withDefaultPort(s.Address, port), Path: s.Path}
+}
+
+// withDefaultBrokerPort adds the default MQTT port, 1883 or 8883 with TLS, to
+// address if it has none.
+func withDefaultBrokerPort(address string, useTLS bool) string {
+	if useTLS {
+		return withDefaultPort(address, brokerTLSPort)
+	}
+	return withDefaultPort(address, brokerPort)
+}
+
+func withDefaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
+
+// newBrokerTLSConfig returns the TLS configuration for broker connections:
+// TLS 1.2 or later, verifying the broker's certificate against the system
+// roots, or the PEM certificates in caFile if set, unless skipVerify is set.
+func newBrokerTLSConfig(caFile string, skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: skipVerify} //nolint:gosec // opt-in
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in '%s'", caFile)
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// topicMatches reports whether topic matches the MQTT topic filter, which may
+// contain the + and # wildcards.
+func topicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// builtinTopicVarHostname is the topic template variable that expands to this
+// host's name.
+const builtinTopicVarHostname = "hostname"
+
+// parseTopicVars builds the variables available to topic templates from
+// NAME=VALUE specs, plus {hostname}. A spec may override {hostname}.
+func parseTopicVars(specs []string, hostname string) (map[string]string, error) {
+	vars := map[string]string{builtinTopicVarHostname: hostname}
+	for _, spec := range specs {
+		k, v, ok := strings.Cut(spec, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid -topic-var '%s': must be given as NAME=VALUE", spec)
+		}
+		if strings.ContainsAny(k, "{}") {
+			return nil, fmt.Errorf("invalid -topic-var '%s': NAME must not contain braces", spec)
+		}
+		if strings.ContainsAny(v, "+#") {
+			return nil, fmt.Errorf("invalid -topic-var '%s': VALUE must not contain MQTT wildcards", spec)
+		}
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// expandTopic replaces each {name} in t with the value of that variable.
+func expandTopic(t string, vars map[string]string) (string, error) {
+	orig := t
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(t, '{')
+		if start < 0 {
+			b.WriteString(t)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(t[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable in '%s'", orig)
+		}
+		k := t[start+1 : start+end]
+		v, ok := vars[k]
+		if !ok {
+			return "", fmt.Errorf("unknown variable '{%s}'; define it with -topic-var %s=VALUE", k, k)
+		}
+		b.WriteString(t[:start])
+		b.WriteString(v)
+		t = t[start+end+1:]
+	}
+}
+
+// subscribeOptions are the MQTT v5 subscription options applied to the
+// daemon's subscriptions.
+type subscribeOptions struct {
+	// NoLocal suppresses delivery of the daemon's own publishes.
+	NoLocal bool
+	// RetainHandling is 0 to receive retained messages on every subscribe,
+	// 1 only on a new subscription, or 2 never.
+	RetainHandling byte
+	// RetainAsPublished keeps the retain flag of forwarded messages.
+	RetainAsPublished bool
+	// ShareGroup, if set, makes the subscriptions made with ForShared shared
+	// subscriptions in that group: the broker delivers each message to only
+	// one of the group's subscribers.
+	ShareGroup string
+}
+
+// For returns the options for a QoS 1 subscription to topic.
+func (o subscribeOptions) For(topic string) paho.SubscribeOptions {
+	return paho.SubscribeOptions{
+		Topic:             topic,
+		QoS:               1,
+		NoLocal:           o.NoLocal,
+		RetainHandling:    o.RetainHandling,
+		RetainAsPublished: o.RetainAsPublished,
+	}
+}
+
+// Shared returns the filter subscribed to by ForShared for topic:
+// $share/GROUP/topic if ShareGroup is set, otherwise topic.
+func (o subscribeOptions) Shared(topic string) string {
+	if o.ShareGroup == "" {
+		return topic
+	}
+	return "$share/" + o.ShareGroup + "/" + topic
+}
+
+// ForShared is For the Shared filter for topic. Messages on a shared
+// subscription arrive with their own topic, not the filter's.
+func (o subscribeOptions) ForShared(topic string) paho.SubscribeOptions {
+	return o.For(o.Shared(topic))
+}
+
+// userProperties returns the user properties of a received message as a map.
+// A key given more than once keeps its last value.
+func userProperties(p *paho.PublishProperties) map[string]string {
+	if p == nil || len(p.User) == 0 {
+		return nil
+	}
+	props := make(map[string]string, len(p.User))
+	for _, u := range p.User {
+		props[u.Key] = u.Value
+	}
+	return props
+}
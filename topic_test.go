@@ -0,0 +1,25 @@
+package main
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+func TestUserProperties(t *testing.T) {
+	if got := userProperties(nil); got != nil {
+		t.Errorf("userProperties(nil) = %v, want nil", got)
+	}
+	if got := userProperties(&paho.PublishProperties{}); got != nil {
+		t.Errorf("userProperties of no user properties = %v, want nil", got)
+	}
+	got := userProperties(&paho.PublishProperties{User: paho.UserProperties{
+		{Key: "site", Value: "rack1"},
+		{Key: "origin", Value: "nut"},
+		{Key: "site", Value: "rack2"},
+	}})
+	if want := map[string]string{"site": "rack2", "origin": "nut"}; !maps.Equal(got, want) {
+		t.Errorf("userProperties = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// triggerFilePollInterval is how often a regular trigger file is checked for changes.
+const triggerFilePollInterval = time.Second
+
+// triggerFileSource treats writes to a file or named pipe as power events, so
+// scripts (e.g. apcupsd's doshutdown hook) can drive the daemon locally:
+//
+//	echo down > /run/powerfail
+type triggerFileSource struct {
+	Path        string
+	DownContent string
+	UpContent   string
+}
+
+func (t *triggerFileSource) Name() string {
+	return "file:" + t.Path
+}
+
+func (t *triggerFileSource) Run(ctx context.Context, events chan<- powerEvent) {
+	if fi, err := os.Stat(t.Path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		t.runFIFO(ctx, events)
+		return
+	}
+	t.runFile(ctx, events)
+}
+
+// runFIFO reads lines from a named pipe. The pipe is opened read-write so that
+// opening doesn't block waiting for a writer and the reader never sees EOF
+// between writers.
+func (t *triggerFileSource) runFIFO(ctx context.Context, events chan<- powerEvent) {
+	f, err := os.OpenFile(t.Path, os.O_RDWR, 0)
+	if err != nil {
+		log.Printf("%s: %s", t.Name(), err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = f.Close()
+	}()
+	log.Printf("%s: watching named pipe", t.Name())
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if !t.handle(ctx, sc.Text(), events) {
+			return
+		}
+	}
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("%s: %s", t.Name(), err)
+	}
+}
+
+// runFile re-reads a regular file whenever it changes.
+func (t *triggerFileSource) runFile(ctx context.Context, events chan<- powerEvent) {
+	log.Printf("%s: watching file", t.Name())
+	read := func() {
+		b, err := os.ReadFile(t.Path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("%s: %s", t.Name(), err)
+			}
+			return
+		}
+		if s := strings.TrimSpace(string(b)); s != "" {
+			t.handle(ctx, s, events)
+		}
+	}
+	read()
+	watchFiles(ctx, triggerFilePollInterval, read, t.Path)
+}
+
+// handle maps content to a power event. It returns false if ctx is done.
+func (t *triggerFileSource) handle(ctx context.Context, content string, events chan<- powerEvent) bool {
+	content = strings.TrimSpace(content)
+	var online bool
+	switch {
+	case strings.EqualFold(content, t.DownContent):
+		online = false
+	case strings.EqualFold(content, t.UpContent):
+		online = true
+	default:
+		log.Printf("%s: ignoring unrecognized content '%s' (expected '%s' or '%s')", t.Name(), content, t.DownContent, t.UpContent)
+		return true
+	}
+	m := PowerAlarmMessage{Online: online, PowerType: PowerTypeUtility, Scope: ScopeLocal}
+	select {
+	case events <- powerEvent{Source: t.Name(), Message: m}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
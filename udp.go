@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+)
+
+// udpSource listens for power-fail datagrams broadcast or multicast on the
+// LAN. It provides a failsafe path for when the MQTT broker itself has lost
+// power. Each datagram is decoded with the configured format's normalizer.
+type udpSource struct {
+	Listen    string
+	Format    string
+	Normalize normalizer
+}
+
+func (u *udpSource) Name() string {
+	return "udp:" + u.Listen
+}
+
+func (u *udpSource) Run(ctx context.Context, events chan<- powerEvent) {
+	conn, err := u.listen()
+	if err != nil {
+		log.Fatalf("%s: %s", u.Name(), err)
+	}
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+	log.Printf("%s: listening for %s datagrams", u.Name(), u.Format)
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("%s: %s", u.Name(), err)
+			continue
+		}
+		msgs, err := u.Normalize(u.Listen, buf[:n])
+		if err != nil {
+			log.Printf("%s: failed to decode datagram from %s: %s", u.Name(), from, err)
+			continue
+		}
+		for _, m := range msgs {
+			select {
+			case events <- powerEvent{Source: fmt.Sprintf("udp:%s", from), Message: m}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// listen binds to the configured address, joining the multicast group if the
+// address is a multicast address.
+func (u *udpSource) listen() (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", u.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		return net.ListenMulticastUDP("udp", nil, addr)
+	}
+	return net.ListenUDP("udp", addr)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// unreachableCheckInterval is how often the broker watchdog checks the
+	// connection.
+	unreachableCheckInterval = 10 * time.Second
+	// stateFileUnreachable records when the broker became unreachable, so
+	// the outage isn't forgotten if the daemon restarts during it.
+	stateFileUnreachable = "unreachable.json"
+	// unreachableResumeWindow is how recently stateFileUnreachable must have
+	// been updated for a restarted daemon to pick up the outage it records;
+	// an older record is from a daemon that was stopped, not restarting.
+	unreachableResumeWindow = 2 * time.Minute
+	// unreachableSource is the source of precautionary shutdowns.
+	unreachableSource = "watchdog:broker"
+)
+
+const (
+	UnreachableStateUnreachable = "unreachable"
+	UnreachableStateReachable   = "reachable"
+)
+
+// UnreachableAlert is POSTed to -unreachable-url when the broker has been
+// unreachable for -unreachable-after, and again once it's reachable.
+type UnreachableAlert struct {
+	Host   string    `json:"host"`
+	Server string    `json:"server"`
+	State  string    `json:"state"`
+	Since  time.Time `json:"since"`
+	// Duration is how long the broker has been (or was) unreachable.
+	Duration string `json:"duration"`
+}
+
+type unreachableRecord struct {
+	Since time.Time `json:"since"`
+	At    time.Time `json:"at"`
+}
+
+// restoreUnreachableSince returns when the broker became unreachable
+// according to a recent record left by a previous run, or now.
+func restoreUnreachableSince(store stateStore, now time.Time) time.Time {
+	var r unreachableRecord
+	if err := store.ReadJSON(stateFileUnreachable, &r); err != nil {
+		return now
+	}
+	if now.Sub(r.At) > unreachableResumeWindow || r.Since.After(now) {
+		return now
+	}
+	return r.Since
+}
+
+// unreachableWatchdog alerts when the broker, and every redundant broker, has
+// been unreachable for After, since a host that can't hear power alarms is
+// effectively unprotected. It
+// runs Command and POSTs to URL, and if Shutdown is set, triggers a
+// precautionary shutdown that is cancelled if the broker comes back before
+// it executes.
+type unreachableWatchdog struct {
+	Conn *connectionState
+	// Redundant track the -redundant-server connections; the host is
+	// protected while any broker is reachable.
+	Redundant []*connectionState
+	After     time.Duration
+	Command   string
+	URL       string
+	Shutdown  bool
+	Engine    *Engine
+	Hostname  string
+	Server    string
+	Store     stateStore
+
+	lost    time.Time // when the broker became unreachable; zero while connected
+	alerted bool
+}
+
+func (w *unreachableWatchdog) Run(ctx context.Context) {
+	ticker := time.NewTicker(unreachableCheckInterval)
+	defer ticker.Stop()
+	for {
+		w.check(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check compares the connections' status at now against the last check's,
+// alerting once the broker has been unreachable for After.
+func (w *unreachableWatchdog) check(ctx context.Context, now time.Time) {
+	st := w.status()
+	switch {
+	case st.Connected && !w.lost.IsZero():
+		if err := w.Store.Remove(stateFileUnreachable); err != nil {
+			log.Printf("failed to clear broker outage record: %s", err)
+		}
+		if w.alerted {
+			log.Printf("broker '%s' is reachable again after %s", w.Server, st.Since.Sub(w.lost).Round(time.Second))
+			w.recovered(ctx, w.lost, st.Since)
+			w.alerted = false
+		}
+		w.lost = time.Time{}
+	case !st.Connected:
+		w.lost = st.Since
+		if err := w.Store.WriteJSON(stateFileUnreachable, unreachableRecord{Since: w.lost, At: now}); err != nil {
+			log.Printf("failed to record broker outage: %s", err)
+		}
+		if down := now.Sub(w.lost); !w.alerted && down >= w.After {
+			log.Printf("[WARN] broker '%s' has been unreachable for %s; power alarms can't be received", w.Server, down.Round(time.Second))
+			w.alert(ctx, w.lost, down)
+			w.alerted = true
+		}
+	}
+}
+
+// status combines the status of every connection: connected if any is, since
+// the first of them came up; otherwise, since the last was lost.
+func (w *unreachableWatchdog) status() connectionStatus {
+	st := w.Conn.Status()
+	for _, c := range w.Redundant {
+		rs := c.Status()
+		switch {
+		case rs.Connected && (!st.Connected || rs.Since.Before(st.Since)):
+			st = rs
+		case !rs.Connected && !st.Connected && rs.Since.After(st.Since):
+			st = rs
+		}
+	}
+	return st
+}
+
+func (w *unreachableWatchdog) alert(ctx context.Context, since time.Time, down time.Duration) {
+	if w.Command != "" {
+		log.Printf("running -unreachable-command '%s'", w.Command)
+		if out, err := shellCommand(ctx, w.Command).CombinedOutput(); err != nil {
+			log.Printf("-unreachable-command failed: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	w.post(ctx, UnreachableStateUnreachable, since, down)
+	if w.Shutdown {
+		err := w.Engine.Trigger(ctx, powerEvent{
+			Source:  unreachableSource,
+			Message: PowerAlarmMessage{Online: false, PowerType: PowerTypeUnknown, Scope: ScopeLocal},
+		})
+		if err != nil {
+			log.Printf("precautionary shutdown not triggered: %s", err)
+		}
+	}
+}
+
+func (w *unreachableWatchdog) recovered(ctx context.Context, lost, back time.Time) {
+	w.post(ctx, UnreachableStateReachable, lost, back.Sub(lost))
+	if w.Shutdown {
+		if p := w.Engine.Pending(); p != nil && p.Trigger.Source == unreachableSource {
+			if err := w.Engine.Cancel(ctx, powerEvent{Source: unreachableSource, Message: p.Trigger.Message}); err != nil {
+				log.Printf("failed to cancel precautionary shutdown: %s", err)
+			}
+		}
+	}
+}
+
+func (w *unreachableWatchdog) post(ctx context.Context, state string, since time.Time, d time.Duration) {
+	if w.URL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishIntentTimeout)
+	defer cancel()
+	if err := postJSON(ctx, w.URL, UnreachableAlert{
+		Host:     w.Hostname,
+		Server:   w.Server,
+		State:    state,
+		Since:    since,
+		Duration: d.Round(time.Second).String(),
+	}); err != nil {
+		log.Printf("failed to POST broker outage alert to '%s': %s", w.URL, err)
+	}
+}
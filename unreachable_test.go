@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUnreachableWatchdogFiresWhenAConnectedPrimaryDrops(t *testing.T) {
+	ctx := context.Background()
+	broker := newFakeBroker(t)
+	conn := newConnectionState(time.Now())
+	connectPrimary(t, broker, conn, nil)
+	waitFor(t, "connected", func() bool { return conn.Status().Connected })
+
+	e, _, action := newTestEngine(time.Hour)
+	w := &unreachableWatchdog{Conn: conn, After: time.Minute, Shutdown: true, Engine: e, Server: broker.URL().Host}
+	w.check(ctx, time.Now())
+
+	broker.Drop()
+	waitFor(t, "the connection is lost", func() bool { return !conn.Status().Connected })
+	w.check(ctx, time.Now())
+	assertCalls(t, action)
+	w.check(ctx, time.Now().Add(time.Minute))
+	if p := e.Pending(); p == nil || p.Trigger.Source != unreachableSource {
+		t.Fatalf("pending = %+v, want a precautionary shutdown", p)
+	}
+
+	broker.Restore()
+	waitFor(t, "reconnected", func() bool { return conn.Status().Connected })
+	w.check(ctx, time.Now())
+	if e.Pending() != nil {
+		t.Fatal("precautionary shutdown still pending after reconnecting")
+	}
+	assertCalls(t, action, "armed", "cancelled")
+}
@@ -0,0 +1,223 @@
+//go:build !minimal
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultSecret is the subset of a Vault KV secret used by mqttshutdownd.
+// Recognized keys are username, password, tls_cert, and tls_key (PEM).
+type vaultSecret struct {
+	Username string
+	Password string
+	TLSCert  []byte
+	TLSKey   []byte
+}
+
+func (s vaultSecret) HasTLS() bool {
+	return len(s.TLSCert) > 0 && len(s.TLSKey) > 0
+}
+
+// vaultClient is a minimal client for the Vault HTTP API supporting token and
+// AppRole authentication, token renewal, and reading KV v1/v2 secrets.
+type vaultClient struct {
+	addr     string
+	roleID   string
+	secretID string
+	http     *http.Client
+
+	mu        sync.Mutex
+	token     string
+	renewable bool
+	ttl       time.Duration
+}
+
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultResponse struct {
+	Auth          *vaultAuth     `json:"auth"`
+	Data          map[string]any `json:"data"`
+	LeaseDuration int            `json:"lease_duration"`
+	Errors        []string       `json:"errors"`
+}
+
+// newVaultClient creates a Vault client. If roleID is non-empty, AppRole
+// authentication is used; otherwise token is used as-is.
+func newVaultClient(addr, token, roleID, secretID string) *vaultClient {
+	return &vaultClient{
+		addr:     strings.TrimSuffix(addr, "/"),
+		token:    token,
+		roleID:   roleID,
+		secretID: secretID,
+		http:     &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+func (v *vaultClient) do(ctx context.Context, method, path string, body any) (*vaultResponse, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/v1/%s", v.addr, strings.TrimPrefix(path, "/")), r)
+	if err != nil {
+		return nil, err
+	}
+	v.mu.Lock()
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	v.mu.Unlock()
+
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var vr vaultResponse
+	if resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil {
+			return nil, fmt.Errorf("failed to decode Vault response (HTTP %d): %w", resp.StatusCode, err)
+		}
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("vault %s %s: HTTP %d: %s", method, path, resp.StatusCode, strings.Join(vr.Errors, "; "))
+	}
+	return &vr, nil
+}
+
+func (v *vaultClient) setAuth(a *vaultAuth) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if a.ClientToken != "" {
+		v.token = a.ClientToken
+	}
+	v.renewable = a.Renewable
+	v.ttl = time.Duration(a.LeaseDuration) * time.Second
+}
+
+// Login authenticates using AppRole when configured. With plain token auth it
+// looks up the token's TTL and renewability.
+func (v *vaultClient) Login(ctx context.Context) error {
+	if v.roleID != "" {
+		resp, err := v.do(ctx, http.MethodPost, "auth/approle/login", map[string]string{
+			"role_id":   v.roleID,
+			"secret_id": v.secretID,
+		})
+		if err != nil {
+			return fmt.Errorf("AppRole login failed: %w", err)
+		}
+		if resp.Auth == nil {
+			return errors.New("AppRole login returned no auth data")
+		}
+		v.setAuth(resp.Auth)
+		return nil
+	}
+
+	resp, err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", nil)
+	if err != nil {
+		return fmt.Errorf("token lookup failed: %w", err)
+	}
+	ttl, _ := resp.Data["ttl"].(float64)
+	renewable, _ := resp.Data["renewable"].(bool)
+	v.setAuth(&vaultAuth{LeaseDuration: int(ttl), Renewable: renewable})
+	return nil
+}
+
+// Renew renews the client token, falling back to a fresh AppRole login if the
+// token can't be renewed.
+func (v *vaultClient) Renew(ctx context.Context) error {
+	v.mu.Lock()
+	renewable := v.renewable
+	v.mu.Unlock()
+
+	if renewable {
+		resp, err := v.do(ctx, http.MethodPost, "auth/token/renew-self", map[string]string{})
+		if err == nil && resp.Auth != nil {
+			v.setAuth(resp.Auth)
+			return nil
+		}
+		if v.roleID == "" {
+			return fmt.Errorf("token renewal failed: %w", err)
+		}
+	}
+	if v.roleID != "" {
+		return v.Login(ctx)
+	}
+	return nil
+}
+
+// ReadSecret reads a KV secret at path (e.g. "secret/data/mqttshutdownd" for KV v2).
+func (v *vaultClient) ReadSecret(ctx context.Context, path string) (vaultSecret, error) {
+	resp, err := v.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return vaultSecret{}, err
+	}
+	data := resp.Data
+	// KV v2 nests the secret's data under data.data
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, hasMeta := data["metadata"]; hasMeta {
+			data = inner
+		}
+	}
+	str := func(k string) string {
+		s, _ := data[k].(string)
+		return s
+	}
+	return vaultSecret{
+		Username: str("username"),
+		Password: str("password"),
+		TLSCert:  []byte(str("tls_cert")),
+		TLSKey:   []byte(str("tls_key")),
+	}, nil
+}
+
+// Run renews the Vault token and re-reads the secret at path every refresh
+// interval (or sooner, at half the token TTL), calling onUpdate with each
+// successfully read secret. It returns when ctx is done.
+func (v *vaultClient) Run(ctx context.Context, path string, refresh time.Duration, onUpdate func(vaultSecret)) {
+	for {
+		wait := refresh
+		v.mu.Lock()
+		if v.ttl > 0 && v.ttl/2 < wait {
+			wait = v.ttl / 2
+		}
+		v.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if err := v.Renew(ctx); err != nil {
+			log.Printf("vault: %s", err)
+			continue
+		}
+		s, err := v.ReadSecret(ctx, path)
+		if err != nil {
+			log.Printf("vault: failed to read secret '%s': %s", path, err)
+			continue
+		}
+		onUpdate(s)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build minimal
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Vault is left out of minimal builds; the -vault-* flags are rejected at
+// startup.
+type vaultSecret struct {
+	Username string
+	Password string
+	TLSCert  []byte
+	TLSKey   []byte
+}
+
+func (s vaultSecret) HasTLS() bool {
+	return len(s.TLSCert) > 0 && len(s.TLSKey) > 0
+}
+
+type vaultClient struct{}
+
+func newVaultClient(string, string, string, string) *vaultClient { return &vaultClient{} }
+
+func (*vaultClient) Login(context.Context) error {
+	return errors.New("vault is not supported in minimal builds")
+}
+
+func (*vaultClient) ReadSecret(context.Context, string) (vaultSecret, error) {
+	return vaultSecret{}, errors.New("vault is not supported in minimal builds")
+}
+
+func (*vaultClient) Run(context.Context, string, time.Duration, func(vaultSecret)) {}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// verifyConfig is the subset of the daemon's configuration checked by the
+// verify-broker subcommand.
+type verifyConfig struct {
+	Server      string
+	TLS         *tls.Config
+	MQTTVersion string
+	Creds       *brokerCredentials
+	Hostname    string
+	// Topics are subscribed to by the daemon.
+	Topics []string
+	// PublishTopics are published to by the daemon.
+	PublishTopics []string
+}
+
+// verifyLoopbackWait is how long verify-broker waits for its own test
+// message to come back.
+const verifyLoopbackWait = 5 * time.Second
+
+// IntentStateTest marks a message published by verify-broker to check that
+// publishing is allowed; consumers of the coordination topic should ignore it.
+const IntentStateTest = "test"
+
+// verifyMessage is the test message verify-broker publishes.
+type verifyMessage struct {
+	Host  string    `json:"host"`
+	State string    `json:"state"`
+	At    time.Time `json:"at"`
+	Nonce string    `json:"nonce"`
+}
+
+// runVerifyBroker connects to the broker with the configured credentials,
+// checks that each topic the daemon uses may be subscribed to or published
+// to, and measures round-trip latency by publishing a test message and
+// waiting for it to come back. It returns the process exit code.
+func runVerifyBroker(ctx context.Context, cfg verifyConfig) int {
+	r := &doctorReport{}
+	fmt.Printf("%s %s verify-broker\n\n", name, version)
+
+	username, password := cfg.Creds.Get()
+	probe := brokerProbe{Server: cfg.Server, TLS: cfg.TLS, MQTTVersion: cfg.MQTTVersion, Username: username, Password: string(password)}
+	received := make(chan *paho.Publish, 16)
+	c, closeConn, res := probe.Connect(ctx, func(m *paho.Publish) {
+		select {
+		case received <- m:
+		default:
+		}
+	})
+	switch {
+	case res.DialErr != nil:
+		r.Add(doctorFail, "connect", fmt.Sprintf("can't reach %s: %s", cfg.Server, res.DialErr),
+			"check -server, DNS, and that no firewall blocks the port")
+		return 1
+	case res.ConnectErr != nil:
+		r.Add(doctorFail, "connect", fmt.Sprintf("connection to %s refused: %s", cfg.Server, res.ConnectErr),
+			"check -user and the password, keyring entry, or Vault secret")
+		return 1
+	}
+	defer closeConn()
+	r.Add(doctorOK, "connect", fmt.Sprintf("connected to %s as '%s'", cfg.Server, username), "")
+
+	opCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	for _, t := range cfg.Topics {
+		if err := probeSubscribe(opCtx, c, t); err != nil {
+			r.Add(doctorFail, "subscribe", fmt.Sprintf("'%s': %s", t, err),
+				"grant this user read access to the topic in the broker's ACLs")
+			continue
+		}
+		r.Add(doctorOK, "subscribe", fmt.Sprintf("'%s'", t), "")
+	}
+
+	for _, t := range cfg.PublishTopics {
+		verifyPublish(ctx, r, c, received, cfg.Hostname, t)
+	}
+	if len(cfg.PublishTopics) == 0 {
+		r.Add(doctorOK, "publish", "no publish topics configured; skipped", "")
+	}
+
+	if r.failed {
+		return 1
+	}
+	return 0
+}
+
+// verifyPublish publishes a test message to topic and, if it can subscribe
+// to topic, waits for the message to come back to measure latency.
+func verifyPublish(ctx context.Context, r *doctorReport, c *paho.Client, received <-chan *paho.Publish, host, topic string) {
+	opCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	loopback := probeSubscribe(opCtx, c, topic) == nil
+
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+	msg := verifyMessage{Host: host, State: IntentStateTest, At: time.Now(), Nonce: hex.EncodeToString(nonce)}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	start := time.Now()
+	if _, err := c.Publish(opCtx, &paho.Publish{Topic: topic, QoS: 1, Payload: payload}); err != nil {
+		r.Add(doctorFail, "publish", fmt.Sprintf("'%s': %s", topic, err),
+			"grant this user write access to the topic in the broker's ACLs")
+		return
+	}
+	acked := time.Since(start)
+	if !loopback {
+		r.Add(doctorWarn, "publish", fmt.Sprintf("'%s': acknowledged in %s; latency not measured", topic, acked.Round(time.Millisecond)),
+			"grant this user read access to the topic to measure round-trip latency")
+		return
+	}
+
+	timeout := time.After(verifyLoopbackWait)
+	for {
+		select {
+		case m := <-received:
+			var got verifyMessage
+			if m.Topic != topic || json.Unmarshal(m.Payload, &got) != nil || got.Nonce != msg.Nonce {
+				continue // e.g. a retained message on a subscribed topic
+			}
+			r.Add(doctorOK, "publish", fmt.Sprintf("'%s': acknowledged in %s; round trip %s",
+				topic, acked.Round(time.Millisecond), time.Since(start).Round(time.Millisecond)), "")
+			return
+		case <-timeout:
+			r.Add(doctorWarn, "publish", fmt.Sprintf("'%s': acknowledged in %s, but the message didn't come back within %s",
+				topic, acked.Round(time.Millisecond), verifyLoopbackWait),
+				"the broker may be silently dropping this user's publishes (MQTT v3 brokers can't report ACL denials); check its ACLs")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
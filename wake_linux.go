@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// setRTCWake programs the wake alarm of the given RTC (e.g. "rtc0") via sysfs,
+// like `rtcwake -m no -t`. Any existing alarm is cleared first, since the
+// kernel refuses to overwrite an armed alarm.
+func setRTCWake(device string, at time.Time) error {
+	p := filepath.Join("/sys/class/rtc", device, "wakealarm")
+	if err := os.WriteFile(p, []byte("0"), 0); err != nil {
+		return fmt.Errorf("failed to clear %s: %w", p, err)
+	}
+	if err := os.WriteFile(p, []byte(strconv.FormatInt(at.Unix(), 10)), 0); err != nil {
+		return fmt.Errorf("failed to write %s: %w", p, err)
+	}
+	return nil
+}
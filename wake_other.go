@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+func setRTCWake(_ string, _ time.Time) error {
+	return errors.New("RTC wake alarms are only supported on Linux")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// fileStamp is the modification time and size of a file, zero if it can't be
+// read, by which watchFiles tells that it changed.
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// statFiles returns the fileStamp of each path.
+func statFiles(paths ...string) []fileStamp {
+	s := make([]fileStamp, len(paths))
+	for i, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			s[i] = fileStamp{fi.ModTime(), fi.Size()}
+		}
+	}
+	return s
+}
+
+// watchFiles polls the modification time and size of each path every interval
+// and calls onChange whenever any of them differs from the previous poll.
+// It returns when ctx is done. Polling (rather than inotify) keeps this portable
+// and works with files that are replaced atomically via rename.
+func watchFiles(ctx context.Context, interval time.Duration, onChange func(), paths ...string) {
+	stat := func() []fileStamp { return statFiles(paths...) }
+
+	last := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cur := stat()
+			changed := false
+			for i := range cur {
+				if cur[i] != last[i] {
+					changed = true
+				}
+			}
+			last = cur
+			if changed {
+				onChange()
+			}
+		}
+	}
+}
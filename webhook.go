@@ -0,0 +1,96 @@
+//go:build !minimal
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// webhookMaxBody bounds the size of an accepted webhook request body.
+const webhookMaxBody = 64 * 1024
+
+// webhookSource accepts power events POSTed over HTTP, authenticated with a
+// bearer token. Each request body is decoded with the configured format's
+// normalizer, by default the canonical JSON schema.
+type webhookSource struct {
+	Listen    string
+	Path      string
+	Token     string
+	Normalize normalizer
+}
+
+func (w *webhookSource) Name() string {
+	return "webhook:" + w.Listen
+}
+
+func (w *webhookSource) Run(ctx context.Context, events chan<- powerEvent) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(w.Path, func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !w.authorized(r) {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, webhookMaxBody))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		msgs, err := w.Normalize(w.Path, body)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("invalid power event: %s", err), http.StatusBadRequest)
+			return
+		}
+		for _, m := range msgs {
+			select {
+			case events <- powerEvent{Source: fmt.Sprintf("webhook:%s", r.RemoteAddr), Message: m}:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	})
+
+	srv := &http.Server{
+		Addr:              w.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	log.Printf("%s: listening for power events on %s", w.Name(), w.Path)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("%s: %s", w.Name(), err)
+	}
+}
+
+// authorized checks the request's bearer token.
+func (w *webhookSource) authorized(r *http.Request) bool {
+	return bearerAuthorized(r, w.Token)
+}
+
+// bearerAuthorized checks that the request presents token as its bearer
+// token, in constant time.
+func bearerAuthorized(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
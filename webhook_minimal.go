@@ -0,0 +1,20 @@
+//go:build minimal
+
+package main
+
+import "context"
+
+// webhookSource is left out of minimal builds; -webhook-listen is rejected at
+// startup.
+type webhookSource struct {
+	Listen    string
+	Path      string
+	Token     string
+	Normalize normalizer
+}
+
+func (w *webhookSource) Name() string {
+	return "webhook:" + w.Listen
+}
+
+func (w *webhookSource) Run(context.Context, chan<- powerEvent) {}
@@ -0,0 +1,96 @@
+//go:build !minimal
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// webSocketPort and webSocketTLSPort are the default ports for ws:// and
+	// wss:// servers.
+	webSocketPort    = "80"
+	webSocketTLSPort = "443"
+	// webSocketHandshakeTimeout bounds the HTTP upgrade of a WebSocket
+	// connection, after the TCP connection is established.
+	webSocketHandshakeTimeout = 10 * time.Second
+)
+
+// webSocketSchemes maps the URL schemes accepted in -server for MQTT over
+// WebSockets to whether they connect using TLS.
+var webSocketSchemes = map[string]bool{"ws": false, "wss": true}
+
+// dialWebSocket connects to the broker's WebSocket endpoint at u, a ws:// or
+// wss:// URL, negotiating the "mqtt" subprotocol. The TCP connection is made
+// with dialHappyEyeballs; for wss://, TLS is negotiated using tlsCfg.
+func dialWebSocket(ctx context.Context, u *url.URL, tlsCfg *tls.Config) (net.Conn, error) {
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return dialHappyEyeballs(ctx, address)
+		},
+		TLSClientConfig:  tlsCfg,
+		HandshakeTimeout: webSocketHandshakeTimeout,
+		Subprotocols:     []string{"mqtt"},
+	}
+	ws, resp, err := d.DialContext(ctx, u.String(), nil)
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &webSocketConn{Conn: ws}, nil
+}
+
+// webSocketConn adapts a WebSocket connection to a net.Conn carrying an MQTT
+// byte stream: each Write is sent as one binary message, and Read reads
+// across message boundaries, since MQTT packets needn't align with them.
+type webSocketConn struct {
+	*websocket.Conn
+
+	r       io.Reader // the message being read, if any
+	writeMu sync.Mutex
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if errors.Is(err, io.EOF) {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
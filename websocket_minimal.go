@@ -0,0 +1,25 @@
+//go:build minimal
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+)
+
+// MQTT over WebSockets is left out of minimal builds, along with
+// gorilla/websocket; ws:// and wss:// servers are rejected by
+// parseBrokerServer.
+const (
+	webSocketPort    = "80"
+	webSocketTLSPort = "443"
+)
+
+var webSocketSchemes = map[string]bool{"ws": false, "wss": true}
+
+func dialWebSocket(context.Context, *url.URL, *tls.Config) (net.Conn, error) {
+	return nil, errors.New("MQTT over WebSockets is not supported in minimal builds")
+}